@@ -0,0 +1,512 @@
+package dr
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// AEAD is an authenticated encryption algorithm used to encrypt
+// individual messages.
+//
+// Each message is encrypted with a unique key and nonce derived
+// from the message key, so unlike cipher.AEAD the key is
+// provided to each call.
+type AEAD interface {
+	// KeySize returns the size in bytes of the key.
+	KeySize() int
+	// NonceSize returns the size in bytes of the nonce.
+	NonceSize() int
+	// Overhead returns the maximum difference between the
+	// lengths of a plaintext and its ciphertext.
+	Overhead() int
+	// Seal encrypts and authenticates plaintext, authenticates
+	// additionalData, and appends the result to dst.
+	Seal(dst, key, nonce, plaintext, additionalData []byte) []byte
+	// Open decrypts and authenticates ciphertext, authenticates
+	// additionalData, and appends the result to dst.
+	Open(dst, key, nonce, ciphertext, additionalData []byte) ([]byte, error)
+}
+
+// RatchetOption configures a Ratchet.
+type RatchetOption func(*ratchetOptions)
+
+// ratchetOptions are the options common to each Ratchet.
+type ratchetOptions struct {
+	// aead is used to encrypt messages.
+	aead AEAD
+	// hash is used by HKDF and HMAC.
+	//
+	// If nil, the Ratchet's default hash is used.
+	hash func() hash.Hash
+	// mkInfo and rkInfo are the HKDF info labels.
+	//
+	// If nil, they are derived from the namespace.
+	mkInfo, rkInfo []byte
+	// rand, if non-nil, is used to generate random nonces.
+	rand io.Reader
+	// nonceCounter mixes the message number into the nonce.
+	nonceCounter bool
+	// keyedBLAKE2b replaces HMAC in KDF_CK with keyed BLAKE2b.
+	keyedBLAKE2b bool
+	// zeroNonce derives only the AEAD key from the message key
+	// and uses an all-zero nonce.
+	zeroNonce bool
+	// uncompressedPoints encodes NIST public keys in
+	// uncompressed form.
+	uncompressedPoints bool
+}
+
+// newRatchetOptions applies opts on top of the defaults.
+func newRatchetOptions(aead AEAD, opts []RatchetOption) ratchetOptions {
+	o := ratchetOptions{
+		aead: aead,
+	}
+	for _, fn := range opts {
+		fn(&o)
+	}
+	if o.rand != nil {
+		o.aead = randomNonce{AEAD: o.aead, rand: o.rand}
+		o.zeroNonce = false
+	}
+	return o
+}
+
+// kdfHash returns the configured hash, or def if none was
+// configured.
+func (o ratchetOptions) kdfHash(def func() hash.Hash) func() hash.Hash {
+	if o.keyedBLAKE2b {
+		return blake2b256
+	}
+	if o.hash != nil {
+		return o.hash
+	}
+	return def
+}
+
+// labels returns the configured HKDF info labels, or the labels
+// derived from namespace if none were configured.
+func (o ratchetOptions) labels(namespace string) (mkInfo, rkInfo []byte) {
+	if o.mkInfo != nil {
+		return o.mkInfo, o.rkInfo
+	}
+	if o.zeroNonce {
+		return []byte(namespace + "ZeroNonceMessageKeys"), []byte(namespace + "Ratchet")
+	}
+	return []byte(namespace + "MessageKeys"), []byte(namespace + "Ratchet")
+}
+
+// name returns the Ratchet name for the Diffie-Hellman (or KEM)
+// algorithm dh. See Ratchet.Name.
+func (o ratchetOptions) name(dh string, hash func() hash.Hash, namespace string) string {
+	var b strings.Builder
+	b.WriteString("DR-")
+	b.WriteString(dh)
+	b.WriteByte('-')
+	b.WriteString(aeadName(o.aead))
+	if o.nonceCounter {
+		b.WriteString("-NonceCounter")
+	}
+	if o.keyedBLAKE2b {
+		b.WriteString("-KeyedBLAKE2b")
+	}
+	if o.zeroNonce {
+		b.WriteString("-ZeroNonce")
+	}
+	b.WriteString("-HKDF-")
+	b.WriteString(hashName(hash))
+	b.WriteByte('/')
+	if o.mkInfo != nil {
+		b.WriteString(strconv.Quote(string(o.mkInfo)))
+		b.WriteByte(',')
+		b.WriteString(strconv.Quote(string(o.rkInfo)))
+	} else {
+		b.WriteString(namespace)
+	}
+	return b.String()
+}
+
+// aeadName returns the name of an AEAD.
+//
+// Custom AEADs are named by their Name method, if any, or by
+// their type.
+func aeadName(a AEAD) string {
+	switch a := a.(type) {
+	case xchacha:
+		return "XChaCha20Poly1305"
+	case aesGCM:
+		return "AES256GCM"
+	case aesGCMSIV:
+		return "AES256GCMSIV"
+	case randomNonce:
+		return aeadName(a.AEAD) + "-RandomNonce"
+	case interface{ Name() string }:
+		return a.Name()
+	default:
+		return fmt.Sprintf("%T", a)
+	}
+}
+
+// hashNames maps the digest of the empty string to the name of
+// each well-known hash.
+var hashNames = func() map[string]string {
+	m := make(map[string]string)
+	for _, h := range []struct {
+		name string
+		fn   func() hash.Hash
+	}{
+		{"SHA224", sha256.New224},
+		{"SHA256", sha256.New},
+		{"SHA384", sha512.New384},
+		{"SHA512", sha512.New},
+		{"SHA512/256", sha512.New512_256},
+		{"BLAKE2b256", blake2b256},
+	} {
+		m[string(h.fn().Sum(nil))] = h.name
+	}
+	return m
+}()
+
+// hashName returns the name of a hash function.
+//
+// Hash functions are identified by their output, since
+// functions cannot be compared. Unknown hashes are named by
+// their type and size.
+func hashName(fn func() hash.Hash) string {
+	h := fn()
+	if name, ok := hashNames[string(h.Sum(nil))]; ok {
+		return name
+	}
+	return fmt.Sprintf("%T-%d", h, h.Size())
+}
+
+// WithAEAD configures the AEAD used to encrypt messages.
+//
+// The AEAD key and nonce are still derived from the message key,
+// so changing the AEAD does not change the KDF chains.
+//
+// By default, DJB and X448 use XChaCha20-Poly1305 and NIST uses
+// AES-GCM.
+func WithAEAD(aead AEAD) RatchetOption {
+	return func(o *ratchetOptions) {
+		o.aead = aead
+	}
+}
+
+// WithKDFHash configures the hash used by HKDF and HMAC in each
+// KDF chain.
+//
+// The hash must produce at least 32 bytes of output. Longer
+// outputs are truncated to 32 bytes when deriving chain and
+// message keys.
+//
+// By default, DJB uses BLAKE2b-256, X448 uses SHA-512, and NIST
+// uses the hash provided to it.
+func WithKDFHash(h func() hash.Hash) RatchetOption {
+	if n := h().Size(); n < KeySize {
+		panic("dr: KDF hash output too small: " + strconv.Itoa(n))
+	}
+	return func(o *ratchetOptions) {
+		o.hash = h
+	}
+}
+
+// WithInfoLabels configures the HKDF info labels used when
+// deriving message keys and root keys, respectively.
+//
+// The labels are used as-is and replace the labels derived from
+// the namespace, which are
+//
+//    namespace + "MessageKeys"
+//    namespace + "Ratchet"
+//
+func WithInfoLabels(mk, rk string) RatchetOption {
+	return func(o *ratchetOptions) {
+		o.mkInfo = []byte(mk)
+		o.rkInfo = []byte(rk)
+	}
+}
+
+// WithRandomNonce configures the Ratchet to generate a random
+// nonce for each message using r and transmit it with the
+// ciphertext, which is option 4 from the Ratchet.Seal
+// documentation.
+//
+// The nonce is prepended to the ciphertext, so each ciphertext
+// is larger by the AEAD's nonce size. The AEAD key is still
+// derived from the message key.
+//
+// Sealing panics if r returns an error, since Ratchet.Seal
+// cannot report one, so r should be a reader that does not fail,
+// like crypto/rand.Reader.
+//
+// By default, the nonce is derived from the message key
+// alongside the AEAD key and is not transmitted.
+func WithRandomNonce(r io.Reader) RatchetOption {
+	return func(o *ratchetOptions) {
+		o.rand = r
+	}
+}
+
+// WithNonceCounter mixes the message number (Header.N) into each
+// derived nonce as defense in depth.
+//
+// Every message key is unique, so the derived nonce is already
+// unique. But if a message key were ever reused, for example by a
+// bug in how skipped message keys are stored, messages at
+// different positions would still be encrypted with distinct
+// nonces instead of repeating the (key, nonce) pair.
+//
+// The message number is XORed into the last eight bytes of the
+// nonce as a big-endian uint64, truncated if the nonce is
+// shorter. It is provided by Session through
+// CounterRatchet, so the Ratchet's Seal and Open methods, which
+// do not know the message number, behave as if it were zero.
+// Streams sealed with SealStream use the chunk index instead.
+//
+// WithNonceCounter changes the ciphertexts, so both parties must
+// use it. It has no effect with WithRandomNonce.
+//
+// By default, the nonce does not depend on the message number.
+func WithNonceCounter() RatchetOption {
+	return func(o *ratchetOptions) {
+		o.nonceCounter = true
+	}
+}
+
+// WithKeyedBLAKE2b configures each KDF chain to use BLAKE2b-256
+// throughout: KDF_CK uses keyed BLAKE2b-256 instead of HMAC,
+// and KDF_RK and message key derivation use HKDF with
+// BLAKE2b-256.
+//
+// BLAKE2b is a MAC when keyed, so it is a valid replacement for
+// HMAC. Keyed BLAKE2b processes the chain key and input in a
+// single compression, which is faster than HMAC-SHA-256 on
+// platforms without SHA hardware acceleration.
+//
+// WithKeyedBLAKE2b changes every derived key, so both parties
+// must use it. It takes precedence over WithKDFHash.
+//
+// By default, KDF_CK uses HMAC.
+func WithKeyedBLAKE2b() RatchetOption {
+	return func(o *ratchetOptions) {
+		o.keyedBLAKE2b = true
+	}
+}
+
+// WithZeroNonce derives only the AEAD key from each message key
+// and uses an all-zero nonce, which is option 1 from the
+// Ratchet.Seal documentation. It exists to interoperate with
+// implementations that do the same.
+//
+// Each message key is used exactly once, so a fixed nonce is
+// safe. With WithNonceCounter, the message number is mixed into
+// the zero nonce.
+//
+// The AEAD key is derived with HKDF like the default, but since
+// HKDF output is a prefix of any longer output, the default
+// message key label would derive the same AEAD key as the
+// default (key, nonce) pair. So, unless WithInfoLabels is used,
+// the message key label is
+//
+//    namespace + "ZeroNonceMessageKeys"
+//
+// WithZeroNonce changes the ciphertexts, so both parties must
+// use it. It has no effect with WithRandomNonce.
+//
+// By default, the nonce is derived from the message key
+// alongside the AEAD key.
+func WithZeroNonce() RatchetOption {
+	return func(o *ratchetOptions) {
+		o.zeroNonce = true
+	}
+}
+
+// WithUncompressedPoints configures NIST to encode public keys in
+// ANSI X9.62 uncompressed form, which is
+//
+//    0x04 || x || y
+//
+// It exists to interoperate with implementations that do not
+// accept compressed points. Uncompressed public keys are about
+// twice as large, so each Header is larger by the size of the
+// curve in bytes (see DHPublicKeyLen). Public keys in compressed
+// form are rejected.
+//
+// WithUncompressedPoints only changes the encoding of public
+// keys, not the Diffie-Hellman outputs or any derived keys, but
+// both parties must use it. Key pairs created by Generate also
+// contain the public key, so key pairs generated with and
+// without WithUncompressedPoints cannot be mixed. It has no
+// effect on other Ratchets.
+//
+// By default, NIST encodes public keys in compressed form.
+func WithUncompressedPoints() RatchetOption {
+	return func(o *ratchetOptions) {
+		o.uncompressedPoints = true
+	}
+}
+
+// mixCounter XORs the big-endian encoding of n into the end of
+// nonce.
+func mixCounter(nonce []byte, n int) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(n))
+	k := min(len(nonce), len(b))
+	subtle.XORBytes(nonce[len(nonce)-k:], nonce[len(nonce)-k:], b[len(b)-k:])
+}
+
+// randomNonce is an AEAD that ignores the provided nonce and
+// instead generates and transmits a random nonce.
+type randomNonce struct {
+	AEAD
+	rand io.Reader
+}
+
+var _ AEAD = randomNonce{}
+
+func (r randomNonce) Overhead() int {
+	return r.AEAD.NonceSize() + r.AEAD.Overhead()
+}
+
+func (r randomNonce) Seal(dst, key, _, plaintext, additionalData []byte) []byte {
+	N := r.AEAD.NonceSize()
+	nonce := make([]byte, N)
+	if _, err := io.ReadFull(r.rand, nonce); err != nil {
+		panic("dr: unable to read random nonce: " + err.Error())
+	}
+	if !inPlace(dst, plaintext) {
+		return r.AEAD.Seal(append(dst, nonce...), key, nonce, plaintext, additionalData)
+	}
+	// Writing the nonce would overwrite the start of the
+	// plaintext, so move the plaintext after the nonce and seal
+	// it there.
+	n := len(dst)
+	ret, out := sliceForAppend(dst, N+len(plaintext)+r.AEAD.Overhead())
+	copy(out[N:], plaintext)
+	copy(out, nonce)
+	return r.AEAD.Seal(ret[:n+N], key, nonce, out[N:N+len(plaintext)], additionalData)
+}
+
+func (r randomNonce) Open(dst, key, _, ciphertext, additionalData []byte) ([]byte, error) {
+	N := r.AEAD.NonceSize()
+	if len(ciphertext) < N {
+		return nil, errors.New("dr: ciphertext too short")
+	}
+	nonce := append([]byte(nil), ciphertext[:N]...)
+	if !inPlace(dst, ciphertext) {
+		return r.AEAD.Open(dst, key, nonce, ciphertext[N:], additionalData)
+	}
+	// The plaintext would start N bytes before the rest of the
+	// ciphertext, which AEADs do not allow, so open it in place
+	// and then move it.
+	plaintext, err := r.AEAD.Open(ciphertext[N:N], key, nonce, ciphertext[N:], additionalData)
+	if err != nil {
+		return nil, err
+	}
+	return append(dst, plaintext...), nil
+}
+
+// inPlace reports whether the unused capacity of dst starts at
+// the start of buf.
+func inPlace(dst, buf []byte) bool {
+	return len(buf) > 0 && cap(dst) > len(dst) &&
+		&dst[:len(dst)+1][len(dst)] == &buf[0]
+}
+
+// scratch pools the buffers used to derive AEAD keys and
+// nonces.
+var scratch = sync.Pool{
+	New: func() interface{} {
+		// Large enough for XChaCha20-Poly1305's 32-byte key and
+		// 24-byte nonce.
+		b := make([]byte, 0, 64)
+		return &b
+	},
+}
+
+// getScratch returns a pooled buffer of length n.
+func getScratch(n int) *[]byte {
+	buf := scratch.Get().(*[]byte)
+	if cap(*buf) < n {
+		*buf = make([]byte, n)
+	}
+	*buf = (*buf)[:n]
+	return buf
+}
+
+// putScratch wipes the buffer and returns it to the pool.
+func putScratch(buf *[]byte) {
+	wipe(*buf)
+	scratch.Put(buf)
+}
+
+// xchacha is 256-bit XChaCha20-Poly1305.
+type xchacha struct{}
+
+var _ AEAD = xchacha{}
+
+func (xchacha) KeySize() int   { return chacha20poly1305.KeySize }
+func (xchacha) NonceSize() int { return chacha20poly1305.NonceSizeX }
+func (xchacha) Overhead() int  { return chacha20poly1305.Overhead }
+
+func (xchacha) Seal(dst, key, nonce, plaintext, additionalData []byte) []byte {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		panic(err)
+	}
+	return aead.Seal(dst, nonce, plaintext, additionalData)
+}
+
+func (xchacha) Open(dst, key, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(dst, nonce, ciphertext, additionalData)
+}
+
+// aesGCM is 256-bit AES-GCM.
+type aesGCM struct{}
+
+var _ AEAD = aesGCM{}
+
+func (aesGCM) KeySize() int   { return 32 }
+func (aesGCM) NonceSize() int { return 12 }
+func (aesGCM) Overhead() int  { return 16 }
+
+func (aesGCM) Seal(dst, key, nonce, plaintext, additionalData []byte) []byte {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return aead.Seal(dst, nonce, plaintext, additionalData)
+}
+
+func (aesGCM) Open(dst, key, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(dst, nonce, ciphertext, additionalData)
+}
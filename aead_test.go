@@ -0,0 +1,694 @@
+package dr
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"hash"
+	"io"
+	"testing"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// xorAEAD is a trivial, insecure AEAD.
+type xorAEAD struct{}
+
+var _ AEAD = xorAEAD{}
+
+func (xorAEAD) KeySize() int   { return 16 }
+func (xorAEAD) NonceSize() int { return 4 }
+func (xorAEAD) Overhead() int  { return 1 }
+
+// tag computes a "tag" over the inputs.
+func (xorAEAD) tag(key, nonce, data, additionalData []byte) byte {
+	var t byte
+	for _, s := range [][]byte{key, nonce, data, additionalData} {
+		for _, c := range s {
+			t ^= c
+		}
+	}
+	return t
+}
+
+func (x xorAEAD) Seal(dst, key, nonce, plaintext, additionalData []byte) []byte {
+	// Compute the tag first since dst may overwrite plaintext.
+	tag := x.tag(key, nonce, plaintext, additionalData)
+	for i, c := range plaintext {
+		dst = append(dst, c^key[i%len(key)])
+	}
+	return append(dst, tag)
+}
+
+func (x xorAEAD) Open(dst, key, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < 1 {
+		return nil, errors.New("ciphertext too short")
+	}
+	tag := ciphertext[len(ciphertext)-1]
+	ciphertext = ciphertext[:len(ciphertext)-1]
+	n := len(dst)
+	for i, c := range ciphertext {
+		dst = append(dst, c^key[i%len(key)])
+	}
+	if x.tag(key, nonce, dst[n:], additionalData) != tag {
+		return nil, errors.New("invalid tag")
+	}
+	return dst, nil
+}
+
+// TestWithAEAD tests that a custom AEAD is used end to end.
+func TestWithAEAD(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		fn   func(*testing.T) Ratchet
+	}{
+		{"P-256", func(t *testing.T) Ratchet {
+			return NIST(elliptic.P256(), sha256.New, t.Name(), WithAEAD(xorAEAD{}))
+		}},
+		{"DJB", func(t *testing.T) Ratchet {
+			return DJB(t.Name(), WithAEAD(xorAEAD{}))
+		}},
+		{"X448", func(t *testing.T) Ratchet {
+			return X448(t.Name(), WithAEAD(xorAEAD{}))
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fn := tc.fn
+			SK := make([]byte, 32)
+			_, err := rand.Read(SK)
+			if err != nil {
+				t.Fatal(err)
+			}
+			priv, err := fn(t).Generate(rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			bob, err := NewRecv(fn(t), SK, priv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			alice, err := NewSend(fn(t), SK, fn(t).Public(priv))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			send, recv := alice, bob
+			plaintext := make([]byte, 100)
+			ad := make([]byte, 10)
+			for i := 0; i < 10; i++ {
+				rand.Read(plaintext)
+				rand.Read(ad)
+				msg, err := send.Seal(plaintext, ad)
+				if err != nil {
+					t.Fatalf("#%d: %v", i, err)
+				}
+				if len(msg.Ciphertext) != len(plaintext)+1 {
+					t.Fatalf("#%d: custom AEAD not used", i)
+				}
+				got, err := recv.Open(msg, ad)
+				if err != nil {
+					t.Fatalf("#%d: %v", i, err)
+				}
+				if !hmac.Equal(plaintext, got) {
+					t.Fatalf("#%d: expected %q, got %q", i, plaintext, got)
+				}
+				send, recv = recv, send
+			}
+		})
+	}
+}
+
+// TestDefaultAEAD tests that the default AEAD matches the
+// original hardcoded construction.
+func TestDefaultAEAD(t *testing.T) {
+	mk := make([]byte, 32)
+	_, err := rand.Read(mk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext := []byte("plaintext")
+	ad := []byte("additional data")
+
+	const namespace = "namespace"
+	got := DJB(namespace).Seal(mk, plaintext, ad)
+
+	buf := make([]byte, chacha20poly1305.KeySize+chacha20poly1305.NonceSizeX)
+	h := func() hash.Hash {
+		h, _ := blake2b.New256(nil)
+		return h
+	}
+	_, err = io.ReadFull(hkdf.New(h, mk, nil, []byte(namespace+"MessageKeys")), buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := chacha20poly1305.NewX(buf[:chacha20poly1305.KeySize])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := aead.Seal(nil, buf[chacha20poly1305.KeySize:], plaintext, ad)
+	if !bytes.Equal(got, want) {
+		t.Fatalf("expected %#x, got %#x", want, got)
+	}
+}
+
+// TestKDFOptions tests that ratchets configured differently
+// but sharing a KDF hash and info labels can talk to each other.
+func TestKDFOptions(t *testing.T) {
+	const (
+		mkInfo = "external MessageKeys"
+		rkInfo = "external Ratchet"
+	)
+	for _, tc := range []struct {
+		name string
+		a, b func(*testing.T) Ratchet
+	}{
+		{"P-256",
+			func(t *testing.T) Ratchet {
+				return NIST(elliptic.P256(), sha256.New, "alice",
+					WithKDFHash(sha512.New),
+					WithInfoLabels(mkInfo, rkInfo))
+			},
+			func(t *testing.T) Ratchet {
+				return NIST(elliptic.P256(), sha512.New, "bob",
+					WithInfoLabels(mkInfo, rkInfo))
+			},
+		},
+		{"DJB",
+			func(t *testing.T) Ratchet {
+				return DJB("alice",
+					WithKDFHash(sha512.New),
+					WithInfoLabels(mkInfo, rkInfo))
+			},
+			func(t *testing.T) Ratchet {
+				return DJB("bob",
+					WithInfoLabels(mkInfo, rkInfo),
+					WithKDFHash(sha512.New))
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			SK := make([]byte, 32)
+			_, err := rand.Read(SK)
+			if err != nil {
+				t.Fatal(err)
+			}
+			priv, err := tc.b(t).Generate(rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			bob, err := NewRecv(tc.b(t), append([]byte(nil), SK...), priv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			alice, err := NewSend(tc.a(t), SK, tc.b(t).Public(priv))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			send, recv := alice, bob
+			plaintext := make([]byte, 100)
+			for i := 0; i < 10; i++ {
+				rand.Read(plaintext)
+				msg, err := send.Seal(plaintext, nil)
+				if err != nil {
+					t.Fatalf("#%d: %v", i, err)
+				}
+				got, err := recv.Open(msg, nil)
+				if err != nil {
+					t.Fatalf("#%d: %v", i, err)
+				}
+				if !hmac.Equal(plaintext, got) {
+					t.Fatalf("#%d: expected %q, got %q", i, plaintext, got)
+				}
+				send, recv = recv, send
+			}
+		})
+	}
+}
+
+// TestKDFOptionsVector tests the KDF chains against a manual
+// HKDF-SHA-512 and HMAC-SHA-512 construction.
+func TestKDFOptionsVector(t *testing.T) {
+	r := DJB("ignored",
+		WithKDFHash(sha512.New),
+		WithInfoLabels("mk", "rk"))
+
+	rk := bytes.Repeat([]byte{0x01}, 32)
+	dh := bytes.Repeat([]byte{0x02}, 32)
+	gotRK, gotCK := r.KDFrk(rk, dh)
+
+	buf := make([]byte, 64)
+	_, err := io.ReadFull(hkdf.New(sha512.New, dh, rk, []byte("rk")), buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(gotRK, buf[:32]) {
+		t.Fatalf("RootKey: expected %#x, got %#x", buf[:32], gotRK)
+	}
+	if !bytes.Equal(gotCK, buf[32:]) {
+		t.Fatalf("ChainKey: expected %#x, got %#x", buf[32:], gotCK)
+	}
+
+	ck, mk := r.KDFck(gotCK)
+	mac := func(c byte) []byte {
+		h := hmac.New(sha512.New, gotCK)
+		h.Write([]byte{c})
+		return h.Sum(nil)[:32]
+	}
+	if want := mac(0x02); !bytes.Equal(ck, want) {
+		t.Fatalf("ChainKey: expected %#x, got %#x", want, ck)
+	}
+	if want := mac(0x01); !bytes.Equal(mk, want) {
+		t.Fatalf("MessageKey: expected %#x, got %#x", want, mk)
+	}
+
+	// Different labels must not interoperate.
+	other := DJB("ignored", WithKDFHash(sha512.New))
+	ct := r.Seal(mk, []byte("plaintext"), nil)
+	if _, err := other.Open(mk, ct, nil); err == nil {
+		t.Fatal("expected an error with different labels")
+	}
+}
+
+// TestKeyedBLAKE2b tests KDF_CK against a manual keyed BLAKE2b
+// construction and that WithKeyedBLAKE2b creates a distinct
+// parameter set.
+func TestKeyedBLAKE2b(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		fn   func(...RatchetOption) Ratchet
+	}{
+		{"P-256", func(opts ...RatchetOption) Ratchet {
+			return NIST(elliptic.P256(), sha256.New, "namespace", opts...)
+		}},
+		{"DJB", func(opts ...RatchetOption) Ratchet {
+			return DJB("namespace", opts...)
+		}},
+		{"X448", func(opts ...RatchetOption) Ratchet {
+			return X448("namespace", opts...)
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ck := make(ChainKey, KeySize)
+			if _, err := rand.Read(ck); err != nil {
+				t.Fatal(err)
+			}
+			mac := func(b byte) []byte {
+				h, err := blake2b.New256(ck)
+				if err != nil {
+					t.Fatal(err)
+				}
+				h.Write([]byte{b})
+				return h.Sum(nil)
+			}
+
+			r := tc.fn(WithKeyedBLAKE2b())
+			gotCK, gotMK := r.KDFck(ck)
+			if want := mac(0x02); !bytes.Equal(gotCK, want) {
+				t.Fatalf("expected chain key %#x, got %#x", want, gotCK)
+			}
+			if want := mac(0x01); !bytes.Equal(gotMK, want) {
+				t.Fatalf("expected message key %#x, got %#x", want, gotMK)
+			}
+
+			// WithKDFHash is ignored.
+			r2 := tc.fn(WithKDFHash(sha512.New), WithKeyedBLAKE2b())
+			if r.Name() != r2.Name() {
+				t.Fatalf("names differ: %q and %q", r.Name(), r2.Name())
+			}
+			rk := make(RootKey, KeySize)
+			dh := []byte("dh")
+			rk1, ck1 := r.KDFrk(rk, dh)
+			rk2, ck2 := r2.KDFrk(rk, dh)
+			if !bytes.Equal(rk1, rk2) || !bytes.Equal(ck1, ck2) {
+				t.Fatal("KDFrk should not depend on WithKDFHash")
+			}
+
+			def := tc.fn()
+			if def.Name() == r.Name() {
+				t.Fatalf("names should differ: %q", r.Name())
+			}
+			if defCK, _ := def.KDFck(ck); bytes.Equal(defCK, gotCK) {
+				t.Fatal("chain keys should differ")
+			}
+		})
+	}
+}
+
+// TestZeroNonce tests WithZeroNonce against a manual HKDF and
+// fixed-nonce AEAD construction.
+func TestZeroNonce(t *testing.T) {
+	newGCM := func(key []byte) (cipher.AEAD, error) {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	}
+	for _, tc := range []struct {
+		name string
+		fn   func(...RatchetOption) Ratchet
+		hash func() hash.Hash
+		aead func([]byte) (cipher.AEAD, error)
+	}{
+		{"P-256", func(opts ...RatchetOption) Ratchet {
+			return NIST(elliptic.P256(), sha256.New, "namespace", opts...)
+		}, sha256.New, newGCM},
+		{"DJB", func(opts ...RatchetOption) Ratchet {
+			return DJB("namespace", opts...)
+		}, blake2b256, chacha20poly1305.NewX},
+		{"X448", func(opts ...RatchetOption) Ratchet {
+			return X448("namespace", opts...)
+		}, sha512.New, chacha20poly1305.NewX},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mk := make(MessageKey, KeySize)
+			if _, err := rand.Read(mk); err != nil {
+				t.Fatal(err)
+			}
+			plaintext := []byte("plaintext")
+			ad := []byte("additional data")
+
+			want := func(info string) []byte {
+				key := make([]byte, 32)
+				_, err := io.ReadFull(hkdf.New(tc.hash, mk, nil, []byte(info)), key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				aead, err := tc.aead(key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				nonce := make([]byte, aead.NonceSize())
+				return aead.Seal(nil, nonce, plaintext, ad)
+			}
+
+			r := tc.fn(WithZeroNonce())
+			got := r.Seal(mk, plaintext, ad)
+			if want := want("namespaceZeroNonceMessageKeys"); !bytes.Equal(got, want) {
+				t.Fatalf("expected %#x, got %#x", want, got)
+			}
+			if _, err := tc.fn().Open(mk, got, ad); err == nil {
+				t.Fatal("expected an error without WithZeroNonce")
+			}
+			if r.Name() == tc.fn().Name() {
+				t.Fatalf("names should differ: %q", r.Name())
+			}
+
+			// Explicit labels are used as-is.
+			r = tc.fn(WithZeroNonce(), WithInfoLabels("mk", "rk"))
+			got = r.Seal(mk, plaintext, ad)
+			if want := want("mk"); !bytes.Equal(got, want) {
+				t.Fatalf("expected %#x, got %#x", want, got)
+			}
+		})
+	}
+
+	alice, bob := newSessions(t, func(t *testing.T) Ratchet {
+		return DJB(t.Name(), WithZeroNonce(), WithNonceCounter())
+	})
+	for i := 0; i < 4; i++ {
+		msg, err := alice.Seal([]byte("hello"), nil)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if _, err := bob.Open(msg, nil); err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		alice, bob = bob, alice
+	}
+}
+
+// TestRandomNonce tests WithRandomNonce against a manual
+// construction with a fixed nonce.
+func TestRandomNonce(t *testing.T) {
+	mk := make([]byte, 32)
+	_, err := rand.Read(mk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext := []byte("plaintext")
+	ad := []byte("additional data")
+	nonce := bytes.Repeat([]byte{0x42}, chacha20poly1305.NonceSizeX)
+
+	const namespace = "namespace"
+	r := DJB(namespace, WithRandomNonce(bytes.NewReader(nonce)))
+	got := r.Seal(mk, plaintext, ad)
+
+	buf := make([]byte, chacha20poly1305.KeySize+chacha20poly1305.NonceSizeX)
+	h := func() hash.Hash {
+		h, _ := blake2b.New256(nil)
+		return h
+	}
+	_, err = io.ReadFull(hkdf.New(h, mk, nil, []byte(namespace+"MessageKeys")), buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := chacha20poly1305.NewX(buf[:chacha20poly1305.KeySize])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := aead.Seal(append([]byte(nil), nonce...), nonce, plaintext, ad)
+	if !bytes.Equal(got, want) {
+		t.Fatalf("expected %#x, got %#x", want, got)
+	}
+
+	pt, err := r.Open(mk, got, ad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(pt, plaintext) {
+		t.Fatalf("expected %q, got %q", plaintext, pt)
+	}
+	if _, err := r.Open(mk, got[:len(nonce)-1], ad); err == nil {
+		t.Fatal("expected an error for a truncated nonce")
+	}
+
+	// The default derived nonce must not interoperate.
+	if _, err := DJB(namespace).Open(mk, got, ad); err == nil {
+		t.Fatal("expected an error without WithRandomNonce")
+	}
+}
+
+// TestRandomNonceSession tests WithRandomNonce end to end.
+func TestRandomNonceSession(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		fn   func(*testing.T) Ratchet
+	}{
+		{"P-256", func(t *testing.T) Ratchet {
+			return NIST(elliptic.P256(), sha256.New, t.Name(), WithRandomNonce(rand.Reader))
+		}},
+		{"DJB", func(t *testing.T) Ratchet {
+			return DJB(t.Name(), WithRandomNonce(rand.Reader))
+		}},
+		{"X448", func(t *testing.T) Ratchet {
+			return X448(t.Name(), WithAEAD(xorAEAD{}), WithRandomNonce(rand.Reader))
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fn := tc.fn
+			SK := make([]byte, 32)
+			priv, err := fn(t).Generate(rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			bob, err := NewRecv(fn(t), append([]byte(nil), SK...), priv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			alice, err := NewSend(fn(t), SK, fn(t).Public(priv))
+			if err != nil {
+				t.Fatal(err)
+			}
+			send, recv := alice, bob
+			plaintext := make([]byte, 100)
+			for i := 0; i < 10; i++ {
+				rand.Read(plaintext)
+				msg, err := send.Seal(plaintext, nil)
+				if err != nil {
+					t.Fatalf("#%d: %v", i, err)
+				}
+				got, err := recv.Open(msg, nil)
+				if err != nil {
+					t.Fatalf("#%d: %v", i, err)
+				}
+				if !hmac.Equal(plaintext, got) {
+					t.Fatalf("#%d: expected %q, got %q", i, plaintext, got)
+				}
+
+				// In place, with enough capacity that nothing
+				// is reallocated.
+				buf := make([]byte, len(plaintext), len(plaintext)+100)
+				copy(buf, plaintext)
+				ciphertext, h, err := send.SealTo(buf[:0], buf, nil)
+				if err != nil {
+					t.Fatalf("#%d: %v", i, err)
+				}
+				if &ciphertext[0] != &buf[0] {
+					t.Fatalf("#%d: SealTo reallocated", i)
+				}
+				msg = Message{Header: h, Ciphertext: ciphertext}
+				got, err = recv.OpenTo(ciphertext[:0], msg, nil)
+				if err != nil {
+					t.Fatalf("#%d: %v", i, err)
+				}
+				if !hmac.Equal(plaintext, got) {
+					t.Fatalf("#%d: expected %q, got %q", i, plaintext, got)
+				}
+				send, recv = recv, send
+			}
+		})
+	}
+}
+
+// TestScratchWiped tests that putScratch wipes buffers before
+// returning them to the pool.
+func TestScratchWiped(t *testing.T) {
+	buf := getScratch(44)
+	if len(*buf) != 44 {
+		t.Fatalf("expected length 44, got %d", len(*buf))
+	}
+	b := *buf
+	for i := range b {
+		b[i] = 0xff
+	}
+	putScratch(buf)
+	for i, c := range b {
+		if c != 0 {
+			t.Fatalf("byte %d was not wiped: %#x", i, b)
+		}
+	}
+}
+
+// TestNonceCounter tests that WithNonceCounter produces distinct
+// ciphertexts for distinct message numbers even if the message
+// key is reused.
+func TestNonceCounter(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		fn   func(...RatchetOption) Ratchet
+	}{
+		{"P-256", func(opts ...RatchetOption) Ratchet {
+			return NIST(elliptic.P256(), sha256.New, "namespace", opts...)
+		}},
+		{"DJB", func(opts ...RatchetOption) Ratchet {
+			return DJB("namespace", opts...)
+		}},
+		{"X448", func(opts ...RatchetOption) Ratchet {
+			return X448("namespace", opts...)
+		}},
+		{"xorAEAD", func(opts ...RatchetOption) Ratchet {
+			return DJB("namespace", append(opts, WithAEAD(xorAEAD{}))...)
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mk := make(MessageKey, 32)
+			if _, err := rand.Read(mk); err != nil {
+				t.Fatal(err)
+			}
+			plaintext := []byte("plaintext")
+			ad := []byte("additional data")
+
+			r := tc.fn(WithNonceCounter()).(CounterRatchet)
+			c1 := r.AppendSealCounter(nil, mk, 1, plaintext, ad)
+			c2 := r.AppendSealCounter(nil, mk, 2, plaintext, ad)
+			if bytes.Equal(c1, c2) {
+				t.Fatal("ciphertexts should differ")
+			}
+			if _, err := r.AppendOpenCounter(nil, mk, 2, c1, ad); err == nil {
+				t.Fatal("expected an error for the wrong message number")
+			}
+			got, err := r.AppendOpenCounter(nil, mk, 1, c1, ad)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, plaintext) {
+				t.Fatalf("expected %q, got %q", plaintext, got)
+			}
+			// Message number zero leaves the nonce unchanged.
+			c0 := r.AppendSealCounter(nil, mk, 0, plaintext, ad)
+			if want := tc.fn().Seal(mk, plaintext, ad); !bytes.Equal(c0, want) {
+				t.Fatalf("expected %#x, got %#x", want, c0)
+			}
+
+			// By default, the message number is ignored.
+			d := tc.fn().(CounterRatchet)
+			c1 = d.AppendSealCounter(nil, mk, 1, plaintext, ad)
+			c2 = d.AppendSealCounter(nil, mk, 2, plaintext, ad)
+			if !bytes.Equal(c1, c2) {
+				t.Fatal("ciphertexts should not differ")
+			}
+		})
+	}
+}
+
+// TestNonceCounterSession tests WithNonceCounter end to end.
+func TestNonceCounterSession(t *testing.T) {
+	alice, bob := newSessions(t, func(t *testing.T) Ratchet {
+		return DJB(t.Name(), WithNonceCounter())
+	})
+	msgs := make([]Message, 5)
+	for i := range msgs {
+		var err error
+		msgs[i], err = alice.Seal([]byte("hello"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Open out of order so that skipped keys are used.
+	for _, i := range []int{4, 0, 3, 1, 2} {
+		if _, err := bob.Open(msgs[i], nil); err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+	}
+	plaintext := make([]byte, 2*streamChunkSize)
+	ct, h := sealStream(t, bob, plaintext, nil)
+	r, err := alice.OpenStream(bytes.NewReader(ct), h, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(r); err != nil {
+		t.Fatal(err)
+	}
+
+	// A peer without WithNonceCounter can only open the first
+	// message of each chain.
+	SK := make([]byte, 32)
+	priv, err := DJB(t.Name()).Generate(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The Ratchets' names differ, so do not bind them.
+	carol, err := NewRecv(DJB(t.Name()), append([]byte(nil), SK...), priv,
+		WithAlgorithmBinding(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dave, err := NewSend(DJB(t.Name(), WithNonceCounter()), SK, DJB(t.Name()).Public(priv),
+		WithAlgorithmBinding(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		msg, err := dave.Seal([]byte("hello"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = carol.Open(msg, nil)
+		if i == 0 && err != nil {
+			t.Fatal(err)
+		}
+		if i == 1 && err == nil {
+			t.Fatal("expected an error")
+		}
+	}
+}
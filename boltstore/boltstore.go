@@ -0,0 +1,408 @@
+// Package boltstore implements a dr.Store backed by a bbolt
+// database.
+//
+// Each Store is scoped to a single session ID, so one database
+// can hold many sessions.
+//
+// Skipped message keys passed to StoreKey are buffered in memory
+// and only written to the database alongside the next call to
+// Save, in a single transaction. A crash between StoreKey and Save
+// therefore loses both the skipped keys and the new state, which
+// leaves the database consistent: the previous state is still
+// able to rederive the lost keys.
+//
+// bbolt does not zero freed pages, so deleted message keys may
+// linger on disk until their pages are reused.
+package boltstore
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"go.etcd.io/bbolt"
+
+	"github.com/ericlagergren/dr"
+	"github.com/ericlagergren/dr/internal/secure"
+)
+
+// DefaultMaxSkip is the default maximum number of skipped
+// message keys stored per session.
+const DefaultMaxSkip = 1000
+
+var (
+	// sessionsBucket is the top-level bucket that contains one
+	// bucket per session.
+	sessionsBucket = []byte("sessions")
+	// keysBucket is the per-session bucket that contains skipped
+	// message keys.
+	keysBucket = []byte("keys")
+	// stateKey is the per-session key for the saved state.
+	stateKey = []byte("state")
+	// countKey is the per-session key for the number of skipped
+	// message keys in keysBucket, a big-endian uint64.
+	countKey = []byte("count")
+)
+
+// Store is a dr.Store backed by a bbolt database.
+//
+// Store is not safe for concurrent use by multiple goroutines.
+type Store struct {
+	db      *bbolt.DB
+	id      []byte
+	maxSkip int
+	// pending are the skipped keys that have not yet been
+	// written to the database.
+	pending map[string][]byte
+	// fresh are the pending keys that are not already in the
+	// database, so they count against maxSkip.
+	fresh map[string]bool
+	// loaded are copies of keys returned by LoadKey so that they
+	// can be wiped by DeleteKey.
+	loaded map[string][]byte
+}
+
+var (
+	_ dr.Store      = (*Store)(nil)
+	_ dr.KeyPurger  = (*Store)(nil)
+	_ dr.Purger     = (*Store)(nil)
+	_ dr.KeyCounter = (*Store)(nil)
+	_ dr.KeyLimiter = (*Store)(nil)
+)
+
+// Option configures a Store.
+type Option func(*Store)
+
+// WithMaxSkip sets the maximum number of skipped message keys
+// stored for the session.
+//
+// By default, DefaultMaxSkip is used.
+func WithMaxSkip(n int) Option {
+	return func(s *Store) {
+		s.maxSkip = n
+	}
+}
+
+// New creates a Store for the session with the provided ID.
+func New(db *bbolt.DB, id string, opts ...Option) (*Store, error) {
+	if id == "" {
+		return nil, errors.New("boltstore: empty session ID")
+	}
+	s := &Store{
+		db:      db,
+		id:      []byte(id),
+		maxSkip: DefaultMaxSkip,
+		pending: make(map[string][]byte),
+		fresh:   make(map[string]bool),
+		loaded:  make(map[string][]byte),
+	}
+	for _, fn := range opts {
+		fn(s)
+	}
+	err := db.Update(func(tx *bbolt.Tx) error {
+		b, err := s.bucket(tx)
+		if err != nil {
+			return err
+		}
+		if b.Get(countKey) != nil {
+			return nil
+		}
+		// The database predates countKey.
+		return setCount(b, count(b))
+	})
+	if err != nil {
+		return nil, fmt.Errorf("boltstore: unable to create buckets: %w", err)
+	}
+	return s, nil
+}
+
+// bucket returns the session's bucket, creating it if necessary.
+//
+// tx must be writable.
+func (s *Store) bucket(tx *bbolt.Tx) (*bbolt.Bucket, error) {
+	root, err := tx.CreateBucketIfNotExists(sessionsBucket)
+	if err != nil {
+		return nil, err
+	}
+	b, err := root.CreateBucketIfNotExists(s.id)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := b.CreateBucketIfNotExists(keysBucket); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// view returns the session's bucket in a read-only transaction.
+func (s *Store) view(tx *bbolt.Tx) *bbolt.Bucket {
+	root := tx.Bucket(sessionsBucket)
+	if root == nil {
+		return nil
+	}
+	return root.Bucket(s.id)
+}
+
+// count returns the number of skipped message keys stored in
+// the session's bucket.
+func count(b *bbolt.Bucket) int {
+	if v := b.Get(countKey); len(v) == 8 {
+		return int(binary.BigEndian.Uint64(v))
+	}
+	// Walking the bucket is slow, but it only happens once for
+	// databases written before countKey existed.
+	return b.Bucket(keysBucket).Stats().KeyN
+}
+
+// setCount sets the number of skipped message keys stored in the
+// session's bucket.
+//
+// b must be writable.
+func setCount(b *bbolt.Bucket, n int) error {
+	return b.Put(countKey, binary.BigEndian.AppendUint64(nil, uint64(n)))
+}
+
+// key returns the database key for the (Nr, PublicKey) tuple.
+func key(Nr int, pub dr.PublicKey) []byte {
+	k := make([]byte, 8+len(pub))
+	binary.BigEndian.PutUint64(k, uint64(Nr))
+	copy(k[8:], pub)
+	return k
+}
+
+// Load returns the most recently saved state.
+//
+// If no state has been saved Load returns dr.ErrNotFound.
+func (s *Store) Load() (*dr.State, error) {
+	var state dr.State
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		b := s.view(tx)
+		if b == nil {
+			return dr.ErrNotFound
+		}
+		data := b.Get(stateKey)
+		if data == nil {
+			return dr.ErrNotFound
+		}
+		return state.UnmarshalBinary(data)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// Save saves the state along with any pending skipped message
+// keys in a single transaction.
+//
+// It returns an error wrapping dr.ErrStaleState if the saved
+// state is at least as new as state. See dr.CheckEpoch.
+func (s *Store) Save(state *dr.State) error {
+	data, err := state.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	defer wipe(data)
+
+	err = s.db.Update(func(tx *bbolt.Tx) error {
+		b, err := s.bucket(tx)
+		if err != nil {
+			return err
+		}
+		if err := dr.CheckEpochBinary(b.Get(stateKey), state); err != nil {
+			return err
+		}
+		keys := b.Bucket(keysBucket)
+		n := count(b)
+		for k, v := range s.pending {
+			if keys.Get([]byte(k)) == nil {
+				n++
+			}
+			if err := keys.Put([]byte(k), v); err != nil {
+				return err
+			}
+		}
+		if err := setCount(b, n); err != nil {
+			return err
+		}
+		return b.Put(stateKey, data)
+	})
+	if err != nil {
+		return err
+	}
+	for k, v := range s.pending {
+		wipe(v)
+		delete(s.pending, k)
+	}
+	clear(s.fresh)
+	return nil
+}
+
+// StoreKey buffers a skipped message key until the next call to
+// Save.
+//
+// Replacing a key that is already stored does not count against
+// the limit set by WithMaxSkip.
+func (s *Store) StoreKey(Nr int, pub dr.PublicKey, mk dr.MessageKey) error {
+	k := string(key(Nr, pub))
+	if old, ok := s.pending[k]; ok {
+		wipe(old)
+		s.pending[k] = append([]byte(nil), mk...)
+		return nil
+	}
+	var (
+		n      int
+		exists bool
+	)
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		if b := s.view(tx); b != nil {
+			n = count(b)
+			exists = b.Bucket(keysBucket).Get([]byte(k)) != nil
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if n+len(s.fresh) >= s.maxSkip {
+			return fmt.Errorf("boltstore: %w", dr.ErrTooManySkipped)
+		}
+		s.fresh[k] = true
+	}
+	s.pending[k] = append([]byte(nil), mk...)
+	return nil
+}
+
+// LoadKey retrieves a skipped message key.
+//
+// If the message key is not found LoadKey returns
+// dr.ErrNotFound.
+func (s *Store) LoadKey(Nr int, pub dr.PublicKey) (dr.MessageKey, error) {
+	k := key(Nr, pub)
+	if mk, ok := s.pending[string(k)]; ok {
+		return mk, nil
+	}
+	var mk dr.MessageKey
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		b := s.view(tx)
+		if b == nil {
+			return dr.ErrNotFound
+		}
+		v := b.Bucket(keysBucket).Get(k)
+		if v == nil {
+			return dr.ErrNotFound
+		}
+		// v is only valid for the lifetime of the transaction.
+		mk = append(dr.MessageKey(nil), v...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.loaded[string(k)] = mk
+	return mk, nil
+}
+
+// DeleteKey removes a skipped message key and wipes any copies
+// of it held by the Store.
+func (s *Store) DeleteKey(Nr int, pub dr.PublicKey) error {
+	k := key(Nr, pub)
+	if mk, ok := s.pending[string(k)]; ok {
+		wipe(mk)
+		delete(s.pending, string(k))
+		delete(s.fresh, string(k))
+	}
+	if mk, ok := s.loaded[string(k)]; ok {
+		wipe(mk)
+		delete(s.loaded, string(k))
+	}
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b, err := s.bucket(tx)
+		if err != nil {
+			return err
+		}
+		keys := b.Bucket(keysBucket)
+		if keys.Get(k) == nil {
+			return nil
+		}
+		if err := keys.Delete(k); err != nil {
+			return err
+		}
+		return setCount(b, max(count(b)-1, 0))
+	})
+}
+
+// PurgeKeys removes every skipped message key for the session.
+func (s *Store) PurgeKeys() error {
+	for _, m := range []map[string][]byte{s.pending, s.loaded} {
+		for k, v := range m {
+			wipe(v)
+			delete(m, k)
+		}
+	}
+	clear(s.fresh)
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b, err := s.bucket(tx)
+		if err != nil {
+			return err
+		}
+		if err := b.DeleteBucket(keysBucket); err != nil {
+			return err
+		}
+		if _, err := b.CreateBucket(keysBucket); err != nil {
+			return err
+		}
+		return setCount(b, 0)
+	})
+}
+
+// SkippedCount returns the number of skipped message keys for
+// the session, including those not yet written to the database.
+func (s *Store) SkippedCount() (int, error) {
+	var n int
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		if b := s.view(tx); b != nil {
+			n = count(b)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n + len(s.fresh), nil
+}
+
+// RemainingKeys returns the number of skipped message keys that
+// can be stored before StoreKey returns dr.ErrTooManySkipped.
+func (s *Store) RemainingKeys() (int, error) {
+	n, err := s.SkippedCount()
+	if err != nil {
+		return 0, err
+	}
+	return max(s.maxSkip-n, 0), nil
+}
+
+// Purge removes the session's state and every skipped message
+// key.
+func (s *Store) Purge() error {
+	for _, m := range []map[string][]byte{s.pending, s.loaded} {
+		for k, v := range m {
+			wipe(v)
+			delete(m, k)
+		}
+	}
+	clear(s.fresh)
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		root := tx.Bucket(sessionsBucket)
+		if root == nil || root.Bucket(s.id) == nil {
+			return nil
+		}
+		return root.DeleteBucket(s.id)
+	})
+}
+
+// wipe is shorthand for secure.Wipe.
+func wipe(p []byte) {
+	secure.Wipe(p)
+}
@@ -0,0 +1,131 @@
+package dr
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// WithCompression configures the session to compress plaintexts
+// with DEFLATE (RFC 1951) before sealing them and to decompress
+// them after opening them.
+//
+// Compression saves bandwidth for large, redundant plaintexts
+// like JSON, but it is not safe for every application. The size
+// of a compressed ciphertext depends on the plaintext's contents,
+// not just its length, so an attacker who can inject data into
+// plaintexts that also contain secrets and who can observe the
+// resulting ciphertext sizes can learn the secrets (see CRIME and
+// BREACH). Only enable compression if plaintexts never mix
+// attacker-controlled data with secrets.
+//
+// The length of the uncompressed plaintext is prepended to the
+// ciphertext as a uvarint and authenticated along with the
+// additional data. That is, the additional data passed to the
+// Ratchet's Concat method is
+//
+//    uvarint(len(plaintext)) || additionalData
+//
+// (after the identifier set by WithSessionBinding, if any). Open
+// rejects messages whose length was modified with
+// ErrDecryptFailed, as well as messages that do not decompress to
+// exactly that length. If WithMaxMessageSize is used, the limit
+// applies to the uncompressed length.
+//
+// Both parties must enable compression. It is not part of the
+// State, so it must also be provided to Resume. Streams are not
+// compressed.
+//
+// By default, plaintexts are not compressed.
+func WithCompression(enabled bool) Option {
+	return func(s *Session) {
+		s.compress = enabled
+	}
+}
+
+// sealMessage seals the plaintext of the message with header h
+// and appends the ciphertext to dst.
+//
+// The plaintext is compressed first if WithCompression is
+// enabled.
+func (s *Session) sealMessage(dst []byte, mk MessageKey, h Header, plaintext, additionalData []byte) []byte {
+	if !s.compress {
+		return appendSeal(s.r, dst, mk, h.N, plaintext, s.concat(additionalData, h))
+	}
+	compressed := deflate(plaintext)
+	defer wipe(compressed)
+
+	ad := binary.AppendUvarint(nil, uint64(len(plaintext)))
+	dst = append(dst, ad...)
+	ad = append(ad, additionalData...)
+	return appendSeal(s.r, dst, mk, h.N, compressed, s.concat(ad, h))
+}
+
+// openMessage opens the ciphertext of the message with header h
+// and appends the plaintext to dst.
+//
+// The plaintext is decompressed if WithCompression is enabled.
+//
+// The errors returned by openMessage wrap ErrDecryptFailed
+// unless the message is too large.
+func (s *Session) openMessage(dst []byte, mk MessageKey, h Header, ciphertext, additionalData []byte) ([]byte, error) {
+	if !s.compress {
+		plaintext, err := appendOpen(s.r, dst, mk, h.N,
+			ciphertext, s.concat(additionalData, h))
+		return plaintext, decryptError(err)
+	}
+	n, k := binary.Uvarint(ciphertext)
+	if k <= 0 {
+		return nil, fmt.Errorf("%w: invalid plaintext length", ErrDecryptFailed)
+	}
+	if n >= math.MaxInt || (s.maxMessageSize > 0 && n > uint64(s.maxMessageSize)) {
+		return nil, ErrMessageTooLarge
+	}
+	// Authenticate the length as it was encoded so that there
+	// is exactly one valid encoding.
+	ad := append(ciphertext[:k:k], additionalData...)
+	compressed, err := appendOpen(s.r, nil, mk, h.N,
+		ciphertext[k:], s.concat(ad, h))
+	if err != nil {
+		return nil, decryptError(err)
+	}
+	defer wipe(compressed)
+	plaintext, err := inflate(dst, compressed, int(n))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrDecryptFailed, err)
+	}
+	return plaintext, nil
+}
+
+// deflate returns the compressed form of p.
+func deflate(p []byte) []byte {
+	var buf bytes.Buffer
+	// NewWriter only fails if the level is invalid.
+	w, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+	w.Write(p)
+	w.Close()
+	return buf.Bytes()
+}
+
+// inflate decompresses exactly n bytes from compressed and
+// appends them to dst.
+func inflate(dst, compressed []byte, n int) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	r := flate.NewReader(bytes.NewReader(compressed))
+	defer r.Close()
+	// Read at most one byte too many so that a plaintext that is
+	// longer than advertised cannot use unbounded memory.
+	m, err := io.Copy(buf, io.LimitReader(r, int64(n)+1))
+	if err == nil && m != int64(n) {
+		err = errors.New("dr: invalid compressed plaintext length")
+	}
+	if err != nil {
+		wipe(buf.Bytes()[len(dst):])
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
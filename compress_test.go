@@ -0,0 +1,98 @@
+package dr
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"testing"
+)
+
+// TestCompression tests that WithCompression round-trips
+// compressible plaintexts and that the uncompressed length is
+// authenticated.
+func TestCompression(t *testing.T) {
+	for _, tc := range testCases {
+		fn := tc.fn
+		t.Run(tc.name, func(t *testing.T) {
+			SK := make([]byte, 32)
+			if _, err := rand.Read(SK); err != nil {
+				t.Fatal(err)
+			}
+			priv, err := fn(t).Generate(rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			recv := func(opts ...Option) *Session {
+				t.Helper()
+				s, err := NewRecv(fn(t), append([]byte(nil), SK...),
+					append(PrivateKey(nil), priv...), opts...)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return s
+			}
+			alice, err := NewSend(fn(t), append([]byte(nil), SK...),
+				fn(t).Public(priv), WithCompression(true))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			payload := bytes.Repeat([]byte(`{"key":"value"},`), 100)
+			msg, err := alice.Seal(payload, []byte("ad"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(msg.Ciphertext) >= len(payload) {
+				t.Fatalf("ciphertext is not compressed: %d >= %d",
+					len(msg.Ciphertext), len(payload))
+			}
+
+			bob := recv(WithCompression(true))
+			bad := Message{
+				Header:     msg.Header,
+				Ciphertext: bytes.Clone(msg.Ciphertext),
+			}
+			bad.Ciphertext[0] ^= 1
+			if _, err := bob.Open(bad, []byte("ad")); !errors.Is(err, ErrDecryptFailed) {
+				t.Fatalf("expected %v, got %v", ErrDecryptFailed, err)
+			}
+			// The same length encoded with an extra byte.
+			bad.Ciphertext = append([]byte{msg.Ciphertext[0] | 0x80},
+				msg.Ciphertext[1]|0x80, 0)
+			bad.Ciphertext = append(bad.Ciphertext, msg.Ciphertext[2:]...)
+			if _, err := bob.Open(bad, []byte("ad")); !errors.Is(err, ErrDecryptFailed) {
+				t.Fatalf("expected %v, got %v", ErrDecryptFailed, err)
+			}
+			if _, err := recv().Open(msg, []byte("ad")); err == nil {
+				t.Fatal("expected an error without compression")
+			}
+			_, err = recv(WithCompression(true),
+				WithMaxMessageSize(len(payload)-1)).Open(msg, []byte("ad"))
+			if !errors.Is(err, ErrMessageTooLarge) {
+				t.Fatalf("expected %v, got %v", ErrMessageTooLarge, err)
+			}
+
+			got, err := bob.Open(msg, []byte("ad"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, payload) {
+				t.Fatalf("expected %q, got %q", payload, got)
+			}
+
+			for _, p := range [][]byte{nil, []byte("x")} {
+				msg, err := bob.Seal(p, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := alice.Open(msg, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, p) {
+					t.Fatalf("expected %q, got %q", p, got)
+				}
+			}
+		})
+	}
+}
@@ -8,7 +8,6 @@ import (
 	"strconv"
 
 	"golang.org/x/crypto/blake2b"
-	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/curve25519"
 	"golang.org/x/crypto/hkdf"
 )
@@ -16,27 +15,62 @@ import (
 // djb implements Ratchet using x25519, 256-bit
 // XChaCha20-Poly1305, HKDF with BLAKE2b, and HMAC-BLAKE2b.
 type djb struct {
+	// hash is used by HKDF and HMAC.
+	hash func() hash.Hash
 	// mkInfo is the HKDF info used when deriving message keys.
 	mkInfo []byte
 	// rkInfo is the HKDF info used when deriving root keys.
 	rkInfo []byte
+	// aead is used to encrypt messages.
+	aead AEAD
+	// nonceCounter mixes the message number into the nonce.
+	nonceCounter bool
+	// keyedBLAKE2b uses keyed BLAKE2b in KDFck.
+	keyedBLAKE2b bool
+	// zeroNonce derives only the AEAD key and uses an all-zero
+	// nonce.
+	zeroNonce bool
+	// name is returned by Name.
+	name string
 }
 
-var _ Ratchet = (*djb)(nil)
+var (
+	_ AppendRatchet  = (*djb)(nil)
+	_ CounterRatchet = (*djb)(nil)
+	_ keySizer       = (*djb)(nil)
+	_ hasher         = (*djb)(nil)
+)
 
 // DJB creates a Ratchet using X25519, 256-bit
 // XChaCha20-Poly1305, HKDF with BLAKE2b, and HMAC-BLAKE2b.
 //
 // The namespace is used to bind keys to a particular application
 // or context.
-func DJB(namespace string) Ratchet {
+func DJB(namespace string, opts ...RatchetOption) Ratchet {
+	return newDJB("X25519", namespace, opts)
+}
+
+// newDJB creates a djb whose name uses dh as the name of the
+// asymmetric algorithm.
+func newDJB(dh, namespace string, opts []RatchetOption) *djb {
+	o := newRatchetOptions(xchacha{}, opts)
+	mkInfo, rkInfo := o.labels(namespace)
+	hash := o.kdfHash(blake2b256)
 	return &djb{
-		mkInfo: []byte(namespace + "MessageKeys"),
-		rkInfo: []byte(namespace + "Ratchet"),
+		hash:   hash,
+		mkInfo: mkInfo,
+		rkInfo: rkInfo,
+		aead:   o.aead,
+
+		nonceCounter: o.nonceCounter,
+		keyedBLAKE2b: o.keyedBLAKE2b,
+		zeroNonce:    o.zeroNonce,
+		name:         o.name(dh, hash, namespace),
 	}
 }
 
-func (d djb) hash() hash.Hash {
+// blake2b256 returns an unkeyed BLAKE2b-256 hash.
+func blake2b256() hash.Hash {
 	h, err := blake2b.New256(nil)
 	if err != nil {
 		panic(err)
@@ -44,6 +78,37 @@ func (d djb) hash() hash.Hash {
 	return h
 }
 
+// blake2bKDFck implements KDF_CK with keyed BLAKE2b-256 using
+// the same constants as the HMAC construction.
+func blake2bKDFck(ck ChainKey) (ChainKey, MessageKey) {
+	mustKeySize("ChainKey", ck)
+
+	const (
+		ckConst = 0x02
+		mkConst = 0x01
+	)
+	h, err := blake2b.New256(ck)
+	if err != nil {
+		panic(err)
+	}
+	h.Write([]byte{ckConst})
+	ck = h.Sum(nil)
+
+	h.Reset()
+	h.Write([]byte{mkConst})
+	mk := h.Sum(nil)
+
+	return ck, mk
+}
+
+func (djb) privKeyLen() int { return curve25519.ScalarSize + curve25519.PointSize }
+
+// DHPublicKeyLen returns the size in bytes of an X25519 public
+// key.
+func (djb) DHPublicKeyLen() int { return curve25519.PointSize }
+
+func (d djb) newHash() hash.Hash { return d.hash() }
+
 func (djb) Generate(r io.Reader) (PrivateKey, error) {
 	const (
 		S = curve25519.ScalarSize
@@ -73,19 +138,17 @@ func (djb) Public(priv PrivateKey) PublicKey {
 
 func (djb) DH(priv PrivateKey, pub PublicKey) ([]byte, error) {
 	if len(priv) != curve25519.ScalarSize+curve25519.PointSize {
-		panic("dr: invalid key pair size: " + strconv.Itoa(len(priv)))
+		return nil, fmt.Errorf("dr: invalid key pair size: %d", len(priv))
 	}
 	if len(pub) != curve25519.PointSize {
-		panic("dr: invalid public key size: " + strconv.Itoa(len(pub)))
+		return nil, fmt.Errorf("dr: invalid public key size: %d", len(pub))
 	}
 	return curve25519.X25519(priv[:curve25519.ScalarSize], pub)
 }
 
 func (d djb) KDFrk(rk RootKey, dh []byte) (RootKey, ChainKey) {
-	if len(rk) != 32 {
-		panic("dr: invalid RootKey size: " + strconv.Itoa(len(rk)))
-	}
-	buf := make([]byte, 2*32)
+	mustKeySize("RootKey", rk)
+	buf := make([]byte, 2*KeySize)
 	// The Double Ratchet spec says:
 	//
 	//    as the out of applying a KDF keyed by a 32-byte root
@@ -100,13 +163,14 @@ func (d djb) KDFrk(rk RootKey, dh []byte) (RootKey, ChainKey) {
 	if err != nil {
 		panic(err)
 	}
-	return buf[:32:32], buf[32 : 2*32 : 2*32]
+	return buf[:KeySize:KeySize], buf[KeySize : 2*KeySize : 2*KeySize]
 }
 
 func (d djb) KDFck(ck ChainKey) (ChainKey, MessageKey) {
-	if len(ck) != 32 {
-		panic("dr: invalid ChainKey size: " + strconv.Itoa(len(ck)))
+	if d.keyedBLAKE2b {
+		return blake2bKDFck(ck)
 	}
+	mustKeySize("ChainKey", ck)
 
 	h := hmac.New(d.hash, ck)
 
@@ -115,59 +179,89 @@ func (d djb) KDFck(ck ChainKey) (ChainKey, MessageKey) {
 		mkConst = 0x01
 	)
 
+	// Chain and message keys are always KeySize bytes, even if
+	// the hash is larger.
 	h.Write([]byte{ckConst})
-	ck = h.Sum(nil)
+	ck = h.Sum(nil)[:KeySize:KeySize]
 
 	h.Reset()
 	h.Write([]byte{mkConst})
-	mk := h.Sum(nil)
+	mk := h.Sum(nil)[:KeySize:KeySize]
 
 	return ck, mk
 }
 
-// derive derives a 256-bit XChaCha20-Poly1305 key and 192-bit
-// XChaCha20-Poly1305 nonce.
-func (d djb) derive(ikm []byte) (key, nonce []byte) {
-	const (
-		K = chacha20poly1305.KeySize
-		N = chacha20poly1305.NonceSizeX
-	)
-	buf := make([]byte, K+N)
+// derive derives an AEAD key and nonce into a pooled scratch
+// buffer, which must be released with putScratch.
+//
+// By default, these are a 256-bit XChaCha20-Poly1305 key and
+// 192-bit XChaCha20-Poly1305 nonce.
+func (d djb) derive(ikm []byte) (key, nonce []byte, buf *[]byte) {
+	K := d.aead.KeySize()
+	N := d.aead.NonceSize()
+	buf = getScratch(K + N)
+	b := *buf
 	r := hkdf.New(d.hash, ikm, nil, d.mkInfo)
-	_, err := io.ReadFull(r, buf)
+	out := b
+	if d.zeroNonce {
+		// Only derive the key. See WithZeroNonce.
+		clear(b[K:])
+		out = b[:K]
+	}
+	_, err := io.ReadFull(r, out)
 	if err != nil {
 		panic(err)
 	}
-	return buf[:K:K], buf[K : K+N : K+N]
+	return b[:K:K], b[K : K+N : K+N], buf
 }
 
 func (d djb) Seal(key MessageKey, plaintext, additionalData []byte) []byte {
-	if len(key) != chacha20poly1305.KeySize {
-		panic("Seal: invalid message key size: " + strconv.Itoa(len(key)))
-	}
+	return d.AppendSeal(nil, key, plaintext, additionalData)
+}
 
-	key, nonce := d.derive(key)
-	defer wipe(key)
+func (d djb) Open(key MessageKey, ciphertext, additionalData []byte) ([]byte, error) {
+	return d.AppendOpen(nil, key, ciphertext, additionalData)
+}
 
-	aead, err := chacha20poly1305.NewX(key)
-	if err != nil {
-		panic(err)
-	}
-	return aead.Seal(nil, nonce, plaintext, additionalData)
+func (d djb) Overhead() int {
+	return d.aead.Overhead()
 }
 
-func (d djb) Open(key MessageKey, ciphertext, additionalData []byte) ([]byte, error) {
-	if len(key) != chacha20poly1305.KeySize {
-		return nil, fmt.Errorf("Open: invalid message key size: %d", len(key))
+func (d djb) Name() string {
+	return d.name
+}
+
+func (d djb) AppendSeal(dst []byte, key MessageKey, plaintext, additionalData []byte) []byte {
+	return d.AppendSealCounter(dst, key, 0, plaintext, additionalData)
+}
+
+func (d djb) AppendOpen(dst []byte, key MessageKey, ciphertext, additionalData []byte) ([]byte, error) {
+	return d.AppendOpenCounter(dst, key, 0, ciphertext, additionalData)
+}
+
+func (d djb) AppendSealCounter(dst []byte, key MessageKey, n int, plaintext, additionalData []byte) []byte {
+	mustKeySize("MessageKey", key)
+
+	key, nonce, buf := d.derive(key)
+	defer putScratch(buf)
+	if d.nonceCounter {
+		mixCounter(nonce, n)
 	}
-	key, nonce := d.derive(key)
-	defer wipe(key)
 
-	aead, err := chacha20poly1305.NewX(key)
-	if err != nil {
-		panic(err)
+	return d.aead.Seal(dst, key, nonce, plaintext, additionalData)
+}
+
+func (d djb) AppendOpenCounter(dst []byte, key MessageKey, n int, ciphertext, additionalData []byte) ([]byte, error) {
+	if err := checkKeySize("MessageKey", key); err != nil {
+		return nil, fmt.Errorf("dr: %w", err)
+	}
+	key, nonce, buf := d.derive(key)
+	defer putScratch(buf)
+	if d.nonceCounter {
+		mixCounter(nonce, n)
 	}
-	return aead.Open(nil, nonce, ciphertext, additionalData)
+
+	return d.aead.Open(dst, key, nonce, ciphertext, additionalData)
 }
 
 func (d djb) Header(priv PrivateKey, prevChainLength, messageNum int) Header {
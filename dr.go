@@ -78,7 +78,9 @@
 //
 // Notes
 //
-// This package does not implement encrypted headers.
+// This package does not implement encrypted headers. Headers are
+// sent in the clear, and State has no header keys (HKs, HKr,
+// NHKs, and NHKr in the specification).
 //
 // References
 //
@@ -89,13 +91,25 @@
 package dr
 
 import (
-	"crypto/hmac"
+	"bytes"
+	"context"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
-	"runtime"
+	"math"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/ericlagergren/dr/internal/secure"
+	"golang.org/x/crypto/hkdf"
 )
 
 // PrivateKey is a complete (private, public) key pair.
@@ -104,9 +118,61 @@ type PrivateKey []byte
 // PublicKey is a peer's public.
 type PublicKey []byte
 
+// Equal reports whether pub and other are the same public key.
+//
+// The comparison is constant time. Public keys are not secret,
+// but pub may be compared against values derived from secrets.
+func (pub PublicKey) Equal(other PublicKey) bool {
+	return subtle.ConstantTimeCompare(pub, other) == 1
+}
+
+// KeySize is the size in bytes of every RootKey, ChainKey, and
+// MessageKey, and of the shared key passed to NewSend and
+// NewRecv.
+const KeySize = 32
+
+// ErrInvalidKeySize is returned (wrapped) when a key is not
+// KeySize bytes.
+var ErrInvalidKeySize = errors.New("dr: invalid key size")
+
+// keySizeError is returned by checkKeySize.
+type keySizeError struct {
+	// name is the type of key, like "RootKey".
+	name string
+	// n is the key's actual size.
+	n int
+}
+
+func (e keySizeError) Error() string {
+	return fmt.Sprintf("invalid %s size: %d", e.name, e.n)
+}
+
+func (keySizeError) Is(target error) bool {
+	return target == ErrInvalidKeySize
+}
+
+// checkKeySize returns an error wrapping ErrInvalidKeySize if key
+// is not KeySize bytes.
+//
+// name is the type of key, like "RootKey".
+func checkKeySize(name string, key []byte) error {
+	if len(key) != KeySize {
+		return keySizeError{name: name, n: len(key)}
+	}
+	return nil
+}
+
+// mustKeySize is like checkKeySize, but panics. It is used by
+// methods that cannot return an error.
+func mustKeySize(name string, key []byte) {
+	if err := checkKeySize(name, key); err != nil {
+		panic("dr: " + err.Error())
+	}
+}
+
 // RootKey is a key generated by each step in the root chain.
 //
-// RootKeys are always 32 bytes.
+// RootKeys are always KeySize bytes.
 type RootKey []byte
 
 // ChainKey is an ephemeral key used to key the KDF used to
@@ -128,7 +194,7 @@ type RootKey []byte
 //                  v
 //               chain key
 //
-// ChainKeys are always 32 bytes.
+// ChainKeys are always KeySize bytes.
 type ChainKey []byte
 
 // MessageKey is an ephemeral key used to encrypt a single
@@ -137,7 +203,7 @@ type ChainKey []byte
 // MessageKeys are output from the sending and receiving KDF
 // chains.
 //
-// MessageKeys are always 32 bytes.
+// MessageKeys are always KeySize bytes.
 type MessageKey []byte
 
 // Header is generated alongside each message.
@@ -148,29 +214,352 @@ type Header struct {
 	PN int
 	// N is the current message number.
 	N int
+	// KEMCiphertext is the KEM ciphertext for the sender's
+	// current sending chain.
+	//
+	// It is only used by Ratchets that implement KEMRatchet.
+	KEMCiphertext []byte
+}
+
+const (
+	// headerVersion is the current version of the Header
+	// encoding.
+	headerVersion = 1
+	// headerVersionKEM is the version of the Header encoding
+	// used when the Header has a KEM ciphertext.
+	headerVersionKEM = 2
+	// headerVersionCompact and headerVersionCompactKEM are the
+	// versions of the compact Header encoding.
+	headerVersionCompact    = 3
+	headerVersionCompactKEM = 4
+)
+
+// Equal reports whether h and other are the same Header.
+//
+// The public keys are compared in constant time; see
+// PublicKey.Equal. Headers with a KEM ciphertext must also have
+// the same ciphertext.
+func (h Header) Equal(other Header) bool {
+	return h.PN == other.PN &&
+		h.N == other.N &&
+		PublicKey(h.PublicKey).Equal(other.PublicKey) &&
+		bytes.Equal(h.KEMCiphertext, other.KEMCiphertext)
+}
+
+// headerKeyPrefix is the number of bytes of the public key
+// printed by Header.String.
+const headerKeyPrefix = 8
+
+// String returns a description of the Header for debugging, like
+//
+//    {PN: 3, N: 7, PublicKey: 8520f0098930a754...}
+//
+// Only the first few bytes of the public key are printed.
+func (h Header) String() string {
+	pub := hex.EncodeToString(h.PublicKey[:min(len(h.PublicKey), headerKeyPrefix)])
+	if len(h.PublicKey) > headerKeyPrefix {
+		pub += "..."
+	}
+	return fmt.Sprintf("{PN: %d, N: %d, PublicKey: %s}", h.PN, h.N, pub)
+}
+
+// maxHeaderKeyLen is the largest public key that can be encoded
+// in a Header.
+const maxHeaderKeyLen = math.MaxUint16
+
+// size returns the size in bytes of the serialized Header.
+func (h Header) size() int {
+	n := 1 + 8 + 8 + 2 + len(h.PublicKey)
+	if len(h.KEMCiphertext) > 0 {
+		n += 2 + len(h.KEMCiphertext)
+	}
+	return n
 }
 
 // Append serializes the Header and appends it to buf.
+//
+// The encoding is
+//
+//    version || PN || N || len(PublicKey) || PublicKey
+//
+// where version is a single byte, PN and N are big-endian
+// uint64s, and len(PublicKey) is a big-endian uint16.
+//
+// If the Header has a KEM ciphertext, the version is 2 and the
+// encoding is followed by
+//
+//    len(KEMCiphertext) || KEMCiphertext
+//
+// where len(KEMCiphertext) is a big-endian uint16.
+//
+// Append panics if the public key or KEM ciphertext is larger
+// than 65535 bytes.
 func (h Header) Append(buf []byte) []byte {
-	n := len(buf)
-	buf = append(buf, make([]byte, 16+len(h.PublicKey))...)
-	binary.BigEndian.PutUint64(buf[n:n+8], uint64(h.PN))
-	binary.BigEndian.PutUint64(buf[n+8:n+16], uint64(h.N))
-	buf = append(buf[n+16:], h.PublicKey...)
+	if len(h.PublicKey) > maxHeaderKeyLen {
+		panic("dr: public key too large: " + strconv.Itoa(len(h.PublicKey)))
+	}
+	if len(h.KEMCiphertext) > maxHeaderKeyLen {
+		panic("dr: KEM ciphertext too large: " + strconv.Itoa(len(h.KEMCiphertext)))
+	}
+	version := byte(headerVersion)
+	if len(h.KEMCiphertext) > 0 {
+		version = headerVersionKEM
+	}
+	buf = append(buf, version)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(h.PN))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(h.N))
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(h.PublicKey)))
+	buf = append(buf, h.PublicKey...)
+	if version == headerVersionKEM {
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(h.KEMCiphertext)))
+		buf = append(buf, h.KEMCiphertext...)
+	}
+	return buf
+}
+
+// AppendCompact is like Append, but encodes PN, N, and the
+// lengths with variable-length integers, which saves 15 or more
+// bytes per Header in practice. It is meant for constrained links
+// where every byte counts.
+//
+// The encoding is
+//
+//    version || uvarint(PN) || uvarint(N) || uvarint(len(PublicKey)) || PublicKey
+//
+// where version is 3, or 4 if the Header has a KEM ciphertext,
+// in which case the encoding is followed by
+//
+//    uvarint(len(KEMCiphertext)) || KEMCiphertext
+//
+// Decode and SplitHeader accept both encodings. The additional
+// data built by Concat always uses Append, so the choice of
+// encoding does not affect the ciphertext.
+//
+// Like Append, AppendCompact panics if the public key or KEM
+// ciphertext is larger than 65535 bytes.
+func (h Header) AppendCompact(buf []byte) []byte {
+	if len(h.PublicKey) > maxHeaderKeyLen {
+		panic("dr: public key too large: " + strconv.Itoa(len(h.PublicKey)))
+	}
+	if len(h.KEMCiphertext) > maxHeaderKeyLen {
+		panic("dr: KEM ciphertext too large: " + strconv.Itoa(len(h.KEMCiphertext)))
+	}
+	version := byte(headerVersionCompact)
+	if len(h.KEMCiphertext) > 0 {
+		version = headerVersionCompactKEM
+	}
+	buf = append(buf, version)
+	buf = binary.AppendUvarint(buf, uint64(h.PN))
+	buf = binary.AppendUvarint(buf, uint64(h.N))
+	buf = binary.AppendUvarint(buf, uint64(len(h.PublicKey)))
+	buf = append(buf, h.PublicKey...)
+	if version == headerVersionCompactKEM {
+		buf = binary.AppendUvarint(buf, uint64(len(h.KEMCiphertext)))
+		buf = append(buf, h.KEMCiphertext...)
+	}
 	return buf
 }
 
 // Decode deserializes a Header from data.
+//
+// It is an error if data contains anything other than exactly
+// one Header. Use SplitHeader to decode a Header that is followed
+// by other data.
+//
+// PN and N are encoded as uint64s, so Decode rejects counters
+// that do not fit in a non-negative int with ErrInvalidHeader.
 func (h *Header) Decode(data []byte) error {
+	t, rest, err := SplitHeader(data)
+	if err != nil {
+		return err
+	}
+	if len(rest) != 0 {
+		return fmt.Errorf("%w: %d trailing bytes", ErrInvalidHeader, len(rest))
+	}
+	*h = t
+	return nil
+}
+
+// DecodeHeader is like Header.Decode, but also checks that the
+// Header is valid for the Ratchet.
+//
+// The public key must have the size reported by the Ratchet's
+// DHPublicKeyLen method, unless it is zero. Ratchets that
+// implement KEMRatchet require a KEM ciphertext and other
+// Ratchets reject one.
+//
+// The errors returned by DecodeHeader wrap ErrInvalidHeader.
+func DecodeHeader(r Ratchet, data []byte) (Header, error) {
+	var h Header
+	if err := h.Decode(data); err != nil {
+		return Header{}, err
+	}
+	if err := checkHeader(r, h); err != nil {
+		return Header{}, err
+	}
+	return h, nil
+}
+
+// checkHeader checks that h is valid for the Ratchet.
+func checkHeader(r Ratchet, h Header) error {
+	if h.PN < 0 || h.N < 0 {
+		return fmt.Errorf("%w: negative counter", ErrInvalidHeader)
+	}
+	if n := r.DHPublicKeyLen(); n > 0 && len(h.PublicKey) != n {
+		return fmt.Errorf("%w: public key length %d", ErrInvalidHeader, len(h.PublicKey))
+	}
+	_, isKEM := r.(KEMRatchet)
+	if isKEM != (len(h.KEMCiphertext) > 0) {
+		if isKEM {
+			return fmt.Errorf("%w: missing KEM ciphertext", ErrInvalidHeader)
+		}
+		return fmt.Errorf("%w: unexpected KEM ciphertext", ErrInvalidHeader)
+	}
+	return nil
+}
+
+// DecodeLegacy deserializes a Header from data in the original,
+// unversioned encoding
+//
+//    PN || N || PublicKey
+//
+// where PN and N are big-endian uint64s and the public key is
+// the remainder of data.
+func (h *Header) DecodeLegacy(data []byte) error {
 	if len(data) < 16 {
-		return fmt.Errorf("invalid data length: %d", len(data))
+		return fmt.Errorf("%w: length %d", ErrInvalidHeader, len(data))
+	}
+	if len(data) == 16 {
+		return fmt.Errorf("%w: missing public key", ErrInvalidHeader)
+	}
+	PN, N, err := headerCounters(binary.BigEndian.Uint64(data[0:8]),
+		binary.BigEndian.Uint64(data[8:16]))
+	if err != nil {
+		return err
 	}
-	h.PN = int(binary.BigEndian.Uint64(data[0:8]))
-	h.N = int(binary.BigEndian.Uint64(data[8:16]))
+	h.PN = PN
+	h.N = N
 	h.PublicKey = append(h.PublicKey[:0], data[16:]...)
 	return nil
 }
 
+// headerCounters converts the encoded PN and N of a Header to
+// ints.
+//
+// It returns an error wrapping ErrInvalidHeader if either
+// counter does not fit in a non-negative int, which on 32-bit
+// platforms includes every counter of 2^31 or more.
+func headerCounters(PN, N uint64) (int, int, error) {
+	if PN > math.MaxInt {
+		return 0, 0, fmt.Errorf("%w: PN %d out of range", ErrInvalidHeader, PN)
+	}
+	if N > math.MaxInt {
+		return 0, 0, fmt.Errorf("%w: N %d out of range", ErrInvalidHeader, N)
+	}
+	return int(PN), int(N), nil
+}
+
+// SplitHeader decodes the Header at the beginning of data and
+// returns the remaining bytes.
+//
+// The Header may use either the encoding written by Append or
+// the encoding written by AppendCompact.
+func SplitHeader(data []byte) (h Header, rest []byte, err error) {
+	const (
+		prefix = 1 + 8 + 8 + 2
+	)
+	if len(data) > 0 && (data[0] == headerVersionCompact || data[0] == headerVersionCompactKEM) {
+		return splitCompactHeader(data)
+	}
+	if len(data) < prefix {
+		return Header{}, nil, fmt.Errorf("%w: length %d", ErrInvalidHeader, len(data))
+	}
+	version := data[0]
+	if version != headerVersion && version != headerVersionKEM {
+		return Header{}, nil, fmt.Errorf("%w: unknown version %d", ErrInvalidHeader, version)
+	}
+	h.PN, h.N, err = headerCounters(binary.BigEndian.Uint64(data[1:9]),
+		binary.BigEndian.Uint64(data[9:17]))
+	if err != nil {
+		return Header{}, nil, err
+	}
+	n := int(binary.BigEndian.Uint16(data[17:19]))
+	data = data[prefix:]
+	if len(data) < n {
+		return Header{}, nil, fmt.Errorf("%w: public key length %d", ErrInvalidHeader, n)
+	}
+	h.PublicKey = make(PublicKey, n)
+	copy(h.PublicKey, data)
+	data = data[n:]
+	if version == headerVersionKEM {
+		if len(data) < 2 {
+			return Header{}, nil, fmt.Errorf("%w: missing KEM ciphertext length", ErrInvalidHeader)
+		}
+		n := int(binary.BigEndian.Uint16(data))
+		data = data[2:]
+		if n == 0 || len(data) < n {
+			return Header{}, nil, fmt.Errorf("%w: KEM ciphertext length %d", ErrInvalidHeader, n)
+		}
+		h.KEMCiphertext = append([]byte(nil), data[:n]...)
+		data = data[n:]
+	}
+	return h, data, nil
+}
+
+// splitCompactHeader is SplitHeader for the encoding written by
+// AppendCompact.
+func splitCompactHeader(data []byte) (h Header, rest []byte, err error) {
+	version := data[0]
+	data = data[1:]
+	var v [3]uint64
+	for i := range v {
+		v[i], data, err = splitUvarint(data)
+		if err != nil {
+			return Header{}, nil, err
+		}
+	}
+	h.PN, h.N, err = headerCounters(v[0], v[1])
+	if err != nil {
+		return Header{}, nil, err
+	}
+	if v[2] > maxHeaderKeyLen || v[2] > uint64(len(data)) {
+		return Header{}, nil, fmt.Errorf("%w: public key length %d", ErrInvalidHeader, v[2])
+	}
+	n := int(v[2])
+	h.PublicKey = make(PublicKey, n)
+	copy(h.PublicKey, data)
+	data = data[n:]
+	if version == headerVersionCompactKEM {
+		m, rest, err := splitUvarint(data)
+		if err != nil {
+			return Header{}, nil, err
+		}
+		if m == 0 || m > maxHeaderKeyLen || m > uint64(len(rest)) {
+			return Header{}, nil, fmt.Errorf("%w: KEM ciphertext length %d", ErrInvalidHeader, m)
+		}
+		h.KEMCiphertext = append([]byte(nil), rest[:m]...)
+		data = rest[m:]
+	}
+	return h, data, nil
+}
+
+// splitUvarint decodes the minimally encoded uvarint at the
+// beginning of data and returns the remaining bytes.
+//
+// Non-minimal encodings are rejected so that every Header has
+// exactly one compact encoding.
+func splitUvarint(data []byte) (uint64, []byte, error) {
+	v, n := binary.Uvarint(data)
+	if n <= 0 {
+		return 0, nil, fmt.Errorf("%w: invalid varint", ErrInvalidHeader)
+	}
+	var buf [binary.MaxVarintLen64]byte
+	if binary.PutUvarint(buf[:], v) != n {
+		return 0, nil, fmt.Errorf("%w: non-minimal varint", ErrInvalidHeader)
+	}
+	return v, data[n:], nil
+}
+
 // Ratchet implements the Double Ratchet scheme.
 //
 // Ratchet should be safe for concurrent use by multiple distinct
@@ -183,8 +572,18 @@ type Ratchet interface {
 	// Public returns a copy of the public key portion of the key
 	// pair.
 	Public(PrivateKey) PublicKey
+	// DHPublicKeyLen returns the size in bytes of the
+	// PublicKeys returned by Public, or zero if their size is
+	// not fixed.
+	//
+	// Headers whose public key has a different size are
+	// rejected.
+	DHPublicKeyLen() int
 	// DH returns the Diffie-Hellman value computed with the key
 	// pair and public key.
+	//
+	// The public key is provided by the peer, so DH must return
+	// an error instead of panicking if it is malformed.
 	DH(PrivateKey, PublicKey) ([]byte, error)
 	// KDFrk applies a KDF keyed by the root key to the
 	// Diffie-Hellman value and returns a (root key, chain key)
@@ -209,6 +608,19 @@ type Ratchet interface {
 	// Open decrypts and authenticates ciphertext, authenticates
 	// additionalData, and appends the plaintext to dst.
 	Open(key MessageKey, ciphertext, additionalData []byte) ([]byte, error)
+	// Overhead returns the maximum difference between the
+	// lengths of a plaintext and the ciphertext returned by
+	// Seal.
+	Overhead() int
+	// Name returns a stable identifier for the Ratchet's
+	// parameters, such as
+	//
+	//    DR-X25519-XChaCha20Poly1305-HKDF-BLAKE2b256/namespace
+	//
+	// Peers can compare names before exchanging messages to
+	// detect mismatched parameters, which otherwise only show
+	// up as authentication failures.
+	Name() string
 	// Header creates a message header from the key pair,
 	// previous chain length, and current message number.
 	//
@@ -224,18 +636,225 @@ type Ratchet interface {
 	Concat(additionalData []byte, h Header) []byte
 }
 
+// KEMRatchet is an optional interface implemented by Ratchets
+// whose asymmetric ratchet step uses a key encapsulation
+// mechanism (KEM), possibly alongside Diffie-Hellman.
+//
+// Unlike Diffie-Hellman, a KEM is not symmetric: the party that
+// starts a new sending chain encapsulates a secret to the peer's
+// public key and sends the resulting ciphertext in
+// Header.KEMCiphertext, and the peer decapsulates it when it
+// starts the corresponding receiving chain.
+//
+// Sessions use Encapsulate and Decapsulate instead of DH when the
+// Ratchet implements KEMRatchet.
+type KEMRatchet interface {
+	Ratchet
+	// Encapsulate returns the secret shared between the key
+	// pair and the peer's public key along with the ciphertext
+	// the peer needs to compute the same secret.
+	Encapsulate(priv PrivateKey, peer PublicKey) (secret, ciphertext []byte, err error)
+	// Decapsulate returns the secret shared between the key
+	// pair and the peer's public key using the ciphertext
+	// created by the peer's Encapsulate.
+	//
+	// The public key and ciphertext are provided by the peer,
+	// so Decapsulate must return an error instead of panicking
+	// if either is malformed.
+	Decapsulate(priv PrivateKey, peer PublicKey, ciphertext []byte) ([]byte, error)
+}
+
+// keySizer is implemented by the built-in Ratchets to report
+// their private key sizes so that untrusted states can be
+// validated.
+type keySizer interface {
+	// privKeyLen returns the size in bytes of a PrivateKey.
+	privKeyLen() int
+}
+
+// peerDHer is implemented by Ratchets that can share work on the
+// peer's public key between Diffie-Hellman operations.
+//
+// State.ratchet uses it to validate and decode the peer's key
+// once instead of once per DH. The results must be identical to
+// calling DH. It must not be implemented by KEMRatchets.
+type peerDHer interface {
+	// peerDH validates and decodes pub and returns a function
+	// that computes DH(priv, pub).
+	peerDH(pub PublicKey) (func(PrivateKey) ([]byte, error), error)
+}
+
+// sendSecret computes the secret for a new sending chain and, if
+// r is a KEMRatchet, the KEM ciphertext for the peer.
+func sendSecret(r Ratchet, priv PrivateKey, peer PublicKey) (secret, ct []byte, err error) {
+	if k, ok := r.(KEMRatchet); ok {
+		return k.Encapsulate(priv, peer)
+	}
+	secret, err = r.DH(priv, peer)
+	return secret, nil, err
+}
+
+// recvSecret computes the secret for a new receiving chain.
+func recvSecret(r Ratchet, priv PrivateKey, peer PublicKey, ct []byte) ([]byte, error) {
+	if k, ok := r.(KEMRatchet); ok {
+		return k.Decapsulate(priv, peer, ct)
+	}
+	secret, err := r.DH(priv, peer)
+	if err != nil {
+		// Our own key pair is valid, so the peer's key is at
+		// fault.
+		return nil, fmt.Errorf("%w: %w", ErrInvalidPeerKey, err)
+	}
+	return secret, nil
+}
+
+// AppendRatchet is an optional interface implemented by Ratchets
+// that can append ciphertexts and plaintexts to a caller-provided
+// buffer.
+//
+// Session.SealTo and Session.OpenTo use AppendSeal and AppendOpen
+// when the Ratchet implements AppendRatchet.
+type AppendRatchet interface {
+	Ratchet
+	// AppendSeal is like Seal, but appends the ciphertext to
+	// dst.
+	AppendSeal(dst []byte, key MessageKey, plaintext, additionalData []byte) []byte
+	// AppendOpen is like Open, but appends the plaintext to dst.
+	AppendOpen(dst []byte, key MessageKey, ciphertext, additionalData []byte) ([]byte, error)
+}
+
+// CounterRatchet is an optional interface implemented by
+// Ratchets whose nonces can depend on the message number. See
+// WithNonceCounter.
+//
+// Session uses AppendSealCounter and AppendOpenCounter when the
+// Ratchet implements CounterRatchet.
+type CounterRatchet interface {
+	Ratchet
+	// AppendSealCounter is like AppendSeal, but also provides
+	// the message number n.
+	AppendSealCounter(dst []byte, key MessageKey, n int, plaintext, additionalData []byte) []byte
+	// AppendOpenCounter is like AppendOpen, but also provides
+	// the message number n.
+	AppendOpenCounter(dst []byte, key MessageKey, n int, ciphertext, additionalData []byte) ([]byte, error)
+}
+
+// appendSeal appends the ciphertext of the nth message to dst,
+// using AppendSealCounter if r is a CounterRatchet or AppendSeal
+// if r is an AppendRatchet.
+func appendSeal(r Ratchet, dst []byte, key MessageKey, n int, plaintext, additionalData []byte) []byte {
+	if c, ok := r.(CounterRatchet); ok {
+		return c.AppendSealCounter(dst, key, n, plaintext, additionalData)
+	}
+	if a, ok := r.(AppendRatchet); ok {
+		return a.AppendSeal(dst, key, plaintext, additionalData)
+	}
+	return append(dst, r.Seal(key, plaintext, additionalData)...)
+}
+
+// appendOpen appends the plaintext of the nth message to dst,
+// using AppendOpenCounter if r is a CounterRatchet or AppendOpen
+// if r is an AppendRatchet.
+func appendOpen(r Ratchet, dst []byte, key MessageKey, n int, ciphertext, additionalData []byte) ([]byte, error) {
+	if c, ok := r.(CounterRatchet); ok {
+		return c.AppendOpenCounter(dst, key, n, ciphertext, additionalData)
+	}
+	if a, ok := r.(AppendRatchet); ok {
+		return a.AppendOpen(dst, key, ciphertext, additionalData)
+	}
+	plaintext, err := r.Open(key, ciphertext, additionalData)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(plaintext)
+	return append(dst, plaintext...), nil
+}
+
+// concatVersion is the current version of the Concat encoding.
+const concatVersion = 1
+
 // Concat is a default implementation of Ratchet.Concat.
+//
+// The result is
+//
+//    version || varint(len(additionalData)) || additionalData || header
+//
+// where version is a single byte that identifies the format of
+// the result and header is encoded with Header.Append, which has
+// its own version byte. Both versions are authenticated along
+// with everything else, so a message sealed under one format
+// cannot be opened under another.
+//
+// See SplitConcat for the inverse.
 func Concat(additionalData []byte, h Header) []byte {
 	const (
 		max64 = binary.MaxVarintLen64
 	)
-	buf := make([]byte, 0, max64+len(additionalData)+8+len(h.PublicKey))
-	i := binary.PutVarint(buf[:max64], int64(len(additionalData)))
-	buf = append(buf[:i], additionalData...)
+	buf := make([]byte, 0, 1+max64+len(additionalData)+h.size())
+	buf = append(buf, concatVersion)
+	buf = binary.AppendVarint(buf, int64(len(additionalData)))
+	buf = append(buf, additionalData...)
 	buf = h.Append(buf)
 	return buf
 }
 
+// SplitConcat splits the output of Concat into the additional
+// data and header.
+func SplitConcat(data []byte) (additionalData []byte, h Header, err error) {
+	if len(data) == 0 || data[0] != concatVersion {
+		return nil, Header{}, errors.New("dr: invalid additional data version")
+	}
+	data = data[1:]
+	n, m := binary.Varint(data)
+	if m <= 0 || n < 0 || n > int64(len(data)-m) {
+		return nil, Header{}, errors.New("dr: invalid additional data length")
+	}
+	data = data[m:]
+	additionalData = data[:n:n]
+	h, rest, err := SplitHeader(data[n:])
+	if err != nil {
+		return nil, Header{}, err
+	}
+	if len(rest) != 0 {
+		return nil, Header{}, fmt.Errorf("dr: %d trailing bytes after header", len(rest))
+	}
+	return additionalData, h, nil
+}
+
+// BindAD encodes multiple additional data components as a single
+// byte slice suitable for Seal and Open.
+//
+// Simply concatenating the components is ambiguous: the
+// components "a", "bc" and "ab", "c" both concatenate to "abc",
+// so a message sealed for one would also open for the other.
+// BindAD prefixes each component with its length, so different
+// lists of components always produce different results. The
+// result is
+//
+//    varint(len(parts[0])) || parts[0] || varint(len(parts[1])) || ...
+//
+// For example, to authenticate routing metadata that travels
+// with the message:
+//
+//    ad := dr.BindAD(senderID, timestamp)
+//    msg, err := s.Seal(plaintext, ad)
+//
+// The recipient must pass the same components in the same order
+// to Open. The result is further combined with the message
+// header by the Ratchet's Concat method.
+func BindAD(parts ...[]byte) []byte {
+	n := 0
+	for _, p := range parts {
+		n += binary.MaxVarintLen64 + len(p)
+	}
+	buf := make([]byte, 0, n)
+	for _, p := range parts {
+		buf = binary.AppendUvarint(buf, uint64(len(p)))
+		buf = append(buf, p...)
+	}
+	return buf
+}
+
 // State is the current state of a session.
 type State struct {
 	// DHs is the sending (self) ratchet key pair.
@@ -255,11 +874,82 @@ type State struct {
 	// PN is the number of messages in the previous sending
 	// chain.
 	PN int
+	// CTs is the KEM ciphertext for the sending chain.
+	//
+	// It is only used by Ratchets that implement KEMRatchet.
+	CTs []byte
+	// Accepted are the most recently accepted messages, oldest
+	// first.
+	//
+	// It is only used when replay detection is enabled. See
+	// WithReplayWindow.
+	Accepted []MessageID
+	// PendingRekey is the entropy passed to Session.Rekey that
+	// has not yet been mixed into the root key, or nil if there
+	// is none.
+	PendingRekey []byte
+	// RekeyAhead reports whether, when Session.Rekey was called,
+	// the session had a sending chain that the peer had not yet
+	// derived.
+	RekeyAhead bool
+	// Epoch is incremented each time the session saves the state.
+	//
+	// Stores use it to detect forked sessions. See CheckEpoch.
+	Epoch uint64
+}
+
+// validate checks the state's invariants.
+func (s *State) validate(r Ratchet) error {
+	if s == nil {
+		return errors.New("nil state")
+	}
+	if err := checkKeySize("RootKey", s.RK); err != nil {
+		return err
+	}
+	for _, ck := range []struct {
+		name string
+		key  ChainKey
+	}{
+		{"sending ChainKey", s.CKs},
+		{"receiving ChainKey", s.CKr},
+	} {
+		if ck.key != nil {
+			if err := checkKeySize(ck.name, ck.key); err != nil {
+				return err
+			}
+		}
+	}
+	if s.Ns < 0 || s.Nr < 0 || s.PN < 0 {
+		return fmt.Errorf("negative counter: Ns=%d Nr=%d PN=%d",
+			s.Ns, s.Nr, s.PN)
+	}
+	for _, id := range s.Accepted {
+		if id.N < 0 {
+			return fmt.Errorf("negative accepted message number: %d", id.N)
+		}
+	}
+	if len(s.DHs) == 0 {
+		return errors.New("missing ratchet key pair")
+	}
+	if k, ok := r.(keySizer); ok && len(s.DHs) != k.privKeyLen() {
+		return fmt.Errorf("invalid key pair size: %d", len(s.DHs))
+	}
+	if n := r.DHPublicKeyLen(); n > 0 && s.DHr != nil && len(s.DHr) != n {
+		return fmt.Errorf("invalid peer public key size: %d", len(s.DHr))
+	}
+	return nil
+}
+
+// MessageID identifies a message by its sender's ratchet public
+// key and message number.
+type MessageID struct {
+	PublicKey PublicKey
+	N         int
 }
 
 // Clone performs a deep copy of the session state.
 func (s *State) Clone() *State {
-	return &State{
+	t := &State{
 		DHs: append(PrivateKey(nil), s.DHs...),
 		DHr: append(PublicKey(nil), s.DHr...),
 		RK:  append(RootKey(nil), s.RK...),
@@ -268,75 +958,638 @@ func (s *State) Clone() *State {
 		Ns:  s.Ns,
 		Nr:  s.Nr,
 		PN:  s.PN,
-	}
-}
+		CTs: append([]byte(nil), s.CTs...),
 
-func (s *State) wipe() {
-	wipe(s.DHs)
-	wipe(s.DHr)
-	wipe(s.RK)
-	wipe(s.CKs)
-	wipe(s.CKr)
+		PendingRekey: append([]byte(nil), s.PendingRekey...),
+		RekeyAhead:   s.RekeyAhead,
+		Epoch:        s.Epoch,
+	}
+	for _, id := range s.Accepted {
+		t.Accepted = append(t.Accepted, MessageID{
+			PublicKey: append(PublicKey(nil), id.PublicKey...),
+			N:         id.N,
+		})
+	}
+	return t
 }
 
-// ErrNotFound is returned by Store when a message key is not
-// found in the Store.
-var ErrNotFound = errors.New("dr: key not found")
-
-// Store saves session state.
-type Store interface {
-	// Save saves the state.
-	Save(s *State) error
-	// StoreKey stores a skipped message's key under the (Nr,
-	// PublicKey) tuple.
-	//
-	// StoreKey must return an error if too many messages have
-	// been Skipped.
-	StoreKey(Nr int, pub PublicKey, key MessageKey) error
-	// LoadKey retrieves a message key using the (Nr, PublicKey)
-	// tuple.
-	//
-	// If the message key is not found LoadKey returns
-	// ErrNotFound.
-	LoadKey(Nr int, pub PublicKey) (MessageKey, error)
-	// DeleteKey removes a message key using the (Nr, PublicKey)
-	// tuple.
-	DeleteKey(Nr int, pub PublicKey) error
+// accepted reports whether the message has already been
+// accepted.
+func (s *State) accepted(pub PublicKey, n int) bool {
+	for _, id := range s.Accepted {
+		if id.N == n && id.PublicKey.Equal(pub) {
+			return true
+		}
+	}
+	return false
 }
 
-// memory is an in-memory Store.
-type memory struct {
-	maxSkip int
-	keys    map[string][]byte
+// accept records the message as accepted, evicting the oldest
+// messages so that at most window are retained.
+func (s *State) accept(pub PublicKey, n, window int) {
+	s.Accepted = append(s.Accepted, MessageID{
+		PublicKey: append(PublicKey(nil), pub...),
+		N:         n,
+	})
+	if excess := len(s.Accepted) - window; excess > 0 {
+		s.Accepted = append(s.Accepted[:0], s.Accepted[excess:]...)
+	}
 }
 
-var _ Store = (*memory)(nil)
+// stateVersion is the current version of the State binary
+// encoding.
+//
+// Version 1 did not include CTs, version 2 did not include
+// Accepted, version 3 did not include PendingRekey or
+// RekeyAhead, and version 4 did not include Epoch.
+const stateVersion = 5
 
-func (memory) key(Nr int, pub PublicKey) string {
-	return fmt.Sprintf("%d:%x", Nr, pub)
+// MarshalBinary encodes the session state.
+//
+// The result contains secret key material and must be protected
+// accordingly.
+func (s *State) MarshalBinary() ([]byte, error) {
+	n := 1 + 11*binary.MaxVarintLen64 + 1 +
+		len(s.DHs) + len(s.DHr) + len(s.RK) + len(s.CKs) + len(s.CKr) +
+		len(s.CTs) + len(s.PendingRekey)
+	buf := make([]byte, 0, n)
+	buf = append(buf, stateVersion)
+	for _, key := range [][]byte{s.DHs, s.DHr, s.RK, s.CKs, s.CKr} {
+		buf = appendKey(buf, key)
+	}
+	for _, n := range []int{s.Ns, s.Nr, s.PN} {
+		if n < 0 {
+			return nil, fmt.Errorf("dr: invalid counter: %d", n)
+		}
+		buf = binary.AppendUvarint(buf, uint64(n))
+	}
+	buf = appendKey(buf, s.CTs)
+	buf = binary.AppendUvarint(buf, uint64(len(s.Accepted)))
+	for _, id := range s.Accepted {
+		if id.N < 0 {
+			return nil, fmt.Errorf("dr: invalid counter: %d", id.N)
+		}
+		buf = appendKey(buf, id.PublicKey)
+		buf = binary.AppendUvarint(buf, uint64(id.N))
+	}
+	buf = appendKey(buf, s.PendingRekey)
+	if s.RekeyAhead {
+		buf = append(buf, 1)
+	} else {
+		buf = append(buf, 0)
+	}
+	buf = binary.AppendUvarint(buf, s.Epoch)
+	return buf, nil
 }
 
-func (m *memory) Save(_ *State) error {
-	return nil
+// appendKey appends a key to buf, preserving whether the key is
+// nil.
+func appendKey(buf, key []byte) []byte {
+	if key == nil {
+		return append(buf, 0)
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(key))+1)
+	return append(buf, key...)
+}
+
+// UnmarshalBinary decodes session state encoded by
+// MarshalBinary.
+func (s *State) UnmarshalBinary(data []byte) error {
+	if len(data) < 1 {
+		return errors.New("dr: state too short")
+	}
+	version := data[0]
+	if version < 1 || version > stateVersion {
+		return fmt.Errorf("dr: unknown state version: %d", version)
+	}
+	data = data[1:]
+
+	var t State
+	for _, key := range []*[]byte{
+		(*[]byte)(&t.DHs),
+		(*[]byte)(&t.DHr),
+		(*[]byte)(&t.RK),
+		(*[]byte)(&t.CKs),
+		(*[]byte)(&t.CKr),
+	} {
+		var err error
+		*key, data, err = readKey(data)
+		if err != nil {
+			return err
+		}
+	}
+	for _, n := range []*int{&t.Ns, &t.Nr, &t.PN} {
+		v, m := binary.Uvarint(data)
+		if m <= 0 || v > math.MaxInt {
+			return errors.New("dr: invalid state counter")
+		}
+		*n = int(v)
+		data = data[m:]
+	}
+	if version >= 2 {
+		var err error
+		t.CTs, data, err = readKey(data)
+		if err != nil {
+			return err
+		}
+	}
+	if version >= 3 {
+		n, m := binary.Uvarint(data)
+		if m <= 0 || n > uint64(len(data)) {
+			return errors.New("dr: invalid accepted message count")
+		}
+		data = data[m:]
+		for i := uint64(0); i < n; i++ {
+			var id MessageID
+			var err error
+			id.PublicKey, data, err = readKey(data)
+			if err != nil {
+				return err
+			}
+			v, m := binary.Uvarint(data)
+			if m <= 0 || v > math.MaxInt {
+				return errors.New("dr: invalid state counter")
+			}
+			id.N = int(v)
+			data = data[m:]
+			t.Accepted = append(t.Accepted, id)
+		}
+	}
+	if version >= 4 {
+		var err error
+		t.PendingRekey, data, err = readKey(data)
+		if err != nil {
+			return err
+		}
+		if len(data) < 1 || data[0] > 1 {
+			return errors.New("dr: invalid rekey flag")
+		}
+		t.RekeyAhead = data[0] == 1
+		data = data[1:]
+	}
+	if version >= 5 {
+		v, m := binary.Uvarint(data)
+		if m <= 0 {
+			return errors.New("dr: invalid state epoch")
+		}
+		t.Epoch = v
+		data = data[m:]
+	}
+	if len(data) != 0 {
+		return errors.New("dr: trailing state data")
+	}
+	*s = t
+	return nil
+}
+
+// readKey reads a key appended by appendKey.
+func readKey(data []byte) (key, rest []byte, err error) {
+	n, m := binary.Uvarint(data)
+	if m <= 0 {
+		return nil, nil, errors.New("dr: invalid state key length")
+	}
+	data = data[m:]
+	if n == 0 {
+		return nil, data, nil
+	}
+	n--
+	if n > uint64(len(data)) {
+		return nil, nil, errors.New("dr: state key too short")
+	}
+	return append([]byte{}, data[:n]...), data[n:], nil
+}
+
+// stateJSON is the JSON encoding of State.
+type stateJSON struct {
+	DHs      []byte          `json:"dhs"`
+	DHr      []byte          `json:"dhr"`
+	RK       []byte          `json:"rk"`
+	CKs      []byte          `json:"cks"`
+	CKr      []byte          `json:"ckr"`
+	Ns       int             `json:"ns"`
+	Nr       int             `json:"nr"`
+	PN       int             `json:"pn"`
+	CTs      []byte          `json:"cts"`
+	Accepted []messageIDJSON `json:"accepted,omitempty"`
+
+	PendingRekey []byte `json:"pending_rekey,omitempty"`
+	RekeyAhead   bool   `json:"rekey_ahead,omitempty"`
+	Epoch        uint64 `json:"epoch,omitempty"`
+}
+
+// messageIDJSON is the JSON encoding of MessageID.
+type messageIDJSON struct {
+	PublicKey []byte `json:"pub"`
+	N         int    `json:"n"`
+}
+
+// MarshalJSON encodes the session state as JSON, which is
+// intended for debugging and document stores.
+//
+// Keys are encoded as standard base64 strings, and nil keys are
+// encoded as null. For example:
+//
+//    {"dhs":"...","dhr":null,"rk":"...","cks":null,"ckr":null,
+//     "ns":0,"nr":0,"pn":0,"cts":null}
+//
+// The result contains secret key material and must be protected
+// accordingly.
+func (s *State) MarshalJSON() ([]byte, error) {
+	v := stateJSON{
+		DHs: s.DHs,
+		DHr: s.DHr,
+		RK:  s.RK,
+		CKs: s.CKs,
+		CKr: s.CKr,
+		Ns:  s.Ns,
+		Nr:  s.Nr,
+		PN:  s.PN,
+		CTs: s.CTs,
+
+		PendingRekey: s.PendingRekey,
+		RekeyAhead:   s.RekeyAhead,
+		Epoch:        s.Epoch,
+	}
+	for _, id := range s.Accepted {
+		v.Accepted = append(v.Accepted, messageIDJSON{
+			PublicKey: id.PublicKey,
+			N:         id.N,
+		})
+	}
+	return json.Marshal(v)
+}
+
+// UnmarshalJSON decodes session state encoded by MarshalJSON.
+//
+// It rejects unknown fields, malformed base64, and negative
+// counters.
+func (s *State) UnmarshalJSON(data []byte) error {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.DisallowUnknownFields()
+	var v stateJSON
+	if err := d.Decode(&v); err != nil {
+		return fmt.Errorf("dr: invalid state: %w", err)
+	}
+	if v.Ns < 0 || v.Nr < 0 || v.PN < 0 {
+		return errors.New("dr: invalid state counter")
+	}
+	t := State{
+		DHs: v.DHs,
+		DHr: v.DHr,
+		RK:  v.RK,
+		CKs: v.CKs,
+		CKr: v.CKr,
+		Ns:  v.Ns,
+		Nr:  v.Nr,
+		PN:  v.PN,
+		CTs: v.CTs,
+
+		PendingRekey: v.PendingRekey,
+		RekeyAhead:   v.RekeyAhead,
+		Epoch:        v.Epoch,
+	}
+	for _, id := range v.Accepted {
+		if id.N < 0 {
+			return errors.New("dr: invalid state counter")
+		}
+		t.Accepted = append(t.Accepted, MessageID{
+			PublicKey: id.PublicKey,
+			N:         id.N,
+		})
+	}
+	*s = t
+	return nil
+}
+
+func (s *State) wipe() {
+	wipe(s.DHs)
+	wipe(s.DHr)
+	wipe(s.RK)
+	wipe(s.CKs)
+	wipe(s.CKr)
+	wipe(s.CTs)
+	wipe(s.PendingRekey)
+}
+
+// ErrNotFound is returned by Store when a message key is not
+// found in the Store.
+var ErrNotFound = errors.New("dr: key not found")
+
+// ErrInvalidHeader is returned when a Header is malformed or does
+// not match the Ratchet.
+var ErrInvalidHeader = errors.New("dr: invalid header")
+
+// ErrStaleState is returned by a Store's Save method when the
+// state being saved is not newer than the state that was already
+// saved. See CheckEpoch.
+var ErrStaleState = errors.New("dr: stale session state")
+
+// CheckEpoch reports whether it is safe to replace the saved
+// state with state.
+//
+// Each time a session saves its state it increments the state's
+// Epoch. If the same snapshot is resumed twice, for example by
+// restoring a backup onto a second device, both copies derive
+// the same message keys, which reuses AEAD keys and nonces. Both
+// copies also save the same epoch, so the second save can be
+// detected: CheckEpoch returns an error wrapping ErrStaleState
+// if state's epoch is not greater than saved's.
+//
+// A Store that persists state should call CheckEpoch with the
+// currently saved state, atomically with the write, and return
+// the error from Save. The Stores in this module's subpackages
+// do so. Detection only works if both copies of the session save
+// to the same underlying storage.
+//
+// States with an epoch of zero, like those saved before epochs
+// were introduced, are never considered stale.
+func CheckEpoch(saved, state *State) error {
+	if saved == nil || state.Epoch == 0 {
+		return nil
+	}
+	if state.Epoch <= saved.Epoch {
+		return fmt.Errorf("%w: epoch %d is not newer than saved epoch %d",
+			ErrStaleState, state.Epoch, saved.Epoch)
+	}
+	return nil
+}
+
+// CheckEpochBinary is like CheckEpoch, but saved is the
+// MarshalBinary encoding of the saved state, or nil if no state
+// has been saved.
+//
+// The decoded key material is wiped before CheckEpochBinary
+// returns.
+func CheckEpochBinary(saved []byte, state *State) error {
+	if saved == nil {
+		return nil
+	}
+	var t State
+	if err := t.UnmarshalBinary(saved); err != nil {
+		return err
+	}
+	defer t.wipe()
+	return CheckEpoch(&t, state)
+}
+
+// ErrClosed is returned when using a Session after it has been
+// closed.
+var ErrClosed = errors.New("dr: session closed")
+
+// ErrInvalidPeerKey is returned by Open when the header's ratchet
+// public key is degenerate: equal to our own ratchet public key,
+// all zeros, or rejected by the Ratchet's Diffie-Hellman function
+// (for example, a low-order point).
+var ErrInvalidPeerKey = errors.New("dr: invalid peer public key")
+
+// ErrTooManySkipped is returned by Open when the message would
+// require skipping more messages than the Store or the session's
+// skip limit allows. See WithSkipLimit.
+//
+// Stores should return (or wrap) ErrTooManySkipped from StoreKey
+// when their limit is reached so that applications can tell it
+// apart from storage failures and, for example, re-key the
+// session instead of retrying.
+var ErrTooManySkipped = errors.New("dr: too many skipped messages")
+
+// ErrReplay is returned by Open when replay detection is enabled
+// and the message has already been accepted.
+var ErrReplay = errors.New("dr: message replayed")
+
+// ErrMessageTooLarge is returned by Open when the message is
+// larger than the limit set by WithMaxMessageSize.
+var ErrMessageTooLarge = errors.New("dr: message too large")
+
+// ErrInvalidMessage is returned (wrapped) by Open when the message
+// is malformed, for example because the ciphertext is shorter
+// than the Ratchet's overhead.
+//
+// Unlike ErrDecryptFailed, which means that the message was well
+// formed but could not be authenticated, ErrInvalidMessage is
+// detected before any keys are derived.
+var ErrInvalidMessage = errors.New("dr: invalid message")
+
+// ErrDecryptFailed is returned (wrapped) by Open when the
+// message could not be authenticated, for example because it was
+// tampered with or sealed with a different key.
+var ErrDecryptFailed = errors.New("dr: decryption failed")
+
+// decryptError wraps an error returned by the AEAD in
+// ErrDecryptFailed.
+func decryptError(err error) error {
+	if err == nil || errors.Is(err, ErrInvalidKeySize) {
+		return err
+	}
+	return fmt.Errorf("%w: %w", ErrDecryptFailed, err)
+}
+
+// ErrStoreFailure is returned (wrapped) by Session methods when
+// the Store fails.
+//
+// The Store's error is wrapped as well, so it can still be
+// checked with errors.Is or errors.As. Errors wrapping
+// ErrTooManySkipped are returned as-is since they are not a
+// failure of the Store itself.
+var ErrStoreFailure = errors.New("dr: store failure")
+
+// storeError wraps an error returned by the Store in
+// ErrStoreFailure.
+func storeError(err error) error {
+	if err == nil ||
+		errors.Is(err, ErrTooManySkipped) ||
+		errors.Is(err, ErrStoreFailure) {
+		return err
+	}
+	return fmt.Errorf("%w: %w", ErrStoreFailure, err)
+}
+
+// Store saves session state.
+type Store interface {
+	// Save saves the state.
+	Save(s *State) error
+	// StoreKey stores a skipped message's key under the (Nr,
+	// PublicKey) tuple.
+	//
+	// StoreKey must return an error that wraps
+	// ErrTooManySkipped if too many messages have been skipped.
+	StoreKey(Nr int, pub PublicKey, key MessageKey) error
+	// LoadKey retrieves a message key using the (Nr, PublicKey)
+	// tuple.
+	//
+	// If the message key is not found LoadKey returns
+	// ErrNotFound.
+	LoadKey(Nr int, pub PublicKey) (MessageKey, error)
+	// DeleteKey removes a message key using the (Nr, PublicKey)
+	// tuple.
+	DeleteKey(Nr int, pub PublicKey) error
+}
+
+// StoreContext is a Store whose methods accept
+// a context.Context.
+//
+// Implementations should return promptly with the context's
+// error if the context is canceled.
+type StoreContext interface {
+	// SaveContext saves the state.
+	SaveContext(ctx context.Context, s *State) error
+	// StoreKeyContext stores a skipped message's key under the
+	// (Nr, PublicKey) tuple.
+	//
+	// StoreKeyContext must return an error that wraps
+	// ErrTooManySkipped if too many messages have been skipped.
+	StoreKeyContext(ctx context.Context, Nr int, pub PublicKey, key MessageKey) error
+	// LoadKeyContext retrieves a message key using the (Nr,
+	// PublicKey) tuple.
+	//
+	// If the message key is not found LoadKeyContext returns
+	// ErrNotFound.
+	LoadKeyContext(ctx context.Context, Nr int, pub PublicKey) (MessageKey, error)
+	// DeleteKeyContext removes a message key using the (Nr,
+	// PublicKey) tuple.
+	DeleteKeyContext(ctx context.Context, Nr int, pub PublicKey) error
+}
+
+// storeContext adapts a Store to StoreContext.
+//
+// The Store cannot be interrupted, so the context is only
+// checked before each call.
+type storeContext struct {
+	Store
+}
+
+var _ StoreContext = storeContext{}
+
+func (s storeContext) SaveContext(ctx context.Context, state *State) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Save(state)
+}
+
+func (s storeContext) StoreKeyContext(ctx context.Context, Nr int, pub PublicKey, key MessageKey) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.StoreKey(Nr, pub, key)
+}
+
+func (s storeContext) LoadKeyContext(ctx context.Context, Nr int, pub PublicKey) (MessageKey, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.LoadKey(Nr, pub)
+}
+
+func (s storeContext) DeleteKeyContext(ctx context.Context, Nr int, pub PublicKey) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.DeleteKey(Nr, pub)
+}
+
+// memory is an in-memory Store.
+type memory struct {
+	maxSkip int
+	keys    map[string]memoryKey
+	// ttl is how long skipped keys are retained, or zero if
+	// they are retained indefinitely.
+	ttl time.Duration
+	// now returns the current time.
+	now func() time.Time
+	// evict is set by WithSkipEviction.
+	evict SkipEviction
+	// seq is the sequence number of the next stored key.
+	seq uint64
+}
+
+// memoryKey is a skipped message key stored by memory.
+type memoryKey struct {
+	key     MessageKey
+	nr      int
+	pub     PublicKey
+	created time.Time
+	// seq orders keys by when they were stored.
+	seq uint64
+}
+
+var _ Store = (*memory)(nil)
+
+func (memory) key(Nr int, pub PublicKey) string {
+	return fmt.Sprintf("%d:%x", Nr, pub)
+}
+
+// expired reports whether the key has outlived the TTL.
+func (m *memory) expired(k memoryKey) bool {
+	return m.ttl > 0 && m.now().Sub(k.created) >= m.ttl
+}
+
+// sweep wipes and removes every expired key.
+func (m *memory) sweep() {
+	if m.ttl <= 0 {
+		return
+	}
+	for s, k := range m.keys {
+		if m.expired(k) {
+			wipe(k.key)
+			delete(m.keys, s)
+		}
+	}
+}
+
+func (m *memory) Save(_ *State) error {
+	return nil
 }
 
 func (m *memory) StoreKey(Nr int, pub PublicKey, key MessageKey) error {
 	if m.keys == nil {
-		m.keys = make(map[string][]byte)
+		m.keys = make(map[string]memoryKey)
 	}
+	m.sweep()
 	if len(m.keys) > m.maxSkip {
-		return errors.New("too many skipped messages")
+		if m.evict != EvictOldest {
+			return ErrTooManySkipped
+		}
+		m.evictOldest()
+	}
+	k := memoryKey{key: key, nr: Nr, pub: append(PublicKey(nil), pub...)}
+	if m.ttl > 0 {
+		k.created = m.now()
 	}
-	m.keys[m.key(Nr, pub)] = key
+	k.seq = m.seq
+	m.seq++
+	m.keys[m.key(Nr, pub)] = k
 	return nil
 }
 
+// evictOldest wipes and removes the key that was stored first.
+func (m *memory) evictOldest() {
+	var (
+		oldest string
+		seq    uint64 = math.MaxUint64
+	)
+	for s, k := range m.keys {
+		if k.seq <= seq {
+			oldest, seq = s, k.seq
+		}
+	}
+	if k, ok := m.keys[oldest]; ok {
+		wipe(k.key)
+		delete(m.keys, oldest)
+	}
+}
+
 func (m *memory) LoadKey(Nr int, pub PublicKey) (MessageKey, error) {
-	key, ok := m.keys[m.key(Nr, pub)]
+	s := m.key(Nr, pub)
+	k, ok := m.keys[s]
 	if !ok {
 		return nil, ErrNotFound
 	}
-	return key, nil
+	if m.expired(k) {
+		wipe(k.key)
+		delete(m.keys, s)
+		return nil, ErrNotFound
+	}
+	return k.key, nil
 }
 
 func (m *memory) DeleteKey(Nr int, pub PublicKey) error {
@@ -344,241 +1597,2565 @@ func (m *memory) DeleteKey(Nr int, pub PublicKey) error {
 	return nil
 }
 
-// Session encapsulates an asynchronous conversation between two
-// parties.
-type Session struct {
-	// r is the underlying Ratchet.
-	r Ratchet
-	// state is the current session state.
-	state *State
-	// store is the underlying session stte store.
-	store Store
+// KeyPurger is an optional interface implemented by Stores that
+// can remove every skipped message key.
+type KeyPurger interface {
+	// PurgeKeys removes and wipes every skipped message key.
+	PurgeKeys() error
+}
+
+var _ KeyPurger = (*memory)(nil)
+
+// KeyPruner is an optional interface implemented by Stores that
+// can remove skipped message keys for obsolete receiving chains.
+//
+// After each Diffie-Hellman ratchet step, Open calls PruneKeys
+// with the peer's current and previous ratchet public keys.
+// Skipped message keys for any other public key belong to chains
+// that are two or more steps old and are unlikely to ever be
+// used. See WithKeepOldChains to disable pruning.
+type KeyPruner interface {
+	// PruneKeys removes and wipes every skipped message key
+	// whose public key is not one of keep.
+	PruneKeys(keep ...PublicKey) error
+}
+
+var _ KeyPruner = (*memory)(nil)
+
+func (m *memory) PruneKeys(keep ...PublicKey) error {
+	for s, k := range m.keys {
+		if !containsKey(keep, k.pub) {
+			wipe(k.key)
+			delete(m.keys, s)
+		}
+	}
+	return nil
+}
+
+// containsKey reports whether keys contains key.
+func containsKey(keys []PublicKey, key PublicKey) bool {
+	for _, k := range keys {
+		if k.Equal(key) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *memory) PurgeKeys() error {
+	for k, v := range m.keys {
+		wipe(v.key)
+		delete(m.keys, k)
+	}
+	return nil
+}
+
+// Purger is an optional interface implemented by Stores that can
+// remove everything they hold for a session.
+type Purger interface {
+	// Purge removes and wipes every skipped message key and the
+	// saved state.
+	Purge() error
+}
+
+var _ Purger = (*memory)(nil)
+
+// Purge implements Purger. memory does not retain the state, so
+// Purge is equivalent to PurgeKeys.
+func (m *memory) Purge() error {
+	return m.PurgeKeys()
+}
+
+// KeyCounter is an optional interface implemented by Stores that
+// can count their skipped message keys.
+type KeyCounter interface {
+	// SkippedCount returns the number of stored skipped message
+	// keys.
+	SkippedCount() (int, error)
+}
+
+var _ KeyCounter = (*memory)(nil)
+
+func (m *memory) SkippedCount() (int, error) {
+	m.sweep()
+	return len(m.keys), nil
+}
+
+// KeyLimiter is an optional interface implemented by Stores that
+// limit the number of skipped message keys they store.
+//
+// Open uses it to reject a message that would skip more keys
+// than the Store has room for before deriving any of them.
+type KeyLimiter interface {
+	// RemainingKeys returns the number of skipped message keys
+	// that can be stored before StoreKey returns
+	// ErrTooManySkipped.
+	RemainingKeys() (int, error)
+}
+
+var _ KeyLimiter = (*memory)(nil)
+
+// RemainingKeys implements KeyLimiter.
+func (m *memory) RemainingKeys() (int, error) {
+	if m.evict == EvictOldest {
+		return math.MaxInt, nil
+	}
+	m.sweep()
+	n := m.maxSkip - len(m.keys)
+	if n < math.MaxInt {
+		// StoreKey allows maxSkip+1 keys.
+		n++
+	}
+	return max(n, 0), nil
+}
+
+// ExportedKey is a skipped message key exported from a Store.
+type ExportedKey struct {
+	// Nr is the message number.
+	Nr int
+	// PublicKey is the ratchet public key of the message's
+	// receiving chain.
+	PublicKey PublicKey
+	// Key is the message key.
+	Key MessageKey
+}
+
+// KeyExporter is an optional interface implemented by Stores that
+// can export and import every skipped message key, for example
+// to move a session to another device.
+//
+// Exported keys are secret key material. They should be
+// encrypted while in transit, for example after encoding them
+// with MarshalExportedKeys.
+type KeyExporter interface {
+	// ExportKeys returns a copy of every stored skipped message
+	// key.
+	ExportKeys() ([]ExportedKey, error)
+	// ImportKeys stores each of the keys as if by StoreKey.
+	//
+	// ImportKeys must return an error that wraps
+	// ErrTooManySkipped if the keys would exceed the Store's
+	// limit.
+	ImportKeys(keys []ExportedKey) error
+}
+
+var _ KeyExporter = (*memory)(nil)
+
+func (m *memory) ExportKeys() ([]ExportedKey, error) {
+	m.sweep()
+	keys := make([]ExportedKey, 0, len(m.keys))
+	for _, k := range m.keys {
+		keys = append(keys, ExportedKey{
+			Nr:        k.nr,
+			PublicKey: append(PublicKey(nil), k.pub...),
+			Key:       append(MessageKey(nil), k.key...),
+		})
+	}
+	return keys, nil
+}
+
+// ImportKeys implements KeyExporter.
+//
+// Imported keys replace any stored keys with the same (Nr,
+// PublicKey) tuple. The TTL set by WithSkipTTL starts over for
+// imported keys.
+func (m *memory) ImportKeys(keys []ExportedKey) error {
+	m.sweep()
+	n := len(m.keys)
+	for _, k := range keys {
+		if _, ok := m.keys[m.key(k.Nr, k.PublicKey)]; !ok {
+			n++
+		}
+	}
+	if n > m.maxSkip+1 {
+		return ErrTooManySkipped
+	}
+	if m.keys == nil {
+		m.keys = make(map[string]memoryKey)
+	}
+	for _, k := range keys {
+		v := memoryKey{
+			key: append(MessageKey(nil), k.Key...),
+			nr:  k.Nr,
+			pub: append(PublicKey(nil), k.PublicKey...),
+		}
+		if m.ttl > 0 {
+			v.created = m.now()
+		}
+		v.seq = m.seq
+		m.seq++
+		s := m.key(k.Nr, k.PublicKey)
+		if old, ok := m.keys[s]; ok {
+			wipe(old.key)
+		}
+		m.keys[s] = v
+	}
+	return nil
+}
+
+// exportedKeysVersion is the current version of the
+// MarshalExportedKeys encoding.
+const exportedKeysVersion = 1
+
+// MarshalExportedKeys encodes keys.
+//
+// The result contains secret key material and must be protected
+// accordingly.
+func MarshalExportedKeys(keys []ExportedKey) ([]byte, error) {
+	n := 1 + binary.MaxVarintLen64
+	for _, k := range keys {
+		n += 3*binary.MaxVarintLen64 + len(k.PublicKey) + len(k.Key)
+	}
+	buf := make([]byte, 0, n)
+	buf = append(buf, exportedKeysVersion)
+	buf = binary.AppendUvarint(buf, uint64(len(keys)))
+	for _, k := range keys {
+		if k.Nr < 0 {
+			return nil, fmt.Errorf("dr: invalid counter: %d", k.Nr)
+		}
+		buf = binary.AppendUvarint(buf, uint64(k.Nr))
+		buf = appendKey(buf, k.PublicKey)
+		buf = appendKey(buf, k.Key)
+	}
+	return buf, nil
+}
+
+// UnmarshalExportedKeys decodes keys encoded by
+// MarshalExportedKeys.
+func UnmarshalExportedKeys(data []byte) ([]ExportedKey, error) {
+	if len(data) < 1 {
+		return nil, errors.New("dr: exported keys too short")
+	}
+	if data[0] != exportedKeysVersion {
+		return nil, fmt.Errorf("dr: unknown exported keys version: %d", data[0])
+	}
+	data = data[1:]
+	n, m := binary.Uvarint(data)
+	if m <= 0 || n > uint64(len(data)) {
+		return nil, errors.New("dr: invalid number of exported keys")
+	}
+	data = data[m:]
+	keys := make([]ExportedKey, n)
+	for i := range keys {
+		Nr, m := binary.Uvarint(data)
+		if m <= 0 || Nr > math.MaxInt {
+			return nil, errors.New("dr: invalid exported key counter")
+		}
+		keys[i].Nr = int(Nr)
+		data = data[m:]
+
+		var (
+			pub, key []byte
+			err      error
+		)
+		pub, data, err = readKey(data)
+		if err != nil {
+			return nil, err
+		}
+		key, data, err = readKey(data)
+		if err != nil {
+			return nil, err
+		}
+		keys[i].PublicKey = pub
+		keys[i].Key = key
+	}
+	if len(data) != 0 {
+		return nil, errors.New("dr: trailing data after exported keys")
+	}
+	return keys, nil
+}
+
+// Session encapsulates an asynchronous conversation between two
+// parties.
+type Session struct {
+	// r is the underlying Ratchet.
+	r Ratchet
+	// state is the current session state.
+	state *State
+	// store is the underlying session state store.
+	store StoreContext
+	// closed is set by Close.
+	closed bool
+	// replayWindow is the number of accepted messages retained
+	// for replay detection, or zero if disabled.
+	replayWindow int
+	// skipTTL is how long the default store retains skipped
+	// message keys, or zero if they are retained indefinitely.
+	skipTTL time.Duration
+	// skipEviction is set by WithSkipEviction.
+	skipEviction SkipEviction
+	// now returns the current time. It is set by WithClock.
+	//
+	// If nil, time.Now is used.
+	now func() time.Time
+	// rand is used to generate ratchet key pairs.
+	//
+	// If nil, crypto/rand.Reader is used.
+	rand io.Reader
+	// keyExport enables SealWithKey.
+	keyExport bool
+	// hooks are invoked by Open.
+	hooks Hooks
+	// logger receives diagnostics, or is nil.
+	logger Logger
+	// skipLimit is the maximum number of message keys skipped
+	// by a single call to Open.
+	//
+	// If zero, defaultMaxSkip is used.
+	skipLimit int
+	// binding is folded into the additional data of every
+	// message, or nil if disabled.
+	binding []byte
+	// transcript is set by WithTranscript.
+	transcript []byte
+	// noBindName is set by WithAlgorithmBinding(false).
+	noBindName bool
+	// readOnly is set by WithReadOnly.
+	readOnly bool
+	// compress is set by WithCompression.
+	compress bool
+	// uniformTiming is set by WithUniformTiming.
+	uniformTiming bool
+	// storeErrorPolicy is set by WithStoreErrorPolicy.
+	storeErrorPolicy StoreErrorPolicy
+	// dh is set by WithDH.
+	dh DHFunc
+	// keepOldChains disables pruning of skipped message keys
+	// after a ratchet step.
+	keepOldChains bool
+	// peerKeyValidator is set by WithPeerKeyValidator.
+	peerKeyValidator func(PublicKey) error
+	// maxMessageSize is set by WithMaxMessageSize.
+	maxMessageSize int
+	// saveEvery is set by WithSaveEvery.
+	saveEvery int
+	// unsaved is the number of messages opened since the state
+	// was last saved.
+	unsaved int
+	// sendLease is the sending message number stored in the most
+	// recently saved state. Seal does not need to save the state
+	// while the sending message number is below it.
+	sendLease int
+}
+
+// concat binds the Ratchet's name, the session's transcript, and
+// the session's binding, if any, to additionalData and passes the
+// result to the Ratchet's Concat method.
+//
+// If any of them is used, every one is encoded, even if empty, so
+// that each has its own slot.
+func (s *Session) concat(additionalData []byte, h Header) []byte {
+	if s.noBindName && len(s.binding) == 0 && len(s.transcript) == 0 {
+		return s.r.Concat(additionalData, h)
+	}
+	const (
+		max64 = binary.MaxVarintLen64
+	)
+	var name string
+	if !s.noBindName {
+		name = s.r.Name()
+	}
+	ad := make([]byte, 0, 3*max64+len(name)+len(s.transcript)+len(s.binding)+len(additionalData))
+	ad = binary.AppendVarint(ad, int64(len(name)))
+	ad = append(ad, name...)
+	ad = binary.AppendVarint(ad, int64(len(s.transcript)))
+	ad = append(ad, s.transcript...)
+	ad = binary.AppendVarint(ad, int64(len(s.binding)))
+	ad = append(ad, s.binding...)
+	ad = append(ad, additionalData...)
+	return s.r.Concat(ad, h)
+}
+
+// maxSkip returns the maximum number of message keys skipped by
+// a single call to Open.
+func (s *Session) maxSkip() int {
+	if s.skipLimit > 0 {
+		return s.skipLimit
+	}
+	return defaultMaxSkip
+}
+
+// random returns the session's source of randomness.
+func (s *Session) random() io.Reader {
+	if s.rand != nil {
+		return s.rand
+	}
+	return rand.Reader
+}
+
+// initStore configures the default store if no store was
+// provided and applies WithReadOnly.
+func (s *Session) initStore() {
+	if s.store == nil {
+		s.store = storeContext{s.newMemory()}
+	}
+	if s.readOnly {
+		s.store = readOnlyStore{StoreContext: s.store, mem: s.newMemory()}
+	}
+}
+
+// newMemory returns the default in-memory Store.
+func (s *Session) newMemory() *memory {
+	now := s.now
+	if now == nil {
+		now = time.Now
+	}
+	return &memory{
+		maxSkip: defaultMaxSkip,
+		ttl:     s.skipTTL,
+		now:     now,
+		evict:   s.skipEviction,
+	}
+}
+
+// defaultMaxSkip is the default maximum number of messages that
+// can be skipped.
+const defaultMaxSkip = 1000
+
+// Option configures a Session.
+type Option func(*Session)
+
+// WithStore configures some backing store for saving state and
+// skipped messages.
+//
+// Saving session state allows the session to be paused and
+// resumed at a later time.
+//
+// Messages are skipped and queued when they arrive out of order.
+//
+// By default, skipped messages are stored in memory and sessions
+// are ephemeral.
+func WithStore(t Store) Option {
+	return func(s *Session) {
+		s.store = storeContext{t}
+	}
+}
+
+// WithStoreContext is like WithStore, but for stores that accept
+// a context.Context.
+//
+// The context provided to SealContext and OpenContext is passed
+// to each store call.
+func WithStoreContext(t StoreContext) Option {
+	return func(s *Session) {
+		s.store = t
+	}
+}
+
+// WithSkipTTL configures how long the default in-memory store
+// retains skipped message keys.
+//
+// Keys older than d are wiped and treated as missing, so the
+// corresponding messages can no longer be opened. Expired keys
+// are removed whenever a new key is stored or an expired key is
+// looked up.
+//
+// WithSkipTTL has no effect when WithStore or WithStoreContext
+// is used. By default, skipped message keys do not expire.
+func WithSkipTTL(d time.Duration) Option {
+	return func(s *Session) {
+		s.skipTTL = d
+	}
+}
+
+// SkipEviction is the policy used by the default in-memory store
+// when it is full.
+type SkipEviction int
+
+const (
+	// EvictNone rejects new skipped message keys when the store
+	// is full, so Open returns ErrTooManySkipped.
+	EvictNone SkipEviction = iota
+	// EvictOldest wipes and removes the skipped message key that
+	// was stored first to make room for a new one.
+	EvictOldest
+)
+
+// WithSkipEviction configures what the default in-memory store
+// does when it is full.
+//
+// With EvictNone, messages that would skip more keys than the
+// store has room for are rejected, which can stall the
+// conversation until old messages arrive. With EvictOldest, the
+// store keeps accepting new keys by evicting the oldest ones, so
+// the conversation continues but very late messages can no
+// longer be opened.
+//
+// WithSkipEviction has no effect when WithStore or
+// WithStoreContext is used. By default, EvictNone is used.
+func WithSkipEviction(p SkipEviction) Option {
+	return func(s *Session) {
+		s.skipEviction = p
+	}
+}
+
+// WithKeepOldChains configures whether skipped message keys from
+// old receiving chains are retained after a Diffie-Hellman
+// ratchet step.
+//
+// By default, if the store implements KeyPruner, each ratchet
+// step prunes the skipped message keys of every chain except the
+// peer's current and previous ones, so messages delayed by two or
+// more ratchet steps cannot be opened. When enabled, skipped
+// message keys are retained until they are used, expire (see
+// WithSkipTTL), or are purged, subject to the store's limit.
+func WithKeepOldChains(enabled bool) Option {
+	return func(s *Session) {
+		s.keepOldChains = enabled
+	}
+}
+
+// WithPeerKeyValidator configures a function that Open calls with
+// each new ratchet public key received from the peer, before the
+// session performs a Diffie-Hellman ratchet step with it.
+//
+// If fn returns an error, Open returns that error without
+// modifying the session. This makes it possible to enforce
+// policy on peer keys, for example an allowlist or a particular
+// encoding, without wrapping the Ratchet.
+//
+// fn is only called for keys that would cause a ratchet step.
+// Messages from the peer's current sending chain and skipped
+// messages use keys that were already validated. fn must not
+// modify the key.
+func WithPeerKeyValidator(fn func(PublicKey) error) Option {
+	return func(s *Session) {
+		s.peerKeyValidator = fn
+	}
+}
+
+// WithMaxMessageSize configures the largest plaintext, in bytes,
+// that Open accepts.
+//
+// Open returns ErrMessageTooLarge without decrypting or
+// allocating anything if the ciphertext is larger than n plus
+// the Ratchet's overhead. This bounds the memory that a peer can
+// make Open allocate.
+//
+// By default, or if n is not positive, the size is not limited.
+func WithMaxMessageSize(n int) Option {
+	return func(s *Session) {
+		s.maxMessageSize = n
+	}
+}
+
+// WithSaveEvery configures the session to save its state less
+// often, trading a bounded window of replayable messages after a
+// crash for fewer writes to the store.
+//
+// By default, or if n is less than two, the state is saved after
+// every message.
+//
+// Otherwise, Open saves the state after every Diffie-Hellman
+// ratchet step and after every n messages. If the process
+// crashes, the session resumes from an older state, so up to n-1
+// messages that were already opened can be opened again.
+// Skipped message keys are still stored immediately.
+//
+// Seal saves the state once every n messages, but the saved
+// state's sending chain is advanced n messages ahead. A session
+// resumed after a crash therefore never reuses a message key;
+// instead, it skips the message numbers that were reserved but
+// never sent, which the peer stores as up to n-1 skipped message
+// keys.
+//
+// Use Flush to save the state before shutting down.
+func WithSaveEvery(n int) Option {
+	return func(s *Session) {
+		s.saveEvery = n
+	}
+}
+
+// Clock is a source of the current time.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+}
+
+// WithClock configures the clock used by the session and the
+// default in-memory store for anything that depends on the
+// current time, such as WithSkipTTL.
+//
+// It is primarily useful for tests. By default, the system clock
+// is used.
+func WithClock(c Clock) Option {
+	return func(s *Session) {
+		s.now = c.Now
+	}
+}
+
+// WithRand configures the source of randomness used to generate
+// ratchet key pairs, both in NewSend and in each asymmetric
+// ratchet step.
+//
+// r must be cryptographically secure unless the session is only
+// used for testing. WithRand does not affect randomness used
+// internally by a Ratchet, such as ML-KEM encapsulation.
+//
+// By default, crypto/rand.Reader is used.
+func WithRand(r io.Reader) Option {
+	return func(s *Session) {
+		s.rand = r
+	}
+}
+
+// WithKeyExport enables or disables SealWithKey.
+//
+// Exporting message keys defeats forward secrecy for every
+// exported message. See SealWithKey.
+//
+// By default, key export is disabled.
+func WithKeyExport(enabled bool) Option {
+	return func(s *Session) {
+		s.keyExport = enabled
+	}
+}
+
+// Hooks are optional callbacks invoked while opening messages,
+// intended for debugging and metrics.
+//
+// Hooks are called synchronously on the goroutine that called
+// Open, after the outcome is known, so they must be cheap and must
+// not call methods on the Session. Nil fields are ignored.
+type Hooks struct {
+	// OnRatchet is called after an asymmetric ratchet step is
+	// committed with a copy of the peer's new ratchet public
+	// key.
+	OnRatchet func(newDHr PublicKey)
+	// OnSkip is called after a message is opened with the
+	// number of skipped message keys stored while opening it.
+	OnSkip func(count int)
+	// OnSkippedKeyUsed is called after a message is opened with
+	// a previously skipped message key with the message's
+	// number.
+	OnSkippedKeyUsed func(n int)
+	// OnError is called when a message cannot be opened and, if
+	// WithStoreErrorPolicy(StoreErrorBestEffort) is used, when
+	// the state cannot be saved.
+	OnError func(err error)
+}
+
+func (h Hooks) ratchet(pub PublicKey) {
+	if h.OnRatchet != nil {
+		h.OnRatchet(pub)
+	}
+}
+
+func (h Hooks) skip(count int) {
+	if h.OnSkip != nil {
+		h.OnSkip(count)
+	}
+}
+
+func (h Hooks) skippedKeyUsed(n int) {
+	if h.OnSkippedKeyUsed != nil {
+		h.OnSkippedKeyUsed(n)
+	}
+}
+
+func (h Hooks) error(err error) {
+	if h.OnError != nil {
+		h.OnError(err)
+	}
+}
+
+// WithHooks configures callbacks for ratchet events.
+//
+// By default, no hooks are called.
+func WithHooks(h Hooks) Option {
+	return func(s *Session) {
+		s.hooks = h
+	}
+}
+
+// Logger receives human-readable diagnostics from a Session.
+//
+// The diagnostics are meant for tracing problems like desynced
+// sessions. They never contain key material, but they do contain
+// message numbers and (truncated) public keys.
+type Logger interface {
+	// Debug logs msg along with alternating keys and values,
+	// like log/slog.Logger.Debug.
+	Debug(msg string, kv ...any)
+}
+
+// WithLogger configures the session to log diagnostics to l.
+//
+// Messages are logged when Open performs a Diffie-Hellman
+// ratchet step, skips message keys, uses a skipped message key,
+// or rejects a message, and when the session's state cannot be
+// saved. Like Hooks, l is called synchronously and must not call
+// methods on the Session.
+//
+// By default, or if l is nil, nothing is logged. The arguments
+// are not even evaluated, so unused logging has no overhead.
+func WithLogger(l Logger) Option {
+	return func(s *Session) {
+		s.logger = l
+	}
+}
+
+// WithSkipLimit sets the maximum number of message keys that a
+// single call to Open may skip, counting both the rest of the
+// previous receiving chain (Header.PN) and the start of the new
+// one (Header.N).
+//
+// Headers that exceed the limit are rejected with
+// ErrTooManySkipped before any keys are derived. This is
+// independent of the limit on the number of stored skipped keys,
+// which is enforced by the Store. If the Store implements
+// KeyLimiter, headers that would skip more keys than the Store
+// has room for are also rejected before any keys are derived.
+//
+// By default, the limit is 1000.
+func WithSkipLimit(n int) Option {
+	return func(s *Session) {
+		s.skipLimit = n
+	}
+}
+
+// WithSessionBinding binds every message to the session
+// identifier id.
+//
+// The identifier is authenticated along with the additional data
+// passed to Seal and Open, so a message sealed by a session with
+// one identifier cannot be opened by a session with another,
+// even if both share the same keys. Both parties must use the
+// same identifier.
+//
+// The identifier is not part of the State, so it must also be
+// provided to Resume. Specifically, the additional data passed
+// to the Ratchet's Concat method is
+//
+//    varint(len(name)) || name ||
+//        varint(len(transcript)) || transcript ||
+//        varint(len(id)) || id || additionalData
+//
+// where name is the Ratchet's name, or empty with
+// WithAlgorithmBinding(false), and transcript is the hash set by
+// WithTranscript, or empty.
+//
+// By default, or if id is empty, messages are not bound to a
+// session identifier.
+func WithSessionBinding(id []byte) Option {
+	return func(s *Session) {
+		s.binding = append([]byte(nil), id...)
+	}
+}
+
+// WithTranscript binds every message to the transcript hash of
+// the handshake that produced the shared key, such as the hash
+// computed by Noise or over the X3DH messages.
+//
+// Without it, nothing ties the ratchet to the handshake that it
+// was started from, so messages from one session could be spliced
+// onto a different handshake that happens to produce the same
+// keys. Both parties must use the same transcript hash.
+//
+// The transcript is authenticated with every message, separately
+// from the additional data passed to Seal and Open. It is not
+// part of the State, so it must also be provided to Resume.
+// Specifically, the additional data passed to the Ratchet's
+// Concat method is
+//
+//    varint(len(name)) || name ||
+//        varint(len(transcript)) || transcript ||
+//        varint(len(id)) || id || additionalData
+//
+// where name is the Ratchet's name (see WithAlgorithmBinding)
+// and id is the identifier set by WithSessionBinding, or empty.
+//
+// By default, or if hash is empty, messages are not bound to a
+// transcript.
+func WithTranscript(hash []byte) Option {
+	return func(s *Session) {
+		s.transcript = append([]byte(nil), hash...)
+	}
+}
+
+// WithAlgorithmBinding controls whether every message is bound
+// to the Ratchet's name (see Ratchet.Name), which identifies its
+// algorithms and namespace.
+//
+// Without it, nothing but the keys ties a message to the Ratchet
+// that sealed it. If the same shared key is (incorrectly) used
+// with two Ratchets whose derived keys coincide, a message sealed
+// by one could be opened by the other. With it, a message can
+// only be opened by a session whose Ratchet has the same name.
+// Both parties must use the same setting.
+//
+// The name is authenticated with every message, separately from
+// the additional data passed to Seal and Open. The setting is not
+// part of the State, so WithAlgorithmBinding(false) must also be
+// provided to Resume. Specifically, the additional data passed to
+// the Ratchet's Concat method is
+//
+//    varint(len(name)) || name ||
+//        varint(len(transcript)) || transcript ||
+//        varint(len(id)) || id || additionalData
+//
+// where transcript is the hash set by WithTranscript and id is
+// the identifier set by WithSessionBinding, or empty. If the name
+// is not bound and neither of those options is used, the
+// additional data is passed to Concat unchanged.
+//
+// By default, messages are bound to the Ratchet's name.
+func WithAlgorithmBinding(enabled bool) Option {
+	return func(s *Session) {
+		s.noBindName = !enabled
+	}
+}
+
+// WithReadOnly configures the session to never write to its
+// store, for example because the store is a read-only replica.
+//
+// Open still advances the session's in-memory state, but the
+// state is never saved. Skipped message keys are read from the
+// store, but are never deleted from it, and newly skipped message
+// keys are kept in memory instead. They are therefore lost when
+// the session is discarded, and the messages they belong to can
+// no longer be opened; a read-only session has no skipped-key
+// durability.
+//
+// Sending from a replica would reuse message keys that the
+// primary also uses, so Seal and the other sealing methods
+// return ErrReadOnly.
+//
+// By default, sessions are not read-only.
+func WithReadOnly(enabled bool) Option {
+	return func(s *Session) {
+		s.readOnly = enabled
+	}
+}
+
+// ErrReadOnly is returned when sealing a message with a session
+// created with WithReadOnly.
+var ErrReadOnly = errors.New("dr: session is read-only")
+
+// readOnlyStore is a StoreContext that never writes to the
+// underlying store. Skipped message keys are stored in mem.
+type readOnlyStore struct {
+	StoreContext
+	mem *memory
+}
+
+var (
+	_ KeyPurger = readOnlyStore{}
+	_ KeyPruner = readOnlyStore{}
+)
+
+func (readOnlyStore) SaveContext(_ context.Context, _ *State) error {
+	return nil
+}
+
+func (r readOnlyStore) StoreKeyContext(_ context.Context, Nr int, pub PublicKey, key MessageKey) error {
+	return r.mem.StoreKey(Nr, pub, key)
+}
+
+func (r readOnlyStore) LoadKeyContext(ctx context.Context, Nr int, pub PublicKey) (MessageKey, error) {
+	mk, err := r.mem.LoadKey(Nr, pub)
+	if errors.Is(err, ErrNotFound) {
+		return r.StoreContext.LoadKeyContext(ctx, Nr, pub)
+	}
+	return mk, err
+}
+
+func (r readOnlyStore) DeleteKeyContext(_ context.Context, Nr int, pub PublicKey) error {
+	return r.mem.DeleteKey(Nr, pub)
+}
+
+// PurgeKeys only purges the keys held in memory.
+func (r readOnlyStore) PurgeKeys() error {
+	return r.mem.PurgeKeys()
+}
+
+// PruneKeys only prunes the keys held in memory.
+func (r readOnlyStore) PruneKeys(keep ...PublicKey) error {
+	return r.mem.PruneKeys(keep...)
+}
+
+// DHFunc computes the Diffie-Hellman value between a private key
+// held elsewhere, such as in a hardware security module, and the
+// peer's public key.
+type DHFunc func(peer PublicKey) ([]byte, error)
+
+// WithDH delegates the Diffie-Hellman operation that uses the
+// key pair passed to NewRecv to fn, so that the private key never
+// has to leave the device that holds it.
+//
+// The key pair passed to NewRecv is typically long-term, like a
+// signed prekey, and is only used for the first ratchet step.
+// Every later key pair is ephemeral and stays in software. With
+// WithDH, the PrivateKey passed to NewRecv is only a handle: its
+// public half (as returned by the Ratchet's Public method) must
+// be the device's public key, but its private half is never used
+// and can be all zeros. For the built-in Ratchets, a PrivateKey
+// is the private key followed by the public key, so
+//
+//    handle := append(make(PrivateKey, len(priv)-len(pub)), pub...)
+//
+// has the right layout.
+//
+// WithDH must also be passed to Resume until the session has
+// received its first message. It is ignored by sessions created
+// with NewSend and is not supported for KEMRatchets.
+//
+// By default, the Ratchet's DH method is used.
+func WithDH(fn DHFunc) Option {
+	return func(s *Session) {
+		s.dh = fn
+	}
+}
+
+// StoreErrorPolicy determines what a Session does when its store
+// fails to save the state.
+type StoreErrorPolicy int
+
+const (
+	// StoreErrorFail makes Seal and Open return the error. The
+	// message is not sealed or opened and the session is
+	// unchanged.
+	StoreErrorFail StoreErrorPolicy = iota
+	// StoreErrorBestEffort makes Seal and Open continue without
+	// saving the state. The error is reported to the OnError
+	// hook (see WithHooks) and the save is retried by Flush.
+	StoreErrorBestEffort
+)
+
+// WithStoreErrorPolicy configures what Seal and Open do when the
+// store fails to save the state.
+//
+// The policy only applies to saving the state. Failures to store,
+// load, or delete skipped message keys are always returned since
+// continuing would lose the keys, and so would the messages they
+// belong to. ErrStaleState is also always returned since it means
+// that another session is using the same store.
+//
+// StoreErrorBestEffort trades durability for availability. Until
+// the state is saved, the saved state is behind the session, and
+// a session resumed from it will derive message keys that were
+// already used. Sealing a different message with a reused key
+// breaks the confidentiality of both messages. Applications that
+// use StoreErrorBestEffort must call Flush until it succeeds
+// before the session could be resumed, and must not resume from
+// a state that may be stale.
+//
+// By default, StoreErrorFail is used.
+func WithStoreErrorPolicy(p StoreErrorPolicy) Option {
+	return func(s *Session) {
+		s.storeErrorPolicy = p
+	}
+}
+
+// WithUniformTiming configures Open to derive a message key even
+// when it opens a skipped message with a key from the store, so
+// that opening a late message takes about as long as opening the
+// next message in the receiving chain.
+//
+// This is a best-effort mitigation. The timing of the store
+// itself, of skipping messages, and of Diffie-Hellman ratchet
+// steps still depends on the message. Headers are not encrypted,
+// so whether a message is late is visible to anyone who can see
+// it anyway.
+//
+// By default, skipped messages are opened without deriving any
+// keys.
+func WithUniformTiming(enabled bool) Option {
+	return func(s *Session) {
+		s.uniformTiming = enabled
+	}
+}
+
+// WithReplayWindow enables replay detection.
+//
+// The session records the n most recently accepted messages in
+// its State, and Open returns ErrReplay if one of them arrives
+// again. Because the record is part of the State it is persisted
+// by the Store and survives Resume.
+//
+// By default, replay detection is disabled. Replayed messages
+// are still rejected, but with an authentication error that is
+// indistinguishable from any other invalid message.
+func WithReplayWindow(n int) Option {
+	return func(s *Session) {
+		s.replayWindow = n
+	}
+}
+
+// Resume continues an existing Session.
+//
+// Resume returns an error if the state is inconsistent: a key
+// has the wrong size for r or a counter is negative. The key
+// pair sizes are only checked for the built-in Ratchets.
+func Resume(r Ratchet, state *State, opts ...Option) (*Session, error) {
+	if err := state.validate(r); err != nil {
+		return nil, fmt.Errorf("Resume: %w", err)
+	}
+	s := &Session{
+		r:     r,
+		state: state,
+	}
+	for _, fn := range opts {
+		fn(s)
+	}
+	s.initStore()
+	return s, nil
+}
+
+// NewSend creates a new Session for initiating communication
+// with some peer.
+//
+// The shared key SK must be negotiated with the peer ahead of
+// time. It must be KeySize bytes.
+func NewSend(r Ratchet, SK []byte, peer PublicKey, opts ...Option) (*Session, error) {
+	if err := checkKeySize("shared key", SK); err != nil {
+		return nil, fmt.Errorf("NewSend: %w", err)
+	}
+	s := &Session{
+		r: r,
+	}
+	for _, fn := range opts {
+		fn(s)
+	}
+	s.initStore()
+	state, err := newSendState(r, s.random(), SK, peer)
+	if err != nil {
+		return nil, fmt.Errorf("NewSend: %w", err)
+	}
+	s.state = state
+	return s, nil
+}
+
+// newSendState creates the initial state of the party that
+// initiates the conversation.
+func newSendState(r Ratchet, rand io.Reader, SK []byte, peer PublicKey) (*State, error) {
+	priv, err := r.Generate(rand)
+	if err != nil {
+		return nil, fmt.Errorf("Generate failed: %w", err)
+	}
+	dh, ct, err := sendSecret(r, priv, peer)
+	if err != nil {
+		return nil, fmt.Errorf("DH failed: %w", err)
+	}
+	rk, ck := r.KDFrk(SK, dh)
+	return &State{
+		DHs: priv,
+		DHr: peer,
+		RK:  rk,
+		CKs: ck,
+		CTs: ct,
+	}, nil
+}
+
+// NewRecv creates a new Session for receiving communication
+// initiated by some peer.
+//
+// The shared key SK must be negotiated with the peer ahead of
+// time. It must be KeySize bytes.
+func NewRecv(r Ratchet, SK []byte, priv PrivateKey, opts ...Option) (*Session, error) {
+	if err := checkKeySize("shared key", SK); err != nil {
+		return nil, fmt.Errorf("NewRecv: %w", err)
+	}
+	s := &Session{
+		r: r,
+	}
+	for _, fn := range opts {
+		fn(s)
+	}
+	s.initStore()
+	s.state = &State{
+		DHs: priv,
+		RK:  SK,
+	}
+	return s, nil
+}
+
+// Reset reinitializes the session for a new conversation with
+// peer, as if it had been created by NewSend with the same
+// Ratchet and options.
+//
+// Reusing a Session avoids allocating a new one for each
+// conversation, for example in a server that handles many
+// short-lived conversations. Reset wipes the old state and, if
+// the store implements KeyPurger, purges its skipped message
+// keys. The new state's epoch continues from the old one so that
+// stores that reject stale states (see CheckEpoch) accept it.
+//
+// Reset can be called after Close. If Reset returns an error,
+// the session's state is unchanged, but its skipped message keys
+// might have been purged.
+func (s *Session) Reset(SK []byte, peer PublicKey) error {
+	if err := checkKeySize("shared key", SK); err != nil {
+		return fmt.Errorf("Reset: %w", err)
+	}
+	if err := s.purgeKeys(); err != nil {
+		return err
+	}
+	state, err := newSendState(s.r, s.random(), SK, peer)
+	if err != nil {
+		return fmt.Errorf("Reset: %w", err)
+	}
+	s.reset(state)
+	return nil
+}
+
+// ResetRecv is like Reset, but reinitializes the session as if it
+// had been created by NewRecv.
+func (s *Session) ResetRecv(SK []byte, priv PrivateKey) error {
+	if err := checkKeySize("shared key", SK); err != nil {
+		return fmt.Errorf("ResetRecv: %w", err)
+	}
+	if err := s.purgeKeys(); err != nil {
+		return err
+	}
+	s.reset(&State{
+		DHs: priv,
+		RK:  SK,
+	})
+	return nil
+}
+
+// purgeKeys purges the store's skipped message keys if it
+// implements KeyPurger.
+func (s *Session) purgeKeys() error {
+	if p, ok := s.rawStore().(KeyPurger); ok {
+		if err := p.PurgeKeys(); err != nil {
+			return storeError(err)
+		}
+	}
+	return nil
+}
+
+// reset wipes the session's state and replaces it with state.
+func (s *Session) reset(state *State) {
+	state.Epoch = s.state.Epoch
+	s.state.wipe()
+	s.state = state
+	s.closed = false
+	s.unsaved = 0
+	s.sendLease = 0
+}
+
+// NeedsResync reports whether msg is on the session's current
+// receiving chain but the chain key has been lost, for example
+// because the state was partially wiped or restored from a
+// corrupt copy.
+//
+// Open cannot open such a message, since it can only rebuild a
+// receiving chain from a message with a new ratchet public key,
+// and rejects it with ErrInvalidHeader. Use Resync to rebuild the
+// chain. Messages whose keys were stored as skipped can still be
+// opened with OpenSkipped.
+func (s *Session) NeedsResync(msg Message) bool {
+	return !s.closed &&
+		s.state.DHr != nil &&
+		s.state.CKr == nil &&
+		s.state.DHr.Equal(msg.Header.PublicKey)
+}
+
+// Resync rebuilds the session's receiving chain from checkpoint,
+// a known-good copy of the state saved earlier on the same
+// receiving chain, such as a backup or an older state from a
+// Store.
+//
+// The checkpoint must have the same peer ratchet public key
+// (DHr) and root key (RK) as the session, which are both
+// unchanged by sending and receiving messages until the peer's
+// next ratchet step, and it must not be ahead of the session.
+// Its receiving chain key is advanced to the session's position
+// in the chain, so messages that the session has already opened
+// still cannot be opened again. The checkpoint must also have
+// been saved after the most recent call to Rekey, or the rebuilt
+// chain will not match the peer's.
+//
+// If the receiving chain is intact (see NeedsResync), Resync does
+// nothing. Otherwise, the updated state is saved.
+func (s *Session) Resync(checkpoint *State) error {
+	if s.closed {
+		return ErrClosed
+	}
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	if checkpoint == nil {
+		return errors.New("dr: nil checkpoint")
+	}
+	if s.state.CKr != nil {
+		return nil
+	}
+	if s.state.DHr == nil ||
+		!s.state.DHr.Equal(checkpoint.DHr) ||
+		subtle.ConstantTimeCompare(s.state.RK, checkpoint.RK) != 1 {
+		return errors.New("dr: checkpoint is not on the current receiving chain")
+	}
+	if checkpoint.CKr == nil {
+		return errors.New("dr: checkpoint has no receiving chain")
+	}
+	if checkpoint.Nr > s.state.Nr {
+		return fmt.Errorf("dr: checkpoint is ahead of the session: Nr %d > %d",
+			checkpoint.Nr, s.state.Nr)
+	}
+	tmp := s.state.Clone()
+	tmp.CKr = append(ChainKey(nil), checkpoint.CKr...)
+	for i := checkpoint.Nr; i < tmp.Nr; i++ {
+		ck, mk := s.r.KDFck(tmp.CKr)
+		wipe(tmp.CKr)
+		wipe(mk)
+		tmp.CKr = ck
+	}
+	if err := s.save(context.Background(), tmp); err != nil {
+		tmp.wipe()
+		return err
+	}
+	s.state.wipe()
+	s.state = tmp
+	return nil
+}
+
+// SessionIDSize is the size in bytes of the identifiers returned
+// by SessionID.
+const SessionIDSize = 32
+
+// sessionIDLabel domain separates SessionID from the keys derived
+// from the shared key.
+const sessionIDLabel = "dr session id"
+
+// SessionID derives a stable identifier for the session that
+// uses the shared key SK between the initiator, whose identity
+// key is aliceID, and the responder, whose identity key is
+// bobID.
+//
+// Both parties compute the same identifier, so it can be used to
+// correlate logs and metrics or as the session ID of a store that
+// holds many sessions. The identifier is
+//
+//    HKDF-SHA-256(ikm=SK, salt=nil, info="dr session id" ||
+//        varint(len(aliceID)) || aliceID ||
+//        varint(len(bobID)) || bobID)
+//
+// which is independent of the session's keys, so revealing it
+// does not reveal anything about them.
+//
+// NewSend and NewRecv take ownership of SK, so SessionID must be
+// called first.
+func SessionID(SK, aliceID, bobID []byte) []byte {
+	const (
+		max64 = binary.MaxVarintLen64
+	)
+	info := make([]byte, 0, len(sessionIDLabel)+2*max64+len(aliceID)+len(bobID))
+	info = append(info, sessionIDLabel...)
+	info = binary.AppendVarint(info, int64(len(aliceID)))
+	info = append(info, aliceID...)
+	info = binary.AppendVarint(info, int64(len(bobID)))
+	info = append(info, bobID...)
+
+	id := make([]byte, SessionIDSize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, SK, nil, info), id); err != nil {
+		panic(err)
+	}
+	return id
+}
+
+// State returns a deep copy of the session's current state.
+//
+// The copy can be persisted or passed to Resume, and mutating it
+// does not affect the session. It is a snapshot: it does not
+// reflect subsequent calls to Seal or Open. Callers that retain
+// it while continuing to use the session should Clone it again
+// before each use.
+//
+// State returns nil if the session is closed.
+func (s *Session) State() *State {
+	if s.closed {
+		return nil
+	}
+	return s.state.Clone()
+}
+
+// PeerPublicKey returns a copy of the peer's current ratchet
+// public key.
+//
+// It returns nil if the session has not yet received a message
+// from the peer (for sessions created with NewRecv) or if the
+// session is closed.
+func (s *Session) PeerPublicKey() PublicKey {
+	if s.closed || s.state.DHr == nil {
+		return nil
+	}
+	return append(PublicKey(nil), s.state.DHr...)
+}
+
+// LocalPublicKey returns a copy of the session's current ratchet
+// public key, which is sent in the header of each message.
+//
+// Both ratchet public keys change with each Diffie-Hellman
+// ratchet step.
+//
+// It returns nil if the session is closed.
+func (s *Session) LocalPublicKey() PublicKey {
+	if s.closed {
+		return nil
+	}
+	return append(PublicKey(nil), s.r.Public(s.state.DHs)...)
+}
+
+// Message is a messages encrypted with the Double Ratchet
+// Algorithm.
+type Message struct {
+	Header     Header
+	Ciphertext []byte
+}
+
+// messageVersion is the current version of the Message binary
+// encoding.
+const messageVersion = 1
+
+// MarshalBinary encodes the message as
+//
+//    version || len(header) || header || ciphertext
+//
+// where version is a single byte, len(header) is a big-endian
+// uint32, and header is encoded by Header.Append.
+func (m Message) MarshalBinary() ([]byte, error) {
+	h := m.Header
+	if len(h.PublicKey) > maxHeaderKeyLen {
+		return nil, fmt.Errorf("dr: public key too large: %d", len(h.PublicKey))
+	}
+	if len(h.KEMCiphertext) > maxHeaderKeyLen {
+		return nil, fmt.Errorf("dr: KEM ciphertext too large: %d", len(h.KEMCiphertext))
+	}
+	n := h.size()
+	buf := make([]byte, 0, 1+4+n+len(m.Ciphertext))
+	buf = append(buf, messageVersion)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(n))
+	buf = h.Append(buf)
+	buf = append(buf, m.Ciphertext...)
+	return buf, nil
+}
+
+// UnmarshalBinary decodes a message encoded by MarshalBinary.
+//
+// Malformed messages are rejected with an error wrapping
+// ErrInvalidMessage, or ErrInvalidHeader if the header is
+// malformed.
+func (m *Message) UnmarshalBinary(data []byte) error {
+	h, ciphertext, err := splitMessage(data)
+	if err != nil {
+		return err
+	}
+	m.Header = h
+	m.Ciphertext = append([]byte(nil), ciphertext...)
+	return nil
+}
+
+// splitMessage decodes the header of a message encoded by
+// MarshalBinary and returns it along with the ciphertext, which
+// aliases data.
+func splitMessage(data []byte) (Header, []byte, error) {
+	if len(data) < 1+4 {
+		return Header{}, nil, fmt.Errorf("%w: length %d", ErrInvalidMessage, len(data))
+	}
+	if data[0] != messageVersion {
+		return Header{}, nil, fmt.Errorf("%w: unknown version %d", ErrInvalidMessage, data[0])
+	}
+	n := binary.BigEndian.Uint32(data[1:5])
+	data = data[5:]
+	if uint64(n) > uint64(len(data)) {
+		return Header{}, nil, fmt.Errorf("%w: header length %d", ErrInvalidMessage, n)
+	}
+	var h Header
+	if err := h.Decode(data[:n]); err != nil {
+		return Header{}, nil, err
+	}
+	return h, data[n:], nil
+}
+
+// Seal encrypts and authenticates plaintext, authenticates
+// additionalData, and returns the resulting message.
+//
+// The plaintext may be empty. For example, the initiator can
+// send an empty first message to start the peer's receiving
+// chain without a payload.
+//
+// Seal is shorthand for SealContext with context.Background.
+func (s *Session) Seal(plaintext, additionalData []byte) (Message, error) {
+	return s.SealContext(context.Background(), plaintext, additionalData)
+}
+
+// SealContext encrypts and authenticates plaintext,
+// authenticates additionalData, and returns the resulting
+// message.
+//
+// The context is passed to the underlying store.
+func (s *Session) SealContext(ctx context.Context, plaintext, additionalData []byte) (Message, error) {
+	ciphertext, h, err := s.sealTo(ctx, nil, plaintext, additionalData)
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{Header: h, Ciphertext: ciphertext}, nil
+}
+
+// SealBytes is like Seal, but returns the message encoded by
+// Message.MarshalBinary.
+//
+// The message can be opened with OpenBytes.
+func (s *Session) SealBytes(plaintext, additionalData []byte) ([]byte, error) {
+	msg, err := s.Seal(plaintext, additionalData)
+	if err != nil {
+		return nil, err
+	}
+	return msg.MarshalBinary()
+}
+
+// Overhead returns the maximum number of bytes that the next
+// call to Seal adds to the plaintext: the size of the serialized
+// Header (see Header.Append) plus the Ratchet's ciphertext
+// overhead. For example,
+//
+//    buf := make([]byte, 0, len(plaintext)+s.Overhead())
+//
+// Message.MarshalBinary adds another 5 bytes of framing.
+//
+// Overhead returns zero if the session is closed.
+func (s *Session) Overhead() int {
+	if s.closed {
+		return 0
+	}
+	h := s.r.Header(s.state.DHs, s.state.PN, s.state.Ns)
+	h.KEMCiphertext = s.state.CTs
+	return h.size() + s.r.Overhead()
+}
+
+// SkippedCount returns the number of skipped message keys held
+// by the session's store.
+//
+// A count that approaches the limit set by WithSkipLimit (or the
+// store's own limit) indicates that the conversation is
+// desynchronized, since messages are being skipped faster than
+// they arrive.
+//
+// The store must implement KeyCounter. The default in-memory
+// store does.
+func (s *Session) SkippedCount() (int, error) {
+	if s.closed {
+		return 0, ErrClosed
+	}
+	c, ok := s.rawStore().(KeyCounter)
+	if !ok {
+		return 0, errors.New("dr: store does not implement KeyCounter")
+	}
+	return c.SkippedCount()
+}
+
+// ExportKeys returns a copy of every skipped message key held by
+// the session's store.
+//
+// Together with State, the keys can be used to move the session
+// to another device without losing messages that have not
+// arrived yet. See ImportKeys.
+//
+// The store must implement KeyExporter. The default in-memory
+// store does.
+func (s *Session) ExportKeys() ([]ExportedKey, error) {
+	if s.closed {
+		return nil, ErrClosed
+	}
+	e, ok := s.rawStore().(KeyExporter)
+	if !ok {
+		return nil, errors.New("dr: store does not implement KeyExporter")
+	}
+	return e.ExportKeys()
+}
+
+// ImportKeys adds keys exported by ExportKeys to the session's
+// store.
+//
+// The store must implement KeyExporter. The default in-memory
+// store does.
+func (s *Session) ImportKeys(keys []ExportedKey) error {
+	if s.closed {
+		return ErrClosed
+	}
+	e, ok := s.rawStore().(KeyExporter)
+	if !ok {
+		return errors.New("dr: store does not implement KeyExporter")
+	}
+	return e.ImportKeys(keys)
+}
+
+// Gaps returns, in ascending order, the numbers of the messages
+// in the current receiving chain that were skipped and have not
+// arrived yet.
+//
+// Gaps are found from the skipped message keys still held by the
+// session's store, so a message that was dropped is reported
+// until its key is removed, for example by the store's TTL or
+// limit. Applications can use Gaps to ask the peer to resend
+// missing messages.
+//
+// Gaps returns nil if the store does not implement KeyExporter.
+// The default in-memory store does.
+func (s *Session) Gaps() []int {
+	if s.closed || s.state.CKr == nil {
+		return nil
+	}
+	e, ok := s.rawStore().(KeyExporter)
+	if !ok {
+		return nil
+	}
+	keys, err := e.ExportKeys()
+	if err != nil {
+		return nil
+	}
+	var gaps []int
+	for _, k := range keys {
+		if k.Nr < s.state.Nr && k.PublicKey.Equal(s.state.DHr) {
+			gaps = append(gaps, k.Nr)
+		}
+		wipe(k.Key)
+	}
+	slices.Sort(gaps)
+	return gaps
+}
+
+// Migrate re-encrypts the session's skipped message keys and
+// state under a new key-encryption key.
+//
+// The session's store must be an *EncryptedStore whose inner
+// Store implements KeyExporter. The keys are migrated with
+// EncryptedStore.Migrate and then the state is saved under the
+// new KEK. If saving the state fails, the keys are restored
+// under the old KEK.
+func (s *Session) Migrate(newKEK []byte) error {
+	if s.closed {
+		return ErrClosed
+	}
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	e, ok := s.rawStore().(*EncryptedStore)
+	if !ok {
+		return errors.New("dr: store is not an EncryptedStore")
+	}
+	undo, err := e.migrate(newKEK)
+	if err != nil {
+		return storeError(err)
+	}
+	tmp := s.state.Clone()
+	if err := s.save(context.Background(), tmp); err != nil {
+		tmp.wipe()
+		if uerr := undo(); uerr != nil {
+			return errors.Join(err, storeError(uerr))
+		}
+		return err
+	}
+	s.state.wipe()
+	s.state = tmp
+	return nil
+}
+
+// RatchetName returns the name of the session's Ratchet.
+//
+// See Ratchet.Name.
+func (s *Session) RatchetName() string {
+	return s.r.Name()
+}
+
+// SealWithKey is like Seal, but also returns a copy of the
+// message key used to encrypt the message.
+//
+// WARNING: this defeats forward secrecy for the message. Anybody
+// who obtains the returned key can decrypt the message, no matter
+// how much the session has advanced since, so the key must be
+// protected at least as well as the plaintext. It is intended for
+// deployments that are legally required to escrow keys.
+//
+// The key is used with the Ratchet's Open method:
+//
+//    r.Open(mk, msg.Ciphertext, r.Concat(additionalData, msg.Header))
+//
+// That only holds if the session was created with
+// WithAlgorithmBinding(false) and none of the other options that
+// change what is authenticated. Otherwise, they apply to the
+// message as well, so the additional data must be reproduced
+// exactly as Open builds it:
+//
+//   - The Ratchet's name and the values set by WithTranscript
+//     and WithSessionBinding are prepended, in that order. Unless
+//     all three are unused, each is prepended, even if empty. See
+//     WithAlgorithmBinding.
+//   - WithCompression inserts the uncompressed length between
+//     those and additionalData and also prepends it to the
+//     ciphertext. The opened plaintext must be decompressed. See
+//     WithCompression.
+//
+// If the Ratchet was created with WithNonceCounter, use
+// AppendOpenCounter with msg.Header.N instead of Open. Otherwise,
+// opening the message fails with an authentication error.
+//
+// SealWithKey returns an error unless the session was created
+// with WithKeyExport(true).
+func (s *Session) SealWithKey(plaintext, additionalData []byte) (Message, MessageKey, error) {
+	if !s.keyExport {
+		return Message{}, nil, errors.New("dr: key export is not enabled")
+	}
+	mk, h, err := s.next(context.Background())
+	if err != nil {
+		return Message{}, nil, err
+	}
+	defer wipe(mk)
+	ciphertext := s.sealMessage(nil, mk, h, plaintext, additionalData)
+	msg := Message{Header: h, Ciphertext: ciphertext}
+	return msg, append(MessageKey(nil), mk...), nil
+}
+
+// SealTo encrypts and authenticates plaintext, authenticates
+// additionalData, appends the ciphertext to dst, and returns the
+// updated slice along with the message header.
+//
+// To reuse plaintext's storage for the ciphertext, use
+// plaintext[:0] as dst. Otherwise, the remaining capacity of dst
+// must not overlap plaintext.
+//
+// If the Ratchet implements AppendRatchet the ciphertext is
+// written directly into dst.
+func (s *Session) SealTo(dst, plaintext, additionalData []byte) ([]byte, Header, error) {
+	return s.sealTo(context.Background(), dst, plaintext, additionalData)
+}
+
+func (s *Session) sealTo(ctx context.Context, dst, plaintext, additionalData []byte) ([]byte, Header, error) {
+	mk, h, err := s.next(ctx)
+	if err != nil {
+		return nil, Header{}, err
+	}
+	return s.sealMessage(dst, mk, h, plaintext, additionalData), h, nil
+}
+
+// next advances the sending chain and returns the message key
+// and header for the next message.
+func (s *Session) next(ctx context.Context) (MessageKey, Header, error) {
+	if s.closed {
+		return nil, Header{}, ErrClosed
+	}
+	if s.readOnly {
+		return nil, Header{}, ErrReadOnly
+	}
+	state := s.state
+
+	cks, mk := s.r.KDFck(state.CKs)
+	h := s.r.Header(state.DHs, state.PN, state.Ns)
+	h.KEMCiphertext = append([]byte(nil), state.CTs...)
+
+	if s.saveEvery > 1 {
+		// See WithSaveEvery.
+		if state.Ns >= s.sendLease {
+			if err := s.bestEffort(s.saveLease(ctx)); err != nil {
+				wipe(cks)
+				wipe(mk)
+				return nil, Header{}, err
+			}
+		}
+		wipe(state.CKs)
+		state.CKs = cks
+		state.Ns++
+		return mk, h, nil
+	}
+
+	// Save the advanced state before returning the message key
+	// so that a session resumed from the store never reuses it.
+	ck := state.CKs
+	state.CKs = cks
+	state.Ns++
+	if err := s.bestEffort(s.save(ctx, state)); err != nil {
+		state.CKs = ck
+		state.Ns--
+		wipe(cks)
+		wipe(mk)
+		return nil, Header{}, err
+	}
+	wipe(ck)
+	return mk, h, nil
+}
+
+// saveLease saves a copy of the state whose sending chain is
+// advanced saveEvery messages ahead, so that the next saveEvery
+// calls to Seal do not need to save the state.
+func (s *Session) saveLease(ctx context.Context) error {
+	leased := s.state.Clone()
+	defer leased.wipe()
+	for i := 0; i < s.saveEvery; i++ {
+		ck, mk := s.r.KDFck(leased.CKs)
+		wipe(mk)
+		wipe(leased.CKs)
+		leased.CKs = ck
+	}
+	leased.Ns += s.saveEvery
+	if err := s.save(ctx, leased); err != nil {
+		return err
+	}
+	s.state.Epoch = leased.Epoch
+	return nil
+}
+
+// save increments the state's epoch and saves it.
+//
+// The epoch is restored if the store returns an error.
+func (s *Session) save(ctx context.Context, state *State) error {
+	state.Epoch++
+	if err := s.store.SaveContext(ctx, state); err != nil {
+		state.Epoch--
+		if s.logger != nil {
+			s.logger.Debug("dr: unable to save state", "epoch", state.Epoch+1, "err", err)
+		}
+		return storeError(err)
+	}
+	s.unsaved = 0
+	s.sendLease = state.Ns
+	return nil
+}
+
+// saveOpened saves the state after a message has been opened,
+// unless WithSaveEvery allows the save to be deferred.
+//
+// stepped reports whether opening the message performed a
+// Diffie-Hellman ratchet step, which is always saved.
+func (s *Session) saveOpened(ctx context.Context, state *State, stepped bool) error {
+	if s.saveEvery > 1 && !stepped && s.unsaved+1 < s.saveEvery {
+		s.unsaved++
+		return nil
+	}
+	return s.bestEffort(s.save(ctx, state))
+}
+
+// bestEffort returns err, which was returned by save, unless
+// WithStoreErrorPolicy allows the session to continue without
+// saving. In that case, it reports err to the OnError hook and
+// marks the state as unsaved so that Flush retries the save.
+func (s *Session) bestEffort(err error) error {
+	if err == nil ||
+		s.storeErrorPolicy != StoreErrorBestEffort ||
+		errors.Is(err, ErrStaleState) {
+		return err
+	}
+	s.hooks.error(err)
+	s.unsaved++
+	if s.logger != nil {
+		s.logger.Debug("dr: continuing without saving state", "unsaved", s.unsaved)
+	}
+	return nil
+}
+
+// Flush saves the session's state if any opened messages have
+// not yet been saved because of WithSaveEvery, or if a save
+// failed and WithStoreErrorPolicy(StoreErrorBestEffort) is used.
+func (s *Session) Flush(ctx context.Context) error {
+	if s.closed {
+		return ErrClosed
+	}
+	if s.unsaved == 0 || s.readOnly {
+		return nil
+	}
+	return s.save(ctx, s.state)
+}
+
+// Open decrypts and authenticates ciphertext, authenticates
+// additionalData, and returns the resulting plaintext.
+//
+// Messages that cannot be authenticated, for example because
+// they were tampered with, are rejected with an error wrapping
+// ErrDecryptFailed. Malformed messages are rejected with an error
+// wrapping ErrInvalidHeader or ErrInvalidMessage before any keys
+// are derived.
+//
+// Open is shorthand for OpenContext with context.Background.
+func (s *Session) Open(msg Message, additionalData []byte) ([]byte, error) {
+	return s.OpenContext(context.Background(), msg, additionalData)
+}
+
+// OpenContext decrypts and authenticates ciphertext,
+// authenticates additionalData, and returns the resulting
+// plaintext.
+//
+// The context is passed to the underlying store.
+func (s *Session) OpenContext(ctx context.Context, msg Message, additionalData []byte) ([]byte, error) {
+	return s.openTo(ctx, nil, msg, additionalData)
+}
+
+// OpenTo decrypts and authenticates the message, authenticates
+// additionalData, appends the plaintext to dst, and returns the
+// updated slice.
+//
+// To reuse the ciphertext's storage for the plaintext, use
+// msg.Ciphertext[:0] as dst. Otherwise, the remaining capacity
+// of dst must not overlap the ciphertext.
+//
+// If the Ratchet implements AppendRatchet the plaintext is
+// written directly into dst.
+func (s *Session) OpenTo(dst []byte, msg Message, additionalData []byte) ([]byte, error) {
+	return s.openTo(context.Background(), dst, msg, additionalData)
+}
+
+// OpenBytes is like Open, but accepts a message encoded by
+// Message.MarshalBinary.
+//
+// The header is checked against the Ratchet like DecodeHeader
+// before the message is opened. Malformed messages are rejected
+// like UnmarshalBinary.
+//
+// OpenBytes opens messages sealed with SealBytes.
+func (s *Session) OpenBytes(data, additionalData []byte) ([]byte, error) {
+	h, ciphertext, err := splitMessage(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkHeader(s.r, h); err != nil {
+		return nil, err
+	}
+	msg := Message{Header: h, Ciphertext: ciphertext}
+	return s.openTo(context.Background(), nil, msg, additionalData)
+}
+
+// SealAD is like Seal, but reads the additional data from ad
+// instead of requiring it to be in memory.
+//
+// AEADs authenticate additional data in one piece, so SealAD
+// hashes ad and authenticates the digest instead. The digest is
+//
+//    H("dr additional data" || ad)
+//
+// where H is the hash function used by the Ratchet's KDFs, or
+// SHA-256 for Ratchets outside of this package. The message must
+// be opened with OpenAD or, equivalently, by passing the digest
+// to Open.
+func (s *Session) SealAD(plaintext []byte, ad io.WriterTo) (Message, error) {
+	digest, err := digestAD(s.r, ad)
+	if err != nil {
+		return Message{}, err
+	}
+	return s.Seal(plaintext, digest)
+}
+
+// OpenAD is like Open, but reads the additional data from ad
+// instead of requiring it to be in memory.
+//
+// It opens messages sealed with SealAD.
+func (s *Session) OpenAD(msg Message, ad io.WriterTo) ([]byte, error) {
+	digest, err := digestAD(s.r, ad)
+	if err != nil {
+		return nil, err
+	}
+	return s.Open(msg, digest)
+}
+
+// hasher is implemented by the built-in Ratchets to report the
+// hash function used by their KDFs.
+type hasher interface {
+	// newHash returns a new instance of the hash.
+	newHash() hash.Hash
+}
+
+// adDigestLabel domain separates the digest computed by
+// digestAD.
+const adDigestLabel = "dr additional data"
+
+// digestAD hashes additional data for SealAD and OpenAD.
+func digestAD(r Ratchet, ad io.WriterTo) ([]byte, error) {
+	var h hash.Hash
+	if v, ok := r.(hasher); ok {
+		h = v.newHash()
+	} else {
+		h = sha256.New()
+	}
+	h.Write([]byte(adDigestLabel))
+	if _, err := ad.WriteTo(h); err != nil {
+		return nil, fmt.Errorf("dr: unable to read additional data: %w", err)
+	}
+	return h.Sum(nil), nil
+}
+
+// TrialOpen is like Open, but does not modify the session.
+//
+// The message is decrypted with a copy of the session state that
+// is discarded afterward, so the state is not saved, skipped
+// message keys are neither stored nor consumed, and hooks are not
+// called. This makes it possible to check which messages in a
+// batch can be opened before opening them in order with Open.
+//
+// TrialOpen reads skipped message keys from the store, but never
+// writes to it.
+func (s *Session) TrialOpen(msg Message, additionalData []byte) ([]byte, error) {
+	t := *s
+	t.state = s.state.Clone()
+	t.store = trialStore{s.store}
+	t.hooks = Hooks{}
+	plaintext, err := t.openTo(context.Background(), nil, msg, additionalData)
+	t.state.wipe()
+	return plaintext, err
+}
+
+// trialStore is a StoreContext that reads skipped message keys
+// from the underlying store but discards every write.
+type trialStore struct {
+	StoreContext
+}
+
+func (trialStore) SaveContext(_ context.Context, _ *State) error {
+	return nil
+}
+
+func (trialStore) StoreKeyContext(_ context.Context, _ int, _ PublicKey, key MessageKey) error {
+	wipe(key)
+	return nil
+}
+
+func (trialStore) DeleteKeyContext(_ context.Context, _ int, _ PublicKey) error {
+	return nil
 }
 
-// defaultMaxSkip is the default maximum number of messages that
-// can be skipped.
-const defaultMaxSkip = 1000
-
-// Option configures a Session.
-type Option func(*Session)
-
-// WithStore configures some backing store for saving state and
-// skipped messages.
-//
-// Saving session state allows the session to be paused and
-// resumed at a later time.
+// CanOpen reports whether the message could be opened, without
+// modifying the session.
 //
-// Messages are skipped and queued when they arrive out of order.
-//
-// By default, skipped messages are stored in memory and sessions
-// are ephemeral.
-func WithStore(t Store) Option {
-	return func(s *Session) {
-		s.store = t
+// It reports true if the store has a skipped message key for
+// the header or if the message is ahead of the receiving chain
+// by no more than the skip limit. It does no cryptographic work,
+// so Open can still fail, for example if the message was
+// tampered with.
+func (s *Session) CanOpen(msg Message) bool {
+	if s.closed {
+		return false
 	}
-}
-
-// Resume continues an existing Session.
-func Resume(r Ratchet, state *State, opts ...Option) (*Session, error) {
-	s := &Session{
-		r:     r,
-		state: state,
+	if s.maxMessageSize > 0 &&
+		len(msg.Ciphertext)-s.r.Overhead() > s.maxMessageSize {
+		return false
 	}
-	for _, fn := range opts {
-		fn(s)
+	h := msg.Header
+	if checkHeader(s.r, h) != nil {
+		return false
 	}
-	if s.store == nil {
-		s.store = &memory{maxSkip: defaultMaxSkip}
+	if s.replayWindow > 0 && s.state.accepted(h.PublicKey, h.N) {
+		return false
 	}
-	return s, nil
+	_, err := s.store.LoadKeyContext(context.Background(), h.N, h.PublicKey)
+	if err == nil {
+		return true
+	}
+	stepped := !s.state.DHr.Equal(h.PublicKey)
+	if !stepped && (s.state.CKr == nil || h.N < s.state.Nr) {
+		// Either there is no receiving chain or the message
+		// was already opened (or its key was discarded).
+		return false
+	}
+	return s.state.skipCount(h, stepped) <= s.maxSkip()
 }
 
-// NewSend creates a new Session for initiating communication
-// with some peer.
+// OpenSkipped is like Open, but only opens messages whose keys
+// are in the store.
 //
-// The shared key SK must be negotiated with the peer ahead of
-// time.
-func NewSend(r Ratchet, SK []byte, peer PublicKey, opts ...Option) (*Session, error) {
-	s := &Session{
-		r: r,
+// It looks up the message key for the header's (N, PublicKey)
+// tuple and returns ErrNotFound if there is none. It never
+// derives keys, so the session state is neither modified nor
+// saved. The key is deleted after the message is successfully
+// opened.
+//
+// OpenSkipped is useful for opening archived messages without
+// any risk of advancing the ratchet.
+func (s *Session) OpenSkipped(msg Message, additionalData []byte) ([]byte, error) {
+	if s.closed {
+		return nil, ErrClosed
 	}
-	for _, fn := range opts {
-		fn(s)
+	if err := s.checkCiphertext(msg.Ciphertext); err != nil {
+		return nil, err
 	}
-	if s.store == nil {
-		s.store = &memory{maxSkip: defaultMaxSkip}
+	h := msg.Header
+	if err := checkHeader(s.r, h); err != nil {
+		return nil, err
 	}
-	priv, err := r.Generate(rand.Reader)
+	ctx := context.Background()
+	mk, err := s.store.LoadKeyContext(ctx, h.N, h.PublicKey)
 	if err != nil {
-		return nil, fmt.Errorf("NewSend: Generate failed: %w", err)
+		if errors.Is(err, ErrNotFound) {
+			return nil, err
+		}
+		return nil, storeError(err)
 	}
-	dh, err := r.DH(priv, peer)
+	plaintext, err := s.openMessage(nil, mk, h, msg.Ciphertext, additionalData)
 	if err != nil {
-		return nil, fmt.Errorf("NewSend: DH failed: %w", err)
+		return nil, err
 	}
-	rk, ck := r.KDFrk(SK, dh)
-	s.state = &State{
-		DHs: priv,
-		DHr: peer,
-		RK:  rk,
-		CKs: ck,
+	if err := s.store.DeleteKeyContext(ctx, h.N, h.PublicKey); err != nil {
+		wipe(plaintext)
+		return nil, storeError(err)
 	}
-	return s, nil
+	s.hooks.skippedKeyUsed(h.N)
+	return plaintext, nil
 }
 
-// NewRecv creates a new Session for receiving communication
-// initiated by some peer.
-//
-// The shared key SK must be negotiated with the peer ahead of
-// time.
-func NewRecv(r Ratchet, SK []byte, priv PrivateKey, opts ...Option) (*Session, error) {
-	s := &Session{
-		r: r,
-	}
-	for _, fn := range opts {
-		fn(s)
-	}
-	if s.store == nil {
-		s.store = &memory{maxSkip: defaultMaxSkip}
+func (s *Session) openTo(ctx context.Context, dst []byte, msg Message, additionalData []byte) ([]byte, error) {
+	if err := s.checkCiphertext(msg.Ciphertext); err != nil {
+		return nil, err
 	}
-	s.state = &State{
-		DHs: priv,
-		RK:  SK,
+	var plaintext []byte
+	err := s.open(ctx, msg.Header, func(mk MessageKey) error {
+		var err error
+		plaintext, err = s.openMessage(dst, mk, msg.Header,
+			msg.Ciphertext, additionalData)
+		return err
+	})
+	if err != nil {
+		if plaintext != nil {
+			wipe(plaintext[len(dst):])
+		}
+		return nil, err
 	}
-	return s, nil
+	return plaintext, nil
 }
 
-// Message is a messages encrypted with the Double Ratchet
-// Algorithm.
-type Message struct {
-	Header     Header
-	Ciphertext []byte
+// checkCiphertext checks the length of a message's ciphertext
+// before it is opened.
+func (s *Session) checkCiphertext(ciphertext []byte) error {
+	if len(ciphertext) < s.r.Overhead() {
+		return fmt.Errorf("%w: ciphertext length %d", ErrInvalidMessage, len(ciphertext))
+	}
+	if s.maxMessageSize > 0 &&
+		len(ciphertext)-s.r.Overhead() > s.maxMessageSize {
+		return ErrMessageTooLarge
+	}
+	return nil
 }
 
-// Seal encrypts and authenticates plaintext, authenticates
-// additionalData, and returns the resulting message.
-func (s *Session) Seal(plaintext, additionalData []byte) (Message, error) {
-	state := s.state
+// open finds or derives the message key for the header and
+// calls fn with it.
+//
+// The session state and skipped message keys are only persisted if
+// fn succeeds, so fn must authenticate the message.
+func (s *Session) open(ctx context.Context, h Header, fn func(MessageKey) error) (err error) {
+	defer func() {
+		if err != nil {
+			s.hooks.error(err)
+			if s.logger != nil {
+				s.logger.Debug("dr: unable to open message", "header", h, "err", err)
+			}
+		}
+	}()
 
-	cks, mk := s.r.KDFck(state.CKs)
-	h := s.r.Header(state.DHs, state.PN, state.Ns)
-	additionalData = s.r.Concat(additionalData, h)
-	msg := Message{
-		Header:     h,
-		Ciphertext: s.r.Seal(mk, plaintext, additionalData),
+	if s.closed {
+		return ErrClosed
 	}
-	if err := s.store.Save(s.state); err != nil {
-		return Message{}, err
+	if err := checkHeader(s.r, h); err != nil {
+		return err
 	}
-	state.CKs = cks
-	state.Ns++
-	return msg, nil
-}
 
-// Open decrypts and authenticates ciphertext, authenticates
-// additionalData, and returns the resulting plaintext.
-func (s *Session) Open(msg Message, additionalData []byte) ([]byte, error) {
-	h := msg.Header
+	if s.replayWindow > 0 && s.state.accepted(h.PublicKey, h.N) {
+		return ErrReplay
+	}
 
-	switch mk, err := s.store.LoadKey(h.N, h.PublicKey); {
+	// Opening a skipped message is faster than opening the next
+	// message in the receiving chain since the message key does
+	// not have to be derived. This reveals little: whether a
+	// message is late is already evident from its header, which
+	// is not encrypted. WithUniformTiming closes the gap that is
+	// easy to close by deriving (and discarding) a message key
+	// for skipped messages, too. The rest of the exposure is
+	// inherent:
+	//
+	//    - the store's latency differs between a hit and a miss,
+	//      and between DeleteKey and the work done on a miss
+	//    - a miss that skips messages or performs a DH ratchet
+	//      step does extra work proportional to the header
+	//    - WithSaveEvery and WithReplayWindow change when the
+	//      state is saved
+	//
+	// Stores that need to hide lookups must do so themselves.
+	switch mk, err := s.store.LoadKeyContext(ctx, h.N, h.PublicKey); {
 	case err == nil:
-		plaintext, err := s.r.Open(mk,
-			msg.Ciphertext, s.r.Concat(additionalData, h))
-		if err != nil {
-			return nil, err
+		if s.uniformTiming && s.state.CKr != nil {
+			ck, dummy := s.r.KDFck(s.state.CKr)
+			wipe(ck)
+			wipe(dummy)
 		}
-		err = s.store.DeleteKey(h.N, h.PublicKey)
-		if err != nil {
-			wipe(plaintext)
-			return nil, err
+		if err := fn(mk); err != nil {
+			return err
+		}
+		if s.replayWindow > 0 {
+			tmp := s.state.Clone()
+			tmp.accept(h.PublicKey, h.N, s.replayWindow)
+			if err := s.saveOpened(ctx, tmp, false); err != nil {
+				return err
+			}
+			s.state.wipe()
+			s.state = tmp
+		}
+		if err := s.store.DeleteKeyContext(ctx, h.N, h.PublicKey); err != nil {
+			return storeError(err)
 		}
-		return plaintext, nil
+		s.hooks.skippedKeyUsed(h.N)
+		if s.logger != nil {
+			s.logger.Debug("dr: used skipped message key", "header", h)
+		}
+		return nil
 	case errors.Is(err, ErrNotFound):
 		// OK
 	default:
-		return nil, err
+		return storeError(err)
 	}
 
 	// Create a temporary state so that failures aren't
 	// persisted.
 	tmp := s.state.Clone()
+	// Likewise, buffer skipped message keys until the message
+	// has been authenticated so that a forged message does not
+	// leave keys behind in the store.
+	pending := &pendingStore{StoreContext: s.store}
+	defer pending.discard()
 
-	if !hmac.Equal(h.PublicKey, tmp.DHr) {
-		if err := tmp.skip(s.store, s.r, h.PN); err != nil {
-			return nil, err
+	var (
+		prev    PublicKey
+		skipped int
+	)
+	// Both keys are public values, so the timing of this
+	// comparison is not sensitive. Equal is used for
+	// consistency, not secrecy.
+	stepped := !tmp.DHr.Equal(h.PublicKey)
+	if stepped {
+		if s.peerKeyValidator != nil {
+			if err := s.peerKeyValidator(h.PublicKey); err != nil {
+				return err
+			}
+		}
+		if err := checkPeerKey(s.r, tmp.DHs, h.PublicKey); err != nil {
+			return err
+		}
+	}
+	if n := tmp.skipCount(h, stepped); n > s.maxSkip() {
+		// Reject before doing any KDF work so that a forged
+		// header cannot burn CPU.
+		if s.logger != nil {
+			s.logger.Debug("dr: too many skipped messages", "header", h,
+				"nr", tmp.Nr, "skip", n, "limit", s.maxSkip())
 		}
-		err := tmp.ratchet(s.r, h.PublicKey)
+		return ErrTooManySkipped
+	} else if l, ok := s.rawStore().(KeyLimiter); ok && n > 0 {
+		// Likewise if the Store does not have room for the
+		// skipped keys, since StoreKey would otherwise only fail
+		// after every key has been derived.
+		rem, err := l.RemainingKeys()
 		if err != nil {
-			return nil, err
+			return storeError(err)
+		}
+		if n > rem {
+			if s.logger != nil {
+				s.logger.Debug("dr: store is full", "header", h,
+					"nr", tmp.Nr, "skip", n, "remaining", rem)
+			}
+			return ErrTooManySkipped
 		}
 	}
-	if err := tmp.skip(s.store, s.r, h.N); err != nil {
-		return nil, err
+	if stepped {
+		prev = append(prev, tmp.DHr...)
+		n, err := tmp.skip(ctx, pending, s.r, h.PN)
+		if err != nil {
+			return err
+		}
+		skipped += n
+		var dh DHFunc
+		if tmp.DHr == nil {
+			// The first step uses the key pair passed to
+			// NewRecv.
+			dh = s.dh
+		}
+		if err := tmp.ratchet(s.r, s.random(), h, dh); err != nil {
+			return err
+		}
+	}
+	n, err := tmp.skip(ctx, pending, s.r, h.N)
+	if err != nil {
+		return err
+	}
+	skipped += n
+	if tmp.CKr == nil {
+		// The header's public key matched our nil DHr, so there
+		// is no receiving chain to advance.
+		return fmt.Errorf("%w: public key", ErrInvalidHeader)
 	}
 
 	var mk MessageKey
 	tmp.CKr, mk = s.r.KDFck(tmp.CKr)
 	tmp.Nr++
-	plaintext, err := s.r.Open(mk,
-		msg.Ciphertext, s.r.Concat(additionalData, h))
-	if err != nil {
-		return nil, err
+	if err := fn(mk); err != nil {
+		return err
 	}
-	if err := s.store.Save(tmp); err != nil {
-		wipe(plaintext)
-		return nil, err
+	if err := pending.flush(ctx); err != nil {
+		return err
+	}
+	if s.replayWindow > 0 {
+		tmp.accept(h.PublicKey, h.N, s.replayWindow)
+	}
+	if err := s.saveOpened(ctx, tmp, stepped); err != nil {
+		return err
 	}
 	s.state.wipe()
 	s.state = tmp
-	return plaintext, nil
+	if p, ok := s.rawStore().(KeyPruner); ok && stepped && !s.keepOldChains {
+		// Pruning is best effort: the message has already been
+		// accepted, and leftover keys are harmless.
+		_ = p.PruneKeys(tmp.DHr, prev)
+	}
+	if stepped {
+		s.hooks.ratchet(append(PublicKey(nil), tmp.DHr...))
+		if s.logger != nil {
+			s.logger.Debug("dr: ratchet step", "header", h)
+		}
+	}
+	if skipped > 0 {
+		s.hooks.skip(skipped)
+		if s.logger != nil {
+			s.logger.Debug("dr: skipped message keys", "header", h, "count", skipped)
+		}
+	}
+	return nil
+}
+
+// Rekey mixes extraEntropy into the session's keys. It is meant
+// to be used after a suspected compromise to inject fresh
+// entropy without tearing down the session.
+//
+// Both parties must call Rekey with the same entropy at the same
+// point in the conversation: after each has opened every message
+// the other sent and before either sends another message. The
+// entropy must be agreed upon out of band (for example, through
+// a fresh key exchange) and must be secret.
+//
+// The entropy is mixed into both chain keys immediately and into
+// the root key at the next Diffie-Hellman ratchet step. (The
+// parties' root keys are only equal in the middle of a ratchet
+// step, so it cannot be mixed into the root key right away.)
+//
+// Rekey returns an error if the session has not yet received a
+// message from the peer, or if the entropy from a previous call
+// has not yet been mixed into the root key.
+func (s *Session) Rekey(extraEntropy []byte) error {
+	if s.closed {
+		return ErrClosed
+	}
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	if len(extraEntropy) == 0 {
+		return errors.New("dr: empty rekey entropy")
+	}
+	if s.state.CKs == nil || s.state.CKr == nil {
+		return errors.New("dr: cannot rekey before both chains exist")
+	}
+	if s.state.PendingRekey != nil {
+		return errors.New("dr: previous rekey is still pending")
+	}
+	tmp := s.state.Clone()
+	tmp.rekey(s.r, extraEntropy)
+	if err := s.save(context.Background(), tmp); err != nil {
+		tmp.wipe()
+		return err
+	}
+	s.state.wipe()
+	s.state = tmp
+	return nil
+}
+
+const (
+	// rekeyRootLabel domain separates the Diffie-Hellman output
+	// mixed with Rekey entropy.
+	rekeyRootLabel = "dr rekey root"
+	// rekeyChainLabel domain separates the input to KDFrk used to
+	// mix Rekey entropy into a chain key.
+	rekeyChainLabel = "dr rekey chain"
+)
+
+// rekey implements Session.Rekey.
+//
+// Between ratchet steps, the party that last received a new
+// ratchet public key is "ahead": it has derived a sending chain
+// that the peer only derives once it receives the first message
+// on that chain. The ahead party's receiving chain is the other
+// party's sending chain, and the other party's receiving chain
+// is no longer used. So:
+//
+//   - Both parties mix the entropy into the chain they share
+//     now.
+//   - The ahead party mixes the entropy into its sending chain
+//     now, and the other party mixes it into the same chain
+//     when it derives it.
+//   - Both parties mix the entropy into the first root key step
+//     that neither has performed yet: the ahead party's next
+//     receiving step, which is the other party's next sending
+//     step.
+//
+// See State.ratchet for the last two.
+func (s *State) rekey(r Ratchet, entropy []byte) {
+	// The ahead party has not sent anything on its current
+	// sending chain, and the other party must have since it
+	// sent the ahead party's new ratchet public key.
+	s.RekeyAhead = s.Ns == 0
+	s.PendingRekey = append([]byte(nil), entropy...)
+	s.CKs = rekeyChain(r, s.CKs, entropy)
+	if s.RekeyAhead {
+		s.CKr = rekeyChain(r, s.CKr, entropy)
+	}
+}
+
+// rekeyChain mixes entropy into the chain key and wipes the old
+// chain key.
+func rekeyChain(r Ratchet, ck ChainKey, entropy []byte) ChainKey {
+	in := make([]byte, 0, len(rekeyChainLabel)+len(entropy))
+	in = append(in, rekeyChainLabel...)
+	in = append(in, entropy...)
+	rk, next := r.KDFrk(RootKey(ck), in)
+	wipe(rk)
+	wipe(in)
+	wipe(ck)
+	return next
+}
+
+// rekeySecret mixes entropy into the Diffie-Hellman (or KEM)
+// output of a ratchet step and wipes the old output.
+func rekeySecret(dh, entropy []byte) []byte {
+	out := make([]byte, 0, len(dh)+len(rekeyRootLabel)+len(entropy))
+	out = append(out, dh...)
+	out = append(out, rekeyRootLabel...)
+	out = append(out, entropy...)
+	wipe(dh)
+	return out
+}
+
+// pendingStore is a StoreContext that buffers skipped message
+// keys until flush is called.
+type pendingStore struct {
+	StoreContext
+	keys []pendingKey
+}
+
+// pendingKey is a skipped message key buffered by pendingStore.
+type pendingKey struct {
+	Nr  int
+	pub PublicKey
+	key MessageKey
+}
+
+func (p *pendingStore) StoreKeyContext(_ context.Context, Nr int, pub PublicKey, key MessageKey) error {
+	p.keys = append(p.keys, pendingKey{
+		Nr:  Nr,
+		pub: append(PublicKey(nil), pub...),
+		key: key,
+	})
+	return nil
+}
+
+// flush writes the buffered keys to the underlying store.
+//
+// Keys that were already written are not removed if a write
+// fails. They are harmless since the message that produced them
+// was authenticated.
+func (p *pendingStore) flush(ctx context.Context) error {
+	for len(p.keys) > 0 {
+		k := p.keys[0]
+		p.keys = p.keys[1:]
+		if err := p.StoreContext.StoreKeyContext(ctx, k.Nr, k.pub, k.key); err != nil {
+			wipe(k.key)
+			return storeError(err)
+		}
+	}
+	return nil
+}
+
+// discard wipes any keys that have not been flushed.
+func (p *pendingStore) discard() {
+	for _, k := range p.keys {
+		wipe(k.key)
+	}
+	p.keys = nil
+}
+
+// Close wipes the session's key material and purges any skipped
+// message keys from the store if it implements KeyPurger.
+//
+// After Close returns, Seal and Open return ErrClosed.
+func (s *Session) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	s.state.wipe()
+
+	if p, ok := s.rawStore().(KeyPurger); ok {
+		return p.PurgeKeys()
+	}
+	return nil
+}
+
+// Destroy closes the session and removes everything its store
+// holds for it, including the saved state.
+//
+// The store must implement Purger. Otherwise, Destroy closes the
+// session and returns an error because the saved state could not
+// be removed.
+func (s *Session) Destroy() error {
+	if err := s.Close(); err != nil {
+		return err
+	}
+	p, ok := s.rawStore().(Purger)
+	if !ok {
+		return errors.New("dr: store does not implement Purger")
+	}
+	return p.Purge()
+}
+
+// rawStore returns the store provided to WithStore or
+// WithStoreContext so that it can be checked for optional
+// interfaces.
+func (s *Session) rawStore() interface{} {
+	if sc, ok := s.store.(storeContext); ok {
+		return sc.Store
+	}
+	return s.store
 }
 
 // skip marks each message in [state.Nr, until) as skipped.
-func (s *State) skip(store Store, r Ratchet, until int) error {
+func (s *State) skip(ctx context.Context, store StoreContext, r Ratchet, until int) (int, error) {
 	if s.CKr == nil {
-		return nil
+		// There is no receiving chain yet, as with the first
+		// message received by NewRecv. Even if the header's PN
+		// is non-zero, none of those messages could have been
+		// encrypted with keys derived from this state.
+		return 0, nil
 	}
+	var n int
 	for s.Nr < until {
 		var mk MessageKey
 		s.CKr, mk = r.KDFck(s.CKr)
-		err := store.StoreKey(s.Nr, s.DHr, mk)
+		err := store.StoreKeyContext(ctx, s.Nr, s.DHr, mk)
 		if err != nil {
-			return err
+			return n, storeError(err)
 		}
 		s.Nr++
+		n++
+	}
+	return n, nil
+}
+
+// checkPeerKey rejects degenerate peer ratchet public keys: our
+// own public key reflected back at us and the all-zero key.
+//
+// Invalid points are rejected by the Ratchet itself.
+func checkPeerKey(r Ratchet, priv PrivateKey, peer PublicKey) error {
+	zero := true
+	for _, c := range peer {
+		zero = zero && c == 0
+	}
+	if zero {
+		return ErrInvalidPeerKey
+	}
+	if r.Public(priv).Equal(peer) {
+		return ErrInvalidPeerKey
 	}
 	return nil
 }
 
-// ratchet advances the state.
-func (s *State) ratchet(r Ratchet, pub PublicKey) error {
+// skipCount returns the number of message keys that must be
+// skipped to open a message with the header.
+func (s *State) skipCount(h Header, stepped bool) int {
+	if !stepped {
+		return max(h.N-s.Nr, 0)
+	}
+	var n int
+	if s.CKr != nil {
+		n = max(h.PN-s.Nr, 0)
+	}
+	// Guard against overflow; both values are non-negative.
+	if h.N > math.MaxInt-n {
+		return math.MaxInt
+	}
+	return n + h.N
+}
+
+// ratchet advances the state, generating the new key pair with
+// rand.
+//
+// If ownDH is not nil, it computes the Diffie-Hellman value for
+// the current key pair instead of r. See WithDH.
+func (s *State) ratchet(r Ratchet, rand io.Reader, h Header, ownDH DHFunc) error {
+	if _, ok := r.(KEMRatchet); ok && ownDH != nil {
+		return errors.New("dr: WithDH does not support KEMRatchets")
+	}
 	s.PN = s.Ns
 	s.Ns = 0
 	s.Nr = 0
-	s.DHr = pub
+	// Copy the key: the state is wiped when it is replaced, and
+	// the caller still owns the header.
+	s.DHr = append(PublicKey(nil), h.PublicKey...)
 
-	dh, err := r.DH(s.DHs, s.DHr)
+	// Both DH operations below use the peer's new public key, so
+	// decode it once if the Ratchet supports doing so.
+	var peerDH func(PrivateKey) ([]byte, error)
+	if p, ok := r.(peerDHer); ok {
+		fn, err := p.peerDH(s.DHr)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidPeerKey, err)
+		}
+		peerDH = fn
+	}
+
+	var dh []byte
+	var err error
+	switch {
+	case ownDH != nil:
+		dh, err = ownDH(s.DHr)
+		if err != nil {
+			err = fmt.Errorf("dr: DH failed: %w", err)
+		}
+	case peerDH != nil:
+		dh, err = peerDH(s.DHs)
+		if err != nil {
+			err = fmt.Errorf("%w: %w", ErrInvalidPeerKey, err)
+		}
+	default:
+		dh, err = recvSecret(r, s.DHs, s.DHr, h.KEMCiphertext)
+	}
 	if err != nil {
 		return err
 	}
+	// See State.rekey.
+	rekey := s.PendingRekey
+	if rekey != nil && s.RekeyAhead {
+		dh = rekeySecret(dh, rekey)
+	}
 	s.RK, s.CKr = r.KDFrk(s.RK, dh)
+	if rekey != nil && !s.RekeyAhead {
+		s.CKr = rekeyChain(r, s.CKr, rekey)
+	}
 
-	s.DHs, err = r.Generate(rand.Reader)
+	s.DHs, err = r.Generate(rand)
 	if err != nil {
 		return err
 	}
-	dh, err = r.DH(s.DHs, s.DHr)
+	if peerDH != nil {
+		dh, err = peerDH(s.DHs)
+	} else {
+		dh, s.CTs, err = sendSecret(r, s.DHs, s.DHr)
+	}
 	if err != nil {
 		return err
 	}
+	if rekey != nil && !s.RekeyAhead {
+		dh = rekeySecret(dh, rekey)
+	}
 	s.RK, s.CKs = r.KDFrk(s.RK, dh)
+	if rekey != nil {
+		wipe(s.PendingRekey)
+		s.PendingRekey = nil
+		s.RekeyAhead = false
+	}
 	return nil
 }
 
-//go:noinline
+// wipe is shorthand for secure.Wipe.
 func wipe(p []byte) {
-	for i := range p {
-		p[i] = 0
-	}
-	runtime.KeepAlive(p)
+	secure.Wipe(p)
 }
@@ -1,13 +1,28 @@
 package dr
 
 import (
+	"bytes"
+	"context"
 	"crypto/elliptic"
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"reflect"
+	"runtime"
+	"slices"
 	"testing"
+	"time"
 
 	mrand "github.com/ericlagergren/saferand"
+	"golang.org/x/crypto/chacha20"
 )
 
 var testCases = []struct {
@@ -17,7 +32,23 @@ var testCases = []struct {
 	{"P-256", func(t *testing.T) Ratchet {
 		return NIST(elliptic.P256(), sha256.New, t.Name())
 	}},
+	{"P-384", func(t *testing.T) Ratchet {
+		return NIST(elliptic.P384(), sha512.New384, t.Name())
+	}},
+	{"P-521", func(t *testing.T) Ratchet {
+		return NIST(elliptic.P521(), sha512.New, t.Name())
+	}},
+	{"P-256-SIV", func(t *testing.T) Ratchet {
+		return NISTSIV(elliptic.P256(), t.Name())
+	}},
 	{"DJB", func(t *testing.T) Ratchet { return DJB(t.Name()) }},
+	{"DJB-KeyedBLAKE2b", func(t *testing.T) Ratchet {
+		return DJB(t.Name(), WithKeyedBLAKE2b())
+	}},
+	{"X448", func(t *testing.T) Ratchet { return X448(t.Name()) }},
+	{"X25519-ML-KEM-768", func(t *testing.T) Ratchet {
+		return X25519MLKEM768(t.Name())
+	}},
 }
 
 // TestAliceBob is a simple positive test that ping-pongs
@@ -182,7 +213,7 @@ func TestResume(t *testing.T) {
 			}
 
 			// Swap and refresh state.
-			rs, ss := send.state, recv.state
+			rs, ss := send.State(), recv.State()
 
 			send, err = Resume(fn(t), ss)
 			if err != nil {
@@ -202,6 +233,57 @@ func TestResume(t *testing.T) {
 	}
 }
 
+// TestResumeInvalidState tests that Resume rejects inconsistent
+// states instead of panicking later.
+func TestResumeInvalidState(t *testing.T) {
+	for _, tc := range testCases {
+		fn := tc.fn
+		t.Run(tc.name, func(t *testing.T) {
+			SK := make([]byte, 32)
+			priv, err := fn(t).Generate(rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			alice, err := NewSend(fn(t), SK, fn(t).Public(priv))
+			if err != nil {
+				t.Fatal(err)
+			}
+			valid := alice.State()
+			if _, err := Resume(fn(t), valid.Clone()); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, bad := range []struct {
+				name string
+				fn   func(*State)
+			}{
+				{"nil RK", func(s *State) { s.RK = nil }},
+				{"short RK", func(s *State) { s.RK = s.RK[:16] }},
+				{"short CKs", func(s *State) { s.CKs = s.CKs[:31] }},
+				{"long CKr", func(s *State) { s.CKr = make(ChainKey, 33) }},
+				{"short DHs", func(s *State) { s.DHs = s.DHs[:len(s.DHs)-1] }},
+				{"nil DHs", func(s *State) { s.DHs = nil }},
+				{"short DHr", func(s *State) { s.DHr = s.DHr[:1] }},
+				{"negative Ns", func(s *State) { s.Ns = -1 }},
+				{"negative Nr", func(s *State) { s.Nr = -1 }},
+				{"negative PN", func(s *State) { s.PN = -1 }},
+				{"negative accepted", func(s *State) {
+					s.Accepted = []MessageID{{PublicKey: s.DHr, N: -1}}
+				}},
+			} {
+				state := valid.Clone()
+				bad.fn(state)
+				if _, err := Resume(fn(t), state); err == nil {
+					t.Fatalf("%s: expected an error", bad.name)
+				}
+			}
+			if _, err := Resume(fn(t), nil); err == nil {
+				t.Fatal("nil state: expected an error")
+			}
+		})
+	}
+}
+
 func TestSendWithRecv(t *testing.T) {
 	for _, tc := range testCases {
 		fn := tc.fn
@@ -225,6 +307,54 @@ func TestSendWithRecv(t *testing.T) {
 	}
 }
 
+// TestKeySize tests that every Ratchet rejects root, chain, and
+// message keys of the wrong size with the same message.
+func TestKeySize(t *testing.T) {
+	panicValue := func(fn func()) (v any) {
+		defer func() {
+			v = recover()
+		}()
+		fn()
+		return nil
+	}
+	for _, tc := range testCases {
+		fn := tc.fn
+		t.Run(tc.name, func(t *testing.T) {
+			r := fn(t)
+			priv, err := r.Generate(rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, n := range []int{0, KeySize - 1, KeySize + 1} {
+				key := make([]byte, n)
+				for _, c := range []struct {
+					name string
+					fn   func()
+				}{
+					{"RootKey", func() { r.KDFrk(key, nil) }},
+					{"ChainKey", func() { r.KDFck(key) }},
+					{"MessageKey", func() { r.Seal(key, nil, nil) }},
+				} {
+					want := fmt.Sprintf("dr: invalid %s size: %d", c.name, n)
+					if got := panicValue(c.fn); got != want {
+						t.Fatalf("%s: expected panic %q, got %v", c.name, want, got)
+					}
+				}
+				want := fmt.Sprintf("dr: invalid MessageKey size: %d", n)
+				if _, err := r.Open(key, make([]byte, 64), nil); err == nil || err.Error() != want {
+					t.Fatalf("Open: expected %q, got %v", want, err)
+				}
+				if _, err := NewSend(r, key, r.Public(priv)); err == nil {
+					t.Fatal("NewSend: expected an error")
+				}
+				if _, err := NewRecv(r, key, priv); err == nil {
+					t.Fatal("NewRecv: expected an error")
+				}
+			}
+		})
+	}
+}
+
 func didPanic(fn func()) (panicked bool) {
 	defer func() {
 		panicked = recover() != nil
@@ -232,3 +362,4977 @@ func didPanic(fn func()) (panicked bool) {
 	fn()
 	return
 }
+
+// TestNISTShortRead tests that Generate returns an error instead
+// of panicking when the reader runs out of entropy.
+func TestNISTShortRead(t *testing.T) {
+	for _, curve := range []elliptic.Curve{
+		elliptic.P256(),
+		elliptic.P384(),
+		elliptic.P521(),
+	} {
+		r := NIST(curve, sha256.New, t.Name())
+		size := (curve.Params().BitSize + 7) / 8
+		for _, n := range []int64{0, 1, int64(size) - 1} {
+			_, err := r.Generate(io.LimitReader(rand.Reader, n))
+			if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Fatalf("%s: %d bytes: expected an EOF error, got %v",
+					curve.Params().Name, n, err)
+			}
+		}
+		_, err := NewSend(r, make([]byte, KeySize), nil,
+			WithRand(io.LimitReader(rand.Reader, 1)))
+		if err == nil {
+			t.Fatalf("%s: expected an error", curve.Params().Name)
+		}
+		// A reader that never produces a valid scalar must not
+		// hang Generate. All ones is larger than the order of
+		// each curve, even after P-521's excess bits are masked.
+		if _, err := r.Generate(constReader(0xff)); err == nil {
+			t.Fatalf("%s: expected an error", curve.Params().Name)
+		}
+		_, err = NewSend(r, make([]byte, KeySize), nil, WithRand(constReader(0xff)))
+		if err == nil {
+			t.Fatalf("%s: expected an error", curve.Params().Name)
+		}
+	}
+}
+
+// constReader is an io.Reader that returns an endless stream of
+// the same byte.
+type constReader byte
+
+func (c constReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte(c)
+	}
+	return len(p), nil
+}
+
+// TestNISTGenerateInvalidScalar tests that Generate gives up with
+// an error instead of looping forever when the reader never
+// produces a valid scalar.
+func TestNISTGenerateInvalidScalar(t *testing.T) {
+	for _, curve := range []elliptic.Curve{
+		elliptic.P256(),
+		elliptic.P384(),
+		elliptic.P521(),
+	} {
+		r := NIST(curve, sha256.New, t.Name())
+		// Zero is never a valid scalar.
+		if _, err := r.Generate(constReader(0)); err == nil {
+			t.Fatalf("%s: expected an error", curve.Params().Name)
+		}
+	}
+}
+
+// TestNISTInvalidPoint tests that DH rejects points that are not
+// on the curve.
+func TestNISTInvalidPoint(t *testing.T) {
+	for _, curve := range []elliptic.Curve{
+		elliptic.P256(),
+		elliptic.P384(),
+		elliptic.P521(),
+	} {
+		t.Run(curve.Params().Name, func(t *testing.T) {
+			r := NIST(curve, sha256.New, t.Name())
+			priv, err := r.Generate(rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pub := r.Public(priv)
+			// x >= p is never a valid coordinate.
+			for i := 1; i < len(pub); i++ {
+				pub[i] = 0xff
+			}
+			if _, err := r.DH(priv, pub); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+// TestNISTKeySizes tests that the root, chain, and message keys
+// are 32 bytes regardless of the curve and hash.
+func TestNISTKeySizes(t *testing.T) {
+	for _, tc := range []struct {
+		curve elliptic.Curve
+		hash  func() hash.Hash
+		dhLen int
+	}{
+		{elliptic.P256(), sha256.New, 32},
+		{elliptic.P384(), sha512.New384, 48},
+		{elliptic.P521(), sha512.New, 66},
+	} {
+		t.Run(tc.curve.Params().Name, func(t *testing.T) {
+			r := NIST(tc.curve, tc.hash, t.Name())
+			a, err := r.Generate(rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := r.Generate(rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dh, err := r.DH(a, r.Public(b))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(dh) != tc.dhLen {
+				t.Fatalf("expected %d-byte DH output, got %d", tc.dhLen, len(dh))
+			}
+			rk, ck := r.KDFrk(make(RootKey, 32), dh)
+			ck, mk := r.KDFck(ck)
+			for _, k := range [][]byte{rk, ck, mk} {
+				if len(k) != 32 {
+					t.Fatalf("expected 32-byte key, got %d", len(k))
+				}
+			}
+		})
+	}
+}
+
+// TestNISTUncompressed tests that NIST with
+// WithUncompressedPoints round-trips messages using uncompressed
+// public keys and rejects compressed ones.
+func TestNISTUncompressed(t *testing.T) {
+	for _, curve := range []elliptic.Curve{
+		elliptic.P256(),
+		elliptic.P384(),
+		elliptic.P521(),
+	} {
+		t.Run(curve.Params().Name, func(t *testing.T) {
+			fn := func(t *testing.T) Ratchet {
+				return NIST(curve, sha256.New, t.Name(), WithUncompressedPoints())
+			}
+			r := fn(t)
+			size := (curve.Params().BitSize + 7) / 8
+			if n := r.DHPublicKeyLen(); n != 1+2*size {
+				t.Fatalf("expected %d, got %d", 1+2*size, n)
+			}
+			priv, err := r.Generate(rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pub := r.Public(priv)
+			if len(pub) != r.DHPublicKeyLen() || pub[0] != 4 {
+				t.Fatalf("invalid uncompressed point: %x", pub)
+			}
+			x, y := elliptic.Unmarshal(curve, pub)
+			if x == nil || !curve.IsOnCurve(x, y) {
+				t.Fatalf("invalid uncompressed point: %x", pub)
+			}
+
+			// The Diffie-Hellman output does not depend on the
+			// encoding.
+			compressed := NIST(curve, sha256.New, t.Name())
+			peer, err := compressed.Generate(rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cpub := compressed.Public(peer)
+			if _, err := r.DH(priv, cpub); err == nil {
+				t.Fatal("expected an error for a compressed public key")
+			}
+			want, err := compressed.DH(peer, elliptic.MarshalCompressed(curve, x, y))
+			if err != nil {
+				t.Fatal(err)
+			}
+			px, py := elliptic.UnmarshalCompressed(curve, cpub)
+			got, err := r.DH(priv, elliptic.Marshal(curve, px, py))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("expected %x, got %x", want, got)
+			}
+
+			alice, bob := newSessions(t, fn)
+			for i, p := range [][2]*Session{{alice, bob}, {bob, alice}, {alice, bob}} {
+				msg, err := p[0].Seal([]byte("hello"), nil)
+				if err != nil {
+					t.Fatalf("#%d: %v", i, err)
+				}
+				if len(msg.Header.PublicKey) != 1+2*size {
+					t.Fatalf("#%d: expected %d-byte public key, got %d",
+						i, 1+2*size, len(msg.Header.PublicKey))
+				}
+				if _, err := DecodeHeader(compressed, msg.Header.Append(nil)); !errors.Is(err, ErrInvalidHeader) {
+					t.Fatalf("#%d: expected %v, got %v", i, ErrInvalidHeader, err)
+				}
+				if _, err := p[1].Open(msg, nil); err != nil {
+					t.Fatalf("#%d: %v", i, err)
+				}
+			}
+		})
+	}
+}
+
+// TestMalformedHeader tests that Open returns an error instead of
+// panicking when the header's public key is malformed.
+func TestMalformedHeader(t *testing.T) {
+	test := func(t *testing.T, fn func(*testing.T) Ratchet) {
+		SK := make([]byte, 32)
+		_, err := rand.Read(SK)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		priv, err := fn(t).Generate(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		alice, err := NewSend(fn(t), SK, fn(t).Public(priv))
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err := alice.Seal([]byte("hello"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub := msg.Header.PublicKey
+
+		for i, key := range []PublicKey{
+			nil,
+			{},
+			pub[:1],
+			pub[:len(pub)-1],
+			append(pub[:len(pub):len(pub)], 0),
+			append(pub[:len(pub):len(pub)], pub...),
+		} {
+			// Use a fresh session each time. Sessions take
+			// ownership of their keys, so copy them.
+			bob, err := NewRecv(fn(t),
+				append([]byte(nil), SK...),
+				append(PrivateKey(nil), priv...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			bad := msg
+			bad.Header.PublicKey = key
+			var got []byte
+			panicked := didPanic(func() {
+				got, err = bob.Open(bad, nil)
+			})
+			if panicked {
+				t.Fatalf("#%d: panicked", i)
+			}
+			if err == nil {
+				t.Fatalf("#%d: expected an error, got %q", i, got)
+			}
+
+			// The original message should still decrypt.
+			if _, err := bob.Open(msg, nil); err != nil {
+				t.Fatalf("#%d: %v", i, err)
+			}
+		}
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			test(t, tc.fn)
+		})
+	}
+}
+
+// TestStateMarshal tests that State survives a round trip
+// through MarshalBinary and UnmarshalBinary.
+func TestStateMarshal(t *testing.T) {
+	for i, want := range []*State{
+		{},
+		{DHs: []byte("DHs"), RK: []byte("RK")},
+		{
+			DHs: []byte("DHs"),
+			DHr: []byte("DHr"),
+			RK:  []byte("RK"),
+			CKs: []byte("CKs"),
+			CKr: []byte{},
+			Ns:  1,
+			Nr:  1 << 40,
+			PN:  300,
+			CTs: []byte("CTs"),
+		},
+		{
+			DHs: []byte("DHs"),
+			Accepted: []MessageID{
+				{PublicKey: []byte("a"), N: 0},
+				{PublicKey: []byte("b"), N: 1 << 40},
+			},
+		},
+		{
+			DHs:          []byte("DHs"),
+			PendingRekey: []byte("entropy"),
+			RekeyAhead:   true,
+		},
+		{DHs: []byte("DHs"), Epoch: 1 << 40},
+	} {
+		data, err := want.MarshalBinary()
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		var got State
+		if err := got.UnmarshalBinary(data); err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if !reflect.DeepEqual(&got, want) {
+			t.Fatalf("#%d: expected %#v, got %#v", i, want, &got)
+		}
+		for n := range data {
+			if err := got.UnmarshalBinary(data[:n]); err == nil {
+				t.Fatalf("#%d: expected an error for length %d", i, n)
+			}
+		}
+	}
+}
+
+// TestStateJSON tests State's JSON encoding.
+func TestStateJSON(t *testing.T) {
+	r := DJB(t.Name())
+	SK := make([]byte, 32)
+	priv, err := r.Generate(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := NewRecv(r, append([]byte(nil), SK...), append(PrivateKey(nil), priv...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fresh := bob.State()
+	if fresh.CKs != nil {
+		t.Fatal("expected nil CKs")
+	}
+	alice, err := NewSend(r, SK, r.Public(priv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		msg, err := alice.Seal([]byte("hello"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := bob.Open(msg, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, want := range []*State{
+		{},
+		fresh,
+		alice.State(),
+		bob.State(),
+		{
+			DHs:          []byte("DHs"),
+			PendingRekey: []byte("entropy"),
+			RekeyAhead:   true,
+			Epoch:        3,
+		},
+		{
+			DHs: []byte("DHs"),
+			CKr: []byte{},
+			Accepted: []MessageID{
+				{PublicKey: []byte("a"), N: 0},
+				{PublicKey: []byte("b"), N: 1 << 40},
+			},
+		},
+	} {
+		data, err := json.Marshal(want)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		var got State
+		if err := json.Unmarshal(data, &got); err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if !reflect.DeepEqual(&got, want) {
+			t.Fatalf("#%d: expected %#v, got %#v", i, want, &got)
+		}
+	}
+
+	data, err := json.Marshal(fresh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte(`"cks":null`)) {
+		t.Fatalf("expected null CKs: %s", data)
+	}
+
+	for i, data := range []string{
+		`{"dhs":"!!!"}`,
+		`{"dhs":"AAAA","bogus":1}`,
+		`{"ns":-1}`,
+		`{"accepted":[{"pub":null,"n":-1}]}`,
+		`[]`,
+	} {
+		var s State
+		if err := json.Unmarshal([]byte(data), &s); err == nil {
+			t.Fatalf("#%d: expected an error", i)
+		}
+	}
+}
+
+// TestMaxMessageSize tests that Open rejects oversized messages
+// before decrypting them.
+func TestMaxMessageSize(t *testing.T) {
+	const (
+		max = 1024
+	)
+	r := DJB(t.Name())
+	SK := make([]byte, 32)
+	priv, err := r.Generate(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err := NewSend(r, append([]byte(nil), SK...), r.Public(priv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := NewRecv(r, SK, priv, WithMaxMessageSize(max))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := alice.Seal(make([]byte, max), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	big := msg
+	big.Ciphertext = make([]byte, 64<<20)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err = bob.Open(big, nil)
+	runtime.ReadMemStats(&after)
+	if !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("expected %v, got %v", ErrMessageTooLarge, err)
+	}
+	if n := after.TotalAlloc - before.TotalAlloc; n > 1<<20 {
+		t.Fatalf("Open allocated %d bytes", n)
+	}
+
+	// Messages at the limit are still accepted.
+	if _, err := bob.Open(msg, nil); err != nil {
+		t.Fatal(err)
+	}
+	msg, err = alice.Seal(make([]byte, max+1), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bob.Open(msg, nil); !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("expected %v, got %v", ErrMessageTooLarge, err)
+	}
+}
+
+// failStore is a Store whose methods fail with err, if
+// non-nil.
+type failStore struct {
+	memory
+	err error
+}
+
+func (f *failStore) Save(s *State) error {
+	if f.err != nil {
+		return f.err
+	}
+	return f.memory.Save(s)
+}
+
+func (f *failStore) StoreKey(Nr int, pub PublicKey, key MessageKey) error {
+	if f.err != nil {
+		return f.err
+	}
+	return f.memory.StoreKey(Nr, pub, key)
+}
+
+func (f *failStore) LoadKey(Nr int, pub PublicKey) (MessageKey, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return f.memory.LoadKey(Nr, pub)
+}
+
+// flakyStore is a Store whose Save and StoreKey methods fail
+// with saveErr and storeKeyErr, if non-nil.
+type flakyStore struct {
+	memory
+	saveErr     error
+	storeKeyErr error
+	saved       *State
+}
+
+func (f *flakyStore) Save(s *State) error {
+	if f.saveErr != nil {
+		return f.saveErr
+	}
+	f.saved = s.Clone()
+	return nil
+}
+
+func (f *flakyStore) StoreKey(Nr int, pub PublicKey, key MessageKey) error {
+	if f.storeKeyErr != nil {
+		return f.storeKeyErr
+	}
+	return f.memory.StoreKey(Nr, pub, key)
+}
+
+// TestStoreErrorPolicy tests that StoreErrorBestEffort only
+// ignores Save failures.
+func TestStoreErrorPolicy(t *testing.T) {
+	errFlaky := errors.New("flaky")
+	for _, policy := range []StoreErrorPolicy{StoreErrorFail, StoreErrorBestEffort} {
+		r := DJB(t.Name())
+		SK := make([]byte, 32)
+		priv, err := r.Generate(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var hooked []error
+		hooks := Hooks{OnError: func(err error) { hooked = append(hooked, err) }}
+		aliceStore := &flakyStore{memory: memory{maxSkip: 10}}
+		alice, err := NewSend(r, append([]byte(nil), SK...), r.Public(priv),
+			WithStore(aliceStore), WithStoreErrorPolicy(policy), WithHooks(hooks))
+		if err != nil {
+			t.Fatal(err)
+		}
+		bobStore := &flakyStore{memory: memory{maxSkip: 10}}
+		bob, err := NewRecv(r, SK, priv,
+			WithStore(bobStore), WithStoreErrorPolicy(policy), WithHooks(hooks))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		aliceStore.saveErr = errFlaky
+		msg, err := alice.Seal([]byte("hello"), nil)
+		if policy == StoreErrorFail {
+			if !errors.Is(err, ErrStoreFailure) || !errors.Is(err, errFlaky) {
+				t.Fatalf("expected %v, got %v", ErrStoreFailure, err)
+			}
+			if alice.state.Ns != 0 {
+				t.Fatalf("expected Ns = 0, got %d", alice.state.Ns)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(hooked) != 1 || !errors.Is(hooked[0], ErrStoreFailure) {
+			t.Fatalf("expected one %v, got %v", ErrStoreFailure, hooked)
+		}
+
+		// Opening continues as well.
+		bobStore.saveErr = errFlaky
+		if _, err := bob.Open(msg, nil); err != nil {
+			t.Fatal(err)
+		}
+		if len(hooked) != 2 {
+			t.Fatalf("expected two errors, got %v", hooked)
+		}
+
+		// Storing skipped keys is never best effort.
+		bobStore.storeKeyErr = errFlaky
+		for i := 0; i < 2; i++ {
+			msg, err = alice.Seal([]byte("hello"), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := bob.Open(msg, nil); !errors.Is(err, errFlaky) {
+			t.Fatalf("expected %v, got %v", errFlaky, err)
+		}
+		bobStore.storeKeyErr = nil
+
+		// Flush retries the save.
+		if err := alice.Flush(context.Background()); !errors.Is(err, errFlaky) {
+			t.Fatalf("expected %v, got %v", errFlaky, err)
+		}
+		aliceStore.saveErr = nil
+		if err := alice.Flush(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if aliceStore.saved == nil || aliceStore.saved.Ns != alice.state.Ns {
+			t.Fatalf("state was not saved: %+v", aliceStore.saved)
+		}
+	}
+}
+
+// TestErrorCategories tests that Session methods wrap failures in
+// the documented sentinel errors.
+func TestErrorCategories(t *testing.T) {
+	r := DJB(t.Name())
+	SK := make([]byte, 32)
+	if _, err := rand.Read(SK); err != nil {
+		t.Fatal(err)
+	}
+	priv, err := r.Generate(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newPair := func(opts ...Option) (alice, bob *Session) {
+		t.Helper()
+		bob, err := NewRecv(r, append([]byte(nil), SK...),
+			append(PrivateKey(nil), priv...), opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		alice, err = NewSend(r, append([]byte(nil), SK...), r.Public(priv))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return alice, bob
+	}
+	seal := func(s *Session, plaintext string) Message {
+		t.Helper()
+		msg, err := s.Seal([]byte(plaintext), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+	errStore := errors.New("store error")
+
+	for _, tc := range []struct {
+		name string
+		want error
+		fn   func() error
+	}{
+		{"ErrTooManySkipped", ErrTooManySkipped, func() error {
+			alice, bob := newPair(WithSkipLimit(1))
+			seal(alice, "0")
+			seal(alice, "1")
+			_, err := bob.Open(seal(alice, "2"), nil)
+			return err
+		}},
+		{"ErrInvalidHeader", ErrInvalidHeader, func() error {
+			alice, bob := newPair()
+			msg := seal(alice, "hello")
+			msg.Header.PublicKey = msg.Header.PublicKey[1:]
+			_, err := bob.Open(msg, nil)
+			return err
+		}},
+		{"ErrInvalidKeySize/NewSend", ErrInvalidKeySize, func() error {
+			_, err := NewSend(r, SK[1:], r.Public(priv))
+			return err
+		}},
+		{"ErrInvalidKeySize/Open", ErrInvalidKeySize, func() error {
+			_, err := r.Open(make(MessageKey, KeySize-1), nil, nil)
+			return err
+		}},
+		{"ErrDecryptFailed", ErrDecryptFailed, func() error {
+			alice, bob := newPair()
+			msg := seal(alice, "hello")
+			msg.Ciphertext[0] ^= 1
+			_, err := bob.Open(msg, nil)
+			return err
+		}},
+		{"ErrInvalidMessage", ErrInvalidMessage, func() error {
+			alice, bob := newPair()
+			msg := seal(alice, "hello")
+			msg.Ciphertext = msg.Ciphertext[:r.Overhead()-1]
+			_, err := bob.Open(msg, nil)
+			return err
+		}},
+		{"ErrMessageTooLarge", ErrMessageTooLarge, func() error {
+			alice, bob := newPair(WithMaxMessageSize(1))
+			_, err := bob.Open(seal(alice, "hello"), nil)
+			return err
+		}},
+		{"ErrStoreFailure/Seal", ErrStoreFailure, func() error {
+			alice, err := NewSend(r, append([]byte(nil), SK...), r.Public(priv),
+				WithStore(&failStore{err: errStore}))
+			if err != nil {
+				return err
+			}
+			_, err = alice.Seal([]byte("hello"), nil)
+			return err
+		}},
+		{"ErrStoreFailure/Open", ErrStoreFailure, func() error {
+			alice, bob := newPair(WithStore(&failStore{err: errStore}))
+			_, err := bob.Open(seal(alice, "hello"), nil)
+			return err
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.fn()
+			if !errors.Is(err, tc.want) {
+				t.Fatalf("expected %v, got %v", tc.want, err)
+			}
+			if tc.want == ErrStoreFailure && !errors.Is(err, errStore) {
+				t.Fatalf("expected %v to wrap %v", err, errStore)
+			}
+			if tc.want == ErrTooManySkipped && errors.Is(err, ErrStoreFailure) {
+				t.Fatalf("%v should not be a store failure", err)
+			}
+		})
+	}
+}
+
+// TestOpenTamperedVsMalformed tests that Open distinguishes
+// messages that fail authentication from malformed messages.
+func TestOpenTamperedVsMalformed(t *testing.T) {
+	for _, tc := range testCases {
+		fn := tc.fn
+		t.Run(tc.name, func(t *testing.T) {
+			alice, bob := newSessions(t, fn)
+			msg, err := alice.Seal([]byte("hello, world"), []byte("ad"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := msg.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			hlen := msg.Header.size()
+
+			tampered := func(i int) bool {
+				bad := Message{
+					Header:     msg.Header,
+					Ciphertext: bytes.Clone(msg.Ciphertext),
+				}
+				bad.Ciphertext[i/8] ^= 1 << (i % 8)
+				_, err := bob.Open(bad, []byte("ad"))
+				return errors.Is(err, ErrDecryptFailed) &&
+					!errors.Is(err, ErrInvalidMessage) &&
+					!errors.Is(err, ErrInvalidHeader)
+			}
+			for _, i := range []int{0, 7, 8 * len(msg.Ciphertext) / 2, 8*len(msg.Ciphertext) - 1} {
+				if !tampered(i) {
+					t.Fatalf("bit %d: expected %v", i, ErrDecryptFailed)
+				}
+			}
+			if _, err := bob.Open(msg, []byte("other ad")); !errors.Is(err, ErrDecryptFailed) {
+				t.Fatalf("expected %v, got %v", ErrDecryptFailed, err)
+			}
+			// Long enough to be authenticated, so it is treated
+			// like tampering.
+			short := Message{
+				Header:     msg.Header,
+				Ciphertext: msg.Ciphertext[:len(msg.Ciphertext)-1],
+			}
+			if _, err := bob.Open(short, []byte("ad")); !errors.Is(err, ErrDecryptFailed) {
+				t.Fatalf("expected %v, got %v", ErrDecryptFailed, err)
+			}
+
+			for n := 0; n < fn(t).Overhead(); n++ {
+				short.Ciphertext = msg.Ciphertext[:n]
+				_, err := bob.Open(short, []byte("ad"))
+				if !errors.Is(err, ErrInvalidMessage) || errors.Is(err, ErrDecryptFailed) {
+					t.Fatalf("%d: expected %v, got %v", n, ErrInvalidMessage, err)
+				}
+			}
+			for n := 0; n < 1+4+hlen; n++ {
+				_, err := bob.OpenBytes(data[:n], []byte("ad"))
+				if !errors.Is(err, ErrInvalidMessage) || errors.Is(err, ErrDecryptFailed) {
+					t.Fatalf("%d: expected %v, got %v", n, ErrInvalidMessage, err)
+				}
+			}
+			// A truncated header with a consistent length.
+			for n := 0; n < hlen; n++ {
+				hdr := msg.Header.Append(nil)[:n]
+				var h Header
+				if err := h.Decode(hdr); !errors.Is(err, ErrInvalidHeader) {
+					t.Fatalf("%d: expected %v, got %v", n, ErrInvalidHeader, err)
+				}
+				bad := []byte{data[0]}
+				bad = binary.BigEndian.AppendUint32(bad, uint32(n))
+				bad = append(bad, hdr...)
+				bad = append(bad, msg.Ciphertext...)
+				_, err := bob.OpenBytes(bad, []byte("ad"))
+				if !errors.Is(err, ErrInvalidHeader) || errors.Is(err, ErrDecryptFailed) {
+					t.Fatalf("%d: expected %v, got %v", n, ErrInvalidHeader, err)
+				}
+			}
+
+			// None of the failures affected the session.
+			got, err := bob.Open(msg, []byte("ad"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != "hello, world" {
+				t.Fatalf("expected %q, got %q", "hello, world", got)
+			}
+		})
+	}
+}
+
+// savesStore is a stateStore that counts calls to Save.
+type savesStore struct {
+	stateStore
+	saves int
+}
+
+func (s *savesStore) Save(state *State) error {
+	s.saves++
+	return s.stateStore.Save(state)
+}
+
+// TestSaveEvery tests that WithSaveEvery saves at the configured
+// frequency, that a crashed sender never reuses a message key,
+// and that a crashed receiver can open at most n-1 messages
+// again.
+func TestSaveEvery(t *testing.T) {
+	const (
+		N     = 4
+		total = 10
+	)
+	r := DJB(t.Name())
+	SK := make([]byte, 32)
+	priv, err := r.Generate(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newStore := func() *savesStore {
+		return &savesStore{stateStore: stateStore{memory: memory{maxSkip: 100}}}
+	}
+	aliceStore, bobStore := newStore(), newStore()
+	alice, err := NewSend(r, append([]byte(nil), SK...), r.Public(priv),
+		WithStore(aliceStore), WithSaveEvery(N))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := NewRecv(r, SK, priv,
+		WithStore(bobStore), WithSaveEvery(N))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := make([]Message, total)
+	for i := range msgs {
+		msgs[i], err = alice.Seal([]byte(fmt.Sprint(i)), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msgs[i].Header.N != i {
+			t.Fatalf("#%d: unexpected message number %d", i, msgs[i].Header.N)
+		}
+	}
+	// Saves happen before messages 0, 4, and 8.
+	if want := (total + N - 1) / N; aliceStore.saves != want {
+		t.Fatalf("expected %d saves, got %d", want, aliceStore.saves)
+	}
+	for i, msg := range msgs {
+		if _, err := bob.Open(msg, nil); err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+	}
+	// The first message causes a ratchet step, which is always
+	// saved. After that, every Nth message is saved.
+	if want := 1 + (total-1)/N; bobStore.saves != want {
+		t.Fatalf("expected %d saves, got %d", want, bobStore.saves)
+	}
+
+	// Alice crashes. The resumed session skips the message
+	// numbers she reserved but did not use, so it never reuses a
+	// message key.
+	state, err := aliceStore.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err = Resume(r, state, WithStore(aliceStore), WithSaveEvery(N))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := alice.Seal([]byte("resumed"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Header.N < total {
+		t.Fatalf("message number %d was reused", msg.Header.N)
+	}
+	if _, err := bob.Open(msg, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := bob.SkippedCount(); err != nil || n >= N {
+		t.Fatalf("expected fewer than %d skipped keys, got %d (%v)", N, n, err)
+	}
+
+	// Bob crashes. Only the messages opened since the last save
+	// can be opened again.
+	state, err = bobStore.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err = Resume(r, state, WithStore(bobStore), WithSaveEvery(N))
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayed := 0
+	for _, msg := range msgs {
+		if _, err := bob.TrialOpen(msg, nil); err == nil {
+			replayed++
+		}
+	}
+	if replayed == 0 || replayed >= N {
+		t.Fatalf("%d messages can be opened again", replayed)
+	}
+
+	// Flush saves the opened messages.
+	before := bobStore.saves
+	if err := bob.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if bobStore.saves != before {
+		t.Fatal("Flush saved a session without unsaved messages")
+	}
+	for _, msg := range msgs[total-replayed:] {
+		if _, err := bob.Open(msg, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := bob.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	state, err = bobStore.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(state, bob.State()) {
+		t.Fatal("Flush did not save the current state")
+	}
+}
+
+// TestStaleState tests that a store detects two sessions resumed
+// from the same snapshot.
+func TestStaleState(t *testing.T) {
+	r := DJB(t.Name())
+	SK := make([]byte, 32)
+	priv, err := r.Generate(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &stateStore{memory: memory{maxSkip: 100}}
+	alice, err := NewSend(r, SK, r.Public(priv), WithStore(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alice.Seal([]byte("hello"), nil); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.Epoch == 0 {
+		t.Fatal("expected a non-zero epoch")
+	}
+
+	resume := func() *Session {
+		s, err := Resume(r, snapshot.Clone(), WithStore(store))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	a1, a2 := resume(), resume()
+	if _, err := a1.Seal([]byte("first"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a2.Seal([]byte("second"), nil); !errors.Is(err, ErrStaleState) {
+		t.Fatalf("expected %v, got %v", ErrStaleState, err)
+	}
+	// The failed Seal must not advance the session.
+	if got := a2.State(); !reflect.DeepEqual(got, snapshot) {
+		t.Fatalf("expected %#v, got %#v", snapshot, got)
+	}
+	// The original session is also stale.
+	if _, err := alice.Seal([]byte("third"), nil); !errors.Is(err, ErrStaleState) {
+		t.Fatalf("expected %v, got %v", ErrStaleState, err)
+	}
+	if _, err := a1.Seal([]byte("fourth"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := store.state.Epoch; got != snapshot.Epoch+2 {
+		t.Fatalf("expected epoch %d, got %d", snapshot.Epoch+2, got)
+	}
+
+	for i, tc := range []struct {
+		saved, state uint64
+		ok           bool
+	}{
+		{0, 0, true},
+		{5, 0, true},
+		{0, 1, true},
+		{1, 2, true},
+		{2, 2, false},
+		{3, 2, false},
+	} {
+		err := CheckEpoch(&State{Epoch: tc.saved}, &State{Epoch: tc.state})
+		if (err == nil) != tc.ok {
+			t.Fatalf("#%d: unexpected result: %v", i, err)
+		}
+		if err != nil && !errors.Is(err, ErrStaleState) {
+			t.Fatalf("#%d: expected %v, got %v", i, ErrStaleState, err)
+		}
+	}
+	if err := CheckEpoch(nil, &State{Epoch: 1}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// countStore is a Store that counts calls to each method.
+type countStore struct {
+	memory
+	saves, stores, loads, deletes int
+}
+
+func (c *countStore) Save(s *State) error {
+	c.saves++
+	return c.memory.Save(s)
+}
+
+func (c *countStore) StoreKey(Nr int, pub PublicKey, key MessageKey) error {
+	c.stores++
+	return c.memory.StoreKey(Nr, pub, key)
+}
+
+func (c *countStore) LoadKey(Nr int, pub PublicKey) (MessageKey, error) {
+	c.loads++
+	return c.memory.LoadKey(Nr, pub)
+}
+
+func (c *countStore) DeleteKey(Nr int, pub PublicKey) error {
+	c.deletes++
+	return c.memory.DeleteKey(Nr, pub)
+}
+
+// blockingStore is a StoreContext that blocks until its context
+// is canceled.
+type blockingStore struct{}
+
+func (blockingStore) SaveContext(ctx context.Context, _ *State) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (blockingStore) StoreKeyContext(ctx context.Context, _ int, _ PublicKey, _ MessageKey) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (blockingStore) LoadKeyContext(ctx context.Context, _ int, _ PublicKey) (MessageKey, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (blockingStore) DeleteKeyContext(ctx context.Context, _ int, _ PublicKey) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// TestStoreContext tests that a canceled context causes store
+// calls to return early.
+func TestStoreContext(t *testing.T) {
+	r := DJB(t.Name())
+	SK := make([]byte, 32)
+	priv, err := r.Generate(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	store := &countStore{memory: memory{maxSkip: defaultMaxSkip}}
+	alice, err := NewSend(r, SK, r.Public(priv), WithStore(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = alice.SealContext(ctx, []byte("hello"), nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+	if store.saves != 0 {
+		t.Fatalf("Save called %d times", store.saves)
+	}
+	msg, err := alice.Seal([]byte("hello"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bob, err := NewRecv(r, SK, priv, WithStoreContext(blockingStore{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = bob.OpenContext(ctx, msg, nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+}
+
+// TestClose tests that Close wipes the session's key material.
+func TestClose(t *testing.T) {
+	for _, tc := range testCases {
+		fn := tc.fn
+		t.Run(tc.name, func(t *testing.T) {
+			SK := make([]byte, 32)
+			_, err := rand.Read(SK)
+			if err != nil {
+				t.Fatal(err)
+			}
+			priv, err := fn(t).Generate(rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			bob, err := NewRecv(fn(t), SK, priv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			alice, err := NewSend(fn(t), SK, fn(t).Public(priv))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Skip a message so that the store has a key.
+			if _, err := alice.Seal(nil, nil); err != nil {
+				t.Fatal(err)
+			}
+			msg, err := alice.Seal(nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := bob.Open(msg, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			state := bob.state
+			store := bob.store.(storeContext).Store.(*memory)
+			var skipped []byte
+			for _, v := range store.keys {
+				skipped = v.key
+			}
+			if skipped == nil {
+				t.Fatal("expected a skipped key")
+			}
+			if err := bob.Close(); err != nil {
+				t.Fatal(err)
+			}
+			for i, key := range [][]byte{
+				state.DHs, state.DHr, state.RK, state.CKs, state.CKr, skipped,
+			} {
+				if len(key) == 0 {
+					t.Fatalf("#%d: empty key", i)
+				}
+				for _, c := range key {
+					if c != 0 {
+						t.Fatalf("#%d: key was not wiped: %#x", i, key)
+					}
+				}
+			}
+			if len(store.keys) != 0 {
+				t.Fatalf("%d skipped keys remain", len(store.keys))
+			}
+
+			if _, err := bob.Seal(nil, nil); !errors.Is(err, ErrClosed) {
+				t.Fatalf("expected %v, got %v", ErrClosed, err)
+			}
+			if _, err := bob.Open(msg, nil); !errors.Is(err, ErrClosed) {
+				t.Fatalf("expected %v, got %v", ErrClosed, err)
+			}
+		})
+	}
+}
+
+// storeOnly hides every optional interface of the underlying
+// Store.
+type storeOnly struct {
+	Store
+}
+
+// TestDestroy tests that Destroy closes the session and wipes
+// every skipped key held by the store.
+func TestDestroy(t *testing.T) {
+	alice, bob := newSessions(t, func(t *testing.T) Ratchet { return DJB(t.Name()) })
+	for i := 0; i < 5; i++ {
+		if _, err := alice.Seal(nil, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	msg, err := alice.Seal(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bob.Open(msg, nil); err != nil {
+		t.Fatal(err)
+	}
+	store := bob.rawStore().(*memory)
+	var skipped [][]byte
+	for _, v := range store.keys {
+		skipped = append(skipped, v.key)
+	}
+	if len(skipped) != 5 {
+		t.Fatalf("expected 5 skipped keys, got %d", len(skipped))
+	}
+	if err := bob.Destroy(); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.keys) != 0 {
+		t.Fatalf("%d skipped keys remain", len(store.keys))
+	}
+	for i, key := range skipped {
+		for _, c := range key {
+			if c != 0 {
+				t.Fatalf("#%d: key was not wiped: %#x", i, key)
+			}
+		}
+	}
+	if _, err := bob.Open(msg, nil); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected %v, got %v", ErrClosed, err)
+	}
+
+	// Stores that cannot purge the state are still closed.
+	r := DJB(t.Name())
+	priv, err := r.Generate(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err = NewSend(r, make([]byte, 32), r.Public(priv),
+		WithStore(storeOnly{&memory{maxSkip: 10}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.Destroy(); err == nil {
+		t.Fatal("expected an error")
+	}
+	if _, err := alice.Seal(nil, nil); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected %v, got %v", ErrClosed, err)
+	}
+}
+
+// TestSessionBinding tests that a message sealed with one session
+// binding cannot be opened by a session with another.
+func TestSessionBinding(t *testing.T) {
+	for _, tc := range testCases {
+		fn := tc.fn
+		t.Run(tc.name, func(t *testing.T) {
+			SK := make([]byte, 32)
+			if _, err := rand.Read(SK); err != nil {
+				t.Fatal(err)
+			}
+			priv, err := fn(t).Generate(rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			recv := func(opts ...Option) *Session {
+				t.Helper()
+				s, err := NewRecv(fn(t), append([]byte(nil), SK...),
+					append(PrivateKey(nil), priv...), opts...)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return s
+			}
+			alice, err := NewSend(fn(t), append([]byte(nil), SK...),
+				fn(t).Public(priv), WithSessionBinding([]byte("A")))
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg, err := alice.Seal([]byte("hello"), []byte("ad"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, opts := range [][]Option{
+				{WithSessionBinding([]byte("B"))},
+				{WithSessionBinding(nil)},
+				nil,
+			} {
+				if _, err := recv(opts...).Open(msg, []byte("ad")); err == nil {
+					t.Fatal("expected an error")
+				}
+			}
+			// Moving bytes between the binding and the additional
+			// data does not help.
+			if _, err := recv(WithSessionBinding(nil)).Open(msg, []byte("Aad")); err == nil {
+				t.Fatal("expected an error")
+			}
+			bob := recv(WithSessionBinding([]byte("A")))
+			got, err := bob.Open(msg, []byte("ad"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !hmac.Equal(got, []byte("hello")) {
+				t.Fatalf("expected %q, got %q", "hello", got)
+			}
+			msg, err = bob.Seal([]byte("hello"), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := alice.Open(msg, nil); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// TestTranscript tests that messages are bound to the transcript
+// hash set by WithTranscript.
+func TestTranscript(t *testing.T) {
+	for _, tc := range testCases {
+		fn := tc.fn
+		t.Run(tc.name, func(t *testing.T) {
+			SK := make([]byte, 32)
+			if _, err := rand.Read(SK); err != nil {
+				t.Fatal(err)
+			}
+			priv, err := fn(t).Generate(rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			recv := func(opts ...Option) *Session {
+				t.Helper()
+				s, err := NewRecv(fn(t), append([]byte(nil), SK...),
+					append(PrivateKey(nil), priv...), opts...)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return s
+			}
+			transcript := sha256.Sum256([]byte("handshake"))
+			other := sha256.Sum256([]byte("other handshake"))
+			alice, err := NewSend(fn(t), append([]byte(nil), SK...),
+				fn(t).Public(priv), WithTranscript(transcript[:]),
+				WithSessionBinding([]byte("A")))
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg, err := alice.Seal([]byte("hello"), []byte("ad"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, opts := range [][]Option{
+				{WithTranscript(other[:]), WithSessionBinding([]byte("A"))},
+				{WithTranscript(transcript[:]), WithSessionBinding([]byte("B"))},
+				{WithTranscript(transcript[:])},
+				{WithSessionBinding([]byte("A"))},
+				{WithSessionBinding(transcript[:])},
+				nil,
+			} {
+				if _, err := recv(opts...).Open(msg, []byte("ad")); !errors.Is(err, ErrDecryptFailed) {
+					t.Fatalf("#%d: expected %v, got %v", i, ErrDecryptFailed, err)
+				}
+			}
+			bob := recv(WithTranscript(transcript[:]), WithSessionBinding([]byte("A")))
+			got, err := bob.Open(msg, []byte("ad"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !hmac.Equal(got, []byte("hello")) {
+				t.Fatalf("expected %q, got %q", "hello", got)
+			}
+			msg, err = bob.Seal([]byte("hello"), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := alice.Open(msg, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			// The transcript and session identifier have separate
+			// slots, so an identifier cannot stand in for the
+			// transcript when the identifier is empty.
+			alice, err = NewSend(fn(t), append([]byte(nil), SK...),
+				fn(t).Public(priv), WithTranscript(transcript[:]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg, err = alice.Seal([]byte("hello"), []byte("ad"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			bob = recv(WithSessionBinding(transcript[:]))
+			if _, err := bob.Open(msg, []byte("\x00ad")); !errors.Is(err, ErrDecryptFailed) {
+				t.Fatalf("expected %v, got %v", ErrDecryptFailed, err)
+			}
+		})
+	}
+}
+
+// namedAEAD is an AEAD with a custom name.
+type namedAEAD struct {
+	AEAD
+	name string
+}
+
+func (a namedAEAD) Name() string { return a.name }
+
+// TestAlgorithmBinding tests that WithAlgorithmBinding prevents
+// a message sealed with one Ratchet from being opened with
+// another Ratchet that derives the same keys but has a different
+// name.
+func TestAlgorithmBinding(t *testing.T) {
+	const ns = "namespace"
+	r1 := DJB(ns)
+	r2 := DJB(ns, WithAEAD(namedAEAD{AEAD: xchacha{}, name: "Other"}))
+	if r1.Name() == r2.Name() {
+		t.Fatalf("expected different names, got %q", r1.Name())
+	}
+
+	SK := make([]byte, 32)
+	if _, err := rand.Read(SK); err != nil {
+		t.Fatal(err)
+	}
+	priv, err := r1.Generate(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recv := func(r Ratchet, opts ...Option) *Session {
+		t.Helper()
+		s, err := NewRecv(r, append([]byte(nil), SK...),
+			append(PrivateKey(nil), priv...), opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	seal := func(opts ...Option) Message {
+		t.Helper()
+		alice, err := NewSend(r1, append([]byte(nil), SK...), r1.Public(priv), opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err := alice.Seal([]byte("hello"), []byte("ad"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+
+	// Without binding, the other Ratchet opens the message.
+	msg := seal(WithAlgorithmBinding(false))
+	if _, err := recv(r2, WithAlgorithmBinding(false)).Open(msg, []byte("ad")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Binding is the default.
+	msg = seal()
+	for i, bob := range []*Session{
+		recv(r2),
+		recv(r2, WithAlgorithmBinding(true)),
+		recv(r1, WithAlgorithmBinding(false)),
+		recv(r1, WithAlgorithmBinding(false), WithSessionBinding([]byte(r1.Name()))),
+	} {
+		if _, err := bob.Open(msg, []byte("ad")); !errors.Is(err, ErrDecryptFailed) {
+			t.Fatalf("#%d: expected %v, got %v", i, ErrDecryptFailed, err)
+		}
+	}
+	bob := recv(r1, WithAlgorithmBinding(true))
+	got, err := bob.Open(msg, []byte("ad"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, []byte("hello")) {
+		t.Fatalf("expected %q, got %q", "hello", got)
+	}
+}
+
+// TestTrialOpen tests that TrialOpen does not modify the session
+// or its store.
+func TestTrialOpen(t *testing.T) {
+	for _, tc := range testCases {
+		fn := tc.fn
+		t.Run(tc.name, func(t *testing.T) {
+			alice, bob := newSessions(t, fn)
+			var calls int
+			bob.hooks = Hooks{
+				OnRatchet: func(PublicKey) { calls++ },
+				OnSkip:    func(int) { calls++ },
+			}
+			store := bob.rawStore().(*memory)
+
+			msgs := make([]Message, 3)
+			for i := range msgs {
+				var err error
+				msgs[i], err = alice.Seal([]byte{byte(i)}, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			trial := func(i int) {
+				t.Helper()
+				want := bob.State()
+				nkeys := len(store.keys)
+				got, err := bob.TrialOpen(msgs[i], nil)
+				if err != nil {
+					t.Fatalf("#%d: %v", i, err)
+				}
+				if !bytes.Equal(got, []byte{byte(i)}) {
+					t.Fatalf("#%d: expected %d, got %x", i, i, got)
+				}
+				if _, err := bob.TrialOpen(msgs[i], []byte("wrong")); err == nil {
+					t.Fatalf("#%d: expected an error", i)
+				}
+				if got := bob.State(); !reflect.DeepEqual(got, want) {
+					t.Fatalf("#%d: state changed: %+v", i, got)
+				}
+				if n := len(store.keys); n != nkeys {
+					t.Fatalf("#%d: expected %d skipped keys, got %d", i, nkeys, n)
+				}
+				if calls != 0 {
+					t.Fatalf("#%d: %d hooks called", i, calls)
+				}
+			}
+			// Ratchet step and skipped keys.
+			trial(2)
+			if _, err := bob.Open(msgs[2], nil); err != nil {
+				t.Fatal(err)
+			}
+			calls = 0
+			// Stored skipped key.
+			trial(0)
+			if _, err := bob.Open(msgs[0], nil); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := bob.TrialOpen(msgs[0], nil); err == nil {
+				t.Fatal("expected an error for a consumed key")
+			}
+			if _, err := bob.Open(msgs[1], nil); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// TestOpenSkipped tests that OpenSkipped only opens messages
+// whose keys are stored and never changes the session state.
+func TestOpenSkipped(t *testing.T) {
+	alice, bob := newSessions(t, func(t *testing.T) Ratchet { return DJB(t.Name()) })
+
+	msgs := make([]Message, 4)
+	for i := range msgs {
+		var err error
+		msgs[i], err = alice.Seal([]byte(fmt.Sprint(i)), nil)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+	}
+	if _, err := bob.Open(msgs[2], nil); err != nil {
+		t.Fatal(err)
+	}
+	want, err := bob.State().MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	unchanged := func() {
+		t.Helper()
+		got, err := bob.State().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatal("state was modified")
+		}
+	}
+
+	// The message's key has not been derived yet.
+	if _, err := bob.OpenSkipped(msgs[3], nil); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected %v, got %v", ErrNotFound, err)
+	}
+	unchanged()
+
+	if _, err := bob.OpenSkipped(msgs[1], []byte("wrong")); err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, i := range []int{1, 0} {
+		got, err := bob.OpenSkipped(msgs[i], nil)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if want := fmt.Sprint(i); string(got) != want {
+			t.Fatalf("#%d: expected %q, got %q", i, want, got)
+		}
+		unchanged()
+	}
+	if _, err := bob.OpenSkipped(msgs[0], nil); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected %v, got %v", ErrNotFound, err)
+	}
+	if n, err := bob.SkippedCount(); err != nil || n != 0 {
+		t.Fatalf("expected no skipped keys, got %d (%v)", n, err)
+	}
+
+	if _, err := bob.Open(msgs[3], nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestCanOpen tests that CanOpen predicts whether Open succeeds
+// without modifying the session.
+func TestCanOpen(t *testing.T) {
+	r := DJB(t.Name())
+	SK := make([]byte, 32)
+	if _, err := rand.Read(SK); err != nil {
+		t.Fatal(err)
+	}
+	priv, err := r.Generate(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err := NewSend(r, append([]byte(nil), SK...), r.Public(priv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const (
+		limit = 5
+	)
+	bob, err := NewRecv(r, SK, priv, WithSkipLimit(limit))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := make([]Message, limit+3)
+	for i := range msgs {
+		msgs[i], err = alice.Seal([]byte("hello"), nil)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+	}
+	want, err := bob.State().MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	canOpen := func(i int, want bool) {
+		t.Helper()
+		if got := bob.CanOpen(msgs[i]); got != want {
+			t.Fatalf("#%d: expected %t, got %t", i, want, got)
+		}
+	}
+
+	// In order.
+	canOpen(0, true)
+	// Within the skip limit.
+	canOpen(limit, true)
+	// Too far in the future.
+	canOpen(limit+1, false)
+	got, err := bob.State().MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("CanOpen modified the state")
+	}
+
+	if _, err := bob.Open(msgs[2], nil); err != nil {
+		t.Fatal(err)
+	}
+	// Skipped keys are present.
+	canOpen(0, true)
+	canOpen(1, true)
+	// Already opened.
+	canOpen(2, false)
+	// In order.
+	canOpen(3, true)
+	if n, err := bob.SkippedCount(); err != nil || n != 2 {
+		t.Fatalf("expected 2 skipped keys, got %d (%v)", n, err)
+	}
+
+	if _, err := bob.Open(msgs[0], nil); err != nil {
+		t.Fatal(err)
+	}
+	canOpen(0, false)
+
+	msg := msgs[1]
+	msg.Header.PublicKey = msg.Header.PublicKey[1:]
+	if bob.CanOpen(msg) {
+		t.Fatal("expected false for an invalid header")
+	}
+}
+
+// TestFirstReceiveOutOfOrder tests that a session created with
+// NewRecv can open the sender's messages out of order as its very
+// first receives, including when the header's PN is non-zero.
+//
+// A fresh receiver has no receiving chain, so it cannot (and
+// need not) skip any messages from the sender's previous chain:
+// those were never derived from this receiver's keys. Only the
+// messages skipped in the new chain are stored.
+func TestFirstReceiveOutOfOrder(t *testing.T) {
+	for _, PN := range []int{0, 3} {
+		t.Run(fmt.Sprintf("PN=%d", PN), func(t *testing.T) {
+			r := DJB(t.Name())
+			SK := make([]byte, 32)
+			if _, err := rand.Read(SK); err != nil {
+				t.Fatal(err)
+			}
+			priv, err := r.Generate(rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			bob, err := NewRecv(r, append([]byte(nil), SK...), priv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			alice, err := NewSend(r, SK, r.Public(priv))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if PN > 0 {
+				// Pretend that Alice had an earlier chain.
+				state := alice.State()
+				state.PN = PN
+				alice, err = Resume(r, state)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			const (
+				N = 5
+			)
+			msgs := make([]Message, N)
+			for i := range msgs {
+				msgs[i], err = alice.Seal([]byte(fmt.Sprint(i)), nil)
+				if err != nil {
+					t.Fatalf("#%d: %v", i, err)
+				}
+				if msgs[i].Header.PN != PN {
+					t.Fatalf("#%d: expected PN = %d, got %d",
+						i, PN, msgs[i].Header.PN)
+				}
+			}
+			for j, i := range []int{3, 0, 4, 1, 2} {
+				got, err := bob.Open(msgs[i], nil)
+				if err != nil {
+					t.Fatalf("#%d: %v", i, err)
+				}
+				if want := fmt.Sprint(i); string(got) != want {
+					t.Fatalf("#%d: expected %q, got %q", i, want, got)
+				}
+				if j == 0 {
+					// Only messages 0, 1, and 2 were skipped.
+					if n, err := bob.SkippedCount(); err != nil || n != 3 {
+						t.Fatalf("expected 3 skipped keys, got %d (%v)", n, err)
+					}
+				}
+			}
+			if n, err := bob.SkippedCount(); err != nil || n != 0 {
+				t.Fatalf("expected no skipped keys, got %d (%v)", n, err)
+			}
+
+			// The sessions are still in sync.
+			send, recv := bob, alice
+			for i := 0; i < 4; i++ {
+				msg, err := send.Seal([]byte("hello"), nil)
+				if err != nil {
+					t.Fatalf("#%d: %v", i, err)
+				}
+				if _, err := recv.Open(msg, nil); err != nil {
+					t.Fatalf("#%d: %v", i, err)
+				}
+				send, recv = recv, send
+			}
+		})
+	}
+}
+
+// TestRatchetName tests that Ratchet names are stable and
+// distinguish every parameter.
+func TestRatchetName(t *testing.T) {
+	const ns = "namespace"
+	for _, tc := range []struct {
+		r    Ratchet
+		want string
+	}{
+		{DJB(ns), "DR-X25519-XChaCha20Poly1305-HKDF-BLAKE2b256/namespace"},
+		{X448(ns), "DR-X448-XChaCha20Poly1305-HKDF-SHA512/namespace"},
+		{X25519MLKEM768(ns), "DR-X25519MLKEM768-XChaCha20Poly1305-HKDF-BLAKE2b256/namespace"},
+		{NIST(elliptic.P256(), sha256.New, ns), "DR-P256-AES256GCM-HKDF-SHA256/namespace"},
+		{NIST(elliptic.P384(), sha512.New384, ns), "DR-P384-AES256GCM-HKDF-SHA384/namespace"},
+		{NIST(elliptic.P521(), sha512.New, ns), "DR-P521-AES256GCM-HKDF-SHA512/namespace"},
+	} {
+		if got := tc.r.Name(); got != tc.want {
+			t.Fatalf("expected %q, got %q", tc.want, got)
+		}
+	}
+
+	seen := make(map[string]bool)
+	for i, r := range []Ratchet{
+		DJB(ns),
+		DJB("other"),
+		DJB(ns, WithAEAD(aesGCM{})),
+		DJB(ns, WithKDFHash(sha256.New)),
+		DJB(ns, WithInfoLabels("mk", "rk")),
+		DJB(ns, WithInfoLabels("rk", "mk")),
+		DJB(ns, WithRandomNonce(rand.Reader)),
+		DJB(ns, WithNonceCounter()),
+		X448(ns),
+		X25519MLKEM768(ns),
+		NIST(elliptic.P256(), sha256.New, ns),
+		NIST(elliptic.P256(), sha512.New, ns),
+		NIST(elliptic.P384(), sha256.New, ns),
+		NIST(elliptic.P256(), sha256.New, ns, WithUncompressedPoints()),
+	} {
+		name := r.Name()
+		if seen[name] {
+			t.Fatalf("#%d: duplicate name %q", i, name)
+		}
+		seen[name] = true
+	}
+
+	alice, _ := newSessions(t, func(t *testing.T) Ratchet { return DJB(ns) })
+	if got, want := alice.RatchetName(), DJB(ns).Name(); got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+}
+
+// TestReadOnly tests that a read-only session can open messages
+// without writing to its store.
+func TestReadOnly(t *testing.T) {
+	for _, tc := range testCases {
+		fn := tc.fn
+		t.Run(tc.name, func(t *testing.T) {
+			SK := make([]byte, 32)
+			if _, err := rand.Read(SK); err != nil {
+				t.Fatal(err)
+			}
+			priv, err := fn(t).Generate(rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			alice, err := NewSend(fn(t), append([]byte(nil), SK...), fn(t).Public(priv))
+			if err != nil {
+				t.Fatal(err)
+			}
+			store := &countStore{memory: memory{maxSkip: 100}}
+			primary, err := NewRecv(fn(t), SK, priv, WithStore(store))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			msgs := make([]Message, 6)
+			for i := range msgs {
+				msgs[i], err = alice.Seal([]byte{byte(i)}, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			// The primary skips message 0.
+			if _, err := primary.Open(msgs[1], nil); err != nil {
+				t.Fatal(err)
+			}
+
+			replica, err := Resume(fn(t), primary.State(),
+				WithStore(store), WithReadOnly(true))
+			if err != nil {
+				t.Fatal(err)
+			}
+			*store = countStore{memory: store.memory}
+			// 0 is read from the store, 3 skips 2, and 2 is read
+			// from memory.
+			for _, i := range []int{0, 3, 2, 5, 4} {
+				got, err := replica.Open(msgs[i], nil)
+				if err != nil {
+					t.Fatalf("#%d: %v", i, err)
+				}
+				if !bytes.Equal(got, []byte{byte(i)}) {
+					t.Fatalf("#%d: expected %d, got %x", i, i, got)
+				}
+			}
+			if store.saves != 0 || store.stores != 0 || store.deletes != 0 {
+				t.Fatalf("store was written: %+v", store)
+			}
+			if n := len(store.keys); n != 1 {
+				t.Fatalf("expected 1 stored key, got %d", n)
+			}
+			if _, err := replica.Seal(nil, nil); !errors.Is(err, ErrReadOnly) {
+				t.Fatalf("expected %v, got %v", ErrReadOnly, err)
+			}
+
+			// The primary is unaffected.
+			if _, err := primary.Open(msgs[0], nil); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// TestHeaderCompact tests that Headers round trip through the
+// compact encoding with small and large counters.
+func TestHeaderCompact(t *testing.T) {
+	trailer := []byte("trailing data")
+	counters := []int{0, 1, 127, 128, 16383, 16384, 1 << 40, math.MaxInt}
+	for _, PN := range counters {
+		for _, N := range counters {
+			for _, n := range []int{0, 32, 1 << 12} {
+				want := Header{
+					PublicKey: make(PublicKey, n),
+					PN:        PN,
+					N:         N,
+				}
+				rand.Read(want.PublicKey)
+				if N%2 == 1 {
+					want.KEMCiphertext = make([]byte, 100)
+					rand.Read(want.KEMCiphertext)
+				}
+				buf := want.AppendCompact(nil)
+				if PN < 128 && N < 128 && len(buf) >= want.size() {
+					t.Fatalf("%d/%d/%d: compact encoding is %d bytes, Append is %d",
+						PN, N, n, len(buf), want.size())
+				}
+				var got Header
+				if err := got.Decode(buf); err != nil {
+					t.Fatalf("%d/%d/%d: %v", PN, N, n, err)
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Fatalf("%d/%d/%d: expected %#v, got %#v", PN, N, n, want, got)
+				}
+				got, rest, err := SplitHeader(append(buf, trailer...))
+				if err != nil {
+					t.Fatalf("%d/%d/%d: %v", PN, N, n, err)
+				}
+				if !reflect.DeepEqual(got, want) || !bytes.Equal(rest, trailer) {
+					t.Fatalf("%d/%d/%d: expected %#v, got %#v", PN, N, n, want, got)
+				}
+				for i := 0; i < len(buf); i++ {
+					if _, _, err := SplitHeader(buf[:i]); err == nil {
+						t.Fatalf("%d/%d/%d: expected an error for length %d", PN, N, n, i)
+					}
+				}
+			}
+		}
+	}
+
+	// Non-minimal varints are rejected.
+	for _, buf := range [][]byte{
+		{headerVersionCompact, 0x80, 0x00, 0, 0},
+		{headerVersionCompact, 0, 0, 0x80, 0x00},
+		{headerVersionCompactKEM, 0, 0, 0, 0x81, 0x00, 1},
+	} {
+		var h Header
+		if err := h.Decode(buf); err == nil {
+			t.Fatalf("%#x: expected an error", buf)
+		}
+	}
+}
+
+// TestHeaderEncoding tests that Headers with public keys of
+// different sizes round trip, including when followed by other
+// data.
+func TestHeaderEncoding(t *testing.T) {
+	trailer := []byte("trailing data")
+	for _, n := range []int{0, 1, 32, 33, 56, 97, 133, 1 << 12} {
+		pub := make(PublicKey, n)
+		rand.Read(pub)
+		want := Header{
+			PublicKey: pub,
+			PN:        n * 3,
+			N:         1<<40 + n,
+		}
+		if n == 0 {
+			want.PublicKey = PublicKey{}
+		}
+		if n%2 == 1 {
+			want.KEMCiphertext = make([]byte, n)
+			rand.Read(want.KEMCiphertext)
+		}
+		buf := want.Append([]byte("prefix"))
+		if string(buf[:6]) != "prefix" {
+			t.Fatalf("%d: Append clobbered the prefix: %q", n, buf[:6])
+		}
+		buf = buf[6:]
+		if len(buf) != want.size() {
+			t.Fatalf("%d: expected size %d, got %d", n, want.size(), len(buf))
+		}
+
+		var got Header
+		if err := got.Decode(buf); err != nil {
+			t.Fatalf("%d: %v", n, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("%d: expected %#v, got %#v", n, want, got)
+		}
+
+		buf = append(buf, trailer...)
+		if err := got.Decode(buf); err == nil {
+			t.Fatalf("%d: expected an error with trailing data", n)
+		}
+		got, rest, err := SplitHeader(buf)
+		if err != nil {
+			t.Fatalf("%d: %v", n, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("%d: expected %#v, got %#v", n, want, got)
+		}
+		if !bytes.Equal(rest, trailer) {
+			t.Fatalf("%d: expected %q, got %q", n, trailer, rest)
+		}
+
+		// Truncated headers are rejected.
+		for i := 0; i < want.size(); i++ {
+			if _, _, err := SplitHeader(buf[:i]); err == nil {
+				t.Fatalf("%d: expected an error for length %d", n, i)
+			}
+		}
+
+		ad := []byte("additional data")
+		gotAD, got, err := SplitConcat(Concat(ad, want))
+		if err != nil {
+			t.Fatalf("%d: %v", n, err)
+		}
+		if !bytes.Equal(gotAD, ad) {
+			t.Fatalf("%d: expected %q, got %q", n, ad, gotAD)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("%d: expected %#v, got %#v", n, want, got)
+		}
+	}
+}
+
+// TestHeaderDecodeLegacy tests decoding the unversioned Header
+// encoding.
+func TestHeaderDecodeLegacy(t *testing.T) {
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint64(buf[0:8], 7)
+	binary.BigEndian.PutUint64(buf[8:16], 9)
+	buf = append(buf, "public key"...)
+	var h Header
+	if err := h.DecodeLegacy(buf); err != nil {
+		t.Fatal(err)
+	}
+	want := Header{PublicKey: PublicKey("public key"), PN: 7, N: 9}
+	if !reflect.DeepEqual(h, want) {
+		t.Fatalf("expected %#v, got %#v", want, h)
+	}
+}
+
+// TestHeaderCounterRange tests that each Header encoding rejects
+// counters that do not fit in a non-negative int.
+func TestHeaderCounterRange(t *testing.T) {
+	pub := PublicKey("public key")
+	legacy := func(PN, N uint64) []byte {
+		buf := binary.BigEndian.AppendUint64(nil, PN)
+		buf = binary.BigEndian.AppendUint64(buf, N)
+		return append(buf, pub...)
+	}
+	fixed := func(PN, N uint64) []byte {
+		buf := []byte{headerVersion}
+		buf = append(buf, legacy(PN, N)[:16]...)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(pub)))
+		return append(buf, pub...)
+	}
+	compact := func(PN, N uint64) []byte {
+		buf := []byte{headerVersionCompact}
+		buf = binary.AppendUvarint(buf, PN)
+		buf = binary.AppendUvarint(buf, N)
+		buf = binary.AppendUvarint(buf, uint64(len(pub)))
+		return append(buf, pub...)
+	}
+	decode := map[string]func([]byte) (Header, error){
+		"legacy": func(b []byte) (Header, error) {
+			var h Header
+			err := h.DecodeLegacy(b)
+			return h, err
+		},
+		"fixed": func(b []byte) (Header, error) {
+			var h Header
+			err := h.Decode(b)
+			return h, err
+		},
+	}
+	decode["compact"] = decode["fixed"]
+	encode := map[string]func(PN, N uint64) []byte{
+		"legacy":  legacy,
+		"fixed":   fixed,
+		"compact": compact,
+	}
+	for _, tc := range []struct {
+		v  uint64
+		ok bool
+	}{
+		{0, true},
+		{math.MaxInt32, true},
+		// 2^31 only fits in a 64-bit int.
+		{1 << 31, math.MaxInt > math.MaxInt32},
+		{math.MaxInt, true},
+		{math.MaxInt + 1, false},
+		{1<<63 + 1, false},
+		{math.MaxUint64, false},
+	} {
+		for name, enc := range encode {
+			for i, b := range [][]byte{enc(tc.v, 0), enc(0, tc.v)} {
+				h, err := decode[name](b)
+				if !tc.ok {
+					if !errors.Is(err, ErrInvalidHeader) {
+						t.Fatalf("%s: %d (#%d): expected %v, got %v",
+							name, tc.v, i, ErrInvalidHeader, err)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("%s: %d (#%d): %v", name, tc.v, i, err)
+				}
+				if uint64(h.PN+h.N) != tc.v {
+					t.Fatalf("%s: %d (#%d): got %v", name, tc.v, i, h)
+				}
+			}
+		}
+	}
+
+	// Headers built by hand cannot have negative counters
+	// either.
+	alice, bob := newSessions(t, func(t *testing.T) Ratchet {
+		return DJB(t.Name())
+	})
+	msg, err := alice.Seal([]byte("hello"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range []Header{
+		{PublicKey: msg.Header.PublicKey, PN: -1},
+		{PublicKey: msg.Header.PublicKey, N: math.MinInt},
+	} {
+		_, err := bob.Open(Message{Header: h, Ciphertext: msg.Ciphertext}, nil)
+		if !errors.Is(err, ErrInvalidHeader) {
+			t.Fatalf("%v: expected %v, got %v", h, ErrInvalidHeader, err)
+		}
+	}
+	if _, err := bob.Open(msg, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestHeaderEqual tests Header.Equal.
+func TestHeaderEqual(t *testing.T) {
+	pub := []byte("public key 1")
+	h := Header{PublicKey: pub, PN: 1, N: 2}
+	for i, tc := range []struct {
+		other Header
+		equal bool
+	}{
+		{Header{PublicKey: bytes.Clone(pub), PN: 1, N: 2}, true},
+		{Header{PublicKey: []byte("public key 2"), PN: 1, N: 2}, false},
+		{Header{PublicKey: pub[:len(pub)-1], PN: 1, N: 2}, false},
+		{Header{PN: 1, N: 2}, false},
+		{Header{PublicKey: pub, PN: 2, N: 2}, false},
+		{Header{PublicKey: pub, PN: 1, N: 1}, false},
+		{Header{PublicKey: pub, PN: 1, N: 2, KEMCiphertext: []byte("x")}, false},
+	} {
+		if got := h.Equal(tc.other); got != tc.equal {
+			t.Fatalf("#%d: expected %t, got %t", i, tc.equal, got)
+		}
+		if got := tc.other.Equal(h); got != tc.equal {
+			t.Fatalf("#%d: Equal is not symmetric", i)
+		}
+	}
+}
+
+// TestHeaderString tests Header.String.
+func TestHeaderString(t *testing.T) {
+	for i, tc := range []struct {
+		h    Header
+		want string
+	}{
+		{
+			Header{PublicKey: []byte{0x01, 0x23}, PN: 3, N: 7},
+			"{PN: 3, N: 7, PublicKey: 0123}",
+		},
+		{
+			Header{PublicKey: bytes.Repeat([]byte{0xab}, 32), N: 1},
+			"{PN: 0, N: 1, PublicKey: abababababababab...}",
+		},
+		{
+			Header{},
+			"{PN: 0, N: 0, PublicKey: }",
+		},
+	} {
+		if got := tc.h.String(); got != tc.want {
+			t.Fatalf("#%d: expected %q, got %q", i, tc.want, got)
+		}
+	}
+}
+
+// TestDHPublicKeyLen tests that DHPublicKeyLen matches the size
+// of the Ratchet's public keys.
+func TestDHPublicKeyLen(t *testing.T) {
+	for _, tc := range testCases {
+		fn := tc.fn
+		t.Run(tc.name, func(t *testing.T) {
+			r := fn(t)
+			priv, err := r.Generate(rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := r.DHPublicKeyLen(), len(r.Public(priv)); got != want {
+				t.Fatalf("expected %d, got %d", want, got)
+			}
+		})
+	}
+}
+
+// TestDecodeHeader tests that DecodeHeader checks the public key
+// and KEM ciphertext against the Ratchet.
+func TestDecodeHeader(t *testing.T) {
+	for _, tc := range testCases {
+		fn := tc.fn
+		t.Run(tc.name, func(t *testing.T) {
+			r := fn(t)
+			priv, err := r.Generate(rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := r.Header(priv, 1, 2)
+			if _, ok := r.(KEMRatchet); ok {
+				want.KEMCiphertext = []byte("ciphertext")
+			}
+			got, err := DecodeHeader(r, want.Append(nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("expected %#v, got %#v", want, got)
+			}
+
+			pub := want.PublicKey
+			bad := []Header{
+				{PublicKey: pub[:len(pub)-1], KEMCiphertext: want.KEMCiphertext},
+				{PublicKey: append(bytes.Clone(pub), 0), KEMCiphertext: want.KEMCiphertext},
+				{PublicKey: nil, KEMCiphertext: want.KEMCiphertext},
+			}
+			if want.KEMCiphertext != nil {
+				bad = append(bad, Header{PublicKey: pub})
+			} else {
+				bad = append(bad, Header{PublicKey: pub, KEMCiphertext: []byte("x")})
+			}
+			for i, h := range bad {
+				if _, err := DecodeHeader(r, h.Append(nil)); !errors.Is(err, ErrInvalidHeader) {
+					t.Fatalf("#%d: expected %v, got %v", i, ErrInvalidHeader, err)
+				}
+			}
+			buf := append(want.Append(nil), 0)
+			if _, err := DecodeHeader(r, buf); !errors.Is(err, ErrInvalidHeader) {
+				t.Fatalf("expected %v, got %v", ErrInvalidHeader, err)
+			}
+
+			// Open rejects the header before doing anything else.
+			alice, bob := newSessions(t, fn)
+			msg, err := alice.Seal([]byte("hello"), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			short := msg
+			short.Header.PublicKey = msg.Header.PublicKey[:len(pub)-1]
+			if _, err := bob.Open(short, nil); !errors.Is(err, ErrInvalidHeader) {
+				t.Fatalf("expected %v, got %v", ErrInvalidHeader, err)
+			}
+			if _, err := bob.Open(msg, nil); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	// Short inputs are rejected by both encodings.
+	var h Header
+	for _, n := range []int{0, 1, 16, 18} {
+		if err := h.Decode(make([]byte, n)); !errors.Is(err, ErrInvalidHeader) {
+			t.Fatalf("%d: expected %v, got %v", n, ErrInvalidHeader, err)
+		}
+	}
+	for _, n := range []int{0, 15, 16} {
+		if err := h.DecodeLegacy(make([]byte, n)); !errors.Is(err, ErrInvalidHeader) {
+			t.Fatalf("%d: expected %v, got %v", n, ErrInvalidHeader, err)
+		}
+	}
+}
+
+// TestAdditionalData tests that Open fails if the additional
+// data or header differ from what was sealed.
+func TestAdditionalData(t *testing.T) {
+	for _, tc := range testCases {
+		fn := tc.fn
+		t.Run(tc.name, func(t *testing.T) {
+			SK := make([]byte, 32)
+			priv, err := fn(t).Generate(rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			alice, err := NewSend(fn(t), SK, fn(t).Public(priv))
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg, err := alice.Seal([]byte("hello"), []byte("ad"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			newBob := func() *Session {
+				bob, err := NewRecv(fn(t),
+					append([]byte(nil), SK...),
+					append(PrivateKey(nil), priv...))
+				if err != nil {
+					t.Fatal(err)
+				}
+				return bob
+			}
+			if _, err := newBob().Open(msg, []byte("AD")); err == nil {
+				t.Fatal("expected an error with different additional data")
+			}
+			bad := msg
+			bad.Header.PN++
+			if _, err := newBob().Open(bad, []byte("ad")); err == nil {
+				t.Fatal("expected an error with a different header")
+			}
+			if _, err := newBob().Open(msg, []byte("ad")); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// TestConcatVersion tests that the version byte written by
+// Concat is authenticated.
+func TestConcatVersion(t *testing.T) {
+	r := DJB(t.Name())
+	priv, err := r.Generate(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err := NewSend(r, make([]byte, 32), r.Public(priv),
+		WithKeyExport(true), WithAlgorithmBinding(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ad := []byte("ad")
+	msg, mk, err := alice.SealWithKey([]byte("hello"), ad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := Concat(ad, msg.Header)
+	if buf[0] != concatVersion {
+		t.Fatalf("expected version %d, got %d", concatVersion, buf[0])
+	}
+	if _, err := r.Open(mk, msg.Ciphertext, buf); err != nil {
+		t.Fatal(err)
+	}
+	buf[0]++
+	if _, err := r.Open(mk, msg.Ciphertext, buf); err == nil {
+		t.Fatal("expected an error with a different version")
+	}
+	if _, _, err := SplitConcat(buf); err == nil {
+		t.Fatal("expected an error with an unknown version")
+	}
+}
+
+// errWriterTo is an io.WriterTo that always fails.
+type errWriterTo struct{}
+
+func (errWriterTo) WriteTo(io.Writer) (int64, error) {
+	return 0, errors.New("failed")
+}
+
+// TestSealAD tests that SealAD and OpenAD are equivalent to Seal
+// and Open with the digest of the additional data.
+func TestSealAD(t *testing.T) {
+	test := func(t *testing.T, fn func(*testing.T) Ratchet) {
+		r := fn(t)
+		SK := make([]byte, 32)
+		priv, err := r.Generate(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		alice, err := NewSend(r, append([]byte(nil), SK...), r.Public(priv))
+		if err != nil {
+			t.Fatal(err)
+		}
+		bob, err := NewRecv(r, SK, priv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ad := make([]byte, 1<<20)
+		if _, err := rand.Read(ad); err != nil {
+			t.Fatal(err)
+		}
+		digest, err := digestAD(r, bytes.NewReader(ad))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		msg, err := alice.SealAD([]byte("hello"), bytes.NewReader(ad))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := bob.OpenAD(msg, bytes.NewReader(ad[1:])); err == nil {
+			t.Fatal("expected an error with different additional data")
+		}
+		if _, err := bob.Open(msg, ad); err == nil {
+			t.Fatal("expected an error with undigested additional data")
+		}
+		if _, err := bob.OpenAD(msg, bytes.NewReader(ad)); err != nil {
+			t.Fatal(err)
+		}
+
+		msg, err = alice.Seal([]byte("hello"), digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := bob.OpenAD(msg, bytes.NewBuffer(ad)); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := alice.SealAD(nil, errWriterTo{}); err == nil {
+			t.Fatal("expected an error")
+		}
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			test(t, tc.fn)
+		})
+	}
+}
+
+// TestPublicKeys tests PeerPublicKey and LocalPublicKey.
+func TestPublicKeys(t *testing.T) {
+	r := DJB(t.Name())
+	SK := make([]byte, 32)
+	priv, err := r.Generate(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err := NewSend(r, append([]byte(nil), SK...), r.Public(priv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := NewRecv(r, SK, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pub := bob.PeerPublicKey(); pub != nil {
+		t.Fatalf("expected nil, got %x", pub)
+	}
+	if got, want := bob.LocalPublicKey(), r.Public(priv); !got.Equal(want) {
+		t.Fatalf("expected %x, got %x", want, got)
+	}
+	if got, want := alice.PeerPublicKey(), r.Public(priv); !got.Equal(want) {
+		t.Fatalf("expected %x, got %x", want, got)
+	}
+
+	send := func(from, to *Session) {
+		t.Helper()
+		msg, err := from.Seal([]byte("hello"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := to.Open(msg, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send(alice, bob)
+	if !bob.PeerPublicKey().Equal(alice.LocalPublicKey()) {
+		t.Fatal("Bob's peer key should be Alice's local key")
+	}
+	prevAlice, prevBob := alice.LocalPublicKey(), bob.LocalPublicKey()
+
+	// Bob's reply and Alice's response each perform a ratchet
+	// step.
+	send(bob, alice)
+	send(alice, bob)
+	if bob.LocalPublicKey().Equal(prevBob) {
+		t.Fatal("Bob's local key did not change")
+	}
+	if alice.LocalPublicKey().Equal(prevAlice) {
+		t.Fatal("Alice's local key did not change")
+	}
+	if !bob.PeerPublicKey().Equal(alice.LocalPublicKey()) {
+		t.Fatal("Bob's peer key should be Alice's local key")
+	}
+	// Alice learns Bob's new key from his next message.
+	if alice.PeerPublicKey().Equal(bob.LocalPublicKey()) {
+		t.Fatal("Alice should not know Bob's new key yet")
+	}
+	send(bob, alice)
+	if !alice.PeerPublicKey().Equal(bob.LocalPublicKey()) {
+		t.Fatal("Alice's peer key should be Bob's local key")
+	}
+
+	// The results are copies.
+	pub := bob.PeerPublicKey()
+	pub[0] ^= 1
+	if bob.PeerPublicKey().Equal(pub) {
+		t.Fatal("PeerPublicKey returned internal state")
+	}
+	pub = bob.LocalPublicKey()
+	pub[0] ^= 1
+	if bob.LocalPublicKey().Equal(pub) {
+		t.Fatal("LocalPublicKey returned internal state")
+	}
+
+	if err := bob.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if bob.PeerPublicKey() != nil || bob.LocalPublicKey() != nil {
+		t.Fatal("expected nil keys after Close")
+	}
+}
+
+// TestBindAD tests that BindAD is unambiguous and that Open
+// rejects a message whose components were split differently.
+func TestBindAD(t *testing.T) {
+	for i, tc := range []struct {
+		a, b [][]byte
+	}{
+		{
+			[][]byte{[]byte("a"), []byte("bc")},
+			[][]byte{[]byte("ab"), []byte("c")},
+		},
+		{
+			[][]byte{[]byte("abc")},
+			[][]byte{[]byte("abc"), nil},
+		},
+		{
+			[][]byte{},
+			[][]byte{nil},
+		},
+		{
+			[][]byte{nil, []byte("a")},
+			[][]byte{[]byte("a"), nil},
+		},
+	} {
+		if bytes.Equal(BindAD(tc.a...), BindAD(tc.b...)) {
+			t.Fatalf("#%d: %q and %q are ambiguous", i, tc.a, tc.b)
+		}
+	}
+	if got, want := BindAD([]byte("a"), []byte("bc")), []byte("\x01a\x02bc"); !bytes.Equal(got, want) {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+
+	r := DJB(t.Name())
+	SK := make([]byte, 32)
+	priv, err := r.Generate(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err := NewSend(r, append([]byte(nil), SK...), r.Public(priv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := NewRecv(r, SK, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := alice.Seal([]byte("hello"), BindAD([]byte("a"), []byte("bc")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bob.Open(msg, BindAD([]byte("ab"), []byte("c"))); err == nil {
+		t.Fatal("expected an error")
+	}
+	if _, err := bob.Open(msg, BindAD([]byte("a"), []byte("bc"))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestMalformedKEMCiphertext tests that Open returns an error
+// instead of panicking when the header's KEM ciphertext is
+// malformed.
+func TestMalformedKEMCiphertext(t *testing.T) {
+	fn := func(t *testing.T) Ratchet { return X25519MLKEM768(t.Name()) }
+
+	SK := make([]byte, 32)
+	priv, err := fn(t).Generate(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err := NewSend(fn(t), SK, fn(t).Public(priv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := alice.Seal([]byte("hello"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ct := msg.Header.KEMCiphertext
+	if len(ct) == 0 {
+		t.Fatal("missing KEM ciphertext")
+	}
+	for i, c := range [][]byte{
+		nil,
+		ct[:1],
+		ct[:len(ct)-1],
+		append(ct[:len(ct):len(ct)], 0),
+	} {
+		bob, err := NewRecv(fn(t),
+			append([]byte(nil), SK...),
+			append(PrivateKey(nil), priv...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		bad := msg
+		bad.Header.KEMCiphertext = c
+		if _, err := bob.Open(bad, nil); err == nil {
+			t.Fatalf("#%d: expected an error", i)
+		}
+	}
+}
+
+// plainRatchet hides any optional interfaces implemented by the
+// underlying Ratchet.
+type plainRatchet struct {
+	Ratchet
+}
+
+// kdfckRatchet counts calls to KDFck.
+type kdfckRatchet struct {
+	Ratchet
+	calls int
+}
+
+func (r *kdfckRatchet) KDFck(ck ChainKey) (ChainKey, MessageKey) {
+	r.calls++
+	return r.Ratchet.KDFck(ck)
+}
+
+// TestUniformTiming tests that WithUniformTiming derives a
+// message key when opening a skipped message.
+func TestUniformTiming(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		r := &kdfckRatchet{Ratchet: DJB(t.Name())}
+		SK := make([]byte, 32)
+		priv, err := r.Generate(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bob, err := NewRecv(r, append([]byte(nil), SK...), priv,
+			WithUniformTiming(enabled))
+		if err != nil {
+			t.Fatal(err)
+		}
+		alice, err := NewSend(r, SK, r.Public(priv))
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs := make([]Message, 3)
+		for i := range msgs {
+			msgs[i], err = alice.Seal([]byte("hello"), nil)
+			if err != nil {
+				t.Fatalf("#%d: %v", i, err)
+			}
+		}
+		if _, err := bob.Open(msgs[1], nil); err != nil {
+			t.Fatal(err)
+		}
+
+		// In order.
+		r.calls = 0
+		if _, err := bob.Open(msgs[2], nil); err != nil {
+			t.Fatal(err)
+		}
+		if r.calls != 1 {
+			t.Fatalf("%t: expected 1 call, got %d", enabled, r.calls)
+		}
+
+		// Skipped.
+		r.calls = 0
+		if _, err := bob.Open(msgs[0], nil); err != nil {
+			t.Fatal(err)
+		}
+		want := 0
+		if enabled {
+			want = 1
+		}
+		if r.calls != want {
+			t.Fatalf("%t: expected %d calls, got %d", enabled, want, r.calls)
+		}
+	}
+}
+
+// TestSealToOpenTo tests that SealTo and OpenTo append to the
+// provided buffers, with and without AppendRatchet.
+func TestSealToOpenTo(t *testing.T) {
+	test := func(t *testing.T, fn func(*testing.T) Ratchet) {
+		SK := make([]byte, 32)
+		if _, err := rand.Read(SK); err != nil {
+			t.Fatal(err)
+		}
+		priv, err := fn(t).Generate(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bob, err := NewRecv(fn(t), append([]byte(nil), SK...), priv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		alice, err := NewSend(fn(t), SK, fn(t).Public(priv))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		prefix := []byte("prefix")
+		plaintext := make([]byte, 256)
+		ad := []byte("ad")
+		for i := 0; i < 10; i++ {
+			rand.Read(plaintext)
+			send, recv := alice, bob
+			if i%2 != 0 {
+				send, recv = bob, alice
+			}
+			ct, h, err := send.SealTo(append([]byte(nil), prefix...), plaintext, ad)
+			if err != nil {
+				t.Fatalf("#%d: %v", i, err)
+			}
+			if !bytes.HasPrefix(ct, prefix) {
+				t.Fatalf("#%d: SealTo clobbered dst: %q", i, ct)
+			}
+			msg := Message{Header: h, Ciphertext: ct[len(prefix):]}
+			got, err := recv.OpenTo(append([]byte(nil), prefix...), msg, ad)
+			if err != nil {
+				t.Fatalf("#%d: %v", i, err)
+			}
+			if !bytes.HasPrefix(got, prefix) {
+				t.Fatalf("#%d: OpenTo clobbered dst: %q", i, got)
+			}
+			if !hmac.Equal(plaintext, got[len(prefix):]) {
+				t.Fatalf("#%d: expected %#x, got %#x", i, plaintext, got[len(prefix):])
+			}
+		}
+	}
+	for _, tc := range testCases {
+		fn := tc.fn
+		t.Run(tc.name, func(t *testing.T) {
+			test(t, fn)
+		})
+		t.Run(tc.name+"/Plain", func(t *testing.T) {
+			test(t, func(t *testing.T) Ratchet {
+				return plainRatchet{fn(t)}
+			})
+		})
+	}
+}
+
+// newBenchSessions returns a connected (sender, receiver) pair.
+func newBenchSessions(b *testing.B, r Ratchet) (alice, bob *Session) {
+	SK := make([]byte, 32)
+	if _, err := rand.Read(SK); err != nil {
+		b.Fatal(err)
+	}
+	priv, err := r.Generate(rand.Reader)
+	if err != nil {
+		b.Fatal(err)
+	}
+	bob, err = NewRecv(r, append([]byte(nil), SK...), priv)
+	if err != nil {
+		b.Fatal(err)
+	}
+	alice, err = NewSend(r, SK, r.Public(priv))
+	if err != nil {
+		b.Fatal(err)
+	}
+	return alice, bob
+}
+
+// benchCases are the Ratchets used by the benchmarks.
+var benchCases = []struct {
+	name string
+	fn   func(namespace string) Ratchet
+}{
+	{"P-256", func(ns string) Ratchet {
+		return NIST(elliptic.P256(), sha256.New, ns)
+	}},
+	{"DJB", func(ns string) Ratchet { return DJB(ns) }},
+	{"DJB-SHA-256", func(ns string) Ratchet {
+		return DJB(ns, WithKDFHash(sha256.New))
+	}},
+	{"DJB-KeyedBLAKE2b", func(ns string) Ratchet {
+		return DJB(ns, WithKeyedBLAKE2b())
+	}},
+}
+
+// benchSize is the size of the plaintext used by the
+// benchmarks.
+const benchSize = 4096
+
+// BenchmarkSeal measures Seal without any ratchet steps.
+func BenchmarkSeal(b *testing.B) {
+	for _, bc := range benchCases {
+		b.Run(bc.name, func(b *testing.B) {
+			alice, _ := newBenchSessions(b, bc.fn(b.Name()))
+			plaintext := make([]byte, benchSize)
+			b.SetBytes(benchSize)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := alice.Seal(plaintext, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkSealBytes compares SealBytes with Seal followed by
+// encoding the message by hand.
+func BenchmarkSealBytes(b *testing.B) {
+	for _, bc := range benchCases {
+		b.Run(bc.name, func(b *testing.B) {
+			plaintext := make([]byte, benchSize)
+			b.Run("SealBytes", func(b *testing.B) {
+				alice, _ := newBenchSessions(b, bc.fn(b.Name()))
+				b.SetBytes(benchSize)
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if _, err := alice.SealBytes(plaintext, nil); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+			b.Run("Seal", func(b *testing.B) {
+				alice, _ := newBenchSessions(b, bc.fn(b.Name()))
+				b.SetBytes(benchSize)
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					msg, err := alice.Seal(plaintext, nil)
+					if err != nil {
+						b.Fatal(err)
+					}
+					buf := make([]byte, 5, 5+msg.Header.size()+len(msg.Ciphertext))
+					buf[0] = messageVersion
+					binary.BigEndian.PutUint32(buf[1:5], uint32(msg.Header.size()))
+					buf = msg.Header.Append(buf)
+					_ = append(buf, msg.Ciphertext...)
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkOpen measures Open for in-order messages without any
+// ratchet steps.
+func BenchmarkOpen(b *testing.B) {
+	for _, bc := range benchCases {
+		b.Run(bc.name, func(b *testing.B) {
+			alice, bob := newBenchSessions(b, bc.fn(b.Name()))
+			plaintext := make([]byte, benchSize)
+			msgs := make([]Message, b.N)
+			for i := range msgs {
+				var err error
+				msgs[i], err = alice.Seal(plaintext, nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.SetBytes(benchSize)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := bob.Open(msgs[i], nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkRatchetStep measures a round trip where every
+// message forces a Diffie-Hellman ratchet step.
+func BenchmarkRatchetStep(b *testing.B) {
+	for _, bc := range benchCases {
+		b.Run(bc.name, func(b *testing.B) {
+			alice, bob := newBenchSessions(b, bc.fn(b.Name()))
+			plaintext := make([]byte, benchSize)
+			b.SetBytes(2 * benchSize)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for _, p := range [][2]*Session{{alice, bob}, {bob, alice}} {
+					msg, err := p[0].Seal(plaintext, nil)
+					if err != nil {
+						b.Fatal(err)
+					}
+					if _, err := p[1].Open(msg, nil); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkRatchet measures a single Diffie-Hellman ratchet
+// step (State.ratchet) without any symmetric-key operations.
+func BenchmarkRatchet(b *testing.B) {
+	for _, bc := range benchCases {
+		b.Run(bc.name, func(b *testing.B) {
+			r := bc.fn(b.Name())
+			alice, bob := newBenchSessions(b, r)
+			msg, err := alice.Seal(nil, nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				s := bob.state.Clone()
+				if err := s.ratchet(r, rand.Reader, msg.Header, nil); err != nil {
+					b.Fatal(err)
+				}
+				s.wipe()
+			}
+		})
+	}
+}
+
+// BenchmarkKDFck measures a single step of the sending or
+// receiving chain.
+func BenchmarkKDFck(b *testing.B) {
+	for _, bc := range benchCases {
+		b.Run(bc.name, func(b *testing.B) {
+			r := bc.fn(b.Name())
+			ck := make(ChainKey, KeySize)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				ck, _ = r.KDFck(ck)
+			}
+		})
+	}
+}
+
+// BenchmarkKDFrk measures a single step of the root chain.
+func BenchmarkKDFrk(b *testing.B) {
+	for _, bc := range benchCases {
+		b.Run(bc.name, func(b *testing.B) {
+			r := bc.fn(b.Name())
+			rk := make(RootKey, KeySize)
+			dh := make([]byte, 32)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				rk, _ = r.KDFrk(rk, dh)
+			}
+		})
+	}
+}
+
+// BenchmarkSealTo compares the allocations made by Seal and
+// SealTo.
+func BenchmarkSealTo(b *testing.B) {
+	plaintext := make([]byte, 1024)
+	ad := make([]byte, 32)
+
+	b.Run("Seal", func(b *testing.B) {
+		alice, _ := newBenchSessions(b, DJB(b.Name()))
+		b.SetBytes(int64(len(plaintext)))
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := alice.Seal(plaintext, ad); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("SealTo", func(b *testing.B) {
+		alice, _ := newBenchSessions(b, DJB(b.Name()))
+		buf := make([]byte, 0, 2*len(plaintext))
+		b.SetBytes(int64(len(plaintext)))
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			var err error
+			buf, _, err = alice.SealTo(buf[:0], plaintext, ad)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkOpenTo compares the allocations made by Open and
+// OpenTo.
+func BenchmarkOpenTo(b *testing.B) {
+	plaintext := make([]byte, 1024)
+	ad := make([]byte, 32)
+
+	setup := func(b *testing.B) (*Session, []Message) {
+		alice, bob := newBenchSessions(b, DJB(b.Name()))
+		msgs := make([]Message, b.N)
+		for i := range msgs {
+			var err error
+			msgs[i], err = alice.Seal(plaintext, ad)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+		return bob, msgs
+	}
+	b.Run("Open", func(b *testing.B) {
+		bob, msgs := setup(b)
+		b.SetBytes(int64(len(plaintext)))
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := bob.Open(msgs[i], ad); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("OpenTo", func(b *testing.B) {
+		bob, msgs := setup(b)
+		buf := make([]byte, 0, len(plaintext))
+		b.SetBytes(int64(len(plaintext)))
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			var err error
+			buf, err = bob.OpenTo(buf[:0], msgs[i], ad)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// TestReplay tests that replayed messages are rejected with
+// ErrReplay, including after the session is resumed.
+func TestReplay(t *testing.T) {
+	test := func(t *testing.T, fn func(*testing.T) Ratchet) {
+		SK := make([]byte, 32)
+		if _, err := rand.Read(SK); err != nil {
+			t.Fatal(err)
+		}
+		priv, err := fn(t).Generate(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		const (
+			window = 5
+		)
+		bob, err := NewRecv(fn(t), append([]byte(nil), SK...), priv,
+			WithReplayWindow(window))
+		if err != nil {
+			t.Fatal(err)
+		}
+		alice, err := NewSend(fn(t), SK, fn(t).Public(priv))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		msgs := make([]Message, window+1)
+		for i := range msgs {
+			msgs[i], err = alice.Seal([]byte("hello"), nil)
+			if err != nil {
+				t.Fatalf("#%d: %v", i, err)
+			}
+		}
+		// Open the first message in order and the remaining
+		// messages out of order so that both in-order and
+		// skipped messages are covered.
+		order := []int{0}
+		for i := len(msgs) - 1; i > 0; i-- {
+			order = append(order, i)
+		}
+		for _, i := range order {
+			if _, err := bob.Open(msgs[i], nil); err != nil {
+				t.Fatalf("#%d: %v", i, err)
+			}
+		}
+
+		// The first message has been evicted from the window.
+		if _, err := bob.Open(msgs[0], nil); err == nil || errors.Is(err, ErrReplay) {
+			t.Fatalf("#0: expected a non-replay error, got %v", err)
+		}
+		for _, i := range order[1:] {
+			if _, err := bob.Open(msgs[i], nil); !errors.Is(err, ErrReplay) {
+				t.Fatalf("#%d: expected %v, got %v", i, ErrReplay, err)
+			}
+		}
+
+		data, err := bob.state.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var state State
+		if err := state.UnmarshalBinary(data); err != nil {
+			t.Fatal(err)
+		}
+		bob, err = Resume(fn(t), &state, WithReplayWindow(window))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := bob.Open(msgs[len(msgs)-1], nil); !errors.Is(err, ErrReplay) {
+			t.Fatalf("expected %v after Resume, got %v", ErrReplay, err)
+		}
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			test(t, tc.fn)
+		})
+	}
+}
+
+// TestState tests that State returns a copy that is independent
+// of the session.
+func TestState(t *testing.T) {
+	for _, tc := range testCases {
+		fn := tc.fn
+		t.Run(tc.name, func(t *testing.T) {
+			SK := make([]byte, 32)
+			priv, err := fn(t).Generate(rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			alice, err := NewSend(fn(t), SK, fn(t).Public(priv))
+			if err != nil {
+				t.Fatal(err)
+			}
+			snap := alice.State()
+			want := snap.Clone()
+
+			// Advancing the session must not affect the
+			// snapshot.
+			for i := 0; i < 3; i++ {
+				if _, err := alice.Seal([]byte("hello"), nil); err != nil {
+					t.Fatalf("#%d: %v", i, err)
+				}
+			}
+			if !reflect.DeepEqual(snap, want) {
+				t.Fatalf("snapshot changed: expected %#v, got %#v", want, snap)
+			}
+
+			// Mutating the snapshot must not affect the
+			// session.
+			cur := alice.State()
+			for i := range snap.CKs {
+				snap.CKs[i] ^= 0xff
+			}
+			snap.RK[0] ^= 0xff
+			if !reflect.DeepEqual(alice.State(), cur) {
+				t.Fatal("session changed after mutating its snapshot")
+			}
+
+			if err := alice.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if s := alice.State(); s != nil {
+				t.Fatalf("expected nil after Close, got %#v", s)
+			}
+		})
+	}
+}
+
+// fakeClock is a Clock that only advances when told to.
+type fakeClock struct {
+	now time.Time
+}
+
+var _ Clock = (*fakeClock)(nil)
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+// advance moves the clock forward by d.
+func (c *fakeClock) advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+// TestSkipTTL tests that skipped message keys expire.
+func TestSkipTTL(t *testing.T) {
+	fn := func(t *testing.T) Ratchet { return DJB(t.Name()) }
+
+	SK := make([]byte, 32)
+	priv, err := fn(t).Generate(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := &fakeClock{now: time.Unix(0, 0)}
+
+	const (
+		ttl = 24 * time.Hour
+	)
+	bob, err := NewRecv(fn(t), append([]byte(nil), SK...), priv,
+		WithSkipTTL(ttl), WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err := NewSend(fn(t), SK, fn(t).Public(priv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs := make([]Message, 4)
+	for i := range msgs {
+		msgs[i], err = alice.Seal([]byte("hello"), nil)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+	}
+
+	// Skip messages 0 through 2.
+	if _, err := bob.Open(msgs[3], nil); err != nil {
+		t.Fatal(err)
+	}
+	store := bob.store.(storeContext).Store.(*memory)
+	if n := len(store.keys); n != 3 {
+		t.Fatalf("expected 3 skipped keys, got %d", n)
+	}
+
+	clock.advance(ttl - time.Second)
+	if _, err := bob.Open(msgs[0], nil); err != nil {
+		t.Fatal(err)
+	}
+	var keys []MessageKey
+	for _, k := range store.keys {
+		keys = append(keys, k.key)
+	}
+	clock.advance(time.Second)
+	for _, i := range []int{1, 2} {
+		if _, err := bob.Open(msgs[i], nil); err == nil {
+			t.Fatalf("#%d: expected an error", i)
+		}
+	}
+	for i, key := range keys {
+		for _, c := range key {
+			if c != 0 {
+				t.Fatalf("#%d: key was not wiped: %#x", i, key)
+			}
+		}
+	}
+	if n := len(store.keys); n != 0 {
+		t.Fatalf("expected 0 skipped keys, got %d", n)
+	}
+}
+
+// TestSkipEviction tests that EvictOldest wipes and removes the
+// oldest skipped message keys instead of rejecting new ones.
+func TestSkipEviction(t *testing.T) {
+	const (
+		maxSkip = 10
+		extra   = 5
+		// memory allows maxSkip+1 keys.
+		total = maxSkip + 1 + extra
+	)
+	m := &memory{maxSkip: maxSkip, evict: EvictOldest}
+	pub := PublicKey("public key")
+	keys := make([]MessageKey, total)
+	for i := range keys {
+		keys[i] = bytes.Repeat([]byte{byte(i + 1)}, KeySize)
+		if err := m.StoreKey(i, pub, keys[i]); err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+	}
+	if n := len(m.keys); n != maxSkip+1 {
+		t.Fatalf("expected %d keys, got %d", maxSkip+1, n)
+	}
+	for i, key := range keys {
+		_, err := m.LoadKey(i, pub)
+		if i < extra {
+			if !errors.Is(err, ErrNotFound) {
+				t.Fatalf("#%d: expected %v, got %v", i, ErrNotFound, err)
+			}
+			if !bytes.Equal(key, make([]byte, KeySize)) {
+				t.Fatalf("#%d: key was not wiped: %#x", i, key)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if key[0] != byte(i+1) {
+			t.Fatalf("#%d: key was wiped", i)
+		}
+	}
+
+	// The default is to reject new keys.
+	m = &memory{maxSkip: maxSkip}
+	for i := 0; i < maxSkip+1; i++ {
+		if err := m.StoreKey(i, pub, make(MessageKey, KeySize)); err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+	}
+	if err := m.StoreKey(maxSkip+1, pub, make(MessageKey, KeySize)); !errors.Is(err, ErrTooManySkipped) {
+		t.Fatalf("expected %v, got %v", ErrTooManySkipped, err)
+	}
+
+	s, err := NewRecv(DJB(t.Name()), make([]byte, KeySize), nil,
+		WithSkipEviction(EvictOldest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.rawStore().(*memory).evict; got != EvictOldest {
+		t.Fatalf("expected %d, got %d", EvictOldest, got)
+	}
+}
+
+// TestPruneKeys tests that skipped message keys for receiving
+// chains two or more steps old are pruned.
+func TestPruneKeys(t *testing.T) {
+	fn := func(t *testing.T) Ratchet { return DJB(t.Name()) }
+
+	SK := make([]byte, 32)
+	priv, err := fn(t).Generate(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := NewRecv(fn(t), append([]byte(nil), SK...), priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err := NewSend(fn(t), SK, fn(t).Public(priv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := bob.store.(storeContext).Store.(*memory)
+
+	// Each generation, Alice sends three messages and Bob only
+	// opens the last, skipping two. Bob then replies so that
+	// Alice's next generation uses a new ratchet key.
+	const (
+		G = 4
+	)
+	skipped := make([][]Message, G)
+	for g := 0; g < G; g++ {
+		var msgs []Message
+		for i := 0; i < 3; i++ {
+			msg, err := alice.Seal([]byte("hello"), nil)
+			if err != nil {
+				t.Fatalf("%d/%d: %v", g, i, err)
+			}
+			msgs = append(msgs, msg)
+		}
+		if _, err := bob.Open(msgs[2], nil); err != nil {
+			t.Fatalf("#%d: %v", g, err)
+		}
+		skipped[g] = msgs[:2]
+
+		// Only the current and previous generations are kept.
+		want := 2 * (g + 1)
+		if want > 4 {
+			want = 4
+		}
+		if n := len(store.keys); n != want {
+			t.Fatalf("#%d: expected %d skipped keys, got %d", g, want, n)
+		}
+
+		reply, err := bob.Seal([]byte("hi"), nil)
+		if err != nil {
+			t.Fatalf("#%d: %v", g, err)
+		}
+		if _, err := alice.Open(reply, nil); err != nil {
+			t.Fatalf("#%d: %v", g, err)
+		}
+	}
+	for g, msgs := range skipped {
+		for i, msg := range msgs {
+			_, err := bob.Open(msg, nil)
+			if g < G-2 {
+				if err == nil {
+					t.Fatalf("%d/%d: expected an error", g, i)
+				}
+			} else if err != nil {
+				t.Fatalf("%d/%d: %v", g, i, err)
+			}
+		}
+	}
+}
+
+// TestPeerKeyValidator tests that Open returns the validator's
+// error without modifying the session, and that the validator is
+// only called for new ratchet keys.
+func TestPeerKeyValidator(t *testing.T) {
+	r := DJB(t.Name())
+	SK := make([]byte, 32)
+	priv, err := r.Generate(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err := NewSend(r, append([]byte(nil), SK...), r.Public(priv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	errRejected := errors.New("rejected")
+	var (
+		rejected PublicKey
+		calls    int
+	)
+	bob, err := NewRecv(r, SK, priv,
+		WithPeerKeyValidator(func(pub PublicKey) error {
+			calls++
+			if pub.Equal(rejected) {
+				return errRejected
+			}
+			return nil
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := alice.Seal([]byte("hello"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rejected = msg.Header.PublicKey
+	want := bob.State()
+	if _, err := bob.Open(msg, nil); !errors.Is(err, errRejected) {
+		t.Fatalf("expected %v, got %v", errRejected, err)
+	}
+	if got := bob.State(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %#v, got %#v", want, got)
+	}
+
+	rejected = nil
+	calls = 0
+	for i := 0; i < 3; i++ {
+		msg, err := alice.Seal([]byte("hello"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := bob.Open(msg, nil); err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+	}
+	if _, err := bob.Open(msg, nil); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 {
+		t.Fatalf("expected 1 call, got %d", calls)
+	}
+}
+
+// TestKeepOldChains tests that WithKeepOldChains retains skipped
+// message keys from receiving chains two or more steps old.
+func TestKeepOldChains(t *testing.T) {
+	for _, tc := range testCases {
+		fn := tc.fn
+		t.Run(tc.name, func(t *testing.T) {
+			SK := make([]byte, 32)
+			priv, err := fn(t).Generate(rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			bob, err := NewRecv(fn(t), append([]byte(nil), SK...), priv,
+				WithKeepOldChains(true))
+			if err != nil {
+				t.Fatal(err)
+			}
+			alice, err := NewSend(fn(t), SK, fn(t).Public(priv))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Each generation, Alice sends three messages and Bob
+			// opens only the last, then replies so that Alice's
+			// next generation uses a new ratchet key.
+			const (
+				G = 3
+			)
+			var skipped [][]Message
+			for g := 0; g < G; g++ {
+				var msgs []Message
+				for i := 0; i < 3; i++ {
+					msg, err := alice.Seal([]byte(fmt.Sprint(g, i)), nil)
+					if err != nil {
+						t.Fatalf("%d/%d: %v", g, i, err)
+					}
+					msgs = append(msgs, msg)
+				}
+				if _, err := bob.Open(msgs[2], nil); err != nil {
+					t.Fatalf("#%d: %v", g, err)
+				}
+				skipped = append(skipped, msgs[:2])
+
+				reply, err := bob.Seal([]byte("hi"), nil)
+				if err != nil {
+					t.Fatalf("#%d: %v", g, err)
+				}
+				if _, err := alice.Open(reply, nil); err != nil {
+					t.Fatalf("#%d: %v", g, err)
+				}
+			}
+
+			// Open the oldest generation last.
+			for g := G - 1; g >= 0; g-- {
+				for i, msg := range skipped[g] {
+					got, err := bob.Open(msg, nil)
+					if err != nil {
+						t.Fatalf("%d/%d: %v", g, i, err)
+					}
+					if want := fmt.Sprint(g, i); string(got) != want {
+						t.Fatalf("%d/%d: expected %q, got %q", g, i, want, got)
+					}
+				}
+			}
+			if n, err := bob.SkippedCount(); err != nil || n != 0 {
+				t.Fatalf("expected no skipped keys, got %d (%v)", n, err)
+			}
+		})
+	}
+}
+
+// TestMessageMarshal tests that Message survives a round trip
+// through MarshalBinary and UnmarshalBinary.
+func TestMessageMarshal(t *testing.T) {
+	for i, want := range []Message{
+		{Header: Header{PublicKey: PublicKey{}}},
+		{
+			Header:     Header{PublicKey: PublicKey("pub"), PN: 1, N: 2},
+			Ciphertext: []byte("ciphertext"),
+		},
+		{
+			Header: Header{
+				PublicKey:     PublicKey("pub"),
+				PN:            1 << 40,
+				KEMCiphertext: []byte("ct"),
+			},
+			Ciphertext: []byte("ciphertext"),
+		},
+	} {
+		data, err := want.MarshalBinary()
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		var got Message
+		if err := got.UnmarshalBinary(data); err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("#%d: expected %#v, got %#v", i, want, got)
+		}
+		// The header length must cover exactly one header.
+		for _, d := range []int{-1, 1} {
+			bad := append([]byte(nil), data...)
+			n := binary.BigEndian.Uint32(bad[1:5])
+			binary.BigEndian.PutUint32(bad[1:5], uint32(int(n)+d))
+			if err := got.UnmarshalBinary(bad); err == nil {
+				t.Fatalf("#%d: expected an error for header length %d", i, int(n)+d)
+			}
+		}
+		for n := 0; n < len(data)-len(want.Ciphertext); n++ {
+			if err := got.UnmarshalBinary(data[:n]); err == nil {
+				t.Fatalf("#%d: expected an error for length %d", i, n)
+			}
+		}
+	}
+}
+
+// TestMessageMarshalGolden tests the Message encoding against a
+// fixed vector.
+func TestMessageMarshalGolden(t *testing.T) {
+	msg := Message{
+		Header: Header{
+			PublicKey: PublicKey{0xaa, 0xbb},
+			PN:        1,
+			N:         2,
+		},
+		Ciphertext: []byte{0xcc, 0xdd, 0xee},
+	}
+	want := []byte{
+		0x01,                   // version
+		0x00, 0x00, 0x00, 0x15, // len(header)
+		0x01,                                           // header version
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, // PN
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, // N
+		0x00, 0x02, // len(PublicKey)
+		0xaa, 0xbb, // PublicKey
+		0xcc, 0xdd, 0xee, // ciphertext
+	}
+	got, err := msg.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("expected %#x, got %#x", want, got)
+	}
+}
+
+// TestOpenBytes tests that OpenBytes opens messages sealed with
+// SealBytes and rejects malformed ones without panicking.
+func TestOpenBytes(t *testing.T) {
+	for _, tc := range testCases {
+		fn := tc.fn
+		t.Run(tc.name, func(t *testing.T) {
+			alice, bob := newSessions(t, fn)
+			data, err := alice.SealBytes([]byte("hello"), []byte("ad"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var msg Message
+			if err := msg.UnmarshalBinary(data); err != nil {
+				t.Fatal(err)
+			}
+
+			for n := 0; n < len(data); n++ {
+				if _, err := bob.OpenBytes(data[:n], []byte("ad")); err == nil {
+					t.Fatalf("expected an error for length %d", n)
+				}
+			}
+			// The public key must have the Ratchet's size.
+			bad := msg
+			bad.Header.PublicKey = append(bytes.Clone(msg.Header.PublicKey), 0)
+			badData, err := bad.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := bob.OpenBytes(badData, []byte("ad")); !errors.Is(err, ErrInvalidHeader) {
+				t.Fatalf("expected %v, got %v", ErrInvalidHeader, err)
+			}
+
+			got, err := bob.OpenBytes(data, []byte("ad"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, []byte("hello")) {
+				t.Fatalf("expected %q, got %q", "hello", got)
+			}
+
+			// And in the other direction.
+			data, err = bob.SealBytes(nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err = alice.OpenBytes(data, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != 0 {
+				t.Fatalf("expected an empty plaintext, got %q", got)
+			}
+		})
+	}
+}
+
+// TestTooManySkipped tests that Open returns ErrTooManySkipped
+// when a message skips more messages than the store allows.
+func TestTooManySkipped(t *testing.T) {
+	for _, tc := range testCases {
+		fn := tc.fn
+		t.Run(tc.name, func(t *testing.T) {
+			SK := make([]byte, 32)
+			priv, err := fn(t).Generate(rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			bob, err := NewRecv(fn(t), append([]byte(nil), SK...), priv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			alice, err := NewSend(fn(t), SK, fn(t).Public(priv))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var msg Message
+			for i := 0; i < defaultMaxSkip+10; i++ {
+				msg, err = alice.Seal([]byte("hello"), nil)
+				if err != nil {
+					t.Fatalf("#%d: %v", i, err)
+				}
+			}
+			_, err = bob.Open(msg, nil)
+			if !errors.Is(err, ErrTooManySkipped) {
+				t.Fatalf("expected %v, got %v", ErrTooManySkipped, err)
+			}
+		})
+	}
+}
+
+// TestOpenTampered tests that a message that fails
+// authentication does not leave skipped message keys or state
+// changes behind in the store.
+func TestOpenTampered(t *testing.T) {
+	for _, tc := range testCases {
+		fn := tc.fn
+		t.Run(tc.name, func(t *testing.T) {
+			SK := make([]byte, 32)
+			priv, err := fn(t).Generate(rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			store := &countStore{memory: memory{maxSkip: defaultMaxSkip}}
+			bob, err := NewRecv(fn(t), append([]byte(nil), SK...), priv,
+				WithStore(store))
+			if err != nil {
+				t.Fatal(err)
+			}
+			alice, err := NewSend(fn(t), SK, fn(t).Public(priv))
+			if err != nil {
+				t.Fatal(err)
+			}
+			msgs := make([]Message, 5)
+			for i := range msgs {
+				msgs[i], err = alice.Seal([]byte(fmt.Sprint(i)), nil)
+				if err != nil {
+					t.Fatalf("#%d: %v", i, err)
+				}
+			}
+			bad := msgs[len(msgs)-1]
+			bad.Ciphertext = bytes.Clone(bad.Ciphertext)
+			bad.Ciphertext[0] ^= 1
+			if _, err := bob.Open(bad, nil); err == nil {
+				t.Fatal("expected an error")
+			}
+			if store.stores != 0 || store.saves != 0 {
+				t.Fatalf("tampered message stored %d keys and saved %d states",
+					store.stores, store.saves)
+			}
+			if n := len(store.keys); n != 0 {
+				t.Fatalf("expected no skipped keys, got %d", n)
+			}
+
+			// The genuine messages can still be opened.
+			for i := len(msgs) - 1; i >= 0; i-- {
+				got, err := bob.Open(msgs[i], nil)
+				if err != nil {
+					t.Fatalf("#%d: %v", i, err)
+				}
+				if want := fmt.Sprint(i); string(got) != want {
+					t.Fatalf("#%d: expected %q, got %q", i, want, got)
+				}
+			}
+			if n := len(store.keys); n != 0 {
+				t.Fatalf("expected no skipped keys, got %d", n)
+			}
+		})
+	}
+}
+
+// TestSkippedCount tests that SkippedCount reflects the keys
+// buffered for out-of-order messages.
+func TestSkippedCount(t *testing.T) {
+	alice, bob := newSessions(t, func(t *testing.T) Ratchet { return DJB(t.Name()) })
+	count := func(want int) {
+		t.Helper()
+		got, err := bob.SkippedCount()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Fatalf("expected %d skipped keys, got %d", want, got)
+		}
+	}
+	count(0)
+
+	const (
+		N = 10
+	)
+	msgs := make([]Message, N)
+	for i := range msgs {
+		var err error
+		msgs[i], err = alice.Seal([]byte("hello"), nil)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+	}
+	if _, err := bob.Open(msgs[N-1], nil); err != nil {
+		t.Fatal(err)
+	}
+	count(N - 1)
+	for i := 0; i < N-1; i++ {
+		if _, err := bob.Open(msgs[i], nil); err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		count(N - 2 - i)
+	}
+
+	bob, err := Resume(DJB(t.Name()), bob.State(), WithStore(storeOnly{&memory{}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bob.SkippedCount(); err == nil {
+		t.Fatal("expected an error")
+	}
+	bob.Close()
+	if _, err := bob.SkippedCount(); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected %v, got %v", ErrClosed, err)
+	}
+}
+
+// TestExportKeys tests that skipped message keys can be moved to
+// another session along with the state.
+func TestExportKeys(t *testing.T) {
+	r := DJB(t.Name())
+	alice, bob := newSessions(t, func(t *testing.T) Ratchet { return r })
+
+	const (
+		N = 5
+	)
+	msgs := make([]Message, N)
+	for i := range msgs {
+		var err error
+		msgs[i], err = alice.Seal([]byte(fmt.Sprint(i)), nil)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+	}
+	if _, err := bob.Open(msgs[N-1], nil); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := bob.ExportKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != N-1 {
+		t.Fatalf("expected %d keys, got %d", N-1, len(keys))
+	}
+	buf, err := MarshalExportedKeys(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err = UnmarshalExportedKeys(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := UnmarshalExportedKeys(buf[:len(buf)-1]); err == nil {
+		t.Fatal("expected an error for truncated keys")
+	}
+
+	moved, err := Resume(r, bob.State())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := moved.Open(msgs[0], nil); err == nil {
+		t.Fatal("expected an error before importing keys")
+	}
+	if err := moved.ImportKeys(keys); err != nil {
+		t.Fatal(err)
+	}
+	for i := N - 2; i >= 0; i-- {
+		got, err := moved.Open(msgs[i], nil)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if want := fmt.Sprint(i); string(got) != want {
+			t.Fatalf("#%d: expected %q, got %q", i, want, got)
+		}
+	}
+
+	moved, err = Resume(r, moved.State(), WithStore(storeOnly{&memory{}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := moved.ExportKeys(); err == nil {
+		t.Fatal("expected an error")
+	}
+	if err := moved.ImportKeys(keys); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+// fakeHSM is a software-backed stand-in for a hardware security
+// module that holds a private key.
+type fakeHSM struct {
+	r     Ratchet
+	priv  PrivateKey
+	calls int
+}
+
+func (h *fakeHSM) DH(peer PublicKey) ([]byte, error) {
+	h.calls++
+	return h.r.DH(h.priv, peer)
+}
+
+// TestWithDH tests that WithDH is used for the key pair passed to
+// NewRecv and that later key pairs stay in software.
+func TestWithDH(t *testing.T) {
+	for _, tc := range testCases {
+		fn := tc.fn
+		t.Run(tc.name, func(t *testing.T) {
+			r := fn(t)
+			SK := make([]byte, 32)
+			if _, err := rand.Read(SK); err != nil {
+				t.Fatal(err)
+			}
+			priv, err := r.Generate(rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pub := r.Public(priv)
+			hsm := &fakeHSM{r: r, priv: priv}
+			handle := append(make(PrivateKey, len(priv)-len(pub)), pub...)
+			bob, err := NewRecv(r, append([]byte(nil), SK...), handle,
+				WithDH(hsm.DH))
+			if err != nil {
+				t.Fatal(err)
+			}
+			alice, err := NewSend(r, SK, pub)
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg, err := alice.Seal([]byte("hello"), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := r.(KEMRatchet); ok {
+				if _, err := bob.Open(msg, nil); err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+
+			for i := 0; i < 3; i++ {
+				if _, err := bob.Open(msg, nil); err != nil {
+					t.Fatalf("#%d: %v", i, err)
+				}
+				msg, err = bob.Seal([]byte("hello"), nil)
+				if err != nil {
+					t.Fatalf("#%d: %v", i, err)
+				}
+				if _, err := alice.Open(msg, nil); err != nil {
+					t.Fatalf("#%d: %v", i, err)
+				}
+				msg, err = alice.Seal([]byte("hello"), nil)
+				if err != nil {
+					t.Fatalf("#%d: %v", i, err)
+				}
+			}
+			if hsm.calls != 1 {
+				t.Fatalf("expected 1 call, got %d", hsm.calls)
+			}
+		})
+	}
+}
+
+// swapReader reads from r, which can be replaced.
+type swapReader struct {
+	r io.Reader
+}
+
+func (s *swapReader) Read(p []byte) (int, error) {
+	return s.r.Read(p)
+}
+
+// TestReset tests that Reset and ResetRecv reinitialize a session
+// in place and wipe the old one.
+func TestReset(t *testing.T) {
+	r := DJB(t.Name())
+	newKeys := func() ([]byte, PrivateKey) {
+		SK := make([]byte, KeySize)
+		if _, err := rand.Read(SK); err != nil {
+			t.Fatal(err)
+		}
+		priv, err := r.Generate(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return SK, priv
+	}
+
+	SK, priv := newKeys()
+	rng := &swapReader{r: rand.Reader}
+	alice, err := NewSend(r, append([]byte(nil), SK...), r.Public(priv), WithRand(rng))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := NewRecv(r, SK, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := alice.Seal([]byte("hello"), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	msg, err := alice.Seal([]byte("hello"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bob.Open(msg, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := bob.SkippedCount(); err != nil || n != 3 {
+		t.Fatalf("expected 3 skipped keys, got %d (%v)", n, err)
+	}
+	oldAlice, oldBob := alice.state, bob.state
+	epoch := alice.state.Epoch
+
+	SK, priv = newKeys()
+	rng.r = newDetReader(1)
+	if err := alice.Reset(append([]byte(nil), SK...), r.Public(priv)); err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.ResetRecv(append([]byte(nil), SK...), append(PrivateKey(nil), priv...)); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range [][]byte{oldAlice.RK, oldAlice.CKs, oldBob.RK, oldBob.CKr} {
+		if !bytes.Equal(k, make([]byte, len(k))) {
+			t.Fatalf("old key was not wiped: %#x", k)
+		}
+	}
+	if n, err := bob.SkippedCount(); err != nil || n != 0 {
+		t.Fatalf("expected no skipped keys, got %d (%v)", n, err)
+	}
+	if alice.state.Epoch != epoch {
+		t.Fatalf("expected epoch %d, got %d", epoch, alice.state.Epoch)
+	}
+
+	// The sessions are identical to new ones, apart from the
+	// epoch.
+	freshAlice, err := NewSend(r, append([]byte(nil), SK...), r.Public(priv),
+		WithRand(newDetReader(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	freshBob, err := NewRecv(r, append([]byte(nil), SK...), append(PrivateKey(nil), priv...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		got, want *Session
+	}{
+		{alice, freshAlice},
+		{bob, freshBob},
+	} {
+		got := tc.got.State()
+		got.Epoch = 0
+		if want := tc.want.State(); !reflect.DeepEqual(got, want) {
+			t.Fatalf("expected %#v, got %#v", want, got)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		msg, err := alice.Seal([]byte("hello"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := bob.Open(msg, nil); err != nil {
+			t.Fatal(err)
+		}
+		msg, err = bob.Seal([]byte("hello"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := alice.Open(msg, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := alice.Reset(make([]byte, KeySize-1), r.Public(priv)); !errors.Is(err, ErrInvalidKeySize) {
+		t.Fatalf("expected %v, got %v", ErrInvalidKeySize, err)
+	}
+}
+
+// TestResync tests that a session whose receiving chain key was
+// lost can rebuild it from a checkpoint.
+func TestResync(t *testing.T) {
+	for _, tc := range testCases {
+		fn := tc.fn
+		t.Run(tc.name, func(t *testing.T) {
+			alice, bob := newSessions(t, fn)
+			msgs := make([]Message, 4)
+			for i := range msgs {
+				var err error
+				msgs[i], err = alice.Seal([]byte("hello"), nil)
+				if err != nil {
+					t.Fatalf("#%d: %v", i, err)
+				}
+			}
+			if _, err := bob.Open(msgs[0], nil); err != nil {
+				t.Fatal(err)
+			}
+			checkpoint := bob.State()
+			if _, err := bob.Open(msgs[1], nil); err != nil {
+				t.Fatal(err)
+			}
+			if bob.NeedsResync(msgs[2]) {
+				t.Fatal("unexpected resync")
+			}
+
+			// Lose the receiving chain key.
+			wipe(bob.state.CKr)
+			bob.state.CKr = nil
+			if !bob.NeedsResync(msgs[2]) {
+				t.Fatal("expected a resync")
+			}
+			if _, err := bob.Open(msgs[2], nil); !errors.Is(err, ErrInvalidHeader) {
+				t.Fatalf("expected %v, got %v", ErrInvalidHeader, err)
+			}
+
+			for i, bad := range []*State{
+				nil,
+				alice.State(),
+				func() *State {
+					s := checkpoint.Clone()
+					s.RK[0] ^= 1
+					return s
+				}(),
+				func() *State {
+					s := checkpoint.Clone()
+					s.Nr = 3
+					return s
+				}(),
+			} {
+				if err := bob.Resync(bad); err == nil {
+					t.Fatalf("#%d: expected an error", i)
+				}
+			}
+			if err := bob.Resync(checkpoint); err != nil {
+				t.Fatal(err)
+			}
+			if bob.NeedsResync(msgs[2]) {
+				t.Fatal("unexpected resync")
+			}
+			// The chain resumes where it left off.
+			if _, err := bob.Open(msgs[1], nil); err == nil {
+				t.Fatal("expected an error for a message that was already opened")
+			}
+			for _, i := range []int{3, 2} {
+				if _, err := bob.Open(msgs[i], nil); err != nil {
+					t.Fatalf("#%d: %v", i, err)
+				}
+			}
+			msg, err := bob.Seal([]byte("hello"), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := alice.Open(msg, nil); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// TestSessionID tests that both parties derive the same session
+// identifier and that it depends on every input.
+func TestSessionID(t *testing.T) {
+	r := DJB(t.Name())
+	SK := make([]byte, KeySize)
+	if _, err := rand.Read(SK); err != nil {
+		t.Fatal(err)
+	}
+	priv, err := r.Generate(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aliceID := []byte("alice identity key")
+	bobID := []byte("bob identity key")
+
+	// Each party computes the identifier from its own copy of
+	// SK before creating its session.
+	aliceSK := bytes.Clone(SK)
+	aliceSessionID := SessionID(aliceSK, aliceID, bobID)
+	alice, err := NewSend(r, aliceSK, r.Public(priv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobSK := bytes.Clone(SK)
+	bobSessionID := SessionID(bobSK, aliceID, bobID)
+	bob, err := NewRecv(r, bobSK, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(aliceSessionID, bobSessionID) {
+		t.Fatalf("IDs differ: %x and %x", aliceSessionID, bobSessionID)
+	}
+	if len(aliceSessionID) != SessionIDSize {
+		t.Fatalf("expected %d bytes, got %d", SessionIDSize, len(aliceSessionID))
+	}
+	msg, err := alice.Seal([]byte("hello"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bob.Open(msg, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	otherSK := bytes.Clone(SK)
+	otherSK[0] ^= 1
+	for i, id := range [][]byte{
+		SessionID(otherSK, aliceID, bobID),
+		SessionID(SK, bobID, aliceID),
+		SessionID(SK, []byte("alice"), []byte(" identity keybob identity key")),
+		SessionID(SK, nil, nil),
+	} {
+		if bytes.Equal(id, aliceSessionID) {
+			t.Fatalf("#%d: expected a different ID", i)
+		}
+	}
+}
+
+// TestGaps tests that Gaps reports dropped messages in the
+// current receiving chain.
+func TestGaps(t *testing.T) {
+	r := DJB(t.Name())
+	alice, bob := newSessions(t, func(t *testing.T) Ratchet { return r })
+
+	if gaps := bob.Gaps(); gaps != nil {
+		t.Fatalf("expected no gaps, got %v", gaps)
+	}
+	const (
+		N = 6
+	)
+	msgs := make([]Message, N)
+	for i := range msgs {
+		var err error
+		msgs[i], err = alice.Seal([]byte(fmt.Sprint(i)), nil)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+	}
+	// Drop 1 and 3 and delay 5.
+	for _, i := range []int{0, 2, 4} {
+		if _, err := bob.Open(msgs[i], nil); err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+	}
+	// 5 has not been skipped yet, so it is not a gap.
+	if gaps := bob.Gaps(); !slices.Equal(gaps, []int{1, 3}) {
+		t.Fatalf("expected [1 3], got %v", gaps)
+	}
+	if _, err := bob.Open(msgs[3], nil); err != nil {
+		t.Fatal(err)
+	}
+	if gaps := bob.Gaps(); !slices.Equal(gaps, []int{1}) {
+		t.Fatalf("expected [1], got %v", gaps)
+	}
+
+	// Gaps only covers the current receiving chain.
+	reply, err := bob.Seal([]byte("reply"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alice.Open(reply, nil); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := alice.Seal([]byte("hello"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bob.Open(msg, nil); err != nil {
+		t.Fatal(err)
+	}
+	if gaps := bob.Gaps(); gaps != nil {
+		t.Fatalf("expected no gaps, got %v", gaps)
+	}
+}
+
+// TestRekey tests that both parties can rekey in the middle of
+// a conversation and continue.
+func TestRekey(t *testing.T) {
+	for _, tc := range testCases {
+		fn := tc.fn
+		t.Run(tc.name, func(t *testing.T) {
+			alice, bob := newSessions(t, fn)
+			if err := alice.Rekey([]byte("entropy")); err == nil {
+				t.Fatal("expected an error before both chains exist")
+			}
+
+			send := func(from, to *Session, n int) {
+				t.Helper()
+				msgs := make([]Message, n)
+				for i := range msgs {
+					var err error
+					msgs[i], err = from.Seal([]byte(fmt.Sprint(i)), nil)
+					if err != nil {
+						t.Fatalf("#%d: %v", i, err)
+					}
+				}
+				// Open out of order.
+				for _, i := range mrand.Perm(n) {
+					got, err := to.Open(msgs[i], nil)
+					if err != nil {
+						t.Fatalf("#%d: %v", i, err)
+					}
+					if want := fmt.Sprint(i); string(got) != want {
+						t.Fatalf("#%d: expected %q, got %q", i, want, got)
+					}
+				}
+			}
+			send(alice, bob, 3)
+			send(bob, alice, 3)
+			send(alice, bob, 2)
+
+			old := alice.State()
+			entropy := make([]byte, 32)
+			rand.Read(entropy)
+			for _, s := range []*Session{alice, bob} {
+				if err := s.Rekey(entropy); err != nil {
+					t.Fatal(err)
+				}
+				if err := s.Rekey(entropy); err == nil {
+					t.Fatal("expected an error while a rekey is pending")
+				}
+			}
+			if bytes.Equal(old.CKs, alice.state.CKs) {
+				t.Fatal("Rekey did not change the sending chain key")
+			}
+
+			// The pending rekey survives a round trip through
+			// the store.
+			data, err := bob.State().MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var state State
+			if err := state.UnmarshalBinary(data); err != nil {
+				t.Fatal(err)
+			}
+			bob, err = Resume(fn(t), &state)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The conversation continues in both directions,
+			// including across later ratchet steps.
+			send(alice, bob, 3)
+			send(bob, alice, 3)
+			send(alice, bob, 3)
+			send(bob, alice, 3)
+			for _, s := range []*Session{alice, bob} {
+				if s.state.PendingRekey != nil {
+					t.Fatal("rekey is still pending")
+				}
+			}
+
+			// Rekeying with different entropy desynchronizes the
+			// session.
+			if err := alice.Rekey([]byte("alice")); err != nil {
+				t.Fatal(err)
+			}
+			if err := bob.Rekey([]byte("bob")); err != nil {
+				t.Fatal(err)
+			}
+			msg, err := alice.Seal([]byte("hello"), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := bob.Open(msg, nil); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+// TestPublicKeyEqual tests PublicKey.Equal.
+func TestPublicKeyEqual(t *testing.T) {
+	for i, tc := range []struct {
+		a, b PublicKey
+		want bool
+	}{
+		{nil, nil, true},
+		{nil, PublicKey{}, true},
+		{PublicKey("abc"), PublicKey("abc"), true},
+		{PublicKey("abc"), PublicKey("abd"), false},
+		{PublicKey("abc"), PublicKey("ab"), false},
+		{PublicKey("abc"), nil, false},
+	} {
+		if got := tc.a.Equal(tc.b); got != tc.want {
+			t.Fatalf("#%d: expected %t, got %t", i, tc.want, got)
+		}
+		if got := tc.b.Equal(tc.a); got != tc.want {
+			t.Fatalf("#%d: expected %t, got %t (swapped)", i, tc.want, got)
+		}
+	}
+}
+
+// detReader is a deterministic io.Reader for testing.
+type detReader struct {
+	c *chacha20.Cipher
+}
+
+func newDetReader(seed byte) *detReader {
+	key := make([]byte, chacha20.KeySize)
+	key[0] = seed
+	c, err := chacha20.NewUnauthenticatedCipher(key, make([]byte, chacha20.NonceSize))
+	if err != nil {
+		panic(err)
+	}
+	return &detReader{c: c}
+}
+
+func (d *detReader) Read(p []byte) (int, error) {
+	clear(p)
+	d.c.XORKeyStream(p, p)
+	return len(p), nil
+}
+
+// TestWithRand tests that WithRand makes sessions reproducible.
+func TestWithRand(t *testing.T) {
+	transcript := func(t *testing.T, r Ratchet, seed byte) []byte {
+		rng := newDetReader(seed)
+		SK := make([]byte, 32)
+		priv, err := r.Generate(rng)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bob, err := NewRecv(r, append([]byte(nil), SK...), priv, WithRand(rng))
+		if err != nil {
+			t.Fatal(err)
+		}
+		alice, err := NewSend(r, SK, r.Public(priv), WithRand(rng))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out []byte
+		send, recv := alice, bob
+		for i := 0; i < 6; i++ {
+			msg, err := send.Seal([]byte("hello"), nil)
+			if err != nil {
+				t.Fatalf("#%d: %v", i, err)
+			}
+			if _, err := recv.Open(msg, nil); err != nil {
+				t.Fatalf("#%d: %v", i, err)
+			}
+			out = msg.Header.Append(out)
+			out = append(out, msg.Ciphertext...)
+			send, recv = recv, send
+		}
+		return out
+	}
+	for _, tc := range testCases {
+		fn := tc.fn
+		t.Run(tc.name, func(t *testing.T) {
+			if _, ok := fn(t).(KEMRatchet); ok {
+				t.Skip("ML-KEM encapsulation always uses crypto/rand")
+			}
+			a := transcript(t, fn(t), 1)
+			b := transcript(t, fn(t), 1)
+			if !bytes.Equal(a, b) {
+				t.Fatal("transcripts differ with the same seed")
+			}
+			c := transcript(t, fn(t), 2)
+			if bytes.Equal(a, c) {
+				t.Fatal("transcripts match with different seeds")
+			}
+		})
+	}
+}
+
+// TestSealWithKey tests that the exported message key can open
+// the message independently of the session.
+func TestSealWithKey(t *testing.T) {
+	for _, tc := range testCases {
+		fn := tc.fn
+		t.Run(tc.name, func(t *testing.T) {
+			r := fn(t)
+			SK := make([]byte, 32)
+			priv, err := r.Generate(rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			alice, err := NewSend(r, SK, r.Public(priv))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := alice.SealWithKey([]byte("hello"), nil); err == nil {
+				t.Fatal("expected an error without WithKeyExport")
+			}
+
+			alice, err = NewSend(r, make([]byte, 32), r.Public(priv),
+				WithKeyExport(true), WithAlgorithmBinding(false))
+			if err != nil {
+				t.Fatal(err)
+			}
+			ad := []byte("ad")
+			msg, mk, err := alice.SealWithKey([]byte("hello"), ad)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := alice.Close(); err != nil {
+				t.Fatal(err)
+			}
+			got, err := r.Open(mk, msg.Ciphertext, r.Concat(ad, msg.Header))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != "hello" {
+				t.Fatalf("expected %q, got %q", "hello", got)
+			}
+
+			// By default, the Ratchet's name and the empty
+			// transcript and session identifier are prepended.
+			alice, err = NewSend(r, make([]byte, 32), r.Public(priv),
+				WithKeyExport(true))
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg, mk, err = alice.SealWithKey([]byte("hello"), ad)
+			if err != nil {
+				t.Fatal(err)
+			}
+			bound := binary.AppendVarint(nil, int64(len(r.Name())))
+			bound = append(bound, r.Name()...)
+			bound = append(bound, 0, 0)
+			bound = append(bound, ad...)
+			got, err = r.Open(mk, msg.Ciphertext, r.Concat(bound, msg.Header))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != "hello" {
+				t.Fatalf("expected %q, got %q", "hello", got)
+			}
+		})
+	}
+}
+
+// TestHooks tests that Hooks fire with the correct values during
+// an out-of-order conversation.
+func TestHooks(t *testing.T) {
+	for _, tc := range testCases {
+		fn := tc.fn
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				ratchets []PublicKey
+				skips    []int
+				used     []int
+				errs     []error
+			)
+			hooks := Hooks{
+				OnRatchet:        func(pub PublicKey) { ratchets = append(ratchets, pub) },
+				OnSkip:           func(n int) { skips = append(skips, n) },
+				OnSkippedKeyUsed: func(n int) { used = append(used, n) },
+				OnError:          func(err error) { errs = append(errs, err) },
+			}
+
+			SK := make([]byte, 32)
+			priv, err := fn(t).Generate(rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			bob, err := NewRecv(fn(t), append([]byte(nil), SK...), priv,
+				WithHooks(hooks))
+			if err != nil {
+				t.Fatal(err)
+			}
+			alice, err := NewSend(fn(t), SK, fn(t).Public(priv))
+			if err != nil {
+				t.Fatal(err)
+			}
+			msgs := make([]Message, 5)
+			for i := range msgs {
+				msgs[i], err = alice.Seal([]byte("hello"), nil)
+				if err != nil {
+					t.Fatalf("#%d: %v", i, err)
+				}
+			}
+
+			for _, i := range []int{3, 1, 4} {
+				if _, err := bob.Open(msgs[i], nil); err != nil {
+					t.Fatalf("#%d: %v", i, err)
+				}
+			}
+			bad := msgs[0]
+			bad.Ciphertext = append([]byte(nil), bad.Ciphertext...)
+			bad.Ciphertext[0] ^= 1
+			if _, err := bob.Open(bad, nil); err == nil {
+				t.Fatal("expected an error")
+			}
+
+			if len(ratchets) != 1 || !ratchets[0].Equal(msgs[0].Header.PublicKey) {
+				t.Fatalf("unexpected ratchets: %x", ratchets)
+			}
+			if !reflect.DeepEqual(skips, []int{3}) {
+				t.Fatalf("expected skips %v, got %v", []int{3}, skips)
+			}
+			if !reflect.DeepEqual(used, []int{1}) {
+				t.Fatalf("expected used %v, got %v", []int{1}, used)
+			}
+			if len(errs) != 1 {
+				t.Fatalf("expected 1 error, got %v", errs)
+			}
+		})
+	}
+}
+
+// testLogger is a Logger that records each message.
+type testLogger struct {
+	lines []string
+}
+
+func (l *testLogger) Debug(msg string, kv ...any) {
+	l.lines = append(l.lines, fmt.Sprintln(append([]any{msg}, kv...)...))
+}
+
+// TestLogger tests that WithLogger logs ratchet steps, skipped
+// message keys, and rejected messages during an out-of-order
+// conversation.
+func TestLogger(t *testing.T) {
+	r := DJB(t.Name())
+	SK := make([]byte, 32)
+	priv, err := r.Generate(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var log testLogger
+	bob, err := NewRecv(r, append([]byte(nil), SK...), priv,
+		WithLogger(&log), WithSkipLimit(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err := NewSend(r, SK, r.Public(priv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs := make([]Message, 20)
+	for i := range msgs {
+		msgs[i], err = alice.Seal([]byte("hello"), nil)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+	}
+	for _, i := range []int{3, 1} {
+		if _, err := bob.Open(msgs[i], nil); err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+	}
+	if _, err := bob.Open(msgs[len(msgs)-1], nil); !errors.Is(err, ErrTooManySkipped) {
+		t.Fatalf("expected %v, got %v", ErrTooManySkipped, err)
+	}
+
+	want := []string{
+		"dr: ratchet step header " + msgs[3].Header.String(),
+		"dr: skipped message keys header " + msgs[3].Header.String() + " count 3",
+		"dr: used skipped message key header " + msgs[1].Header.String(),
+		"dr: too many skipped messages header " + msgs[19].Header.String() + " nr 4 skip 15 limit 10",
+		"dr: unable to open message header " + msgs[19].Header.String() + " err " + ErrTooManySkipped.Error(),
+	}
+	if len(log.lines) != len(want) {
+		t.Fatalf("expected %d lines, got %q", len(want), log.lines)
+	}
+	for i, got := range log.lines {
+		if got != want[i]+"\n" {
+			t.Fatalf("#%d: expected %q, got %q", i, want[i], got)
+		}
+	}
+}
+
+// TestSkipLimit tests that Open rejects headers that would skip
+// too many messages without deriving any keys.
+func TestSkipLimit(t *testing.T) {
+	for _, tc := range testCases {
+		fn := tc.fn
+		t.Run(tc.name, func(t *testing.T) {
+			SK := make([]byte, 32)
+			priv, err := fn(t).Generate(rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			store := &countStore{memory: memory{
+				maxSkip: math.MaxInt,
+				keys:    make(map[string]memoryKey),
+			}}
+			bob, err := NewRecv(fn(t), append([]byte(nil), SK...), priv,
+				WithStore(store), WithSkipLimit(10))
+			if err != nil {
+				t.Fatal(err)
+			}
+			alice, err := NewSend(fn(t), SK, fn(t).Public(priv))
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg, err := alice.Seal([]byte("hello"), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, h := range []Header{
+				{PublicKey: msg.Header.PublicKey, N: 1 << 30},
+				{PublicKey: msg.Header.PublicKey, N: math.MaxInt},
+				{PublicKey: msg.Header.PublicKey, N: 11},
+			} {
+				h.KEMCiphertext = msg.Header.KEMCiphertext
+				bad := Message{Header: h, Ciphertext: msg.Ciphertext}
+				start := time.Now()
+				_, err := bob.Open(bad, nil)
+				if !errors.Is(err, ErrTooManySkipped) {
+					t.Fatalf("N=%d: expected %v, got %v", h.N, ErrTooManySkipped, err)
+				}
+				if d := time.Since(start); d > time.Second {
+					t.Fatalf("N=%d: took %s", h.N, d)
+				}
+			}
+			if store.stores != 0 {
+				t.Fatalf("expected no stored keys, got %d", store.stores)
+			}
+
+			// Exactly at the limit is allowed: the first message
+			// and these nine are skipped.
+			for i := 0; i < 9; i++ {
+				if _, err := alice.Seal([]byte("hello"), nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			msg, err = alice.Seal([]byte("hello"), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := bob.Open(msg, nil); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// TestSkipBudget tests that Open rejects a header that would skip
+// more keys than the Store has room for before deriving any of
+// them.
+func TestSkipBudget(t *testing.T) {
+	for _, tc := range testCases {
+		fn := tc.fn
+		t.Run(tc.name, func(t *testing.T) {
+			SK := make([]byte, 32)
+			priv, err := fn(t).Generate(rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// memory allows maxSkip+1 keys.
+			store := &countStore{memory: memory{
+				maxSkip: 4,
+				keys:    make(map[string]memoryKey),
+			}}
+			bob, err := NewRecv(fn(t), append([]byte(nil), SK...), priv,
+				WithStore(store), WithSkipLimit(1<<30))
+			if err != nil {
+				t.Fatal(err)
+			}
+			alice, err := NewSend(fn(t), SK, fn(t).Public(priv))
+			if err != nil {
+				t.Fatal(err)
+			}
+			msgs := make([]Message, 8)
+			for i := range msgs {
+				msgs[i], err = alice.Seal([]byte("hello"), nil)
+				if err != nil {
+					t.Fatalf("#%d: %v", i, err)
+				}
+			}
+			// Skip 0, 1, and 2, leaving room for two more keys.
+			if _, err := bob.Open(msgs[3], nil); err != nil {
+				t.Fatal(err)
+			}
+
+			h := msgs[3].Header
+			h.N = 1 << 24
+			bad := Message{Header: h, Ciphertext: msgs[3].Ciphertext}
+			start := time.Now()
+			if _, err := bob.Open(bad, nil); !errors.Is(err, ErrTooManySkipped) {
+				t.Fatalf("expected %v, got %v", ErrTooManySkipped, err)
+			}
+			if d := time.Since(start); d > time.Second {
+				t.Fatalf("took %s", d)
+			}
+			// 4, 5, and 6 do not fit.
+			if _, err := bob.Open(msgs[7], nil); !errors.Is(err, ErrTooManySkipped) {
+				t.Fatalf("expected %v, got %v", ErrTooManySkipped, err)
+			}
+			if store.stores != 3 {
+				t.Fatalf("expected 3 stored keys, got %d", store.stores)
+			}
+
+			// Exactly at the limit is allowed.
+			for _, i := range []int{5, 7, 0, 4, 6} {
+				if _, err := bob.Open(msgs[i], nil); err != nil {
+					t.Fatalf("#%d: %v", i, err)
+				}
+			}
+		})
+	}
+}
+
+// TestInvalidPeerKey tests that Open rejects our own public key
+// and the all-zero key.
+func TestInvalidPeerKey(t *testing.T) {
+	for _, tc := range testCases {
+		fn := tc.fn
+		t.Run(tc.name, func(t *testing.T) {
+			SK := make([]byte, 32)
+			priv, err := fn(t).Generate(rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			bob, err := NewRecv(fn(t), append([]byte(nil), SK...), priv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			alice, err := NewSend(fn(t), SK, fn(t).Public(priv))
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg, err := alice.Seal([]byte("hello"), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			own := fn(t).Public(bob.State().DHs)
+			bad := []PublicKey{
+				own,
+				make(PublicKey, len(own)),
+			}
+			if tc.name == "DJB" {
+				// u = 1 is a low-order point.
+				lowOrder := make(PublicKey, 32)
+				lowOrder[0] = 1
+				bad = append(bad, lowOrder)
+			}
+			for _, pub := range bad {
+				bad := msg
+				bad.Header.PublicKey = pub
+				_, err := bob.Open(bad, nil)
+				if !errors.Is(err, ErrInvalidPeerKey) {
+					t.Fatalf("%x: expected %v, got %v", pub, ErrInvalidPeerKey, err)
+				}
+			}
+			if _, err := bob.Open(msg, nil); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// TestOverhead tests that Ratchet.Overhead and Session.Overhead
+// match the actual message sizes.
+func TestOverhead(t *testing.T) {
+	test := func(t *testing.T, fn func(*testing.T) Ratchet) {
+		alice, bob := newSessions(t, fn)
+		send, recv := alice, bob
+		for i := 0; i < 6; i++ {
+			plaintext := make([]byte, i*100)
+			want := send.Overhead()
+			msg, err := send.Seal(plaintext, nil)
+			if err != nil {
+				t.Fatalf("#%d: %v", i, err)
+			}
+			if got := len(msg.Ciphertext) - len(plaintext); got != fn(t).Overhead() {
+				t.Fatalf("#%d: expected AEAD overhead %d, got %d",
+					i, fn(t).Overhead(), got)
+			}
+			got := len(msg.Header.Append(nil)) + len(msg.Ciphertext) - len(plaintext)
+			if got != want {
+				t.Fatalf("#%d: expected overhead %d, got %d", i, want, got)
+			}
+			if _, err := recv.Open(msg, nil); err != nil {
+				t.Fatalf("#%d: %v", i, err)
+			}
+			send, recv = recv, send
+		}
+	}
+	for _, tc := range testCases {
+		fn := tc.fn
+		t.Run(tc.name, func(t *testing.T) {
+			test(t, fn)
+		})
+	}
+	t.Run("RandomNonce", func(t *testing.T) {
+		test(t, func(t *testing.T) Ratchet {
+			return DJB(t.Name(), WithRandomNonce(rand.Reader))
+		})
+	})
+}
+
+// TestEmptyFirstMessage tests that the first message can be
+// empty and still starts the receiver's ratchet.
+func TestEmptyFirstMessage(t *testing.T) {
+	test := func(t *testing.T, fn func(*testing.T) Ratchet) {
+		alice, bob := newSessions(t, fn)
+		if bob.State().CKr != nil {
+			t.Fatal("expected nil CKr before the first message")
+		}
+		for _, plaintext := range [][]byte{nil, {}} {
+			msg, err := alice.Seal(plaintext, []byte("ad"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := bob.Open(msg, []byte("ad"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != 0 {
+				t.Fatalf("expected empty plaintext, got %q", got)
+			}
+		}
+		if bob.State().CKr == nil {
+			t.Fatal("expected non-nil CKr after the first message")
+		}
+		msg, err := bob.Seal(nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := alice.Open(msg, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tc := range testCases {
+		fn := tc.fn
+		t.Run(tc.name, func(t *testing.T) {
+			test(t, fn)
+		})
+		t.Run(tc.name+"/Plain", func(t *testing.T) {
+			test(t, func(t *testing.T) Ratchet {
+				return plainRatchet{fn(t)}
+			})
+		})
+	}
+}
+
+// FuzzHeaderDecode tests that Decode never panics and that every
+// decoded Header re-encodes to its input.
+func FuzzHeaderDecode(f *testing.F) {
+	for _, h := range []Header{
+		{},
+		{PublicKey: make([]byte, 32), PN: 1, N: 2},
+		{PublicKey: make([]byte, 65), PN: 1 << 40, N: math.MaxInt},
+		{PublicKey: make([]byte, 32), KEMCiphertext: make([]byte, 1088)},
+	} {
+		f.Add(h.Append(nil))
+		f.Add(h.AppendCompact(nil))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var h Header
+		if err := h.Decode(data); err != nil {
+			return
+		}
+		if data[0] == headerVersionCompact || data[0] == headerVersionCompactKEM {
+			if got := h.AppendCompact(nil); !bytes.Equal(got, data) {
+				t.Fatalf("expected %#x, got %#x", data, got)
+			}
+			return
+		}
+		if got := h.Append(nil); !bytes.Equal(got, data) {
+			t.Fatalf("expected %#x, got %#x", data, got)
+		}
+		if n := h.size(); n != len(data) {
+			t.Fatalf("expected size %d, got %d", len(data), n)
+		}
+	})
+}
+
+// FuzzMessageUnmarshal tests that UnmarshalBinary never panics,
+// that every decoded Message re-encodes to its input, and that
+// Open never panics on arbitrary messages.
+func FuzzMessageUnmarshal(f *testing.F) {
+	r := DJB("fuzz")
+	SK := bytes.Repeat([]byte{1}, 32)
+	priv, err := r.Generate(bytes.NewReader(bytes.Repeat([]byte{2}, 32)))
+	if err != nil {
+		f.Fatal(err)
+	}
+	alice, err := NewSend(r, append([]byte(nil), SK...), r.Public(priv))
+	if err != nil {
+		f.Fatal(err)
+	}
+	// Bob opens the first message before each input so that
+	// the input can exercise the receiving chain.
+	first, err := alice.Seal([]byte("first"), nil)
+	if err != nil {
+		f.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		msg, err := alice.Seal([]byte("hello"), nil)
+		if err != nil {
+			f.Fatal(err)
+		}
+		data, err := msg.MarshalBinary()
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var msg Message
+		if err := msg.UnmarshalBinary(data); err != nil {
+			return
+		}
+		got, err := msg.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("expected %#x, got %#x", data, got)
+		}
+
+		bob, err := NewRecv(r, append([]byte(nil), SK...),
+			append(PrivateKey(nil), priv...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := bob.Open(first, nil); err != nil {
+			t.Fatal(err)
+		}
+		bob.Open(msg, nil)
+	})
+}
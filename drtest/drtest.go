@@ -0,0 +1,257 @@
+// Package drtest provides utilities for testing code that uses
+// package dr.
+//
+// FaultyStore wraps a dr.Store and injects latency and failures
+// so that applications can test how they handle a slow or
+// unreliable store:
+//
+//    store := drtest.NewFaultyStore(nil,
+//        drtest.WithFailureRate(0.1),
+//        drtest.WithLatency(10*time.Millisecond),
+//        drtest.WithSeed(1))
+//    s, err := dr.NewSend(r, SK, peer, dr.WithStoreContext(store))
+//
+// Failures are chosen with a pseudorandom number generator, so a
+// FaultyStore with a fixed seed fails the same sequence of calls
+// every time.
+package drtest
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/ericlagergren/dr"
+)
+
+// DefaultMaxSkip is the maximum number of skipped message keys
+// held by the in-memory Store that NewFaultyStore uses when no
+// Store is provided.
+const DefaultMaxSkip = 1000
+
+// ErrInjected is the error returned by FaultyStore for injected
+// failures.
+var ErrInjected = errors.New("drtest: injected store failure")
+
+// FaultyStore is a dr.Store that injects latency and failures
+// into calls to another Store.
+//
+// Only Save and StoreKey fail, since those are the calls whose
+// failures a Session has to recover from. Every call is delayed
+// by the configured latency, during which the context can be
+// canceled. The context is also checked before and after the
+// call to the inner Store, so a canceled context is reported
+// even if the inner Store ignores it.
+//
+// FaultyStore is safe for concurrent use by multiple goroutines
+// if the inner Store is.
+type FaultyStore struct {
+	inner   dr.StoreContext
+	rate    float64
+	latency time.Duration
+	seed    uint64
+
+	mu  sync.Mutex
+	rng *rand.Rand
+	// failures is the number of injected failures.
+	failures int
+}
+
+var (
+	_ dr.Store        = (*FaultyStore)(nil)
+	_ dr.StoreContext = (*FaultyStore)(nil)
+)
+
+// Option configures a FaultyStore.
+type Option func(*FaultyStore)
+
+// WithFailureRate sets the probability, from 0 to 1, that each
+// call to Save or StoreKey fails with ErrInjected.
+//
+// By default, calls never fail.
+func WithFailureRate(p float64) Option {
+	return func(s *FaultyStore) {
+		s.rate = p
+	}
+}
+
+// WithLatency delays each call to the Store by d.
+//
+// By default, calls are not delayed.
+func WithLatency(d time.Duration) Option {
+	return func(s *FaultyStore) {
+		s.latency = d
+	}
+}
+
+// WithSeed seeds the pseudorandom number generator that chooses
+// which calls fail.
+//
+// By default, the seed is 0.
+func WithSeed(seed uint64) Option {
+	return func(s *FaultyStore) {
+		s.seed = seed
+	}
+}
+
+// NewFaultyStore creates a FaultyStore that wraps inner.
+//
+// If inner is nil, the FaultyStore wraps a new in-memory Store
+// that holds at most DefaultMaxSkip skipped message keys. If
+// inner implements dr.StoreContext, contexts are passed through
+// to it.
+func NewFaultyStore(inner dr.Store, opts ...Option) *FaultyStore {
+	if inner == nil {
+		inner = dr.NewMemoryMultiStore[struct{}](DefaultMaxSkip).Session(struct{}{})
+	}
+	s := &FaultyStore{
+		inner: storeContext{inner},
+	}
+	if sc, ok := inner.(dr.StoreContext); ok {
+		s.inner = sc
+	}
+	for _, fn := range opts {
+		fn(s)
+	}
+	s.rng = rand.New(rand.NewPCG(s.seed, s.seed))
+	return s
+}
+
+// Failures returns the number of failures injected so far.
+func (s *FaultyStore) Failures() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.failures
+}
+
+// fail reports whether the next call should fail.
+func (s *FaultyStore) fail() bool {
+	if s.rate <= 0 {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.rng.Float64() >= s.rate {
+		return false
+	}
+	s.failures++
+	return true
+}
+
+// wait delays the call by the configured latency.
+//
+// It returns early with the context's error if the context is
+// canceled.
+func (s *FaultyStore) wait(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if s.latency <= 0 {
+		return nil
+	}
+	t := time.NewTimer(s.latency)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// Save implements dr.Store.
+func (s *FaultyStore) Save(state *dr.State) error {
+	return s.SaveContext(context.Background(), state)
+}
+
+// SaveContext implements dr.StoreContext.
+func (s *FaultyStore) SaveContext(ctx context.Context, state *dr.State) error {
+	if err := s.wait(ctx); err != nil {
+		return err
+	}
+	if s.fail() {
+		return ErrInjected
+	}
+	if err := s.inner.SaveContext(ctx, state); err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+// StoreKey implements dr.Store.
+func (s *FaultyStore) StoreKey(Nr int, pub dr.PublicKey, key dr.MessageKey) error {
+	return s.StoreKeyContext(context.Background(), Nr, pub, key)
+}
+
+// StoreKeyContext implements dr.StoreContext.
+func (s *FaultyStore) StoreKeyContext(ctx context.Context, Nr int, pub dr.PublicKey, key dr.MessageKey) error {
+	if err := s.wait(ctx); err != nil {
+		return err
+	}
+	if s.fail() {
+		return ErrInjected
+	}
+	if err := s.inner.StoreKeyContext(ctx, Nr, pub, key); err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+// LoadKey implements dr.Store.
+func (s *FaultyStore) LoadKey(Nr int, pub dr.PublicKey) (dr.MessageKey, error) {
+	return s.LoadKeyContext(context.Background(), Nr, pub)
+}
+
+// LoadKeyContext implements dr.StoreContext.
+func (s *FaultyStore) LoadKeyContext(ctx context.Context, Nr int, pub dr.PublicKey) (dr.MessageKey, error) {
+	if err := s.wait(ctx); err != nil {
+		return nil, err
+	}
+	key, err := s.inner.LoadKeyContext(ctx, Nr, pub)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// DeleteKey implements dr.Store.
+func (s *FaultyStore) DeleteKey(Nr int, pub dr.PublicKey) error {
+	return s.DeleteKeyContext(context.Background(), Nr, pub)
+}
+
+// DeleteKeyContext implements dr.StoreContext.
+func (s *FaultyStore) DeleteKeyContext(ctx context.Context, Nr int, pub dr.PublicKey) error {
+	if err := s.wait(ctx); err != nil {
+		return err
+	}
+	if err := s.inner.DeleteKeyContext(ctx, Nr, pub); err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+// storeContext adapts a dr.Store to dr.StoreContext.
+type storeContext struct {
+	dr.Store
+}
+
+func (s storeContext) SaveContext(_ context.Context, state *dr.State) error {
+	return s.Save(state)
+}
+
+func (s storeContext) StoreKeyContext(_ context.Context, Nr int, pub dr.PublicKey, key dr.MessageKey) error {
+	return s.StoreKey(Nr, pub, key)
+}
+
+func (s storeContext) LoadKeyContext(_ context.Context, Nr int, pub dr.PublicKey) (dr.MessageKey, error) {
+	return s.LoadKey(Nr, pub)
+}
+
+func (s storeContext) DeleteKeyContext(_ context.Context, Nr int, pub dr.PublicKey) error {
+	return s.DeleteKey(Nr, pub)
+}
@@ -0,0 +1,138 @@
+package drtest
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ericlagergren/dr"
+)
+
+// TestFaultyStoreSeed tests that FaultyStores with the same seed
+// fail the same calls.
+func TestFaultyStoreSeed(t *testing.T) {
+	const (
+		N = 1000
+	)
+	calls := func(seed uint64) []bool {
+		s := NewFaultyStore(nil, WithFailureRate(0.25), WithSeed(seed))
+		failed := make([]bool, N)
+		for i := range failed {
+			err := s.Save(&dr.State{})
+			if err != nil && !errors.Is(err, ErrInjected) {
+				t.Fatalf("#%d: unexpected error: %v", i, err)
+			}
+			failed[i] = err != nil
+		}
+		n := 0
+		for _, ok := range failed {
+			if ok {
+				n++
+			}
+		}
+		if n != s.Failures() {
+			t.Fatalf("expected %d failures, got %d", n, s.Failures())
+		}
+		// With N = 1000 this is astronomically unlikely to fail
+		// by chance.
+		if n < N/8 || n > N/2 {
+			t.Fatalf("expected about %d failures, got %d", N/4, n)
+		}
+		return failed
+	}
+	a, b, c := calls(1), calls(1), calls(2)
+	same := true
+	for i := range a {
+		if a[i] != b[i] {
+			t.Fatalf("#%d: same seed, different results", i)
+		}
+		same = same && a[i] == c[i]
+	}
+	if same {
+		t.Fatal("different seeds, same results")
+	}
+}
+
+// TestFaultyStoreSession tests that a Session surfaces injected
+// failures, or hides them with dr.StoreErrorBestEffort.
+func TestFaultyStoreSession(t *testing.T) {
+	r := dr.DJB(t.Name())
+	SK := make([]byte, 32)
+	if _, err := rand.Read(SK); err != nil {
+		t.Fatal(err)
+	}
+	priv, err := r.Generate(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, policy := range []dr.StoreErrorPolicy{dr.StoreErrorFail, dr.StoreErrorBestEffort} {
+		store := NewFaultyStore(nil, WithFailureRate(0.5), WithSeed(1))
+		alice, err := dr.NewSend(r, append([]byte(nil), SK...), r.Public(priv),
+			dr.WithStoreContext(store), dr.WithStoreErrorPolicy(policy))
+		if err != nil {
+			t.Fatal(err)
+		}
+		failed := 0
+		for i := 0; i < 100; i++ {
+			_, err := alice.Seal([]byte("hello"), nil)
+			if err == nil {
+				continue
+			}
+			if !errors.Is(err, dr.ErrStoreFailure) || !errors.Is(err, ErrInjected) {
+				t.Fatalf("#%d: expected %v, got %v", i, ErrInjected, err)
+			}
+			failed++
+		}
+		switch policy {
+		case dr.StoreErrorFail:
+			if failed == 0 || failed != store.Failures() {
+				t.Fatalf("expected %d failures, got %d", store.Failures(), failed)
+			}
+		case dr.StoreErrorBestEffort:
+			if failed != 0 {
+				t.Fatalf("expected no failures, got %d", failed)
+			}
+			if store.Failures() == 0 {
+				t.Fatal("expected injected failures")
+			}
+		}
+	}
+}
+
+// TestFaultyStoreLatency tests that canceling the context
+// interrupts an injected delay.
+func TestFaultyStoreLatency(t *testing.T) {
+	r := dr.DJB(t.Name())
+	SK := make([]byte, 32)
+	if _, err := rand.Read(SK); err != nil {
+		t.Fatal(err)
+	}
+	priv, err := r.Generate(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewFaultyStore(nil, WithLatency(time.Hour))
+	alice, err := dr.NewSend(r, SK, r.Public(priv), dr.WithStoreContext(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = alice.SealContext(ctx, []byte("hello"), nil)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	if d := time.Since(start); d > time.Minute {
+		t.Fatalf("cancellation took %s", d)
+	}
+
+	store = NewFaultyStore(nil, WithLatency(time.Millisecond))
+	if err := store.SaveContext(context.Background(), &dr.State{}); err != nil {
+		t.Fatal(err)
+	}
+}
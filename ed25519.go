@@ -0,0 +1,128 @@
+package dr
+
+import (
+	"crypto/ed25519"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// fieldPrime is 2^255 - 19.
+var fieldPrime, _ = new(big.Int).SetString(
+	"7fffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffed", 16)
+
+// Ed25519PrivateKey converts an Ed25519 private key to the X25519
+// key pair used by DJB.
+//
+// The X25519 scalar is the clamped first half of SHA-512(seed),
+// which is the same scalar Ed25519 uses for signing. Its public
+// key is therefore the Montgomery form of the Ed25519 public key,
+// as returned by Ed25519PublicKey.
+//
+// Reusing a signing key for Diffie-Hellman is a deliberate
+// trade-off; prefer separate keys where possible. The returned
+// key pair is only used as a session's initial key: every
+// subsequent ratchet key pair is freshly generated.
+func Ed25519PrivateKey(priv ed25519.PrivateKey) (PrivateKey, error) {
+	if len(priv) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("dr: invalid Ed25519 private key size: %d", len(priv))
+	}
+	h := sha512.Sum512(priv.Seed())
+	defer wipe(h[:])
+
+	const (
+		S = curve25519.ScalarSize
+		P = curve25519.PointSize
+	)
+	key := make(PrivateKey, S+P)
+	copy(key, h[:S])
+	// Same clamping as djb.Generate.
+	key[0] &= 248
+	key[31] &= 127
+	key[31] |= 64
+	pub, err := curve25519.X25519(key[:S], curve25519.Basepoint)
+	if err != nil {
+		wipe(key)
+		return nil, err
+	}
+	copy(key[S:], pub)
+	return key, nil
+}
+
+// Ed25519PublicKey converts an Ed25519 public key to the X25519
+// public key used by DJB.
+//
+// The Edwards y-coordinate is mapped to the Montgomery
+// u-coordinate with
+//
+//    u = (1 + y) / (1 - y) mod 2^255 - 19
+//
+// The sign of the Edwards x-coordinate (the high bit of the
+// encoding) is discarded because u does not depend on it.
+func Ed25519PublicKey(pub ed25519.PublicKey) (PublicKey, error) {
+	if len(pub) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("dr: invalid Ed25519 public key size: %d", len(pub))
+	}
+	// Decode the little-endian y-coordinate without the sign
+	// bit.
+	b := make([]byte, len(pub))
+	for i, c := range pub {
+		b[len(b)-1-i] = c
+	}
+	b[0] &= 0x7f
+	y := new(big.Int).SetBytes(b)
+	if y.Cmp(fieldPrime) >= 0 {
+		return nil, errors.New("dr: invalid Ed25519 public key")
+	}
+
+	one := big.NewInt(1)
+	den := new(big.Int).Sub(one, y)
+	den.Mod(den, fieldPrime)
+	if den.Sign() == 0 {
+		// y = 1 is the identity, which has no Montgomery form.
+		return nil, errors.New("dr: invalid Ed25519 public key")
+	}
+	u := new(big.Int).Add(one, y)
+	u.Mul(u, den.ModInverse(den, fieldPrime))
+	u.Mod(u, fieldPrime)
+
+	out := make(PublicKey, curve25519.PointSize)
+	u.FillBytes(out)
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return out, nil
+}
+
+// NewSendEd25519 is like NewSend, but accepts the peer's Ed25519
+// public key as its initial ratchet public key.
+//
+// r must have been created by DJB.
+func NewSendEd25519(r Ratchet, SK []byte, peer ed25519.PublicKey, opts ...Option) (*Session, error) {
+	if _, ok := r.(*djb); !ok {
+		return nil, errors.New("NewSendEd25519: Ratchet must be DJB")
+	}
+	pub, err := Ed25519PublicKey(peer)
+	if err != nil {
+		return nil, fmt.Errorf("NewSendEd25519: %w", err)
+	}
+	return NewSend(r, SK, pub, opts...)
+}
+
+// NewRecvEd25519 is like NewRecv, but accepts an Ed25519 private
+// key as its initial ratchet key pair.
+//
+// r must have been created by DJB.
+func NewRecvEd25519(r Ratchet, SK []byte, priv ed25519.PrivateKey, opts ...Option) (*Session, error) {
+	if _, ok := r.(*djb); !ok {
+		return nil, errors.New("NewRecvEd25519: Ratchet must be DJB")
+	}
+	key, err := Ed25519PrivateKey(priv)
+	if err != nil {
+		return nil, fmt.Errorf("NewRecvEd25519: %w", err)
+	}
+	return NewRecv(r, SK, key, opts...)
+}
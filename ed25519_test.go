@@ -0,0 +1,127 @@
+package dr
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha512"
+	"testing"
+)
+
+// TestEd25519Convert tests that converting an Ed25519 key pair
+// matches the X25519 key pair that DJB generates from the same
+// scalar.
+func TestEd25519Convert(t *testing.T) {
+	r := DJB(t.Name())
+	for i := 0; i < 100; i++ {
+		edPub, edPriv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		priv, err := Ed25519PrivateKey(edPriv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub, err := Ed25519PublicKey(edPub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := r.Public(priv); !bytes.Equal(got, pub) {
+			t.Fatalf("#%d: expected %x, got %x", i, pub, got)
+		}
+
+		h := sha512.Sum512(edPriv.Seed())
+		native, err := r.Generate(bytes.NewReader(h[:32]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(native, priv) {
+			t.Fatalf("#%d: expected %x, got %x", i, native, priv)
+		}
+	}
+}
+
+// TestEd25519Invalid tests that Ed25519PublicKey rejects
+// malformed keys.
+func TestEd25519Invalid(t *testing.T) {
+	identity := make(ed25519.PublicKey, ed25519.PublicKeySize)
+	identity[0] = 1
+	nonCanonical := bytes.Repeat([]byte{0xff}, ed25519.PublicKeySize)
+	for _, pub := range []ed25519.PublicKey{
+		nil,
+		make(ed25519.PublicKey, 31),
+		identity,
+		nonCanonical,
+	} {
+		if _, err := Ed25519PublicKey(pub); err == nil {
+			t.Fatalf("%x: expected an error", pub)
+		}
+	}
+}
+
+// TestEd25519Session tests a conversation that starts from Bob's
+// Ed25519 identity key, and that it interoperates with a session
+// created from the natively generated key pair.
+func TestEd25519Session(t *testing.T) {
+	edPub, edPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := DJB(t.Name())
+	SK := make([]byte, 32)
+	if _, err := rand.Read(SK); err != nil {
+		t.Fatal(err)
+	}
+	alice, err := NewSendEd25519(r, append([]byte(nil), SK...), edPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Bob uses the natively generated key pair derived from the
+	// same scalar.
+	h := sha512.Sum512(edPriv.Seed())
+	priv, err := r.Generate(bytes.NewReader(h[:32]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := NewRecv(r, append([]byte(nil), SK...), priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Carol uses the converted Ed25519 key directly.
+	carol, err := NewRecvEd25519(r, SK, edPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := alice.Seal([]byte("hello"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, recv := range []*Session{bob, carol} {
+		got, err := recv.Open(msg, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !hmac.Equal(got, []byte("hello")) {
+			t.Fatalf("expected %q, got %q", "hello", got)
+		}
+	}
+
+	send, recv := carol, alice
+	for i := 0; i < 10; i++ {
+		msg, err := send.Seal([]byte("hello"), nil)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if _, err := recv.Open(msg, nil); err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		send, recv = recv, send
+	}
+
+	if _, err := NewRecvEd25519(X448(t.Name()), SK, edPriv); err == nil {
+		t.Fatal("expected an error for a non-DJB Ratchet")
+	}
+}
@@ -0,0 +1,377 @@
+package dr
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// EncryptedStore is a Store that encrypts key material at rest
+// before handing it to another Store.
+//
+// Skipped message keys are encrypted with AES-GCM under a
+// key-encryption key (KEK), as are the secret fields of each
+// saved State (DHs, RK, CKs, CKr, and PendingRekey). Public
+// values and counters are stored as-is so that the inner Store
+// can still index them.
+//
+// Each ciphertext is bound to where it is stored: a message key
+// to its (Nr, PublicKey) tuple and a State field to its name. An
+// attacker with write access to the inner Store therefore cannot
+// move ciphertexts around without detection.
+//
+// States saved through an EncryptedStore must be decrypted with
+// Load, LoadContext, or DecryptState before they are passed to
+// Resume.
+type EncryptedStore struct {
+	inner Store
+	aead  cipher.AEAD
+	// loaded are the decrypted keys returned by LoadKey so that
+	// they can be wiped by DeleteKey.
+	loaded map[string]MessageKey
+}
+
+var (
+	_ Store      = (*EncryptedStore)(nil)
+	_ KeyPurger  = (*EncryptedStore)(nil)
+	_ KeyPruner  = (*EncryptedStore)(nil)
+	_ Purger     = (*EncryptedStore)(nil)
+	_ KeyCounter = (*EncryptedStore)(nil)
+	_ KeyLimiter = (*EncryptedStore)(nil)
+)
+
+const (
+	// encStoreKeyLabel is the additional data prefix for
+	// encrypted message keys.
+	encStoreKeyLabel = "dr encrypted store key"
+	// encStoreStateLabel is the additional data prefix for
+	// encrypted State fields.
+	encStoreStateLabel = "dr encrypted store state"
+)
+
+// NewEncryptedStore creates an EncryptedStore that wraps inner.
+//
+// The KEK must be 16, 24, or 32 bytes. It could, for example,
+// come from the operating system's keyring.
+func NewEncryptedStore(inner Store, kek []byte) (*EncryptedStore, error) {
+	aead, err := newKEKAEAD(kek)
+	if err != nil {
+		return nil, fmt.Errorf("NewEncryptedStore: %w", err)
+	}
+	return &EncryptedStore{
+		inner:  inner,
+		aead:   aead,
+		loaded: make(map[string]MessageKey),
+	}, nil
+}
+
+// newKEKAEAD returns the AEAD for a KEK.
+func newKEKAEAD(kek []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plaintext as nonce || ciphertext.
+func (e *EncryptedStore) seal(plaintext, additionalData []byte) ([]byte, error) {
+	n := e.aead.NonceSize()
+	buf := make([]byte, n, n+len(plaintext)+e.aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, buf); err != nil {
+		return nil, err
+	}
+	return e.aead.Seal(buf, buf[:n], plaintext, additionalData), nil
+}
+
+// open decrypts the output of seal.
+func (e *EncryptedStore) open(ciphertext, additionalData []byte) ([]byte, error) {
+	n := e.aead.NonceSize()
+	if len(ciphertext) < n {
+		return nil, errors.New("dr: encrypted key too short")
+	}
+	return e.aead.Open(nil, ciphertext[:n], ciphertext[n:], additionalData)
+}
+
+// keyAD returns the additional data for the (Nr, PublicKey)
+// tuple.
+func keyAD(Nr int, pub PublicKey) []byte {
+	ad := make([]byte, 0, len(encStoreKeyLabel)+binary.MaxVarintLen64+len(pub))
+	ad = append(ad, encStoreKeyLabel...)
+	ad = binary.AppendVarint(ad, int64(Nr))
+	return append(ad, pub...)
+}
+
+// stateFields returns pointers to the secret fields of s along
+// with their names.
+func stateFields(s *State) ([]*[]byte, []string) {
+	return []*[]byte{
+		(*[]byte)(&s.DHs),
+		(*[]byte)(&s.RK),
+		(*[]byte)(&s.CKs),
+		(*[]byte)(&s.CKr),
+		&s.PendingRekey,
+	}, []string{
+		"DHs",
+		"RK",
+		"CKs",
+		"CKr",
+		"PendingRekey",
+	}
+}
+
+// Save encrypts the secret fields of a copy of state and saves
+// the copy with the inner Store.
+func (e *EncryptedStore) Save(state *State) error {
+	t := state.Clone()
+	fields, names := stateFields(t)
+	for i, p := range fields {
+		if *p == nil {
+			continue
+		}
+		ct, err := e.seal(*p, []byte(encStoreStateLabel+names[i]))
+		if err != nil {
+			t.wipe()
+			return err
+		}
+		wipe(*p)
+		*p = ct
+	}
+	return e.inner.Save(t)
+}
+
+// DecryptState returns a copy of a State saved by Save with its
+// secret fields decrypted.
+func (e *EncryptedStore) DecryptState(state *State) (*State, error) {
+	t := state.Clone()
+	fields, names := stateFields(t)
+	for i, p := range fields {
+		if *p == nil {
+			continue
+		}
+		pt, err := e.open(*p, []byte(encStoreStateLabel+names[i]))
+		if err != nil {
+			t.wipe()
+			return nil, fmt.Errorf("dr: unable to decrypt %s: %w", names[i], err)
+		}
+		*p = pt
+	}
+	return t, nil
+}
+
+// Load loads the most recently saved state from the inner Store
+// and decrypts it.
+//
+// It is the same as LoadContext with context.Background.
+func (e *EncryptedStore) Load() (*State, error) {
+	return e.LoadContext(context.Background())
+}
+
+// LoadContext loads the most recently saved state from the inner
+// Store and decrypts it.
+//
+// The inner Store must have a Load method with one of the
+// signatures
+//
+//    Load() (*State, error)
+//    Load(context.Context) (*State, error)
+//
+// like the Stores in this module's subpackages. The context is
+// passed to the latter.
+func (e *EncryptedStore) LoadContext(ctx context.Context) (*State, error) {
+	var (
+		state *State
+		err   error
+	)
+	switch l := e.inner.(type) {
+	case interface{ Load() (*State, error) }:
+		state, err = l.Load()
+	case interface {
+		Load(context.Context) (*State, error)
+	}:
+		state, err = l.Load(ctx)
+	default:
+		return nil, errors.New("dr: inner store does not implement Load")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return e.DecryptState(state)
+}
+
+// StoreKey encrypts the message key, wipes it, and stores the
+// ciphertext with the inner Store.
+func (e *EncryptedStore) StoreKey(Nr int, pub PublicKey, key MessageKey) error {
+	ct, err := e.seal(key, keyAD(Nr, pub))
+	if err != nil {
+		return err
+	}
+	wipe(key)
+	return e.inner.StoreKey(Nr, pub, ct)
+}
+
+// LoadKey loads and decrypts a message key.
+func (e *EncryptedStore) LoadKey(Nr int, pub PublicKey) (MessageKey, error) {
+	ct, err := e.inner.LoadKey(Nr, pub)
+	if err != nil {
+		return nil, err
+	}
+	mk, err := e.open(ct, keyAD(Nr, pub))
+	if err != nil {
+		return nil, fmt.Errorf("dr: unable to decrypt message key: %w", err)
+	}
+	k := memory{}.key(Nr, pub)
+	if old, ok := e.loaded[k]; ok {
+		wipe(old)
+	}
+	e.loaded[k] = mk
+	return mk, nil
+}
+
+// DeleteKey removes a message key from the inner Store and wipes
+// any decrypted copies of it.
+func (e *EncryptedStore) DeleteKey(Nr int, pub PublicKey) error {
+	k := memory{}.key(Nr, pub)
+	if mk, ok := e.loaded[k]; ok {
+		wipe(mk)
+		delete(e.loaded, k)
+	}
+	return e.inner.DeleteKey(Nr, pub)
+}
+
+// wipeLoaded wipes every decrypted message key.
+func (e *EncryptedStore) wipeLoaded() {
+	for k, mk := range e.loaded {
+		wipe(mk)
+		delete(e.loaded, k)
+	}
+}
+
+// PurgeKeys implements KeyPurger.
+//
+// It returns an error if the inner Store does not implement
+// KeyPurger.
+func (e *EncryptedStore) PurgeKeys() error {
+	e.wipeLoaded()
+	p, ok := e.inner.(KeyPurger)
+	if !ok {
+		return errors.New("dr: inner store does not implement KeyPurger")
+	}
+	return p.PurgeKeys()
+}
+
+// PruneKeys implements KeyPruner.
+//
+// It does nothing if the inner Store does not implement
+// KeyPruner.
+func (e *EncryptedStore) PruneKeys(keep ...PublicKey) error {
+	if p, ok := e.inner.(KeyPruner); ok {
+		return p.PruneKeys(keep...)
+	}
+	return nil
+}
+
+// SkippedCount implements KeyCounter.
+//
+// It returns an error if the inner Store does not implement
+// KeyCounter.
+func (e *EncryptedStore) SkippedCount() (int, error) {
+	c, ok := e.inner.(KeyCounter)
+	if !ok {
+		return 0, errors.New("dr: inner store does not implement KeyCounter")
+	}
+	return c.SkippedCount()
+}
+
+// RemainingKeys implements KeyLimiter.
+//
+// It returns math.MaxInt if the inner Store does not implement
+// KeyLimiter.
+func (e *EncryptedStore) RemainingKeys() (int, error) {
+	k, ok := e.inner.(KeyLimiter)
+	if !ok {
+		return math.MaxInt, nil
+	}
+	return k.RemainingKeys()
+}
+
+// Purge implements Purger.
+//
+// It returns an error if the inner Store does not implement
+// Purger.
+func (e *EncryptedStore) Purge() error {
+	e.wipeLoaded()
+	p, ok := e.inner.(Purger)
+	if !ok {
+		return errors.New("dr: inner store does not implement Purger")
+	}
+	return p.Purge()
+}
+
+// Migrate re-encrypts every skipped message key in the inner
+// Store under newKEK and uses newKEK from then on.
+//
+// Every key is decrypted and re-encrypted before any is written,
+// so if a key cannot be decrypted Migrate returns an error and
+// the inner Store is unchanged. If writing the keys fails, the
+// original ciphertexts are restored.
+//
+// The inner Store must implement KeyExporter.
+//
+// The saved state is re-encrypted the next time that it is
+// saved. Session.Migrate migrates both at once.
+func (e *EncryptedStore) Migrate(newKEK []byte) error {
+	_, err := e.migrate(newKEK)
+	return err
+}
+
+// migrate implements Migrate and returns a function that undoes
+// the migration.
+func (e *EncryptedStore) migrate(newKEK []byte) (undo func() error, err error) {
+	x, ok := e.inner.(KeyExporter)
+	if !ok {
+		return nil, errors.New("dr: inner store does not implement KeyExporter")
+	}
+	aead, err := newKEKAEAD(newKEK)
+	if err != nil {
+		return nil, fmt.Errorf("dr: invalid KEK: %w", err)
+	}
+	next := &EncryptedStore{aead: aead}
+
+	old, err := x.ExportKeys()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]ExportedKey, len(old))
+	for i, k := range old {
+		ad := keyAD(k.Nr, k.PublicKey)
+		mk, err := e.open(k.Key, ad)
+		if err != nil {
+			return nil, fmt.Errorf("dr: unable to decrypt message key: %w", err)
+		}
+		ct, err := next.seal(mk, ad)
+		wipe(mk)
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = ExportedKey{Nr: k.Nr, PublicKey: k.PublicKey, Key: ct}
+	}
+	if err := x.ImportKeys(keys); err != nil {
+		if rerr := x.ImportKeys(old); rerr != nil {
+			return nil, errors.Join(err, rerr)
+		}
+		return nil, err
+	}
+	prev := e.aead
+	e.aead = aead
+	return func() error {
+		e.aead = prev
+		return x.ImportKeys(old)
+	}, nil
+}
@@ -0,0 +1,336 @@
+package dr
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// stateStore is a memory Store that retains the most recently
+// saved state.
+type stateStore struct {
+	memory
+	state *State
+}
+
+func (s *stateStore) Save(state *State) error {
+	if err := CheckEpoch(s.state, state); err != nil {
+		return err
+	}
+	s.state = state.Clone()
+	return nil
+}
+
+func (s *stateStore) Load() (*State, error) {
+	if s.state == nil {
+		return nil, ErrNotFound
+	}
+	return s.state.Clone(), nil
+}
+
+// ctxStateStore is a stateStore whose Load method accepts a
+// context, like redisstore.Store.
+type ctxStateStore struct {
+	*stateStore
+}
+
+func (s ctxStateStore) Load(ctx context.Context) (*State, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.stateStore.Load()
+}
+
+// TestEncryptedStore tests that EncryptedStore never hands
+// plaintext keys to the inner Store and that a session can be
+// resumed through it.
+func TestEncryptedStore(t *testing.T) {
+	kek := make([]byte, 32)
+	if _, err := rand.Read(kek); err != nil {
+		t.Fatal(err)
+	}
+	inner := &stateStore{memory: memory{maxSkip: 100}}
+	store, err := NewEncryptedStore(inner, kek)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := DJB(t.Name())
+	SK := make([]byte, 32)
+	if _, err := rand.Read(SK); err != nil {
+		t.Fatal(err)
+	}
+	priv, err := r.Generate(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err := NewSend(r, append([]byte(nil), SK...), r.Public(priv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := NewRecv(r, SK, priv, WithStore(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := make([]Message, 5)
+	for i := range msgs {
+		msgs[i], err = alice.Seal([]byte("hello"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := bob.Open(msgs[4], nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(inner.keys); n != 4 {
+		t.Fatalf("expected 4 stored keys, got %d", n)
+	}
+	var skipped [][]byte
+	for Nr := 0; Nr < 4; Nr++ {
+		mk, err := store.LoadKey(Nr, msgs[Nr].Header.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		skipped = append(skipped, append([]byte(nil), mk...))
+	}
+	for _, k := range inner.keys {
+		for _, mk := range skipped {
+			if bytes.Contains(k.key, mk) {
+				t.Fatal("inner store contains a plaintext key")
+			}
+		}
+	}
+
+	want := bob.State()
+	saved := inner.state
+	for i, pair := range [][2][]byte{
+		{want.DHs, saved.DHs},
+		{want.RK, saved.RK},
+		{want.CKr, saved.CKr},
+	} {
+		if bytes.Contains(pair[1], pair[0]) {
+			t.Fatalf("#%d: inner store contains a plaintext key", i)
+		}
+	}
+	if !bytes.Equal(want.DHr, saved.DHr) || want.Nr != saved.Nr {
+		t.Fatal("public values should be stored as-is")
+	}
+
+	// Resume through the EncryptedStore.
+	state, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(state, want) {
+		t.Fatalf("expected %+v, got %+v", want, state)
+	}
+	bob, err = Resume(r, state, WithStore(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		got, err := bob.Open(msgs[i], nil)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if !hmac.Equal(got, []byte("hello")) {
+			t.Fatalf("#%d: expected %q, got %q", i, "hello", got)
+		}
+	}
+	if n := len(inner.keys); n != 0 {
+		t.Fatalf("expected no stored keys, got %d", n)
+	}
+}
+
+// TestEncryptedStoreLoadContext tests that EncryptedStore loads
+// from inner Stores whose Load method accepts a context.
+func TestEncryptedStoreLoadContext(t *testing.T) {
+	kek := make([]byte, 32)
+	if _, err := rand.Read(kek); err != nil {
+		t.Fatal(err)
+	}
+	inner := ctxStateStore{&stateStore{memory: memory{maxSkip: 100}}}
+	store, err := NewEncryptedStore(inner, kek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &State{
+		DHs: PrivateKey("DHs"),
+		RK:  RootKey("RK"),
+	}
+	if err := store.Save(want); err != nil {
+		t.Fatal(err)
+	}
+	state, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(state, want) {
+		t.Fatalf("expected %+v, got %+v", want, state)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := store.LoadContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+}
+
+// TestEncryptedStoreTamper tests that ciphertexts cannot be moved
+// between slots or decrypted with the wrong KEK.
+func TestEncryptedStoreTamper(t *testing.T) {
+	kek := make([]byte, 32)
+	inner := &stateStore{memory: memory{maxSkip: 100}}
+	store, err := NewEncryptedStore(inner, kek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := PublicKey("public key")
+	if err := store.StoreKey(1, pub, make(MessageKey, 32)); err != nil {
+		t.Fatal(err)
+	}
+	ct, err := inner.LoadKey(1, pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := inner.StoreKey(2, pub, ct); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.LoadKey(2, pub); err == nil {
+		t.Fatal("expected an error for a moved key")
+	}
+	if _, err := store.LoadKey(1, pub); err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := NewEncryptedStore(inner, bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.LoadKey(1, pub); err == nil {
+		t.Fatal("expected an error for the wrong KEK")
+	}
+
+	state := &State{
+		DHs: PrivateKey("DHs"),
+		RK:  RootKey("RK"),
+		CKs: ChainKey("CKs"),
+	}
+	if err := store.Save(state); err != nil {
+		t.Fatal(err)
+	}
+	inner.state.RK, inner.state.CKs = RootKey(inner.state.CKs), ChainKey(inner.state.RK)
+	if _, err := store.Load(); err == nil {
+		t.Fatal("expected an error for swapped fields")
+	}
+
+	if _, err := NewEncryptedStore(inner, make([]byte, 31)); err == nil {
+		t.Fatal("expected an error for an invalid KEK")
+	}
+}
+
+// TestEncryptedStoreMigrate tests that Session.Migrate
+// re-encrypts every skipped key and the state under the new KEK
+// and that a failed migration leaves the store unchanged.
+func TestEncryptedStoreMigrate(t *testing.T) {
+	oldKEK := bytes.Repeat([]byte{1}, 32)
+	newKEK := bytes.Repeat([]byte{2}, 32)
+	inner := &stateStore{memory: memory{maxSkip: 100}}
+	store, err := NewEncryptedStore(inner, oldKEK)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := DJB(t.Name())
+	SK := make([]byte, 32)
+	if _, err := rand.Read(SK); err != nil {
+		t.Fatal(err)
+	}
+	priv, err := r.Generate(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err := NewSend(r, append([]byte(nil), SK...), r.Public(priv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := NewRecv(r, SK, priv, WithStore(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const (
+		N = 5
+	)
+	msgs := make([]Message, N)
+	for i := range msgs {
+		msgs[i], err = alice.Seal([]byte("hello"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := bob.Open(msgs[N-1], nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// readable reports whether every skipped key and the state
+	// can be decrypted with kek.
+	readable := func(kek []byte) bool {
+		s, err := NewEncryptedStore(inner, kek)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Load(); err != nil {
+			return false
+		}
+		for i := 0; i < N-1; i++ {
+			if _, err := s.LoadKey(i, msgs[i].Header.PublicKey); err != nil {
+				return false
+			}
+		}
+		return true
+	}
+	if !readable(oldKEK) || readable(newKEK) {
+		t.Fatal("keys should only be readable with the old KEK")
+	}
+
+	// Corrupt one key so that the migration fails.
+	pub := msgs[0].Header.PublicKey
+	ct, err := inner.LoadKey(0, pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := append([]byte(nil), ct...)
+	ct[len(ct)-1] ^= 1
+	if err := bob.Migrate(newKEK); err == nil {
+		t.Fatal("expected an error")
+	}
+	copy(ct, saved)
+	if !readable(oldKEK) {
+		t.Fatal("a failed migration should not change any keys")
+	}
+
+	if err := bob.Migrate(newKEK); err != nil {
+		t.Fatal(err)
+	}
+	if readable(oldKEK) || !readable(newKEK) {
+		t.Fatal("keys should only be readable with the new KEK")
+	}
+	for i := 0; i < N-1; i++ {
+		if _, err := bob.Open(msgs[i], nil); err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+	}
+
+	bob, err = Resume(r, bob.State(), WithStore(&memory{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.Migrate(newKEK); err == nil {
+		t.Fatal("expected an error without an EncryptedStore")
+	}
+}
@@ -0,0 +1,352 @@
+// Package fsstore implements a dr.Store backed by the
+// filesystem.
+//
+// Each Store is scoped to a single directory, so sessions are
+// kept apart by giving each its own directory. The directory
+// contains
+//
+//    state       the most recently saved dr.State
+//    keys/       one file per skipped message key, named
+//                Nr_hex(PublicKey)
+//
+// Every file is written to a temporary file in the same
+// directory, synced, and then renamed over its final name, so a
+// crash never leaves a partially written state or key behind.
+// Leftover temporary files are removed by New.
+//
+// Public keys longer than 64 bytes are replaced by their SHA-256
+// hash in key file names to stay within filesystem limits.
+//
+// Files are created with mode 0600 and directories with mode
+// 0700 since they contain key material. Removed files are not
+// overwritten, so deleted message keys may linger on disk.
+package fsstore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/ericlagergren/dr"
+	"github.com/ericlagergren/dr/internal/secure"
+)
+
+// DefaultMaxSkip is the default maximum number of skipped
+// message keys stored per session.
+const DefaultMaxSkip = 1000
+
+const (
+	// stateName is the name of the state file.
+	stateName = "state"
+	// keysDir is the name of the directory that contains
+	// skipped message keys.
+	keysDir = "keys"
+	// tmpPattern is the pattern for temporary files.
+	tmpPattern = ".tmp-*"
+	// maxKeyName is the longest public key, in bytes, that is
+	// used directly in a key file name.
+	maxKeyName = 64
+)
+
+// Store is a dr.Store backed by the filesystem.
+//
+// Store is not safe for concurrent use by multiple goroutines or
+// processes.
+type Store struct {
+	dir     string
+	perm    fs.FileMode
+	maxSkip int
+	// loaded are copies of keys returned by LoadKey so that they
+	// can be wiped by DeleteKey.
+	loaded map[string][]byte
+}
+
+var (
+	_ dr.Store      = (*Store)(nil)
+	_ dr.KeyPurger  = (*Store)(nil)
+	_ dr.Purger     = (*Store)(nil)
+	_ dr.KeyCounter = (*Store)(nil)
+	_ dr.KeyLimiter = (*Store)(nil)
+)
+
+// Option configures a Store.
+type Option func(*Store)
+
+// WithMaxSkip sets the maximum number of skipped message keys
+// stored for the session.
+//
+// By default, DefaultMaxSkip is used.
+func WithMaxSkip(n int) Option {
+	return func(s *Store) {
+		s.maxSkip = n
+	}
+}
+
+// WithPerm sets the permissions of the files written by the
+// Store.
+//
+// By default, files are created with mode 0600.
+func WithPerm(perm fs.FileMode) Option {
+	return func(s *Store) {
+		s.perm = perm
+	}
+}
+
+// New creates a Store for the session in the provided
+// directory, creating the directory if necessary.
+func New(dir string, opts ...Option) (*Store, error) {
+	if dir == "" {
+		return nil, errors.New("fsstore: empty directory")
+	}
+	s := &Store{
+		dir:     dir,
+		perm:    0600,
+		maxSkip: DefaultMaxSkip,
+		loaded:  make(map[string][]byte),
+	}
+	for _, fn := range opts {
+		fn(s)
+	}
+	if err := os.MkdirAll(s.keys(), 0700); err != nil {
+		return nil, fmt.Errorf("fsstore: unable to create directory: %w", err)
+	}
+	// Remove temporary files left behind by a crash.
+	for _, d := range []string{s.dir, s.keys()} {
+		tmps, err := filepath.Glob(filepath.Join(d, tmpPattern))
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range tmps {
+			if err := os.Remove(name); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return s, nil
+}
+
+// keys returns the path of the skipped keys directory.
+func (s *Store) keys() string {
+	return filepath.Join(s.dir, keysDir)
+}
+
+// key returns the file path for the (Nr, PublicKey) tuple.
+func (s *Store) key(Nr int, pub dr.PublicKey) string {
+	if len(pub) > maxKeyName {
+		sum := sha256.Sum256(pub)
+		pub = sum[:]
+	}
+	// Not ':', which separates alternate data streams on NTFS.
+	name := strconv.Itoa(Nr) + "_" + hex.EncodeToString(pub)
+	return filepath.Join(s.keys(), name)
+}
+
+// writeFile atomically replaces the named file with data.
+func (s *Store) writeFile(name string, data []byte) (err error) {
+	dir := filepath.Dir(name)
+	f, err := os.CreateTemp(dir, tmpPattern)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	if err := f.Chmod(s.perm); err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), name); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir flushes the directory so that renames are durable.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		// Directories cannot be synced on Windows.
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Load returns the most recently saved state.
+//
+// If no state has been saved Load returns dr.ErrNotFound.
+func (s *Store) Load() (*dr.State, error) {
+	data, err := os.ReadFile(filepath.Join(s.dir, stateName))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, dr.ErrNotFound
+		}
+		return nil, err
+	}
+	defer wipe(data)
+
+	var state dr.State
+	if err := state.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// Save atomically replaces the saved state.
+//
+// It returns an error wrapping dr.ErrStaleState if the saved
+// state is at least as new as state. See dr.CheckEpoch. The
+// check is not atomic with the write, so it only detects forked
+// sessions that do not save at the same time.
+func (s *Store) Save(state *dr.State) error {
+	name := filepath.Join(s.dir, stateName)
+	old, err := os.ReadFile(name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	defer wipe(old)
+	if err := dr.CheckEpochBinary(old, state); err != nil {
+		return err
+	}
+
+	data, err := state.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	defer wipe(data)
+	return s.writeFile(name, data)
+}
+
+// StoreKey stores a skipped message key.
+func (s *Store) StoreKey(Nr int, pub dr.PublicKey, mk dr.MessageKey) error {
+	name := s.key(Nr, pub)
+	if _, err := os.Stat(name); errors.Is(err, fs.ErrNotExist) {
+		n, err := s.count()
+		if err != nil {
+			return err
+		}
+		if n >= s.maxSkip {
+			return fmt.Errorf("fsstore: %w", dr.ErrTooManySkipped)
+		}
+	}
+	return s.writeFile(name, mk)
+}
+
+// count returns the number of stored skipped message keys.
+func (s *Store) count() (int, error) {
+	entries, err := os.ReadDir(s.keys())
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), ".") {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// LoadKey retrieves a skipped message key.
+//
+// If the message key is not found LoadKey returns
+// dr.ErrNotFound.
+func (s *Store) LoadKey(Nr int, pub dr.PublicKey) (dr.MessageKey, error) {
+	name := s.key(Nr, pub)
+	mk, err := os.ReadFile(name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, dr.ErrNotFound
+		}
+		return nil, err
+	}
+	s.loaded[name] = mk
+	return mk, nil
+}
+
+// DeleteKey removes a skipped message key and wipes any copies
+// of it held by the Store.
+func (s *Store) DeleteKey(Nr int, pub dr.PublicKey) error {
+	name := s.key(Nr, pub)
+	if mk, ok := s.loaded[name]; ok {
+		wipe(mk)
+		delete(s.loaded, name)
+	}
+	err := os.Remove(name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// PurgeKeys removes every skipped message key for the session.
+func (s *Store) PurgeKeys() error {
+	for k, v := range s.loaded {
+		wipe(v)
+		delete(s.loaded, k)
+	}
+	entries, err := os.ReadDir(s.keys())
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := os.Remove(filepath.Join(s.keys(), e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SkippedCount returns the number of stored skipped message
+// keys.
+func (s *Store) SkippedCount() (int, error) {
+	return s.count()
+}
+
+// RemainingKeys returns the number of skipped message keys that
+// can be stored before StoreKey returns dr.ErrTooManySkipped.
+func (s *Store) RemainingKeys() (int, error) {
+	n, err := s.SkippedCount()
+	if err != nil {
+		return 0, err
+	}
+	return max(s.maxSkip-n, 0), nil
+}
+
+// Purge removes the state file and every skipped message key.
+func (s *Store) Purge() error {
+	if err := s.PurgeKeys(); err != nil {
+		return err
+	}
+	err := os.Remove(filepath.Join(s.dir, stateName))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// wipe is shorthand for secure.Wipe.
+func wipe(p []byte) {
+	secure.Wipe(p)
+}
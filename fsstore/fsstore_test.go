@@ -0,0 +1,228 @@
+package fsstore
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+
+	mrand "github.com/ericlagergren/saferand"
+
+	"github.com/ericlagergren/dr"
+)
+
+// TestResume tests that a session can be resumed from a new
+// Store in the middle of an out-of-order conversation.
+func TestResume(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "bob")
+	r := dr.DJB(t.Name())
+
+	SK := make([]byte, 32)
+	if _, err := rand.Read(SK); err != nil {
+		t.Fatal(err)
+	}
+	priv, err := r.Generate(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err := dr.NewSend(r, SK, r.Public(priv))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Load(); !errors.Is(err, dr.ErrNotFound) {
+		t.Fatalf("expected %v, got %v", dr.ErrNotFound, err)
+	}
+	bob, err := dr.NewRecv(r, append([]byte(nil), SK...), priv,
+		dr.WithStore(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const (
+		N = 100
+	)
+	msgs := make([]dr.Message, N)
+	plaintexts := make([][]byte, N)
+	for i := range msgs {
+		plaintexts[i] = make([]byte, 64)
+		if _, err := rand.Read(plaintexts[i]); err != nil {
+			t.Fatal(err)
+		}
+		msgs[i], err = alice.Seal(plaintexts[i], nil)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+	}
+	perm := mrand.Perm(N)
+
+	open := func(bob *dr.Session, idx []int) {
+		t.Helper()
+		for _, i := range idx {
+			got, err := bob.Open(msgs[i], nil)
+			if err != nil {
+				t.Fatalf("#%d: %v", i, err)
+			}
+			if !hmac.Equal(plaintexts[i], got) {
+				t.Fatalf("#%d: expected %#x, got %#x", i, plaintexts[i], got)
+			}
+		}
+	}
+	open(bob, perm[:N/2])
+
+	store, err = New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err = dr.Resume(r, state, dr.WithStore(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	open(bob, perm[N/2:])
+}
+
+// TestCrash tests that a partially written temporary file left
+// behind by a crash does not affect the saved state.
+func TestCrash(t *testing.T) {
+	dir := t.TempDir()
+	s, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &dr.State{
+		DHs: []byte("DHs"),
+		RK:  []byte("RK"),
+		Ns:  42,
+	}
+	if err := s.Save(want); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a crash in the middle of the next Save.
+	data, err := (&dr.State{DHs: []byte("new")}).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	partial := filepath.Join(dir, ".tmp-123")
+	if err := os.WriteFile(partial, data[:len(data)/2], 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %#v, got %#v", want, got)
+	}
+	if _, err := os.Stat(partial); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("temporary file was not removed: %v", err)
+	}
+}
+
+// TestKeys tests StoreKey, LoadKey, DeleteKey, and the file
+// permissions.
+func TestKeys(t *testing.T) {
+	s, err := New(t.TempDir(), WithMaxSkip(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := dr.PublicKey("public key")
+	mk := dr.MessageKey("0123456789abcdef0123456789abcdef")
+	if _, err := s.LoadKey(1, pub); !errors.Is(err, dr.ErrNotFound) {
+		t.Fatalf("expected %v, got %v", dr.ErrNotFound, err)
+	}
+	if err := s.StoreKey(1, pub, mk); err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS != "windows" {
+		fi, err := os.Stat(s.key(1, pub))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perm := fi.Mode().Perm(); perm != 0600 {
+			t.Fatalf("expected mode %o, got %o", 0600, perm)
+		}
+	}
+	got, err := s.LoadKey(1, pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hmac.Equal(got, mk) {
+		t.Fatalf("expected %q, got %q", mk, got)
+	}
+	if err := s.DeleteKey(1, pub); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range got {
+		if c != 0 {
+			t.Fatalf("key was not wiped: %q", got)
+		}
+	}
+	if _, err := s.LoadKey(1, pub); !errors.Is(err, dr.ErrNotFound) {
+		t.Fatalf("expected %v, got %v", dr.ErrNotFound, err)
+	}
+
+	// Long public keys are hashed.
+	long := make(dr.PublicKey, 1216)
+	for i := 0; i < 2; i++ {
+		if err := s.StoreKey(i, long, mk); err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+	}
+	if err := s.StoreKey(2, long, mk); !errors.Is(err, dr.ErrTooManySkipped) {
+		t.Fatalf("expected %v, got %v", dr.ErrTooManySkipped, err)
+	}
+	if n, err := s.SkippedCount(); err != nil || n != 2 {
+		t.Fatalf("expected 2 skipped keys, got %d (%v)", n, err)
+	}
+	if err := s.PurgeKeys(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.LoadKey(0, long); !errors.Is(err, dr.ErrNotFound) {
+		t.Fatalf("expected %v, got %v", dr.ErrNotFound, err)
+	}
+}
+
+// TestStaleState tests that Save refuses to overwrite a state
+// that is at least as new.
+func TestStaleState(t *testing.T) {
+	s, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, tc := range []struct {
+		epoch uint64
+		ok    bool
+	}{
+		{1, true},
+		{2, true},
+		{2, false},
+		{1, false},
+		{3, true},
+	} {
+		err := s.Save(&dr.State{Epoch: tc.epoch})
+		if tc.ok && err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if !tc.ok && !errors.Is(err, dr.ErrStaleState) {
+			t.Fatalf("#%d: expected %v, got %v", i, dr.ErrStaleState, err)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package dr
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+)
+
+// aesGCMSIV is 256-bit AES-GCM-SIV as specified in RFC 8452.
+//
+// AES-GCM-SIV is nonce-misuse resistant: repeating a nonce only
+// reveals whether the same plaintext was encrypted twice under
+// the same key and nonce.
+type aesGCMSIV struct{}
+
+var _ AEAD = aesGCMSIV{}
+
+const (
+	// gcmSIVKeySize is the size in bytes of an AES-256-GCM-SIV
+	// key.
+	gcmSIVKeySize = 32
+	// gcmSIVNonceSize is the size in bytes of an AES-GCM-SIV
+	// nonce.
+	gcmSIVNonceSize = 12
+	// gcmSIVTagSize is the size in bytes of an AES-GCM-SIV tag.
+	gcmSIVTagSize = 16
+	// gcmSIVMaxPlaintext is the largest plaintext allowed by
+	// RFC 8452, 2^36 bytes.
+	gcmSIVMaxPlaintext = 1 << 36
+)
+
+func (aesGCMSIV) KeySize() int   { return gcmSIVKeySize }
+func (aesGCMSIV) NonceSize() int { return gcmSIVNonceSize }
+func (aesGCMSIV) Overhead() int  { return gcmSIVTagSize }
+
+func (aesGCMSIV) Seal(dst, key, nonce, plaintext, additionalData []byte) []byte {
+	if uint64(len(plaintext)) > gcmSIVMaxPlaintext ||
+		uint64(len(additionalData)) > gcmSIVMaxPlaintext {
+		panic("dr: AES-GCM-SIV input too large")
+	}
+	authKey, encBlock := gcmSIVDeriveKeys(key, nonce)
+	tag := gcmSIVTag(authKey, encBlock, nonce, plaintext, additionalData)
+	wipe(authKey[:])
+
+	ret, out := sliceForAppend(dst, len(plaintext)+gcmSIVTagSize)
+	gcmSIVCTR(encBlock, &tag, out, plaintext)
+	copy(out[len(plaintext):], tag[:])
+	return ret
+}
+
+func (aesGCMSIV) Open(dst, key, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < gcmSIVTagSize {
+		return nil, errors.New("dr: ciphertext too short")
+	}
+	if uint64(len(ciphertext)) > gcmSIVMaxPlaintext+gcmSIVTagSize ||
+		uint64(len(additionalData)) > gcmSIVMaxPlaintext {
+		return nil, errors.New("dr: message authentication failed")
+	}
+	var tag [gcmSIVTagSize]byte
+	copy(tag[:], ciphertext[len(ciphertext)-gcmSIVTagSize:])
+	ciphertext = ciphertext[:len(ciphertext)-gcmSIVTagSize]
+
+	authKey, encBlock := gcmSIVDeriveKeys(key, nonce)
+	ret, out := sliceForAppend(dst, len(ciphertext))
+	gcmSIVCTR(encBlock, &tag, out, ciphertext)
+	want := gcmSIVTag(authKey, encBlock, nonce, out, additionalData)
+	wipe(authKey[:])
+	if subtle.ConstantTimeCompare(tag[:], want[:]) != 1 {
+		wipe(out)
+		return nil, errors.New("dr: message authentication failed")
+	}
+	return ret, nil
+}
+
+// gcmSIVDeriveKeys derives the per-nonce message authentication
+// and encryption keys (RFC 8452, section 4).
+func gcmSIVDeriveKeys(key, nonce []byte) (authKey [16]byte, encBlock cipher.Block) {
+	if len(key) != gcmSIVKeySize {
+		panic("dr: invalid AES-GCM-SIV key size")
+	}
+	if len(nonce) != gcmSIVNonceSize {
+		panic("dr: invalid AES-GCM-SIV nonce size")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	var (
+		in, out [16]byte
+		encKey  [gcmSIVKeySize]byte
+	)
+	copy(in[4:], nonce)
+	for i := 0; i < 6; i++ {
+		binary.LittleEndian.PutUint32(in[:4], uint32(i))
+		block.Encrypt(out[:], in[:])
+		if i < 2 {
+			copy(authKey[8*i:], out[:8])
+		} else {
+			copy(encKey[8*(i-2):], out[:8])
+		}
+	}
+	wipe(out[:])
+	encBlock, err = aes.NewCipher(encKey[:])
+	if err != nil {
+		panic(err)
+	}
+	wipe(encKey[:])
+	return authKey, encBlock
+}
+
+// gcmSIVTag computes the tag for the plaintext and additional
+// data (RFC 8452, section 4).
+func gcmSIVTag(authKey [16]byte, encBlock cipher.Block, nonce, plaintext, additionalData []byte) [gcmSIVTagSize]byte {
+	p := newPolyval(authKey)
+	p.update(additionalData)
+	p.update(plaintext)
+	var lengths [16]byte
+	binary.LittleEndian.PutUint64(lengths[:8], uint64(len(additionalData))*8)
+	binary.LittleEndian.PutUint64(lengths[8:], uint64(len(plaintext))*8)
+	p.update(lengths[:])
+
+	var s [16]byte
+	p.sum(&s)
+	p.wipe()
+	subtle.XORBytes(s[:gcmSIVNonceSize], s[:gcmSIVNonceSize], nonce)
+	s[15] &= 0x7f
+	var tag [gcmSIVTagSize]byte
+	encBlock.Encrypt(tag[:], s[:])
+	return tag
+}
+
+// gcmSIVCTR XORs src with the AES-CTR keystream whose initial
+// counter block is derived from tag and writes the result to
+// dst.
+//
+// Unlike standard CTR mode, the counter is the first 32 bits of
+// the block in little-endian order.
+func gcmSIVCTR(block cipher.Block, tag *[gcmSIVTagSize]byte, dst, src []byte) {
+	var ctr, ks [16]byte
+	copy(ctr[:], tag[:])
+	ctr[15] |= 0x80
+	for len(src) > 0 {
+		block.Encrypt(ks[:], ctr[:])
+		n := subtle.XORBytes(dst, src, ks[:])
+		dst, src = dst[n:], src[n:]
+		binary.LittleEndian.PutUint32(ctr[:4],
+			binary.LittleEndian.Uint32(ctr[:4])+1)
+	}
+	wipe(ks[:])
+}
+
+// polyval computes POLYVAL (RFC 8452, section 3).
+//
+// Field elements are represented as 128-bit little-endian
+// integers split into two uint64s where bit i is the coefficient
+// of x^i.
+type polyval struct {
+	h, s [2]uint64
+}
+
+func newPolyval(key [16]byte) *polyval {
+	return &polyval{
+		h: [2]uint64{
+			binary.LittleEndian.Uint64(key[:8]),
+			binary.LittleEndian.Uint64(key[8:]),
+		},
+	}
+}
+
+// update absorbs data, zero-padded to a multiple of 16 bytes.
+func (p *polyval) update(data []byte) {
+	for len(data) > 0 {
+		var block [16]byte
+		n := copy(block[:], data)
+		data = data[n:]
+		p.s[0] ^= binary.LittleEndian.Uint64(block[:8])
+		p.s[1] ^= binary.LittleEndian.Uint64(block[8:])
+		p.s = polyvalDot(p.s, p.h)
+	}
+}
+
+// sum writes the current value of the accumulator to out.
+func (p *polyval) sum(out *[16]byte) {
+	binary.LittleEndian.PutUint64(out[:8], p.s[0])
+	binary.LittleEndian.PutUint64(out[8:], p.s[1])
+}
+
+func (p *polyval) wipe() {
+	*p = polyval{}
+}
+
+// polyvalDot returns a*b*x^-128 in GF(2^128) modulo
+// x^128 + x^127 + x^126 + x^121 + 1.
+//
+// It runs in constant time.
+func polyvalDot(a, b [2]uint64) [2]uint64 {
+	// r = (r + a_i*b) * x^-1 for each bit a_i of a, from least to
+	// most significant, which yields a*b*x^-128.
+	//
+	// Multiplying by x^-1 is a right shift, after first adding
+	// the modulus if the low bit is set. The modulus shifted
+	// right by one is x^127 + x^126 + x^125 + x^120.
+	const (
+		poly = 0xe100000000000000
+	)
+	var r [2]uint64
+	for i := 0; i < 128; i++ {
+		bit := (a[i/64] >> (i % 64)) & 1
+		mask := -bit
+		r[0] ^= b[0] & mask
+		r[1] ^= b[1] & mask
+
+		mask = -(r[0] & 1)
+		r[0] = r[0]>>1 | r[1]<<63
+		r[1] = r[1]>>1 ^ poly&mask
+	}
+	return r
+}
+
+// sliceForAppend extends in by n bytes and returns the entire
+// slice and the extension.
+func sliceForAppend(in []byte, n int) (head, tail []byte) {
+	if total := len(in) + n; cap(in) >= total {
+		head = in[:total]
+	} else {
+		head = make([]byte, total)
+		copy(head, in)
+	}
+	tail = head[len(in):]
+	return head, tail
+}
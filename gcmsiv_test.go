@@ -0,0 +1,129 @@
+package dr
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/hex"
+	"testing"
+)
+
+// TestGCMSIVVectors tests AES-256-GCM-SIV against the test
+// vectors in RFC 8452, appendix C.2.
+func TestGCMSIVVectors(t *testing.T) {
+	for i, tc := range []struct {
+		key, nonce, plaintext, ad, result string
+	}{
+		{
+			key:    "0100000000000000000000000000000000000000000000000000000000000000",
+			nonce:  "030000000000000000000000",
+			result: "07f5f4169bbf55a8400cd47ea6fd400f",
+		},
+		{
+			key:       "0100000000000000000000000000000000000000000000000000000000000000",
+			nonce:     "030000000000000000000000",
+			plaintext: "0100000000000000",
+			result:    "c2ef328e5c71c83b843122130f7364b761e0b97427e3df28",
+		},
+		{
+			key:       "0100000000000000000000000000000000000000000000000000000000000000",
+			nonce:     "030000000000000000000000",
+			plaintext: "01000000000000000000000000000000",
+			result:    "85a01b63025ba19b7fd3ddfc033b3e76c9eac6fa700942702e90862383c6c366",
+		},
+		{
+			key:       "0100000000000000000000000000000000000000000000000000000000000000",
+			nonce:     "030000000000000000000000",
+			plaintext: "0200000000000000",
+			ad:        "01",
+			result:    "1de22967237a813291213f267e3b452f02d01ae33e4ec854",
+		},
+	} {
+		key := unhex(t, tc.key)
+		nonce := unhex(t, tc.nonce)
+		plaintext := unhex(t, tc.plaintext)
+		ad := unhex(t, tc.ad)
+		want := unhex(t, tc.result)
+
+		got := aesGCMSIV{}.Seal(nil, key, nonce, plaintext, ad)
+		if !bytes.Equal(got, want) {
+			t.Fatalf("#%d: expected %x, got %x", i, want, got)
+		}
+		pt, err := aesGCMSIV{}.Open(nil, key, nonce, got, ad)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if !bytes.Equal(pt, plaintext) {
+			t.Fatalf("#%d: expected %x, got %x", i, plaintext, pt)
+		}
+	}
+}
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// TestGCMSIV tests AES-GCM-SIV round trips and that Open
+// rejects modified inputs.
+func TestGCMSIV(t *testing.T) {
+	var a aesGCMSIV
+	key := make([]byte, a.KeySize())
+	nonce := make([]byte, a.NonceSize())
+	rand.Read(key)
+	rand.Read(nonce)
+	ad := []byte("additional data")
+	for _, n := range []int{0, 1, 15, 16, 17, 1000} {
+		plaintext := make([]byte, n)
+		rand.Read(plaintext)
+		prefix := []byte("prefix")
+		ct := a.Seal(bytes.Clone(prefix), key, nonce, plaintext, ad)
+		if !bytes.HasPrefix(ct, prefix) {
+			t.Fatalf("%d: Seal did not append to dst", n)
+		}
+		ct = ct[len(prefix):]
+		if len(ct) != n+a.Overhead() {
+			t.Fatalf("%d: expected %d bytes, got %d", n, n+a.Overhead(), len(ct))
+		}
+		got, err := a.Open(bytes.Clone(prefix), key, nonce, ct, ad)
+		if err != nil {
+			t.Fatalf("%d: %v", n, err)
+		}
+		if !bytes.Equal(got, append(prefix, plaintext...)) {
+			t.Fatalf("%d: plaintext mismatch", n)
+		}
+
+		for i := range ct {
+			bad := bytes.Clone(ct)
+			bad[i] ^= 1
+			if _, err := a.Open(nil, key, nonce, bad, ad); err == nil {
+				t.Fatalf("%d: expected an error for modified byte %d", n, i)
+			}
+		}
+		if _, err := a.Open(nil, key, nonce, ct, nil); err == nil {
+			t.Fatalf("%d: expected an error with different additional data", n)
+		}
+	}
+	if _, err := a.Open(nil, key, nonce, make([]byte, a.Overhead()-1), ad); err == nil {
+		t.Fatal("expected an error for a short ciphertext")
+	}
+}
+
+// TestNISTSIV tests that NISTSIV does not interoperate with NIST.
+func TestNISTSIV(t *testing.T) {
+	r := NISTSIV(elliptic.P256(), t.Name())
+	if got, want := r.Name(), "DR-P256-AES256GCMSIV-HKDF-SHA512/"+t.Name(); got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+	mk := make(MessageKey, 32)
+	rand.Read(mk)
+	ct := r.Seal(mk, []byte("hello"), nil)
+	if _, err := NIST(elliptic.P256(), sha512.New, t.Name()).Open(mk, ct, nil); err == nil {
+		t.Fatal("expected an error")
+	}
+}
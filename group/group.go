@@ -0,0 +1,263 @@
+// Package group implements "sender key" group messaging on top
+// of package dr.
+//
+// # Overview
+//
+// Pairwise Double Ratchet sessions do not scale to large groups
+// since the sender has to encrypt each message once per member.
+// Instead, each member creates a SenderChain: a symmetric KDF
+// chain that is stepped with the Ratchet's KDFck method. The
+// member distributes the chain's current chain key to every
+// other member over their pairwise dr.Session and then encrypts
+// each group message exactly once:
+//
+//	chain, err := group.NewSenderChain(r, rand.Reader)
+//	for _, s := range sessions {
+//	    msg, err := chain.SealDistribution(s)
+//	    // send msg to the member
+//	}
+//	msg, err := chain.Seal(plaintext, ad)
+//	// send msg to the whole group
+//
+// Each recipient opens the distribution message with its own
+// pairwise session and then opens group messages with the
+// resulting ReceiverChain:
+//
+//	chain, err := group.OpenDistribution(r, s, msg)
+//	plaintext, err := chain.Open(groupMsg, ad)
+//
+// # Security
+//
+// Sender chains provide forward secrecy, since chain keys are
+// discarded as the chain advances, but not post-compromise
+// security: anybody who learns a chain key can decrypt every
+// later message in the chain. Senders should create a new chain
+// periodically and whenever the group membership changes.
+//
+// Messages are not signed. Every member holds the sender's chain
+// key, so any member can forge messages that appear to come from
+// the sender. Applications that need to authenticate the sender
+// within the group must sign messages separately.
+package group
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ericlagergren/dr"
+	"github.com/ericlagergren/dr/internal/secure"
+)
+
+// DefaultMaxSkip is the default maximum number of skipped
+// message keys retained by a ReceiverChain.
+const DefaultMaxSkip = 1000
+
+// chainKeySize is the size in bytes of a chain key.
+const chainKeySize = dr.KeySize
+
+// distributionAD is the additional data used to seal
+// distribution messages.
+var distributionAD = []byte("dr group distribution")
+
+// Message is a group message.
+type Message struct {
+	// N is the message's position in the sender chain.
+	N int
+	// Ciphertext is the encrypted message.
+	Ciphertext []byte
+}
+
+// concat returns the additional data for the Nth message.
+func concat(r dr.Ratchet, additionalData []byte, n int) []byte {
+	return r.Concat(additionalData, dr.Header{N: n})
+}
+
+// SenderChain is the sending half of a sender key.
+//
+// SenderChain is not safe for concurrent use by multiple
+// goroutines.
+type SenderChain struct {
+	r  dr.Ratchet
+	ck dr.ChainKey
+	n  int
+}
+
+// NewSenderChain creates a SenderChain with a random chain key
+// read from rand.
+func NewSenderChain(r dr.Ratchet, rand io.Reader) (*SenderChain, error) {
+	ck := make(dr.ChainKey, chainKeySize)
+	if _, err := io.ReadFull(rand, ck); err != nil {
+		return nil, fmt.Errorf("group: unable to generate chain key: %w", err)
+	}
+	return &SenderChain{r: r, ck: ck}, nil
+}
+
+// Seal encrypts and authenticates plaintext, authenticates
+// additionalData, and advances the chain.
+func (c *SenderChain) Seal(plaintext, additionalData []byte) (Message, error) {
+	if c.ck == nil {
+		return Message{}, dr.ErrClosed
+	}
+	ck, mk := c.r.KDFck(c.ck)
+	defer wipe(mk)
+	msg := Message{
+		N:          c.n,
+		Ciphertext: c.r.Seal(mk, plaintext, concat(c.r, additionalData, c.n)),
+	}
+	wipe(c.ck)
+	c.ck = ck
+	c.n++
+	return msg, nil
+}
+
+// SealDistribution seals the chain's current position and chain
+// key to the member at the other end of s.
+//
+// The recipient can open every message sealed after the
+// distribution message was created, but none sealed before it.
+func (c *SenderChain) SealDistribution(s *dr.Session) (dr.Message, error) {
+	if c.ck == nil {
+		return dr.Message{}, dr.ErrClosed
+	}
+	buf := make([]byte, 0, 8+len(c.ck))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(c.n))
+	buf = append(buf, c.ck...)
+	defer wipe(buf)
+	return s.Seal(buf, distributionAD)
+}
+
+// Close wipes the chain key.
+//
+// After Close returns, Seal and SealDistribution return
+// dr.ErrClosed.
+func (c *SenderChain) Close() error {
+	wipe(c.ck)
+	c.ck = nil
+	return nil
+}
+
+// ReceiverChain is the receiving half of another member's sender
+// key.
+//
+// ReceiverChain is not safe for concurrent use by multiple
+// goroutines.
+type ReceiverChain struct {
+	r       dr.Ratchet
+	ck      dr.ChainKey
+	n       int
+	maxSkip int
+	// skipped are the message keys for messages that have not
+	// arrived yet, indexed by message number.
+	skipped map[int]dr.MessageKey
+}
+
+// OpenDistribution opens a distribution message created by
+// SealDistribution and returns the sender's ReceiverChain.
+func OpenDistribution(r dr.Ratchet, s *dr.Session, msg dr.Message) (*ReceiverChain, error) {
+	buf, err := s.Open(msg, distributionAD)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(buf)
+	if len(buf) != 8+chainKeySize {
+		return nil, fmt.Errorf("group: invalid distribution message length: %d", len(buf))
+	}
+	n := binary.BigEndian.Uint64(buf)
+	if n > uint64(^uint(0)>>1) {
+		return nil, errors.New("group: invalid distribution message number")
+	}
+	return &ReceiverChain{
+		r:       r,
+		ck:      append(dr.ChainKey(nil), buf[8:]...),
+		n:       int(n),
+		maxSkip: DefaultMaxSkip,
+		skipped: make(map[int]dr.MessageKey),
+	}, nil
+}
+
+// SetMaxSkip sets the maximum number of skipped message keys
+// retained by the chain.
+//
+// By default, DefaultMaxSkip is used.
+func (c *ReceiverChain) SetMaxSkip(n int) {
+	c.maxSkip = n
+}
+
+// Open decrypts and authenticates msg, authenticates
+// additionalData, and advances the chain.
+//
+// Messages may arrive out of order. The keys of messages that
+// were skipped are retained until they arrive, up to the limit
+// set by SetMaxSkip. Open returns an error wrapping
+// dr.ErrTooManySkipped if the limit would be exceeded.
+func (c *ReceiverChain) Open(msg Message, additionalData []byte) ([]byte, error) {
+	if c.ck == nil {
+		return nil, dr.ErrClosed
+	}
+	ad := concat(c.r, additionalData, msg.N)
+	if msg.N < c.n {
+		mk, ok := c.skipped[msg.N]
+		if !ok {
+			return nil, fmt.Errorf("group: message %d is not available", msg.N)
+		}
+		plaintext, err := c.r.Open(mk, msg.Ciphertext, ad)
+		if err != nil {
+			return nil, err
+		}
+		wipe(mk)
+		delete(c.skipped, msg.N)
+		return plaintext, nil
+	}
+	if n := msg.N - c.n; n > 0 && n > c.maxSkip-len(c.skipped) {
+		return nil, fmt.Errorf("group: %w", dr.ErrTooManySkipped)
+	}
+
+	// Advance a copy of the chain so that failures do not
+	// change it.
+	ck := append(dr.ChainKey(nil), c.ck...)
+	var keys []dr.MessageKey
+	for i := c.n; i < msg.N; i++ {
+		next, mk := c.r.KDFck(ck)
+		wipe(ck)
+		ck = next
+		keys = append(keys, mk)
+	}
+	next, mk := c.r.KDFck(ck)
+	wipe(ck)
+	defer wipe(mk)
+	plaintext, err := c.r.Open(mk, msg.Ciphertext, ad)
+	if err != nil {
+		wipe(next)
+		for _, k := range keys {
+			wipe(k)
+		}
+		return nil, err
+	}
+	for i, k := range keys {
+		c.skipped[c.n+i] = k
+	}
+	wipe(c.ck)
+	c.ck = next
+	c.n = msg.N + 1
+	return plaintext, nil
+}
+
+// Close wipes the chain key and every skipped message key.
+//
+// After Close returns, Open returns dr.ErrClosed.
+func (c *ReceiverChain) Close() error {
+	wipe(c.ck)
+	c.ck = nil
+	for n, mk := range c.skipped {
+		wipe(mk)
+		delete(c.skipped, n)
+	}
+	return nil
+}
+
+// wipe is shorthand for secure.Wipe.
+func wipe(p []byte) {
+	secure.Wipe(p)
+}
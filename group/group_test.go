@@ -0,0 +1,154 @@
+package group
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/ericlagergren/dr"
+)
+
+// newSessions returns a connected (sender, receiver) pair.
+func newSessions(t *testing.T, r dr.Ratchet) (alice, bob *dr.Session) {
+	SK := make([]byte, 32)
+	if _, err := rand.Read(SK); err != nil {
+		t.Fatal(err)
+	}
+	priv, err := r.Generate(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err = dr.NewRecv(r, append([]byte(nil), SK...), priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err = dr.NewSend(r, SK, r.Public(priv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return alice, bob
+}
+
+// TestGroup tests a group of three members where Alice sends and
+// Bob and Carol decrypt.
+func TestGroup(t *testing.T) {
+	r := dr.DJB(t.Name())
+	aliceBob, bobAlice := newSessions(t, r)
+	aliceCarol, carolAlice := newSessions(t, r)
+
+	chain, err := NewSenderChain(r, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Messages sealed before the distribution cannot be opened.
+	early, err := chain.Seal([]byte("early"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var recv []*ReceiverChain
+	for _, s := range []struct {
+		send, recv *dr.Session
+	}{
+		{aliceBob, bobAlice},
+		{aliceCarol, carolAlice},
+	} {
+		msg, err := chain.SealDistribution(s.send)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := OpenDistribution(r, s.recv, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		recv = append(recv, c)
+	}
+	bob, carol := recv[0], recv[1]
+
+	const (
+		N = 10
+	)
+	ad := []byte("group")
+	msgs := make([]Message, N)
+	for i := range msgs {
+		msgs[i], err = chain.Seal([]byte(fmt.Sprint(i)), ad)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	open := func(c *ReceiverChain, i int) {
+		t.Helper()
+		got, err := c.Open(msgs[i], ad)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if want := []byte(fmt.Sprint(i)); !hmac.Equal(got, want) {
+			t.Fatalf("#%d: expected %q, got %q", i, want, got)
+		}
+	}
+	// Bob receives the messages in order and Carol in reverse.
+	for i := 0; i < N; i++ {
+		open(bob, i)
+		open(carol, N-1-i)
+	}
+	if len(carol.skipped) != 0 {
+		t.Fatalf("%d skipped keys remain", len(carol.skipped))
+	}
+
+	for _, c := range recv {
+		if _, err := c.Open(early, nil); err == nil {
+			t.Fatal("expected an error")
+		}
+		if _, err := c.Open(msgs[0], ad); err == nil {
+			t.Fatal("expected an error for a replayed message")
+		}
+	}
+}
+
+// TestGroupInvalid tests that invalid messages do not advance
+// the chain.
+func TestGroupInvalid(t *testing.T) {
+	r := dr.DJB(t.Name())
+	alice, bob := newSessions(t, r)
+
+	chain, err := NewSenderChain(r, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dist, err := chain.SealDistribution(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recv, err := OpenDistribution(r, bob, dist)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recv.SetMaxSkip(5)
+
+	msg, err := chain.Seal([]byte("hello"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := Message{N: 3, Ciphertext: msg.Ciphertext}
+	if _, err := recv.Open(bad, nil); err == nil {
+		t.Fatal("expected an error")
+	}
+	if _, err := recv.Open(Message{N: 6}, nil); !errors.Is(err, dr.ErrTooManySkipped) {
+		t.Fatalf("expected %v, got %v", dr.ErrTooManySkipped, err)
+	}
+	if _, err := recv.Open(msg, []byte("wrong")); err == nil {
+		t.Fatal("expected an error")
+	}
+	if _, err := recv.Open(msg, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := chain.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := chain.Seal(nil, nil); !errors.Is(err, dr.ErrClosed) {
+		t.Fatalf("expected %v, got %v", dr.ErrClosed, err)
+	}
+}
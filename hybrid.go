@@ -0,0 +1,187 @@
+package dr
+
+import (
+	"crypto/mlkem"
+	"fmt"
+	"io"
+	"strconv"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+const (
+	// hybridPrivKeyLen is the size in bytes of a hybrid
+	// PrivateKey:
+	//
+	//    x25519 scalar || x25519 point || ML-KEM seed || ML-KEM encapsulation key
+	//
+	hybridPrivKeyLen = curve25519.ScalarSize + curve25519.PointSize +
+		mlkem.SeedSize + mlkem.EncapsulationKeySize768
+	// hybridPubKeyLen is the size in bytes of a hybrid
+	// PublicKey:
+	//
+	//    x25519 point || ML-KEM encapsulation key
+	//
+	hybridPubKeyLen = curve25519.PointSize + mlkem.EncapsulationKeySize768
+)
+
+// hybrid implements KEMRatchet using X25519 and ML-KEM-768
+// alongside the same KDFs and AEAD as djb.
+type hybrid struct {
+	djb
+}
+
+var (
+	_ KEMRatchet     = (*hybrid)(nil)
+	_ AppendRatchet  = (*hybrid)(nil)
+	_ CounterRatchet = (*hybrid)(nil)
+	_ keySizer       = (*hybrid)(nil)
+)
+
+// X25519MLKEM768 creates a Ratchet that combines X25519 with
+// ML-KEM-768 for resistance against "harvest now, decrypt later"
+// attacks by quantum computers. The KDFs and AEAD are the same as
+// DJB.
+//
+// Each asymmetric ratchet step feeds the concatenation of the
+// X25519 and ML-KEM-768 shared secrets into KDFrk, so the
+// resulting keys are secure as long as either X25519 or
+// ML-KEM-768 is secure.
+//
+// The namespace is used to bind keys to a particular application
+// or context.
+//
+// The returned Ratchet implements KEMRatchet. Compared to DJB,
+// the wire sizes are much larger:
+//
+//    PrivateKey:    1312 bytes
+//    PublicKey:     1216 bytes (vs 32)
+//    KEMCiphertext: 1088 bytes (vs 0)
+//    Header:        2325 bytes (vs 51)
+//
+func X25519MLKEM768(namespace string, opts ...RatchetOption) Ratchet {
+	return &hybrid{djb: *newDJB("X25519MLKEM768", namespace, opts)}
+}
+
+func (hybrid) privKeyLen() int { return hybridPrivKeyLen }
+
+// DHPublicKeyLen returns the size in bytes of an X25519 public
+// key concatenated with an ML-KEM-768 encapsulation key.
+func (hybrid) DHPublicKeyLen() int { return hybridPubKeyLen }
+
+func (h hybrid) Generate(r io.Reader) (PrivateKey, error) {
+	classical, err := h.djb.Generate(r)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(classical)
+
+	seed := make([]byte, mlkem.SeedSize)
+	defer wipe(seed)
+	if _, err := io.ReadFull(r, seed); err != nil {
+		return nil, err
+	}
+	dk, err := mlkem.NewDecapsulationKey768(seed)
+	if err != nil {
+		return nil, err
+	}
+
+	key := make(PrivateKey, 0, hybridPrivKeyLen)
+	key = append(key, classical...)
+	key = append(key, seed...)
+	key = append(key, dk.EncapsulationKey().Bytes()...)
+	return key, nil
+}
+
+// split splits the key pair into its X25519 key pair, ML-KEM
+// seed, and ML-KEM encapsulation key.
+func (hybrid) split(priv PrivateKey) (classical PrivateKey, seed, ek []byte) {
+	const (
+		C = curve25519.ScalarSize + curve25519.PointSize
+		S = mlkem.SeedSize
+	)
+	return priv[:C:C], priv[C : C+S : C+S], priv[C+S:]
+}
+
+func (h hybrid) Public(priv PrivateKey) PublicKey {
+	if len(priv) != hybridPrivKeyLen {
+		panic("dr: invalid key pair size: " + strconv.Itoa(len(priv)))
+	}
+	classical, _, ek := h.split(priv)
+	pub := make(PublicKey, 0, hybridPubKeyLen)
+	pub = append(pub, classical[curve25519.ScalarSize:]...)
+	pub = append(pub, ek...)
+	return pub
+}
+
+// DH performs only the X25519 half of the key exchange.
+//
+// Sessions use Encapsulate and Decapsulate instead.
+func (h hybrid) DH(priv PrivateKey, pub PublicKey) ([]byte, error) {
+	if len(priv) != hybridPrivKeyLen {
+		return nil, fmt.Errorf("dr: invalid key pair size: %d", len(priv))
+	}
+	if len(pub) != hybridPubKeyLen {
+		return nil, fmt.Errorf("dr: invalid public key size: %d", len(pub))
+	}
+	classical, _, _ := h.split(priv)
+	return h.djb.DH(classical, pub[:curve25519.PointSize])
+}
+
+func (h hybrid) Encapsulate(priv PrivateKey, peer PublicKey) (secret, ciphertext []byte, err error) {
+	dh, err := h.DH(priv, peer)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer wipe(dh)
+
+	ek, err := mlkem.NewEncapsulationKey768(peer[curve25519.PointSize:])
+	if err != nil {
+		return nil, nil, fmt.Errorf("dr: invalid public key: %w", err)
+	}
+	ss, ct := ek.Encapsulate()
+	defer wipe(ss)
+
+	secret = make([]byte, 0, len(dh)+len(ss))
+	secret = append(secret, dh...)
+	secret = append(secret, ss...)
+	return secret, ct, nil
+}
+
+func (h hybrid) Decapsulate(priv PrivateKey, peer PublicKey, ciphertext []byte) ([]byte, error) {
+	dh, err := h.DH(priv, peer)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(dh)
+
+	if len(ciphertext) != mlkem.CiphertextSize768 {
+		return nil, fmt.Errorf("dr: invalid KEM ciphertext size: %d", len(ciphertext))
+	}
+	_, seed, _ := h.split(priv)
+	dk, err := mlkem.NewDecapsulationKey768(seed)
+	if err != nil {
+		return nil, err
+	}
+	ss, err := dk.Decapsulate(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(ss)
+
+	secret := make([]byte, 0, len(dh)+len(ss))
+	secret = append(secret, dh...)
+	secret = append(secret, ss...)
+	return secret, nil
+}
+
+func (h hybrid) Header(priv PrivateKey, prevChainLength, messageNum int) Header {
+	if len(priv) != hybridPrivKeyLen {
+		panic("Header: invalid key pair size: " + strconv.Itoa(len(priv)))
+	}
+	return Header{
+		PublicKey: h.Public(priv),
+		PN:        prevChainLength,
+		N:         messageNum,
+	}
+}
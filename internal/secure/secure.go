@@ -0,0 +1,22 @@
+// Package secure implements helpers for handling secret key
+// material.
+package secure
+
+import "runtime"
+
+// Wipe sets every byte in p to zero.
+//
+// Wipe is the single zeroization routine used by this module.
+// It runs in time that depends only on len(p), does not
+// allocate, and is not inlined, so the compiler cannot prove
+// that the writes are dead and remove them. The KeepAlive call
+// keeps p reachable until the writes are complete.
+//
+// Wipe cannot erase copies of p made elsewhere, such as by the
+// garbage collector moving a stack or by a slice being grown.
+//
+//go:noinline
+func Wipe(p []byte) {
+	clear(p)
+	runtime.KeepAlive(p)
+}
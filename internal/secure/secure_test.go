@@ -0,0 +1,37 @@
+package secure
+
+import (
+	"crypto/rand"
+	"testing"
+)
+
+// TestWipe tests that Wipe zeros every byte of the slice and
+// nothing outside of it.
+func TestWipe(t *testing.T) {
+	for _, n := range []int{0, 1, 7, 32, 64, 1000} {
+		buf := make([]byte, n+2)
+		if _, err := rand.Read(buf); err != nil {
+			t.Fatal(err)
+		}
+		buf[0], buf[n+1] = 0xff, 0xff
+
+		Wipe(buf[1 : n+1])
+		for i, c := range buf[1 : n+1] {
+			if c != 0 {
+				t.Fatalf("%d: byte %d was not wiped: %#x", n, i, c)
+			}
+		}
+		if buf[0] != 0xff || buf[n+1] != 0xff {
+			t.Fatalf("%d: wiped outside of the slice", n)
+		}
+	}
+	Wipe(nil)
+}
+
+// TestWipeAllocs tests that Wipe does not allocate.
+func TestWipeAllocs(t *testing.T) {
+	buf := make([]byte, 64)
+	if n := testing.AllocsPerRun(100, func() { Wipe(buf) }); n != 0 {
+		t.Fatalf("expected no allocations, got %v", n)
+	}
+}
@@ -0,0 +1,188 @@
+package dr
+
+import (
+	"errors"
+	"math"
+	"sync"
+)
+
+// KeyLimitStore is a Store that limits the number of skipped
+// message keys stored for each public key.
+//
+// The limit applies in addition to the inner Store's own limit,
+// so StoreKey returns ErrTooManySkipped when either limit is
+// reached. This keeps a single chain, such as one controlled by
+// a malicious sender, from using up the inner Store's limit and
+// starving every other chain that shares it.
+//
+// KeyLimitStore only counts keys stored through it. Keys that
+// were already in the inner Store when the KeyLimitStore was
+// created, or that the inner Store removes on its own (for
+// example, after a TTL), are not counted.
+//
+// KeyLimitStore is safe for concurrent use by multiple
+// goroutines if the inner Store is.
+type KeyLimitStore struct {
+	inner  Store
+	perKey int
+
+	mu sync.Mutex
+	// keys are the message numbers of the stored keys, indexed
+	// by public key.
+	keys map[string]map[int]struct{}
+}
+
+var (
+	_ Store      = (*KeyLimitStore)(nil)
+	_ KeyPurger  = (*KeyLimitStore)(nil)
+	_ KeyPruner  = (*KeyLimitStore)(nil)
+	_ Purger     = (*KeyLimitStore)(nil)
+	_ KeyCounter = (*KeyLimitStore)(nil)
+	_ KeyLimiter = (*KeyLimitStore)(nil)
+)
+
+// NewKeyLimitStore creates a KeyLimitStore that wraps inner and
+// stores at most perKey skipped message keys for each public
+// key.
+func NewKeyLimitStore(inner Store, perKey int) *KeyLimitStore {
+	return &KeyLimitStore{
+		inner:  inner,
+		perKey: perKey,
+		keys:   make(map[string]map[int]struct{}),
+	}
+}
+
+// Save saves the state with the inner Store.
+func (l *KeyLimitStore) Save(state *State) error {
+	return l.inner.Save(state)
+}
+
+// StoreKey stores the message key with the inner Store.
+//
+// It returns ErrTooManySkipped if perKey keys are already stored
+// for pub.
+func (l *KeyLimitStore) StoreKey(Nr int, pub PublicKey, key MessageKey) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	set := l.keys[string(pub)]
+	if _, ok := set[Nr]; !ok && len(set) >= l.perKey {
+		return ErrTooManySkipped
+	}
+	if err := l.inner.StoreKey(Nr, pub, key); err != nil {
+		return err
+	}
+	if set == nil {
+		set = make(map[int]struct{})
+		l.keys[string(pub)] = set
+	}
+	set[Nr] = struct{}{}
+	return nil
+}
+
+// LoadKey loads the message key from the inner Store.
+func (l *KeyLimitStore) LoadKey(Nr int, pub PublicKey) (MessageKey, error) {
+	return l.inner.LoadKey(Nr, pub)
+}
+
+// DeleteKey removes the message key from the inner Store.
+func (l *KeyLimitStore) DeleteKey(Nr int, pub PublicKey) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.inner.DeleteKey(Nr, pub); err != nil {
+		return err
+	}
+	if set, ok := l.keys[string(pub)]; ok {
+		delete(set, Nr)
+		if len(set) == 0 {
+			delete(l.keys, string(pub))
+		}
+	}
+	return nil
+}
+
+// PurgeKeys implements KeyPurger.
+//
+// It returns an error if the inner Store does not implement
+// KeyPurger.
+func (l *KeyLimitStore) PurgeKeys() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	p, ok := l.inner.(KeyPurger)
+	if !ok {
+		return errors.New("dr: inner store does not implement KeyPurger")
+	}
+	if err := p.PurgeKeys(); err != nil {
+		return err
+	}
+	clear(l.keys)
+	return nil
+}
+
+// PruneKeys implements KeyPruner.
+//
+// It does nothing if the inner Store does not implement
+// KeyPruner.
+func (l *KeyLimitStore) PruneKeys(keep ...PublicKey) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	p, ok := l.inner.(KeyPruner)
+	if !ok {
+		return nil
+	}
+	if err := p.PruneKeys(keep...); err != nil {
+		return err
+	}
+	for pub := range l.keys {
+		if !containsKey(keep, PublicKey(pub)) {
+			delete(l.keys, pub)
+		}
+	}
+	return nil
+}
+
+// SkippedCount implements KeyCounter.
+//
+// It returns an error if the inner Store does not implement
+// KeyCounter.
+func (l *KeyLimitStore) SkippedCount() (int, error) {
+	c, ok := l.inner.(KeyCounter)
+	if !ok {
+		return 0, errors.New("dr: inner store does not implement KeyCounter")
+	}
+	return c.SkippedCount()
+}
+
+// RemainingKeys implements KeyLimiter.
+//
+// It returns math.MaxInt if the inner Store does not implement
+// KeyLimiter.
+func (l *KeyLimitStore) RemainingKeys() (int, error) {
+	k, ok := l.inner.(KeyLimiter)
+	if !ok {
+		return math.MaxInt, nil
+	}
+	return k.RemainingKeys()
+}
+
+// Purge implements Purger.
+//
+// It returns an error if the inner Store does not implement
+// Purger.
+func (l *KeyLimitStore) Purge() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	p, ok := l.inner.(Purger)
+	if !ok {
+		return errors.New("dr: inner store does not implement Purger")
+	}
+	if err := p.Purge(); err != nil {
+		return err
+	}
+	clear(l.keys)
+	return nil
+}
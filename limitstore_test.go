@@ -0,0 +1,109 @@
+package dr
+
+import (
+	"crypto/rand"
+	"errors"
+	"testing"
+)
+
+// TestKeyLimitStore tests that KeyLimitStore enforces its
+// per-key limit independently for each public key and that the
+// inner Store's limit still applies.
+func TestKeyLimitStore(t *testing.T) {
+	const (
+		perKey = 3
+	)
+	// memory allows maxSkip+1 keys.
+	store := NewKeyLimitStore(&memory{maxSkip: 2*perKey - 2}, perKey)
+
+	a := PublicKey("public key a")
+	b := PublicKey("public key b")
+	mk := make(MessageKey, KeySize)
+	for i := 0; i < perKey; i++ {
+		if err := store.StoreKey(i, a, mk); err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+	}
+	if err := store.StoreKey(perKey, a, mk); !errors.Is(err, ErrTooManySkipped) {
+		t.Fatalf("expected %v, got %v", ErrTooManySkipped, err)
+	}
+	// a is at its limit, but b still has room.
+	for i := 0; i < perKey-1; i++ {
+		if err := store.StoreKey(i, b, mk); err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+	}
+	// The inner Store is full.
+	if err := store.StoreKey(perKey-1, b, mk); !errors.Is(err, ErrTooManySkipped) {
+		t.Fatalf("expected %v, got %v", ErrTooManySkipped, err)
+	}
+	if n, err := store.SkippedCount(); err != nil || n != 2*perKey-1 {
+		t.Fatalf("expected %d skipped keys, got %d (%v)", 2*perKey-1, n, err)
+	}
+
+	// Deleting a key makes room for another.
+	if err := store.DeleteKey(0, a); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.StoreKey(perKey, a, mk); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.StoreKey(perKey+1, a, mk); !errors.Is(err, ErrTooManySkipped) {
+		t.Fatalf("expected %v, got %v", ErrTooManySkipped, err)
+	}
+
+	// Pruning a's chain resets its count.
+	if err := store.PruneKeys(b); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < perKey; i++ {
+		if err := store.StoreKey(i, a, mk); err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+	}
+}
+
+// TestKeyLimitStoreSession tests that Open returns
+// ErrTooManySkipped when a chain exceeds the per-key limit.
+func TestKeyLimitStoreSession(t *testing.T) {
+	const (
+		perKey = 5
+	)
+	r := DJB(t.Name())
+	SK := make([]byte, 32)
+	if _, err := rand.Read(SK); err != nil {
+		t.Fatal(err)
+	}
+	priv, err := r.Generate(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err := NewSend(r, append([]byte(nil), SK...), r.Public(priv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewKeyLimitStore(&memory{maxSkip: 100}, perKey)
+	bob, err := NewRecv(r, SK, priv, WithStore(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := make([]Message, 2*perKey)
+	for i := range msgs {
+		msgs[i], err = alice.Seal([]byte("hello"), nil)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+	}
+	if _, err := bob.Open(msgs[len(msgs)-1], nil); !errors.Is(err, ErrTooManySkipped) {
+		t.Fatalf("expected %v, got %v", ErrTooManySkipped, err)
+	}
+	if _, err := bob.Open(msgs[perKey], nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < perKey; i++ {
+		if _, err := bob.Open(msgs[i], nil); err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+	}
+}
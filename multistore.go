@@ -0,0 +1,159 @@
+package dr
+
+import "sync"
+
+// MultiStore holds the state and skipped message keys of many
+// sessions, each identified by an ID.
+//
+// For example, a single database can back every conversation of a
+// server by scoping each session's data to its ID.
+type MultiStore[ID comparable] interface {
+	// Session returns a Store whose data is scoped to the
+	// session id.
+	//
+	// Stores returned for different IDs must not share any
+	// data. Calling Session with the same ID more than once
+	// must return Stores that share the same data.
+	Session(id ID) Store
+}
+
+// WithMultiStore is like WithStore, but uses the Store that m
+// scopes to the session id.
+func WithMultiStore[ID comparable](m MultiStore[ID], id ID) Option {
+	return WithStore(m.Session(id))
+}
+
+// MemoryMultiStore is an in-memory MultiStore.
+//
+// Unlike the default in-memory store, it retains each session's
+// state, so sessions can be resumed with the state returned by
+// Load.
+//
+// MemoryMultiStore is safe for concurrent use by multiple
+// goroutines, but each Store that it returns must only be used
+// by one Session at a time.
+type MemoryMultiStore[ID comparable] struct {
+	maxSkip int
+
+	mu       sync.Mutex
+	sessions map[ID]*memorySession
+}
+
+var _ MultiStore[string] = (*MemoryMultiStore[string])(nil)
+
+// NewMemoryMultiStore creates a MemoryMultiStore that holds at
+// most maxSkip skipped message keys per session.
+func NewMemoryMultiStore[ID comparable](maxSkip int) *MemoryMultiStore[ID] {
+	return &MemoryMultiStore[ID]{
+		maxSkip:  maxSkip,
+		sessions: make(map[ID]*memorySession),
+	}
+}
+
+// Session implements MultiStore.
+//
+// The returned Store implements KeyPurger, KeyPruner, KeyCounter,
+// KeyLimiter, KeyExporter, and Purger, as well as a Load method
+// with the same semantics as MemoryMultiStore.Load, so it can be
+// wrapped by EncryptedStore. After Purge, the session's data is
+// removed from the MemoryMultiStore.
+func (m *MemoryMultiStore[ID]) Session(id ID) Store {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.sessions[id]
+	if !ok {
+		s = &memorySession{
+			memory: memory{
+				// memory allows maxSkip+1 keys.
+				maxSkip: m.maxSkip - 1,
+				keys:    make(map[string]memoryKey),
+			},
+			purge: func() {
+				m.mu.Lock()
+				defer m.mu.Unlock()
+				delete(m.sessions, id)
+			},
+		}
+		m.sessions[id] = s
+	}
+	return s
+}
+
+// Load returns a copy of the state most recently saved by the
+// session id.
+//
+// It returns ErrNotFound if the session has not saved a state.
+func (m *MemoryMultiStore[ID]) Load(id ID) (*State, error) {
+	m.mu.Lock()
+	s, ok := m.sessions[id]
+	m.mu.Unlock()
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return s.Load()
+}
+
+// Len returns the number of sessions in the MemoryMultiStore.
+func (m *MemoryMultiStore[ID]) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.sessions)
+}
+
+// memorySession is a session's Store in a MemoryMultiStore.
+type memorySession struct {
+	memory
+	// mu guards state, which MemoryMultiStore.Load reads
+	// concurrently with the Session that owns the Store.
+	mu sync.Mutex
+	// state is the most recently saved state, or nil.
+	state *State
+	// purge removes the session from its MemoryMultiStore.
+	purge func()
+}
+
+var (
+	_ Store  = (*memorySession)(nil)
+	_ Purger = (*memorySession)(nil)
+)
+
+// Save saves a copy of the state.
+func (s *memorySession) Save(state *State) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.state != nil {
+		s.state.wipe()
+	}
+	s.state = state.Clone()
+	return nil
+}
+
+// Load returns a copy of the most recently saved state.
+//
+// It returns ErrNotFound if no state has been saved.
+func (s *memorySession) Load() (*State, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.state == nil {
+		return nil, ErrNotFound
+	}
+	return s.state.Clone(), nil
+}
+
+// Purge implements Purger.
+func (s *memorySession) Purge() error {
+	if err := s.PurgeKeys(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if s.state != nil {
+		s.state.wipe()
+		s.state = nil
+	}
+	s.mu.Unlock()
+	s.purge()
+	return nil
+}
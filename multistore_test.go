@@ -0,0 +1,171 @@
+package dr
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"sync"
+	"testing"
+)
+
+// TestMemoryMultiStore tests that two conversations backed by
+// the same MemoryMultiStore do not share any data.
+func TestMemoryMultiStore(t *testing.T) {
+	type convID struct {
+		user string
+		n    int
+	}
+	const (
+		maxSkip = 10
+	)
+	r := DJB(t.Name())
+	store := NewMemoryMultiStore[convID](maxSkip)
+	ids := []convID{{"alice", 1}, {"alice", 2}}
+
+	var alices, bobs []*Session
+	for _, id := range ids {
+		SK := make([]byte, 32)
+		if _, err := rand.Read(SK); err != nil {
+			t.Fatal(err)
+		}
+		priv, err := r.Generate(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		alice, err := NewSend(r, append([]byte(nil), SK...), r.Public(priv))
+		if err != nil {
+			t.Fatal(err)
+		}
+		bob, err := NewRecv(r, SK, priv, WithMultiStore(store, id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		alices = append(alices, alice)
+		bobs = append(bobs, bob)
+	}
+	if n := store.Len(); n != len(ids) {
+		t.Fatalf("expected %d sessions, got %d", len(ids), n)
+	}
+	if store.Session(ids[0]) != store.Session(ids[0]) {
+		t.Fatal("expected the same Store for the same ID")
+	}
+
+	// Skip a different number of messages in each conversation.
+	var pending [][]Message
+	for i, alice := range alices {
+		var msgs []Message
+		for j := 0; j <= i+1; j++ {
+			msg, err := alice.Seal([]byte("hello"), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			msgs = append(msgs, msg)
+		}
+		if _, err := bobs[i].Open(msgs[len(msgs)-1], nil); err != nil {
+			t.Fatal(err)
+		}
+		pending = append(pending, msgs[:len(msgs)-1])
+	}
+	for i, bob := range bobs {
+		if n, err := bob.SkippedCount(); err != nil || n != i+1 {
+			t.Fatalf("#%d: expected %d skipped keys, got %d (%v)", i, i+1, n, err)
+		}
+	}
+	// A message from one conversation cannot be opened with the
+	// other's keys.
+	if _, err := bobs[1].Open(pending[0][0], nil); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	// Resume the second conversation from its saved state.
+	state, err := store.Load(ids[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := Resume(r, state, WithMultiStore(store, ids[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, msg := range pending[1] {
+		got, err := bob.Open(msg, nil)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if !bytes.Equal(got, []byte("hello")) {
+			t.Fatalf("#%d: expected %q, got %q", i, "hello", got)
+		}
+	}
+
+	// Purging the first conversation leaves the second intact.
+	if err := store.Session(ids[0]).(Purger).Purge(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Load(ids[0]); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected %v, got %v", ErrNotFound, err)
+	}
+	if _, err := store.Load(ids[1]); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestMemoryMultiStoreMaxSkip tests that MemoryMultiStore holds
+// at most maxSkip keys per session.
+func TestMemoryMultiStoreMaxSkip(t *testing.T) {
+	const (
+		maxSkip = 3
+	)
+	store := NewMemoryMultiStore[string](maxSkip)
+	a := store.Session("a")
+	mk := make(MessageKey, KeySize)
+	for i := 0; i < maxSkip; i++ {
+		if err := a.StoreKey(i, PublicKey("pub"), mk); err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+	}
+	if err := a.StoreKey(maxSkip, PublicKey("pub"), mk); !errors.Is(err, ErrTooManySkipped) {
+		t.Fatalf("expected %v, got %v", ErrTooManySkipped, err)
+	}
+	if n, err := a.(KeyLimiter).RemainingKeys(); err != nil || n != 0 {
+		t.Fatalf("expected 0 remaining keys, got %d (%v)", n, err)
+	}
+	b := store.Session("b").(KeyLimiter)
+	if n, err := b.RemainingKeys(); err != nil || n != maxSkip {
+		t.Fatalf("expected %d remaining keys, got %d (%v)", maxSkip, n, err)
+	}
+}
+
+// TestMemoryMultiStoreConcurrentLoad tests that
+// MemoryMultiStore.Load can be called while the session saves.
+//
+// Run with -race.
+func TestMemoryMultiStoreConcurrentLoad(t *testing.T) {
+	store := NewMemoryMultiStore[string](10)
+	s := store.Session("a")
+	if err := s.Save(&State{Ns: 0}); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 1; i <= 100; i++ {
+			if err := s.Save(&State{Ns: i}); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		if _, err := store.Load("a"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+	state, err := store.Load("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Ns != 100 {
+		t.Fatalf("expected Ns = 100, got %d", state.Ns)
+	}
+}
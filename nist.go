@@ -1,15 +1,16 @@
 package dr
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
+	"crypto/ecdh"
 	"crypto/elliptic"
 	"crypto/hmac"
+	"crypto/sha512"
 	"errors"
 	"fmt"
 	"hash"
 	"io"
 	"strconv"
+	"strings"
 
 	"golang.org/x/crypto/hkdf"
 )
@@ -18,31 +19,109 @@ import (
 // HKDF and HMAC with the provided hash function.
 type nist struct {
 	// curve is the underlying curve.
+	//
+	// It is only used to decompress public keys.
 	curve elliptic.Curve
-	// hash is the underlying hash
+	// ecdh is the ECDH implementation of curve.
+	ecdh ecdh.Curve
+	// hash is used by HKDF and HMAC.
 	hash func() hash.Hash
 	// mkInfo is the HKDF info used when deriving message keys.
 	mkInfo []byte
 	// rkInfo is the HKDF info used when deriving root keys.
 	rkInfo []byte
+	// aead is used to encrypt messages.
+	aead AEAD
+	// nonceCounter mixes the message number into the nonce.
+	nonceCounter bool
+	// keyedBLAKE2b uses keyed BLAKE2b in KDFck.
+	keyedBLAKE2b bool
+	// zeroNonce derives only the AEAD key and uses an all-zero
+	// nonce.
+	zeroNonce bool
+	// uncompressed encodes public keys in uncompressed form.
+	uncompressed bool
+	// name is returned by Name.
+	name string
 }
 
-var _ Ratchet = (*nist)(nil)
+var (
+	_ AppendRatchet  = (*nist)(nil)
+	_ CounterRatchet = (*nist)(nil)
+	_ keySizer       = (*nist)(nil)
+	_ peerDHer       = (*nist)(nil)
+	_ hasher         = (*nist)(nil)
+)
 
 // NIST creates a Ratchet using NIST curves, 256-bit AES-GCM, and
 // HKDF and HMAC with the provided hash function.
 //
+// The curve must be one of P-256, P-384, or P-521. Diffie-Hellman
+// is performed with crypto/ecdh. Public keys are encoded in ANSI
+// X9.62 compressed form, or in uncompressed form if
+// WithUncompressedPoints is used.
+//
+// The root, chain, and message keys are 32 bytes regardless of
+// the curve. The Diffie-Hellman output (32, 48, or 66 bytes) is
+// only used as HKDF input keying material, and HMAC outputs
+// longer than 32 bytes are truncated, so larger curves and
+// hashes do not change the size of any key.
+//
 // The namespace is used to bind keys to a particular application
 // or context.
-func NIST(curve elliptic.Curve, hash func() hash.Hash, namespace string) Ratchet {
+func NIST(curve elliptic.Curve, hash func() hash.Hash, namespace string, opts ...RatchetOption) Ratchet {
+	var c ecdh.Curve
+	switch curve {
+	case elliptic.P256():
+		c = ecdh.P256()
+	case elliptic.P384():
+		c = ecdh.P384()
+	case elliptic.P521():
+		c = ecdh.P521()
+	default:
+		panic("dr: unsupported curve: " + curve.Params().Name)
+	}
+	o := newRatchetOptions(aesGCM{}, opts)
+	mkInfo, rkInfo := o.labels(namespace)
+	hash = o.kdfHash(hash)
+	dh := strings.ReplaceAll(curve.Params().Name, "-", "")
+	if o.uncompressedPoints {
+		dh += "Uncompressed"
+	}
 	return &nist{
 		curve:  curve,
+		ecdh:   c,
 		hash:   hash,
-		mkInfo: []byte(namespace + "MessageKeys"),
-		rkInfo: []byte(namespace + "Ratchet"),
+		mkInfo: mkInfo,
+		rkInfo: rkInfo,
+		aead:   o.aead,
+
+		nonceCounter: o.nonceCounter,
+		keyedBLAKE2b: o.keyedBLAKE2b,
+		zeroNonce:    o.zeroNonce,
+		uncompressed: o.uncompressedPoints,
+		name:         o.name(dh, hash, namespace),
 	}
 }
 
+// NISTSIV is like NIST, but uses HKDF and HMAC with SHA-512 and
+// encrypts messages with 256-bit AES-GCM-SIV (RFC 8452) instead
+// of AES-GCM.
+//
+// Message keys and nonces are never reused, so AES-GCM would be
+// safe. AES-GCM-SIV is nonce-misuse resistant, though: if a bug
+// (for example, a state that is restored from a backup) causes a
+// key and nonce to be reused, an attacker only learns whether the
+// two plaintexts are equal, instead of being able to forge
+// messages and recover their XOR. It is slightly slower than
+// AES-GCM since each message is processed twice.
+//
+// The curve must be one of P-256, P-384, or P-521.
+func NISTSIV(curve elliptic.Curve, namespace string, opts ...RatchetOption) Ratchet {
+	opts = append([]RatchetOption{WithAEAD(aesGCMSIV{})}, opts...)
+	return NIST(curve, sha512.New, namespace, opts...)
+}
+
 // byteLen returns the size of the underlying curve in bytes.
 func (n *nist) byteLen() int {
 	return (n.curve.Params().BitSize + 7) / 8
@@ -51,65 +130,160 @@ func (n *nist) byteLen() int {
 // privKeyLen returns the size in bytes of a PrivateKey.
 func (n *nist) privKeyLen() int {
 	// PrivateKey is priv || pub.
-	return n.byteLen() + n.pubKeyLen()
+	return n.byteLen() + n.DHPublicKeyLen()
 }
 
-// pubKeyLen returns the size in bytes of a PublicKey.
+// DHPublicKeyLen returns the size in bytes of a PublicKey.
 //
-// The public key is in ANSI X9.62 compressed form.
-func (n *nist) pubKeyLen() int {
+// The public key is in ANSI X9.62 compressed form, or
+// uncompressed form if WithUncompressedPoints is used.
+func (n *nist) DHPublicKeyLen() int {
+	if n.uncompressed {
+		return 1 + 2*n.byteLen()
+	}
 	return 1 + n.byteLen()
 }
 
+func (n *nist) newHash() hash.Hash { return n.hash() }
+
+// maxGenerateAttempts is the number of scalars that Generate
+// reads before giving up.
+//
+// A random scalar is invalid with probability at most about 2^-32
+// (for P-256), so running out of attempts means that the reader
+// is broken, not unlucky.
+const maxGenerateAttempts = 100
+
 func (n *nist) Generate(r io.Reader) (PrivateKey, error) {
-	d, x, y, err := elliptic.GenerateKey(n.curve, r)
-	if err != nil {
-		return nil, err
+	// Generate the scalar by hand instead of using
+	// ecdh.Curve.GenerateKey so that the entropy is always read
+	// from r.
+	d := make([]byte, n.byteLen())
+	defer wipe(d)
+	var (
+		key *ecdh.PrivateKey
+		err error
+	)
+	for i := 0; key == nil; i++ {
+		if i == maxGenerateAttempts {
+			return nil, fmt.Errorf("dr: unable to generate private key: %w", err)
+		}
+		if _, err := io.ReadFull(r, d); err != nil {
+			return nil, fmt.Errorf("dr: unable to read private key: %w", err)
+		}
+		// Mask off any excess bits, like P-521's.
+		if excess := len(d)*8 - n.curve.Params().BitSize; excess > 0 {
+			d[0] &= 0xff >> excess
+		}
+		// NewPrivateKey rejects zero and scalars larger than the
+		// order of the curve, so retry until we find a valid one.
+		key, err = n.ecdh.NewPrivateKey(d)
+	}
+	pub := key.PublicKey().Bytes()
+	if !n.uncompressed {
+		pub, err = n.compress(pub)
+		if err != nil {
+			return nil, err
+		}
 	}
-	pub := elliptic.MarshalCompressed(n.curve, x, y)
 	priv := make(PrivateKey, n.privKeyLen())
-	m := copy(priv, d)
+	m := copy(priv, key.Bytes())
 	m += copy(priv[m:], pub)
 	if m != len(priv) {
-		panic("dr: key size mismatch")
+		wipe(priv)
+		return nil, fmt.Errorf("dr: key pair size mismatch: got %d bytes, expected %d",
+			m, len(priv))
 	}
 	return priv, nil
 }
 
+// compress converts an uncompressed ANSI X9.62 point to
+// compressed form.
+func (n *nist) compress(p []byte) ([]byte, error) {
+	if len(p) != 1+2*n.byteLen() || p[0] != 4 {
+		return nil, errors.New("dr: invalid uncompressed point")
+	}
+	x := p[1 : 1+n.byteLen()]
+	y := p[1+n.byteLen():]
+	out := make([]byte, 1+n.byteLen())
+	out[0] = 2 | y[len(y)-1]&1
+	copy(out[1:], x)
+	return out, nil
+}
+
+// decompress converts a compressed ANSI X9.62 point to
+// uncompressed form.
+//
+// It returns an error if the point is not on the curve.
+func (n *nist) decompress(p []byte) ([]byte, error) {
+	x, y := elliptic.UnmarshalCompressed(n.curve, p)
+	if x == nil {
+		return nil, errors.New("dr: invalid public key")
+	}
+	out := make([]byte, 1+2*n.byteLen())
+	out[0] = 4
+	x.FillBytes(out[1 : 1+n.byteLen()])
+	y.FillBytes(out[1+n.byteLen():])
+	return out, nil
+}
+
 func (n *nist) Public(priv PrivateKey) PublicKey {
 	if len(priv) != n.privKeyLen() {
 		panic("dr: invalid private key size: " + strconv.Itoa(len(priv)))
 	}
-	pub := make(PublicKey, n.pubKeyLen())
+	pub := make(PublicKey, n.DHPublicKeyLen())
 	copy(pub, priv[n.byteLen():])
 	return pub
 }
 
 func (n *nist) DH(priv PrivateKey, pub PublicKey) ([]byte, error) {
-	if len(priv) != n.privKeyLen() {
-		panic("dr: invalid private key size: " + strconv.Itoa(len(priv)))
-	}
-	if len(pub) != n.pubKeyLen() {
-		panic("dr: invalid public key size: " + strconv.Itoa(len(pub)))
+	dh, err := n.peerDH(pub)
+	if err != nil {
+		return nil, err
 	}
+	return dh(priv)
+}
 
-	x, y := elliptic.UnmarshalCompressed(n.curve, pub)
-	if x == nil {
-		return nil, errors.New("dr: invalid public key")
+// peerDH implements peerDHer.
+//
+// Decompressing and validating the peer's public key accounts
+// for roughly 15% of the cost of DH (see BenchmarkRatchet), so a
+// ratchet step, which performs two Diffie-Hellman operations
+// with the same peer, only does it once. The scalar
+// multiplications themselves cannot be shared.
+func (n *nist) peerDH(pub PublicKey) (func(PrivateKey) ([]byte, error), error) {
+	if len(pub) != n.DHPublicKeyLen() {
+		return nil, fmt.Errorf("dr: invalid public key size: %d", len(pub))
 	}
-	k := priv[:n.byteLen()]
-
-	secret, _ := n.curve.ScalarMult(x, y, k)
-	dh := make([]byte, n.byteLen())
-	secret.FillBytes(dh)
-	return dh, nil
+	p := []byte(pub)
+	if !n.uncompressed {
+		var err error
+		p, err = n.decompress(pub)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// NewPublicKey rejects points that are not on the curve and
+	// the point at infinity.
+	peer, err := n.ecdh.NewPublicKey(p)
+	if err != nil {
+		return nil, fmt.Errorf("dr: invalid public key: %w", err)
+	}
+	return func(priv PrivateKey) ([]byte, error) {
+		if len(priv) != n.privKeyLen() {
+			return nil, fmt.Errorf("dr: invalid private key size: %d", len(priv))
+		}
+		key, err := n.ecdh.NewPrivateKey(priv[:n.byteLen()])
+		if err != nil {
+			return nil, fmt.Errorf("dr: invalid private key: %w", err)
+		}
+		return key.ECDH(peer)
+	}, nil
 }
 
 func (n *nist) KDFrk(rk RootKey, dh []byte) (RootKey, ChainKey) {
-	if len(rk) != 32 {
-		panic("dr: invalid RootKey size: " + strconv.Itoa(len(rk)))
-	}
-	buf := make([]byte, 2*32)
+	mustKeySize("RootKey", rk)
+	buf := make([]byte, 2*KeySize)
 	// The Double Ratchet spec says:
 	//
 	//    as the out of applying a KDF keyed by a 32-byte root
@@ -124,13 +298,14 @@ func (n *nist) KDFrk(rk RootKey, dh []byte) (RootKey, ChainKey) {
 	if err != nil {
 		panic(err)
 	}
-	return buf[:32:32], buf[32 : 2*32 : 2*32]
+	return buf[:KeySize:KeySize], buf[KeySize : 2*KeySize : 2*KeySize]
 }
 
 func (n *nist) KDFck(ck ChainKey) (ChainKey, MessageKey) {
-	if len(ck) != 32 {
-		panic("dr: invalid ChainKey size: " + strconv.Itoa(len(ck)))
+	if n.keyedBLAKE2b {
+		return blake2bKDFck(ck)
 	}
+	mustKeySize("ChainKey", ck)
 
 	h := hmac.New(n.hash, ck)
 
@@ -139,62 +314,89 @@ func (n *nist) KDFck(ck ChainKey) (ChainKey, MessageKey) {
 		mkConst = 0x01
 	)
 
+	// Chain and message keys are always KeySize bytes, even if
+	// the hash is larger.
 	h.Write([]byte{ckConst})
-	ck = h.Sum(nil)
+	ck = h.Sum(nil)[:KeySize:KeySize]
 
 	h.Reset()
 	h.Write([]byte{mkConst})
-	mk := h.Sum(nil)
+	mk := h.Sum(nil)[:KeySize:KeySize]
 
 	return ck, mk
 }
 
-// derive derives a 256-bit AES-GCM key and 96-bit AES-GCM nonce.
-func (n *nist) derive(ikm []byte) (key, nonce []byte) {
-	buf := make([]byte, 32+12)
+// derive derives an AEAD key and nonce into a pooled scratch
+// buffer, which must be released with putScratch.
+//
+// By default, these are a 256-bit AES-GCM key and 96-bit AES-GCM
+// nonce.
+func (n *nist) derive(ikm []byte) (key, nonce []byte, buf *[]byte) {
+	K := n.aead.KeySize()
+	N := n.aead.NonceSize()
+	buf = getScratch(K + N)
+	b := *buf
 	r := hkdf.New(n.hash, ikm, nil, n.mkInfo)
-	_, err := io.ReadFull(r, buf)
+	out := b
+	if n.zeroNonce {
+		// Only derive the key. See WithZeroNonce.
+		clear(b[K:])
+		out = b[:K]
+	}
+	_, err := io.ReadFull(r, out)
 	if err != nil {
 		panic(err)
 	}
-	return buf[0:32:32], buf[32 : 32+12 : 32+12]
+	return b[:K:K], b[K : K+N : K+N], buf
 }
 
 func (n *nist) Seal(key MessageKey, plaintext, additionalData []byte) []byte {
-	if len(key) != 32 {
-		panic("dr: invalid message key size: " + strconv.Itoa(len(key)))
-	}
+	return n.AppendSeal(nil, key, plaintext, additionalData)
+}
 
-	key, nonce := n.derive(key)
-	defer wipe(key)
+func (n *nist) Open(key MessageKey, ciphertext, additionalData []byte) ([]byte, error) {
+	return n.AppendOpen(nil, key, ciphertext, additionalData)
+}
 
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		panic(err)
-	}
-	aead, err := cipher.NewGCM(block)
-	if err != nil {
-		panic(err)
-	}
-	return aead.Seal(nil, nonce, plaintext, additionalData)
+func (n *nist) Overhead() int {
+	return n.aead.Overhead()
 }
 
-func (n *nist) Open(key MessageKey, ciphertext, additionalData []byte) ([]byte, error) {
-	if len(key) != 32 {
-		return nil, fmt.Errorf("dr: invalid message key size: %d", len(key))
+func (n *nist) Name() string {
+	return n.name
+}
+
+func (n *nist) AppendSeal(dst []byte, key MessageKey, plaintext, additionalData []byte) []byte {
+	return n.AppendSealCounter(dst, key, 0, plaintext, additionalData)
+}
+
+func (n *nist) AppendOpen(dst []byte, key MessageKey, ciphertext, additionalData []byte) ([]byte, error) {
+	return n.AppendOpenCounter(dst, key, 0, ciphertext, additionalData)
+}
+
+func (n *nist) AppendSealCounter(dst []byte, key MessageKey, i int, plaintext, additionalData []byte) []byte {
+	mustKeySize("MessageKey", key)
+
+	key, nonce, buf := n.derive(key)
+	defer putScratch(buf)
+	if n.nonceCounter {
+		mixCounter(nonce, i)
 	}
-	key, nonce := n.derive(key)
-	defer wipe(key)
 
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, err
+	return n.aead.Seal(dst, key, nonce, plaintext, additionalData)
+}
+
+func (n *nist) AppendOpenCounter(dst []byte, key MessageKey, i int, ciphertext, additionalData []byte) ([]byte, error) {
+	if err := checkKeySize("MessageKey", key); err != nil {
+		return nil, fmt.Errorf("dr: %w", err)
 	}
-	aead, err := cipher.NewGCM(block)
-	if err != nil {
-		return nil, err
+	key, nonce, buf := n.derive(key)
+	defer putScratch(buf)
+	if n.nonceCounter {
+		mixCounter(nonce, i)
 	}
-	return aead.Open(nil, nonce, ciphertext, additionalData)
+
+	return n.aead.Open(dst, key, nonce, ciphertext, additionalData)
 }
 
 func (n *nist) Header(priv PrivateKey, prevChainLength, messageNum int) Header {
@@ -0,0 +1,355 @@
+// Package redisstore implements a dr.Store backed by Redis.
+//
+// Each Store is scoped to a single session ID. The session's
+// state is stored as a string under
+//
+//    <prefix><id>:state
+//
+// and its skipped message keys are stored in a hash under
+//
+//    <prefix><id>:keys
+//
+// with one field per key, named Nr:hex(PublicKey).
+//
+// Concurrency
+//
+// Redis lets many stateless frontends share a session, but the
+// Double Ratchet is inherently sequential: if two frontends open
+// messages for the same session concurrently, one of them will
+// overwrite the state saved by the other. Callers must serialize
+// access to each session, for example by holding a distributed
+// lock for the duration of each Seal or Open, or use
+// SaveIfUnchanged to detect conflicting writes and retry. Save
+// refuses to overwrite a newer state (see dr.CheckEpoch), so a
+// frontend that lost a race fails loudly instead of reusing
+// message keys.
+package redisstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/ericlagergren/dr"
+	"github.com/ericlagergren/dr/internal/secure"
+)
+
+// DefaultMaxSkip is the default maximum number of skipped
+// message keys stored per session.
+const DefaultMaxSkip = 1000
+
+// DefaultPrefix is the default prefix for Redis keys.
+const DefaultPrefix = "dr:"
+
+// ErrConflict is returned by SaveContext and SaveIfUnchanged when
+// the saved state was modified concurrently.
+var ErrConflict = errors.New("redisstore: state modified concurrently")
+
+// Store is a dr.Store backed by Redis.
+//
+// Store is not safe for concurrent use by multiple goroutines.
+type Store struct {
+	client  redis.UniversalClient
+	prefix  string
+	maxSkip int
+	ttl     time.Duration
+	// state is the Redis key for the saved state.
+	state string
+	// keys is the Redis key for the skipped message keys hash.
+	keys string
+	// loaded are copies of keys returned by LoadKey so that they
+	// can be wiped by DeleteKey.
+	loaded map[string][]byte
+}
+
+var (
+	_ dr.Store        = (*Store)(nil)
+	_ dr.StoreContext = (*Store)(nil)
+	_ dr.KeyPurger    = (*Store)(nil)
+	_ dr.Purger       = (*Store)(nil)
+	_ dr.KeyCounter   = (*Store)(nil)
+	_ dr.KeyLimiter   = (*Store)(nil)
+)
+
+// Option configures a Store.
+type Option func(*Store)
+
+// WithMaxSkip sets the maximum number of skipped message keys
+// stored for the session.
+//
+// By default, DefaultMaxSkip is used.
+func WithMaxSkip(n int) Option {
+	return func(s *Store) {
+		s.maxSkip = n
+	}
+}
+
+// WithKeyTTL sets how long each skipped message key is retained
+// after it is stored.
+//
+// Per-field expiration requires Redis 7.4 or later. By default,
+// skipped message keys do not expire.
+func WithKeyTTL(d time.Duration) Option {
+	return func(s *Store) {
+		s.ttl = d
+	}
+}
+
+// WithPrefix sets the prefix for the Store's Redis keys.
+//
+// By default, DefaultPrefix is used.
+func WithPrefix(prefix string) Option {
+	return func(s *Store) {
+		s.prefix = prefix
+	}
+}
+
+// New creates a Store for the session with the provided ID.
+func New(client redis.UniversalClient, id string, opts ...Option) (*Store, error) {
+	if id == "" {
+		return nil, errors.New("redisstore: empty session ID")
+	}
+	s := &Store{
+		client:  client,
+		prefix:  DefaultPrefix,
+		maxSkip: DefaultMaxSkip,
+		loaded:  make(map[string][]byte),
+	}
+	for _, fn := range opts {
+		fn(s)
+	}
+	s.state = s.prefix + id + ":state"
+	s.keys = s.prefix + id + ":keys"
+	return s, nil
+}
+
+// field returns the hash field for the (Nr, PublicKey) tuple.
+func field(Nr int, pub dr.PublicKey) string {
+	return fmt.Sprintf("%d:%x", Nr, pub)
+}
+
+// Load returns the most recently saved state.
+//
+// If no state has been saved Load returns dr.ErrNotFound.
+func (s *Store) Load(ctx context.Context) (*dr.State, error) {
+	data, err := s.client.Get(ctx, s.state).Bytes()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, dr.ErrNotFound
+		}
+		return nil, err
+	}
+	defer wipe(data)
+
+	var state dr.State
+	if err := state.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// Save is shorthand for SaveContext with context.Background.
+func (s *Store) Save(state *dr.State) error {
+	return s.SaveContext(context.Background(), state)
+}
+
+// SaveContext saves the state, overwriting the previously saved
+// state.
+//
+// It returns an error wrapping dr.ErrStaleState if the saved
+// state is at least as new as state (see dr.CheckEpoch), or
+// ErrConflict if the saved state was modified while it was being
+// checked.
+func (s *Store) SaveContext(ctx context.Context, state *dr.State) error {
+	data, err := state.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	defer wipe(data)
+
+	err = s.client.Watch(ctx, func(tx *redis.Tx) error {
+		cur, err := tx.Get(ctx, s.state).Bytes()
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return err
+		}
+		defer wipe(cur)
+		if err := dr.CheckEpochBinary(cur, state); err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
+			p.Set(ctx, s.state, data, 0)
+			return nil
+		})
+		return err
+	}, s.state)
+	if errors.Is(err, redis.TxFailedErr) {
+		return ErrConflict
+	}
+	return err
+}
+
+// SaveIfUnchanged saves the state only if the saved state is
+// still equal to prev, which is typically the state returned by
+// Load.
+//
+// If prev is nil, no state must have been saved.
+//
+// If the saved state was modified, SaveIfUnchanged returns
+// ErrConflict and the caller should Load the new state and
+// retry.
+func (s *Store) SaveIfUnchanged(ctx context.Context, prev, state *dr.State) error {
+	var old []byte
+	if prev != nil {
+		var err error
+		old, err = prev.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		defer wipe(old)
+	}
+	data, err := state.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	defer wipe(data)
+
+	err = s.client.Watch(ctx, func(tx *redis.Tx) error {
+		cur, err := tx.Get(ctx, s.state).Bytes()
+		switch {
+		case errors.Is(err, redis.Nil):
+			if prev != nil {
+				return ErrConflict
+			}
+		case err != nil:
+			return err
+		default:
+			defer wipe(cur)
+			if prev == nil || !bytes.Equal(cur, old) {
+				return ErrConflict
+			}
+		}
+		_, err = tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
+			p.Set(ctx, s.state, data, 0)
+			return nil
+		})
+		return err
+	}, s.state)
+	if errors.Is(err, redis.TxFailedErr) {
+		return ErrConflict
+	}
+	return err
+}
+
+// StoreKey is shorthand for StoreKeyContext with
+// context.Background.
+func (s *Store) StoreKey(Nr int, pub dr.PublicKey, mk dr.MessageKey) error {
+	return s.StoreKeyContext(context.Background(), Nr, pub, mk)
+}
+
+// StoreKeyContext stores a skipped message key.
+//
+// The number of stored keys is checked with HLEN before the key
+// is added, so concurrent writers can briefly exceed the limit.
+func (s *Store) StoreKeyContext(ctx context.Context, Nr int, pub dr.PublicKey, mk dr.MessageKey) error {
+	n, err := s.client.HLen(ctx, s.keys).Result()
+	if err != nil {
+		return err
+	}
+	if n >= int64(s.maxSkip) {
+		return fmt.Errorf("redisstore: %w", dr.ErrTooManySkipped)
+	}
+	f := field(Nr, pub)
+	_, err = s.client.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.HSet(ctx, s.keys, f, []byte(mk))
+		if s.ttl > 0 {
+			p.HExpire(ctx, s.keys, s.ttl, f)
+		}
+		return nil
+	})
+	return err
+}
+
+// LoadKey is shorthand for LoadKeyContext with
+// context.Background.
+func (s *Store) LoadKey(Nr int, pub dr.PublicKey) (dr.MessageKey, error) {
+	return s.LoadKeyContext(context.Background(), Nr, pub)
+}
+
+// LoadKeyContext retrieves a skipped message key.
+//
+// If the message key is not found LoadKeyContext returns
+// dr.ErrNotFound.
+func (s *Store) LoadKeyContext(ctx context.Context, Nr int, pub dr.PublicKey) (dr.MessageKey, error) {
+	f := field(Nr, pub)
+	mk, err := s.client.HGet(ctx, s.keys, f).Bytes()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, dr.ErrNotFound
+		}
+		return nil, err
+	}
+	s.loaded[f] = mk
+	return mk, nil
+}
+
+// DeleteKey is shorthand for DeleteKeyContext with
+// context.Background.
+func (s *Store) DeleteKey(Nr int, pub dr.PublicKey) error {
+	return s.DeleteKeyContext(context.Background(), Nr, pub)
+}
+
+// DeleteKeyContext removes a skipped message key and wipes any
+// copies of it held by the Store.
+func (s *Store) DeleteKeyContext(ctx context.Context, Nr int, pub dr.PublicKey) error {
+	f := field(Nr, pub)
+	if mk, ok := s.loaded[f]; ok {
+		wipe(mk)
+		delete(s.loaded, f)
+	}
+	return s.client.HDel(ctx, s.keys, f).Err()
+}
+
+// PurgeKeys removes every skipped message key for the session.
+func (s *Store) PurgeKeys() error {
+	for k, v := range s.loaded {
+		wipe(v)
+		delete(s.loaded, k)
+	}
+	return s.client.Del(context.Background(), s.keys).Err()
+}
+
+// SkippedCount returns the number of skipped message keys for
+// the session.
+func (s *Store) SkippedCount() (int, error) {
+	n, err := s.client.HLen(context.Background(), s.keys).Result()
+	return int(n), err
+}
+
+// RemainingKeys returns the number of skipped message keys that
+// can be stored before StoreKey returns dr.ErrTooManySkipped.
+func (s *Store) RemainingKeys() (int, error) {
+	n, err := s.SkippedCount()
+	if err != nil {
+		return 0, err
+	}
+	return max(s.maxSkip-n, 0), nil
+}
+
+// Purge removes the session's state and every skipped message
+// key.
+func (s *Store) Purge() error {
+	for k, v := range s.loaded {
+		wipe(v)
+		delete(s.loaded, k)
+	}
+	return s.client.Del(context.Background(), s.state, s.keys).Err()
+}
+
+// wipe is shorthand for secure.Wipe.
+func wipe(p []byte) {
+	secure.Wipe(p)
+}
@@ -0,0 +1,203 @@
+//go:build redis
+
+package redisstore
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"errors"
+	"os"
+	"testing"
+
+	mrand "github.com/ericlagergren/saferand"
+	"github.com/redis/go-redis/v9"
+
+	"github.com/ericlagergren/dr"
+)
+
+// newClient connects to the Redis server at $REDIS_ADDR, or
+// localhost:6379 by default.
+func newClient(t *testing.T) redis.UniversalClient {
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		addr = "localhost:6379"
+	}
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		t.Fatalf("unable to connect to %s: %v", addr, err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// newStore creates a Store for a random session ID and removes
+// its keys when the test completes.
+func newStore(t *testing.T, client redis.UniversalClient, opts ...Option) (*Store, string) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(client, t.Name()+string(id), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Del(context.Background(), s.state, s.keys)
+	})
+	return s, t.Name() + string(id)
+}
+
+// TestResume tests that a session can be resumed from a
+// different Store in the middle of an out-of-order
+// conversation.
+func TestResume(t *testing.T) {
+	client := newClient(t)
+	r := dr.DJB(t.Name())
+
+	SK := make([]byte, 32)
+	if _, err := rand.Read(SK); err != nil {
+		t.Fatal(err)
+	}
+	priv, err := r.Generate(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err := dr.NewSend(r, SK, r.Public(priv))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, id := newStore(t, client)
+	if _, err := store.Load(context.Background()); !errors.Is(err, dr.ErrNotFound) {
+		t.Fatalf("expected %v, got %v", dr.ErrNotFound, err)
+	}
+	bob, err := dr.NewRecv(r, append([]byte(nil), SK...), priv,
+		dr.WithStoreContext(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const (
+		N = 100
+	)
+	msgs := make([]dr.Message, N)
+	plaintexts := make([][]byte, N)
+	for i := range msgs {
+		plaintexts[i] = make([]byte, 64)
+		if _, err := rand.Read(plaintexts[i]); err != nil {
+			t.Fatal(err)
+		}
+		msgs[i], err = alice.Seal(plaintexts[i], nil)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+	}
+	perm := mrand.Perm(N)
+
+	open := func(bob *dr.Session, idx []int) {
+		t.Helper()
+		for _, i := range idx {
+			got, err := bob.Open(msgs[i], nil)
+			if err != nil {
+				t.Fatalf("#%d: %v", i, err)
+			}
+			if !hmac.Equal(plaintexts[i], got) {
+				t.Fatalf("#%d: expected %#x, got %#x", i, plaintexts[i], got)
+			}
+		}
+	}
+	open(bob, perm[:N/2])
+
+	// Simulate a different frontend.
+	store, err = New(client, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := store.Load(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err = dr.Resume(r, state, dr.WithStoreContext(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	open(bob, perm[N/2:])
+}
+
+// TestMaxSkip tests that StoreKey enforces the per-session
+// limit.
+func TestMaxSkip(t *testing.T) {
+	client := newClient(t)
+	const (
+		max = 10
+	)
+	s, _ := newStore(t, client, WithMaxSkip(max))
+	pub := dr.PublicKey("public key")
+	mk := make(dr.MessageKey, 32)
+	for i := 0; i < max; i++ {
+		if err := s.StoreKey(i, pub, mk); err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+	}
+	if err := s.StoreKey(max, pub, mk); !errors.Is(err, dr.ErrTooManySkipped) {
+		t.Fatalf("expected %v, got %v", dr.ErrTooManySkipped, err)
+	}
+	if n, err := s.SkippedCount(); err != nil || n != max {
+		t.Fatalf("expected %d skipped keys, got %d (%v)", max, n, err)
+	}
+	if err := s.PurgeKeys(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.LoadKey(0, pub); !errors.Is(err, dr.ErrNotFound) {
+		t.Fatalf("expected %v, got %v", dr.ErrNotFound, err)
+	}
+}
+
+// TestSaveIfUnchanged tests that concurrent modifications are
+// detected.
+func TestSaveIfUnchanged(t *testing.T) {
+	client := newClient(t)
+	ctx := context.Background()
+	s, _ := newStore(t, client)
+
+	a := &dr.State{RK: []byte("a")}
+	b := &dr.State{RK: []byte("b")}
+	if err := s.SaveIfUnchanged(ctx, nil, a); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveIfUnchanged(ctx, nil, b); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected %v, got %v", ErrConflict, err)
+	}
+	if err := s.SaveIfUnchanged(ctx, a, b); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveIfUnchanged(ctx, a, b); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected %v, got %v", ErrConflict, err)
+	}
+}
+
+// TestStaleState tests that Save refuses to overwrite a state
+// that is at least as new.
+func TestStaleState(t *testing.T) {
+	client := newClient(t)
+	s, _ := newStore(t, client)
+	for i, tc := range []struct {
+		epoch uint64
+		ok    bool
+	}{
+		{1, true},
+		{2, true},
+		{2, false},
+		{1, false},
+		{3, true},
+	} {
+		err := s.Save(&dr.State{Epoch: tc.epoch})
+		if tc.ok && err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if !tc.ok && !errors.Is(err, dr.ErrStaleState) {
+			t.Fatalf("#%d: expected %v, got %v", i, dr.ErrStaleState, err)
+		}
+	}
+}
@@ -0,0 +1,348 @@
+// Package sqlitestore implements a dr.Store backed by a SQLite
+// database using modernc.org/sqlite, which does not require cgo.
+//
+// Each Store is scoped to a single session ID, so one database
+// can hold many sessions. The schema is
+//
+//    sessions      (id TEXT PRIMARY KEY, state BLOB)
+//    skipped_keys  (session_id TEXT, nr INTEGER, pub BLOB, mk BLOB)
+//
+// and is created or upgraded by New. The schema version is kept
+// in PRAGMA user_version.
+//
+// Skipped message keys are deleted outright rather than marked
+// as deleted. Databases opened with Open also enable PRAGMA
+// secure_delete so that SQLite overwrites the freed pages.
+package sqlitestore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+
+	_ "modernc.org/sqlite"
+
+	"github.com/ericlagergren/dr"
+	"github.com/ericlagergren/dr/internal/secure"
+)
+
+// DefaultMaxSkip is the default maximum number of skipped
+// message keys stored per session.
+const DefaultMaxSkip = 1000
+
+// migrations are applied in order. migrations[i] upgrades the
+// schema from version i to version i+1.
+var migrations = []string{
+	`CREATE TABLE sessions (
+		id    TEXT PRIMARY KEY,
+		state BLOB NOT NULL
+	);
+	CREATE TABLE skipped_keys (
+		session_id TEXT    NOT NULL,
+		nr         INTEGER NOT NULL,
+		pub        BLOB    NOT NULL,
+		mk         BLOB    NOT NULL,
+		PRIMARY KEY (session_id, nr, pub)
+	);`,
+}
+
+// Open opens the SQLite database at path with the pragmas
+// recommended for a Store: secure_delete, so that deleted keys
+// are overwritten, and a busy timeout.
+//
+// Databases opened by other means work, but should enable
+// secure_delete on every connection.
+func Open(path string) (*sql.DB, error) {
+	q := url.Values{}
+	q.Add("_pragma", "secure_delete(1)")
+	q.Add("_pragma", "busy_timeout(5000)")
+	dsn := url.URL{
+		Scheme: "file",
+		// Escape '?', '#', and '%', which SQLite would otherwise
+		// interpret in the URI.
+		Opaque:   url.PathEscape(path),
+		RawQuery: q.Encode(),
+	}
+	db, err := sql.Open("sqlite", dsn.String())
+	if err != nil {
+		return nil, fmt.Errorf("sqlitestore: %w", err)
+	}
+	return db, nil
+}
+
+// Migrate creates or upgrades the schema.
+//
+// It is called by New, so most callers do not need to call it
+// directly.
+func Migrate(ctx context.Context, db *sql.DB) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("sqlitestore: %w", err)
+	}
+	defer tx.Rollback()
+
+	var version int
+	if err := tx.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version); err != nil {
+		return fmt.Errorf("sqlitestore: unable to read schema version: %w", err)
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("sqlitestore: unknown schema version: %d", version)
+	}
+	if version == len(migrations) {
+		return nil
+	}
+	for i, m := range migrations[version:] {
+		if _, err := tx.ExecContext(ctx, m); err != nil {
+			return fmt.Errorf("sqlitestore: migration %d failed: %w", version+i+1, err)
+		}
+	}
+	// PRAGMA does not support placeholders.
+	q := fmt.Sprintf("PRAGMA user_version = %d", len(migrations))
+	if _, err := tx.ExecContext(ctx, q); err != nil {
+		return fmt.Errorf("sqlitestore: %w", err)
+	}
+	return tx.Commit()
+}
+
+// Store is a dr.Store backed by a SQLite database.
+//
+// Store is not safe for concurrent use by multiple goroutines.
+type Store struct {
+	db      *sql.DB
+	id      string
+	maxSkip int
+	// loaded are copies of keys returned by LoadKey so that they
+	// can be wiped by DeleteKey.
+	loaded map[string][]byte
+}
+
+var (
+	_ dr.Store      = (*Store)(nil)
+	_ dr.KeyPurger  = (*Store)(nil)
+	_ dr.Purger     = (*Store)(nil)
+	_ dr.KeyCounter = (*Store)(nil)
+	_ dr.KeyLimiter = (*Store)(nil)
+)
+
+// Option configures a Store.
+type Option func(*Store)
+
+// WithMaxSkip sets the maximum number of skipped message keys
+// stored for the session.
+//
+// By default, DefaultMaxSkip is used.
+func WithMaxSkip(n int) Option {
+	return func(s *Store) {
+		s.maxSkip = n
+	}
+}
+
+// New creates a Store for the session with the provided ID,
+// migrating the schema if necessary.
+func New(db *sql.DB, id string, opts ...Option) (*Store, error) {
+	if id == "" {
+		return nil, errors.New("sqlitestore: empty session ID")
+	}
+	if err := Migrate(context.Background(), db); err != nil {
+		return nil, err
+	}
+	s := &Store{
+		db:      db,
+		id:      id,
+		maxSkip: DefaultMaxSkip,
+		loaded:  make(map[string][]byte),
+	}
+	for _, fn := range opts {
+		fn(s)
+	}
+	return s, nil
+}
+
+// key returns the map key for the (Nr, PublicKey) tuple.
+func key(Nr int, pub dr.PublicKey) string {
+	return fmt.Sprintf("%d:%x", Nr, pub)
+}
+
+// Load returns the most recently saved state.
+//
+// If no state has been saved Load returns dr.ErrNotFound.
+func (s *Store) Load() (*dr.State, error) {
+	var data []byte
+	err := s.db.QueryRow(
+		"SELECT state FROM sessions WHERE id = ?", s.id).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, dr.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(data)
+	var state dr.State
+	if err := state.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// Save saves the state.
+//
+// It returns an error wrapping dr.ErrStaleState if the saved
+// state is at least as new as state. See dr.CheckEpoch.
+func (s *Store) Save(state *dr.State) error {
+	data, err := state.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	defer wipe(data)
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var old []byte
+	err = tx.QueryRow(
+		"SELECT state FROM sessions WHERE id = ?", s.id).Scan(&old)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	defer wipe(old)
+	if err := dr.CheckEpochBinary(old, state); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO sessions (id, state) VALUES (?, ?)
+		ON CONFLICT (id) DO UPDATE SET state = excluded.state`,
+		s.id, data)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// StoreKey stores a skipped message key.
+//
+// It returns an error wrapping dr.ErrTooManySkipped if the
+// session already has the maximum number of skipped keys.
+func (s *Store) StoreKey(Nr int, pub dr.PublicKey, mk dr.MessageKey) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var n int
+	err = tx.QueryRow(
+		"SELECT COUNT(*) FROM skipped_keys WHERE session_id = ?",
+		s.id).Scan(&n)
+	if err != nil {
+		return err
+	}
+	if n >= s.maxSkip {
+		return fmt.Errorf("sqlitestore: %w", dr.ErrTooManySkipped)
+	}
+	_, err = tx.Exec(`INSERT INTO skipped_keys (session_id, nr, pub, mk)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT (session_id, nr, pub) DO UPDATE SET mk = excluded.mk`,
+		s.id, Nr, []byte(pub), []byte(mk))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// LoadKey retrieves a skipped message key.
+//
+// If the message key is not found LoadKey returns
+// dr.ErrNotFound.
+func (s *Store) LoadKey(Nr int, pub dr.PublicKey) (dr.MessageKey, error) {
+	var mk []byte
+	err := s.db.QueryRow(`SELECT mk FROM skipped_keys
+		WHERE session_id = ? AND nr = ? AND pub = ?`,
+		s.id, Nr, []byte(pub)).Scan(&mk)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, dr.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.loaded[key(Nr, pub)] = mk
+	return mk, nil
+}
+
+// DeleteKey removes a skipped message key and wipes any copies
+// of it held by the Store.
+func (s *Store) DeleteKey(Nr int, pub dr.PublicKey) error {
+	k := key(Nr, pub)
+	if mk, ok := s.loaded[k]; ok {
+		wipe(mk)
+		delete(s.loaded, k)
+	}
+	_, err := s.db.Exec(`DELETE FROM skipped_keys
+		WHERE session_id = ? AND nr = ? AND pub = ?`,
+		s.id, Nr, []byte(pub))
+	return err
+}
+
+// PurgeKeys removes every skipped message key for the session.
+func (s *Store) PurgeKeys() error {
+	for k, v := range s.loaded {
+		wipe(v)
+		delete(s.loaded, k)
+	}
+	_, err := s.db.Exec(
+		"DELETE FROM skipped_keys WHERE session_id = ?", s.id)
+	return err
+}
+
+// SkippedCount returns the number of skipped message keys for
+// the session.
+func (s *Store) SkippedCount() (int, error) {
+	var n int
+	err := s.db.QueryRow(
+		"SELECT COUNT(*) FROM skipped_keys WHERE session_id = ?",
+		s.id).Scan(&n)
+	return n, err
+}
+
+// RemainingKeys returns the number of skipped message keys that
+// can be stored before StoreKey returns dr.ErrTooManySkipped.
+func (s *Store) RemainingKeys() (int, error) {
+	n, err := s.SkippedCount()
+	if err != nil {
+		return 0, err
+	}
+	return max(s.maxSkip-n, 0), nil
+}
+
+// Purge removes the session's state and every skipped message
+// key.
+func (s *Store) Purge() error {
+	for k, v := range s.loaded {
+		wipe(v)
+		delete(s.loaded, k)
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		"DELETE FROM skipped_keys WHERE session_id = ?", s.id)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM sessions WHERE id = ?", s.id)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// wipe is shorthand for secure.Wipe.
+func wipe(p []byte) {
+	secure.Wipe(p)
+}
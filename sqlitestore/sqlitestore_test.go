@@ -0,0 +1,321 @@
+package sqlitestore
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	mrand "github.com/ericlagergren/saferand"
+
+	"github.com/ericlagergren/dr"
+)
+
+func openDB(t *testing.T, path string) *sql.DB {
+	db, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// TestResume tests that a session can be resumed after the
+// database is closed and reopened in the middle of an
+// out-of-order conversation.
+func TestResume(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dr.db")
+	r := dr.DJB(t.Name())
+
+	SK := make([]byte, 32)
+	if _, err := rand.Read(SK); err != nil {
+		t.Fatal(err)
+	}
+	priv, err := r.Generate(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err := dr.NewSend(r, SK, r.Public(priv))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := openDB(t, path)
+	store, err := New(db, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Load(); !errors.Is(err, dr.ErrNotFound) {
+		t.Fatalf("expected %v, got %v", dr.ErrNotFound, err)
+	}
+	bob, err := dr.NewRecv(r, append([]byte(nil), SK...), priv,
+		dr.WithStore(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const (
+		N = 100
+	)
+	msgs := make([]dr.Message, N)
+	plaintexts := make([][]byte, N)
+	for i := range msgs {
+		plaintexts[i] = make([]byte, 64)
+		if _, err := rand.Read(plaintexts[i]); err != nil {
+			t.Fatal(err)
+		}
+		msgs[i], err = alice.Seal(plaintexts[i], nil)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+	}
+	perm := mrand.Perm(N)
+
+	open := func(bob *dr.Session, idx []int) {
+		t.Helper()
+		for _, i := range idx {
+			got, err := bob.Open(msgs[i], nil)
+			if err != nil {
+				t.Fatalf("#%d: %v", i, err)
+			}
+			if !hmac.Equal(plaintexts[i], got) {
+				t.Fatalf("#%d: expected %#x, got %#x", i, plaintexts[i], got)
+			}
+		}
+	}
+	open(bob, perm[:N/2])
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db = openDB(t, path)
+	defer db.Close()
+
+	store, err = New(db, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err = dr.Resume(r, state, dr.WithStore(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	open(bob, perm[N/2:])
+
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM skipped_keys").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatalf("expected no skipped keys, got %d", n)
+	}
+}
+
+// TestMaxSkip tests that StoreKey enforces the per-session
+// limit.
+func TestMaxSkip(t *testing.T) {
+	db := openDB(t, filepath.Join(t.TempDir(), "dr.db"))
+	defer db.Close()
+
+	const (
+		max = 10
+	)
+	a, err := New(db, "a", WithMaxSkip(max))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(db, "b", WithMaxSkip(max))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := dr.PublicKey("public key")
+	mk := make(dr.MessageKey, 32)
+	for i := 0; i < max; i++ {
+		if err := a.StoreKey(i, pub, mk); err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+	}
+	if err := a.StoreKey(max, pub, mk); !errors.Is(err, dr.ErrTooManySkipped) {
+		t.Fatalf("expected %v, got %v", dr.ErrTooManySkipped, err)
+	}
+	if n, err := a.SkippedCount(); err != nil || n != max {
+		t.Fatalf("expected %d skipped keys, got %d (%v)", max, n, err)
+	}
+	if n, err := a.RemainingKeys(); err != nil || n != 0 {
+		t.Fatalf("expected no remaining keys, got %d (%v)", n, err)
+	}
+	// Limits are per session.
+	if err := b.StoreKey(0, pub, mk); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestDeleteKey tests that DeleteKey removes the key and wipes
+// the copy returned by LoadKey.
+func TestDeleteKey(t *testing.T) {
+	db := openDB(t, filepath.Join(t.TempDir(), "dr.db"))
+	defer db.Close()
+
+	s, err := New(db, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := dr.PublicKey("public key")
+	mk := dr.MessageKey("0123456789abcdef0123456789abcdef")
+	if err := s.StoreKey(1, pub, mk); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.LoadKey(1, pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hmac.Equal(got, mk) {
+		t.Fatalf("expected %q, got %q", mk, got)
+	}
+	if err := s.DeleteKey(1, pub); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range got {
+		if c != 0 {
+			t.Fatalf("key was not wiped: %q", got)
+		}
+	}
+	if _, err := s.LoadKey(1, pub); !errors.Is(err, dr.ErrNotFound) {
+		t.Fatalf("expected %v, got %v", dr.ErrNotFound, err)
+	}
+	if err := s.StoreKey(2, pub, mk); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PurgeKeys(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.LoadKey(2, pub); !errors.Is(err, dr.ErrNotFound) {
+		t.Fatalf("expected %v, got %v", dr.ErrNotFound, err)
+	}
+}
+
+// TestOpenPath tests that Open escapes characters in the path
+// that are special in SQLite URIs.
+func TestOpenPath(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dr?mode=ro#%41.db")
+	db := openDB(t, path)
+	defer db.Close()
+
+	if err := Migrate(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	}
+	var v int
+	if err := db.QueryRow("PRAGMA secure_delete").Scan(&v); err != nil {
+		t.Fatal(err)
+	}
+	if v != 1 {
+		t.Fatalf("expected secure_delete = 1, got %d", v)
+	}
+}
+
+// TestMigrate tests that Migrate is idempotent and rejects
+// databases from the future.
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	db := openDB(t, filepath.Join(t.TempDir(), "dr.db"))
+	defer db.Close()
+
+	for i := 0; i < 2; i++ {
+		if err := Migrate(ctx, db); err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+	}
+	var v int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&v); err != nil {
+		t.Fatal(err)
+	}
+	if v != len(migrations) {
+		t.Fatalf("expected version %d, got %d", len(migrations), v)
+	}
+	if _, err := db.Exec("PRAGMA user_version = 1000"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Migrate(ctx, db); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+// TestPurge tests that Purge removes the state and every skipped
+// key for the session, and only that session.
+func TestPurge(t *testing.T) {
+	db := openDB(t, filepath.Join(t.TempDir(), "dr.db"))
+	defer db.Close()
+
+	a, err := New(db, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(db, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := dr.PublicKey("public key")
+	mk := make(dr.MessageKey, 32)
+	for _, s := range []*Store{a, b} {
+		if err := s.StoreKey(1, pub, mk); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Save(&dr.State{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.Purge(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Load(); !errors.Is(err, dr.ErrNotFound) {
+		t.Fatalf("expected %v, got %v", dr.ErrNotFound, err)
+	}
+	if _, err := a.LoadKey(1, pub); !errors.Is(err, dr.ErrNotFound) {
+		t.Fatalf("expected %v, got %v", dr.ErrNotFound, err)
+	}
+	if _, err := b.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.LoadKey(1, pub); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestStaleState tests that Save refuses to overwrite a state
+// that is at least as new.
+func TestStaleState(t *testing.T) {
+	db := openDB(t, filepath.Join(t.TempDir(), "dr.db"))
+	defer db.Close()
+
+	s, err := New(db, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, tc := range []struct {
+		epoch uint64
+		ok    bool
+	}{
+		{1, true},
+		{2, true},
+		{2, false},
+		{1, false},
+		{3, true},
+	} {
+		err := s.Save(&dr.State{Epoch: tc.epoch})
+		if tc.ok && err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if !tc.ok && !errors.Is(err, dr.ErrStaleState) {
+			t.Fatalf("#%d: expected %v, got %v", i, dr.ErrStaleState, err)
+		}
+	}
+}
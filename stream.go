@@ -0,0 +1,279 @@
+package dr
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// streamChunkSize is the maximum size in bytes of each
+	// plaintext chunk in a stream.
+	streamChunkSize = 64 * 1024
+	// streamMaxOverhead is the maximum per-chunk ciphertext
+	// overhead accepted by OpenStream.
+	streamMaxOverhead = 1024
+	// streamFinal is set in a frame's length prefix to mark the
+	// final chunk.
+	streamFinal = 1 << 31
+)
+
+// streamLabel is the HMAC domain separator for chunk keys.
+var streamLabel = []byte("dr stream chunk")
+
+// SealStream encrypts a single message of arbitrary length,
+// writing the ciphertext to w as it is written to the returned
+// io.WriteCloser. The message must be closed to write the final
+// chunk; a stream that is not closed cannot be opened.
+//
+// The ratchet advances exactly once per stream, just as with
+// Seal, and the returned Header must be sent alongside the
+// stream. additionalData is authenticated with each chunk.
+//
+// The plaintext is split into chunks of at most 64 KiB. Chunk i
+// (starting at zero) is sealed with its own message key
+//
+//	HMAC-SHA256(mk, "dr stream chunk" || uint64(i))
+//
+// where mk is the stream's message key, and the additional data
+//
+//	Concat(additionalData, header) || uint64(i) || final
+//
+// where final is 1 for the last chunk and 0 otherwise. Integers
+// are big endian. Each chunk is written as a frame
+//
+//	uint32(len(ciphertext) | final<<31) || ciphertext
+//
+// The final chunk may be empty. Binding the index and final
+// flag into each chunk means that reordered, dropped, or
+// truncated chunks are rejected by OpenStream.
+func (s *Session) SealStream(w io.Writer, additionalData []byte) (io.WriteCloser, Header, error) {
+	mk, h, err := s.next(context.Background())
+	if err != nil {
+		return nil, Header{}, err
+	}
+	sw := &streamWriter{
+		r:   s.r,
+		w:   w,
+		mk:  mk,
+		ad:  s.concat(additionalData, h),
+		buf: make([]byte, 0, streamChunkSize),
+	}
+	return sw, h, nil
+}
+
+// OpenStream decrypts a message written by SealStream, returning
+// a reader for its plaintext.
+//
+// The first chunk is authenticated before OpenStream returns, and
+// the session state is updated only if it is valid. Subsequent
+// chunks are authenticated as they are read; the reader returns
+// an error if any chunk is invalid or if the stream ends before
+// the final chunk. Callers must read until io.EOF before trusting
+// the plaintext in its entirety.
+//
+// The reader does not read past the final chunk, so the stream
+// may be followed by other data in r.
+func (s *Session) OpenStream(r io.Reader, h Header, additionalData []byte) (io.Reader, error) {
+	var sr *streamReader
+	err := s.open(context.Background(), h, func(mk MessageKey) error {
+		sr = &streamReader{
+			r:   s.r,
+			src: r,
+			mk:  append(MessageKey(nil), mk...),
+			ad:  s.concat(additionalData, h),
+		}
+		if err := sr.next(); err != nil {
+			wipe(sr.mk)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sr, nil
+}
+
+// chunkKey derives the message key for the ith chunk.
+func chunkKey(mk MessageKey, i uint64) MessageKey {
+	m := hmac.New(sha256.New, mk)
+	m.Write(streamLabel)
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], i)
+	m.Write(b[:])
+	return m.Sum(nil)
+}
+
+// chunkAD returns the additional data for the ith chunk.
+func chunkAD(dst, ad []byte, i uint64, final bool) []byte {
+	dst = append(dst[:0], ad...)
+	dst = binary.BigEndian.AppendUint64(dst, i)
+	if final {
+		return append(dst, 1)
+	}
+	return append(dst, 0)
+}
+
+// streamWriter implements SealStream.
+type streamWriter struct {
+	r  Ratchet
+	w  io.Writer
+	mk MessageKey
+	ad []byte
+	// i is the index of the next chunk.
+	i uint64
+	// buf is the pending plaintext.
+	buf []byte
+	// frame and cad are reused for each chunk.
+	frame  []byte
+	cad    []byte
+	err    error
+	closed bool
+}
+
+func (s *streamWriter) Write(p []byte) (int, error) {
+	if s.closed {
+		return 0, ErrClosed
+	}
+	if s.err != nil {
+		return 0, s.err
+	}
+	var n int
+	for len(p) > 0 {
+		// Only flush a full chunk once more data arrives, since
+		// the last chunk must be marked final.
+		if len(s.buf) == streamChunkSize {
+			if err := s.flush(false); err != nil {
+				return n, err
+			}
+		}
+		m := min(streamChunkSize-len(s.buf), len(p))
+		s.buf = append(s.buf, p[:m]...)
+		p = p[m:]
+		n += m
+	}
+	return n, nil
+}
+
+// Close writes the final chunk and wipes the message key. It
+// does not close the underlying io.Writer.
+func (s *streamWriter) Close() error {
+	if s.closed {
+		return nil
+	}
+	if s.err != nil {
+		return s.err
+	}
+	err := s.flush(true)
+	wipe(s.mk)
+	wipe(s.buf[:cap(s.buf)])
+	s.closed = err == nil
+	return err
+}
+
+// flush seals and writes the pending plaintext.
+func (s *streamWriter) flush(final bool) error {
+	key := chunkKey(s.mk, s.i)
+	defer wipe(key)
+	s.cad = chunkAD(s.cad, s.ad, s.i, final)
+	s.frame = appendSeal(s.r, append(s.frame[:0], 0, 0, 0, 0), key, int(s.i), s.buf, s.cad)
+
+	hdr := uint32(len(s.frame) - 4)
+	if final {
+		hdr |= streamFinal
+	}
+	binary.BigEndian.PutUint32(s.frame, hdr)
+	if _, err := s.w.Write(s.frame); err != nil {
+		s.err = err
+		return err
+	}
+	wipe(s.buf)
+	s.buf = s.buf[:0]
+	s.i++
+	return nil
+}
+
+// streamReader implements OpenStream.
+type streamReader struct {
+	r   Ratchet
+	src io.Reader
+	mk  MessageKey
+	ad  []byte
+	// i is the index of the next chunk.
+	i uint64
+	// buf is the unread portion of plain.
+	buf []byte
+	// plain, frame, and cad are reused for each chunk.
+	plain []byte
+	frame []byte
+	cad   []byte
+	done  bool
+	err   error
+}
+
+func (s *streamReader) Read(p []byte) (int, error) {
+	for len(s.buf) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		if s.done {
+			return 0, io.EOF
+		}
+		if err := s.next(); err != nil {
+			wipe(s.mk)
+			s.err = err
+		}
+	}
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+// next reads and authenticates the next chunk.
+func (s *streamReader) next() error {
+	var hdr [4]byte
+	if _, err := io.ReadFull(s.src, hdr[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return fmt.Errorf("dr: truncated stream: %w", err)
+	}
+	v := binary.BigEndian.Uint32(hdr[:])
+	final := v&streamFinal != 0
+	n := int(v &^ streamFinal)
+	if n > streamChunkSize+streamMaxOverhead {
+		return errors.New("dr: stream chunk too large")
+	}
+	if cap(s.frame) < n {
+		s.frame = make([]byte, n)
+	}
+	s.frame = s.frame[:n]
+	if _, err := io.ReadFull(s.src, s.frame); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return fmt.Errorf("dr: truncated stream: %w", err)
+	}
+
+	key := chunkKey(s.mk, s.i)
+	defer wipe(key)
+	s.cad = chunkAD(s.cad, s.ad, s.i, final)
+	plaintext, err := appendOpen(s.r, s.plain[:0], key, int(s.i), s.frame, s.cad)
+	if err != nil {
+		return decryptError(err)
+	}
+	s.plain = plaintext
+	s.i++
+
+	if final {
+		wipe(s.mk)
+		s.done = true
+	}
+	s.buf = plaintext
+	return nil
+}
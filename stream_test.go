@@ -0,0 +1,209 @@
+package dr
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+// newSessions returns a connected (sender, receiver) pair.
+func newSessions(t *testing.T, fn func(*testing.T) Ratchet) (alice, bob *Session) {
+	SK := make([]byte, 32)
+	if _, err := rand.Read(SK); err != nil {
+		t.Fatal(err)
+	}
+	priv, err := fn(t).Generate(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err = NewRecv(fn(t), append([]byte(nil), SK...), priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err = NewSend(fn(t), SK, fn(t).Public(priv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return alice, bob
+}
+
+// sealStream seals plaintext with SealStream.
+func sealStream(t *testing.T, s *Session, plaintext, ad []byte) ([]byte, Header) {
+	t.Helper()
+	var buf bytes.Buffer
+	w, h, err := s.SealStream(&buf, ad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Write in odd-sized pieces to exercise buffering.
+	for p := plaintext; len(p) > 0; {
+		n := min(len(p), 1000)
+		if _, err := w.Write(p[:n]); err != nil {
+			t.Fatal(err)
+		}
+		p = p[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes(), h
+}
+
+// splitFrames splits a sealed stream into its frames.
+func splitFrames(t *testing.T, ct []byte) [][]byte {
+	t.Helper()
+	var frames [][]byte
+	for len(ct) > 0 {
+		n := 4 + int(binary.BigEndian.Uint32(ct)&^streamFinal)
+		frames = append(frames, ct[:n:n])
+		ct = ct[n:]
+	}
+	return frames
+}
+
+// TestStream tests a round trip through SealStream and
+// OpenStream interleaved with regular messages.
+func TestStream(t *testing.T) {
+	sizes := []int{
+		0,
+		1,
+		streamChunkSize - 1,
+		streamChunkSize,
+		streamChunkSize + 1,
+		3*streamChunkSize + 5,
+	}
+	for _, tc := range testCases {
+		fn := tc.fn
+		t.Run(tc.name, func(t *testing.T) {
+			alice, bob := newSessions(t, fn)
+			ad := []byte("ad")
+			for i, n := range sizes {
+				send, recv := alice, bob
+				if i%2 != 0 {
+					send, recv = bob, alice
+				}
+				plaintext := make([]byte, n)
+				rand.Read(plaintext)
+				ct, h := sealStream(t, send, plaintext, ad)
+
+				r, err := recv.OpenStream(bytes.NewReader(ct), h, ad)
+				if err != nil {
+					t.Fatalf("#%d: %v", i, err)
+				}
+				got, err := io.ReadAll(r)
+				if err != nil {
+					t.Fatalf("#%d: %v", i, err)
+				}
+				if !hmac.Equal(plaintext, got) {
+					t.Fatalf("#%d: plaintext mismatch", i)
+				}
+
+				// Regular messages still work afterward.
+				msg, err := send.Seal([]byte("hello"), nil)
+				if err != nil {
+					t.Fatalf("#%d: %v", i, err)
+				}
+				if _, err := recv.Open(msg, nil); err != nil {
+					t.Fatalf("#%d: %v", i, err)
+				}
+			}
+		})
+	}
+}
+
+// TestStreamTruncated tests that OpenStream detects truncated
+// and reordered streams.
+func TestStreamTruncated(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		fn   func(ct []byte, frames [][]byte) []byte
+	}{
+		{"drop final", func(_ []byte, frames [][]byte) []byte {
+			return bytes.Join(frames[:2], nil)
+		}},
+		{"short final", func(ct []byte, _ [][]byte) []byte {
+			return ct[:len(ct)-1]
+		}},
+		{"swap", func(_ []byte, frames [][]byte) []byte {
+			return bytes.Join([][]byte{frames[0], frames[2], frames[1]}, nil)
+		}},
+		{"final as middle", func(_ []byte, frames [][]byte) []byte {
+			f := frames[2]
+			binary.BigEndian.PutUint32(f, binary.BigEndian.Uint32(f)&^streamFinal)
+			return bytes.Join(frames, nil)
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			alice, bob := newSessions(t, func(t *testing.T) Ratchet { return DJB(t.Name()) })
+			plaintext := make([]byte, 2*streamChunkSize+100)
+			rand.Read(plaintext)
+			ct, h := sealStream(t, alice, plaintext, nil)
+			frames := splitFrames(t, bytes.Clone(ct))
+			if len(frames) != 3 {
+				t.Fatalf("expected 3 frames, got %d", len(frames))
+			}
+			// OpenStream only authenticates the first chunk, so
+			// the error surfaces while reading.
+			r, err := bob.OpenStream(bytes.NewReader(tc.fn(ct, frames)), h, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.ReadAll(r); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+// TestStreamInvalidFirstChunk tests that OpenStream does not
+// update the session if the first chunk is invalid.
+func TestStreamInvalidFirstChunk(t *testing.T) {
+	for _, tc := range testCases {
+		fn := tc.fn
+		t.Run(tc.name, func(t *testing.T) {
+			alice, bob := newSessions(t, fn)
+			plaintext := make([]byte, 2*streamChunkSize)
+			rand.Read(plaintext)
+			ct, h := sealStream(t, alice, plaintext, nil)
+			frames := splitFrames(t, ct)
+
+			_, err := bob.OpenStream(bytes.NewReader(frames[1]), h, nil)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			r, err := bob.OpenStream(bytes.NewReader(ct), h, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !hmac.Equal(plaintext, got) {
+				t.Fatal("plaintext mismatch")
+			}
+		})
+	}
+}
+
+// TestStreamNotClosed tests that a stream that was never closed
+// cannot be opened.
+func TestStreamNotClosed(t *testing.T) {
+	alice, bob := newSessions(t, func(t *testing.T) Ratchet { return DJB(t.Name()) })
+	var buf bytes.Buffer
+	w, h, err := alice.SealStream(&buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	_, err = bob.OpenStream(bytes.NewReader(buf.Bytes()), h, nil)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("expected %v, got %v", io.ErrUnexpectedEOF, err)
+	}
+}
@@ -0,0 +1,247 @@
+package dr
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var updateVectors = flag.Bool("update", false,
+	"regenerate testdata/vectors.json")
+
+// vectorsPath is the path to the test vectors.
+var vectorsPath = filepath.Join("testdata", "vectors.json")
+
+// The test vectors pin the output of the DJB ratchet so that
+// changes to the wire format or key schedule are caught and so
+// that other implementations can check their output against
+// this package.
+//
+// They are not libsignal's vectors and libsignal cannot
+// reproduce them. The Double Ratchet state machine is the same,
+// but this package differs from libsignal in the following ways:
+//
+//   - KDF_RK is HKDF with BLAKE2b-256 instead of SHA-256. With
+//     the namespace "Whisper" the info labels are the same as
+//     libsignal's: "WhisperRatchet" and "WhisperMessageKeys".
+//   - KDF_CK is HMAC-BLAKE2b-256 instead of HMAC-SHA-256, with
+//     the same 0x01 and 0x02 constants.
+//   - Each message key is expanded with HKDF into an
+//     XChaCha20-Poly1305 key and nonce. libsignal expands it
+//     into AES-256-CBC and HMAC-SHA-256 keys and an IV, and
+//     appends an 8-byte truncated MAC.
+//   - The header is encoded as described by Header.Append and
+//     is authenticated as additional data via Concat, after the
+//     Ratchet's name (see WithAlgorithmBinding). libsignal
+//     encodes the header and ciphertext as a versioned protobuf
+//     and authenticates the identity keys of both parties.
+//
+// Run
+//
+//    go test -run TestVectors -update
+//
+// to regenerate the vectors after an intentional change.
+
+// vector is a single test vector.
+type vector struct {
+	// Ratchet is the name of the Ratchet.
+	Ratchet string `json:"ratchet"`
+	// Namespace is the Ratchet's namespace.
+	Namespace string `json:"namespace"`
+	// SK is the shared secret.
+	SK hexBytes `json:"sk"`
+	// BobPriv is Bob's initial ratchet key pair.
+	BobPriv hexBytes `json:"bob_priv"`
+	// AliceRand and BobRand are the random bytes read by Alice's
+	// and Bob's sessions to generate ratchet key pairs.
+	AliceRand hexBytes `json:"alice_rand"`
+	BobRand   hexBytes `json:"bob_rand"`
+	// Messages are the messages in the order that they are
+	// sealed and opened.
+	Messages []vectorMessage `json:"messages"`
+}
+
+// vectorMessage is a message in a vector.
+type vectorMessage struct {
+	// Sender is either "alice" or "bob".
+	Sender         string   `json:"sender"`
+	Plaintext      hexBytes `json:"plaintext"`
+	AdditionalData hexBytes `json:"ad"`
+	// Header is the output of Header.Append.
+	Header     hexBytes `json:"header"`
+	Ciphertext hexBytes `json:"ciphertext"`
+}
+
+// hexBytes is a []byte that is encoded as hexadecimal in JSON.
+type hexBytes []byte
+
+func (b hexBytes) MarshalText() ([]byte, error) {
+	return []byte(hex.EncodeToString(b)), nil
+}
+
+func (b *hexBytes) UnmarshalText(text []byte) error {
+	v, err := hex.DecodeString(string(text))
+	if err != nil {
+		return err
+	}
+	*b = v
+	return nil
+}
+
+// vectorRatchets are the Ratchets covered by the test vectors.
+var vectorRatchets = map[string]func(namespace string) Ratchet{
+	"DJB": func(namespace string) Ratchet { return DJB(namespace) },
+}
+
+// recordReader records the bytes read from r.
+type recordReader struct {
+	r   io.Reader
+	buf []byte
+}
+
+func (r *recordReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.buf = append(r.buf, p[:n]...)
+	return n, err
+}
+
+// runVector runs the conversation described by v, reading
+// randomness from the provided readers, and returns the sealed
+// messages.
+func runVector(t *testing.T, v vector, aliceRand, bobRand io.Reader) []vectorMessage {
+	t.Helper()
+
+	fn, ok := vectorRatchets[v.Ratchet]
+	if !ok {
+		t.Fatalf("unknown ratchet: %q", v.Ratchet)
+	}
+	r := fn(v.Namespace)
+	bob, err := NewRecv(r, append([]byte(nil), v.SK...),
+		append(PrivateKey(nil), v.BobPriv...), WithRand(bobRand))
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err := NewSend(r, append([]byte(nil), v.SK...),
+		r.Public(PrivateKey(v.BobPriv)), WithRand(aliceRand))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []vectorMessage
+	for i, m := range v.Messages {
+		send, recv := alice, bob
+		if m.Sender == "bob" {
+			send, recv = bob, alice
+		}
+		msg, err := send.Seal(m.Plaintext, m.AdditionalData)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		got, err := recv.Open(msg, m.AdditionalData)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if !bytes.Equal(got, m.Plaintext) {
+			t.Fatalf("#%d: expected %#x, got %#x", i, m.Plaintext, got)
+		}
+		m.Header = msg.Header.Append(nil)
+		m.Ciphertext = msg.Ciphertext
+		out = append(out, m)
+	}
+	return out
+}
+
+// TestVectors tests that sessions reproduce the test vectors in
+// testdata/vectors.json exactly.
+func TestVectors(t *testing.T) {
+	if *updateVectors {
+		generateVectors(t)
+	}
+	buf, err := os.ReadFile(vectorsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vectors []vector
+	if err := json.Unmarshal(buf, &vectors); err != nil {
+		t.Fatal(err)
+	}
+	if len(vectors) == 0 {
+		t.Fatal("no test vectors")
+	}
+	for i, v := range vectors {
+		aliceRand := bytes.NewReader(v.AliceRand)
+		bobRand := bytes.NewReader(v.BobRand)
+		got := runVector(t, v, aliceRand, bobRand)
+		for j, m := range v.Messages {
+			if !bytes.Equal(got[j].Header, m.Header) {
+				t.Fatalf("#%d.%d: expected header %#x, got %#x",
+					i, j, m.Header, got[j].Header)
+			}
+			if !bytes.Equal(got[j].Ciphertext, m.Ciphertext) {
+				t.Fatalf("#%d.%d: expected ciphertext %#x, got %#x",
+					i, j, m.Ciphertext, got[j].Ciphertext)
+			}
+		}
+		if aliceRand.Len() != 0 || bobRand.Len() != 0 {
+			t.Fatalf("#%d: %d and %d random bytes were not read",
+				i, aliceRand.Len(), bobRand.Len())
+		}
+	}
+}
+
+// generateVectors writes new test vectors to vectorsPath.
+func generateVectors(t *testing.T) {
+	t.Helper()
+
+	var msgs []vectorMessage
+	for i, sender := range []string{
+		"alice", "alice", "bob", "bob", "alice", "bob",
+	} {
+		msgs = append(msgs, vectorMessage{
+			Sender:         sender,
+			Plaintext:      []byte(fmt.Sprintf("message %d", i)),
+			AdditionalData: []byte("ad"),
+		})
+	}
+	var vectors []vector
+	for i, name := range []string{"DJB"} {
+		seed := byte(2 * i)
+		rng := newDetReader(seed)
+		v := vector{
+			Ratchet:   name,
+			Namespace: "Whisper",
+			SK:        make([]byte, KeySize),
+			Messages:  msgs,
+		}
+		if _, err := io.ReadFull(rng, v.SK); err != nil {
+			t.Fatal(err)
+		}
+		priv, err := vectorRatchets[name](v.Namespace).Generate(rng)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v.BobPriv = hexBytes(priv)
+
+		aliceRand := &recordReader{r: newDetReader(seed + 1)}
+		bobRand := &recordReader{r: rng}
+		v.Messages = runVector(t, v, aliceRand, bobRand)
+		v.AliceRand = aliceRand.buf
+		v.BobRand = bobRand.buf
+		vectors = append(vectors, v)
+	}
+	buf, err := json.MarshalIndent(vectors, "", "\t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(vectorsPath), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(vectorsPath, append(buf, '\n'), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
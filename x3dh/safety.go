@@ -0,0 +1,85 @@
+package x3dh
+
+import (
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"strings"
+
+	"github.com/ericlagergren/dr"
+)
+
+const (
+	// safetyDomain separates safety number hashes from other
+	// uses of SHA-512.
+	safetyDomain = "github.com/ericlagergren/dr/x3dh safety number v1"
+	// safetyIterations is the number of hash iterations, which
+	// makes it expensive to search for a public key with a
+	// colliding safety number.
+	safetyIterations = 5200
+)
+
+// SafetyNumber computes a 60-digit decimal fingerprint of both
+// parties' identity public keys that users can compare
+// out-of-band to detect a man-in-the-middle.
+//
+// The IDs are stable identifiers for each party, like a user
+// name or phone number.
+//
+// The result does not depend on which party calls SafetyNumber:
+// Alice calling
+//
+//    SafetyNumber(alice, bob, aliceID, bobID)
+//
+// and Bob calling
+//
+//    SafetyNumber(bob, alice, bobID, aliceID)
+//
+// produce the same string. Applications typically display it as
+// twelve groups of five digits.
+//
+// Like Signal's safety numbers, each party's half is derived
+// from an iterated SHA-512 hash of its public key and ID.
+func SafetyNumber(local, remote dr.PublicKey, localID, remoteID []byte) string {
+	a := fingerprint(local, localID)
+	b := fingerprint(remote, remoteID)
+	if a > b {
+		a, b = b, a
+	}
+	return a + b
+}
+
+// fingerprint returns the 30-digit fingerprint of a single
+// public key.
+func fingerprint(key dr.PublicKey, id []byte) string {
+	h := sha512.New()
+	h.Write([]byte(safetyDomain))
+	writeLen(h, id)
+	writeLen(h, key)
+	sum := h.Sum(nil)
+	for i := 0; i < safetyIterations; i++ {
+		h.Reset()
+		h.Write(sum)
+		h.Write(key)
+		sum = h.Sum(sum[:0])
+	}
+
+	// Each 5-byte chunk encodes five decimal digits.
+	var b strings.Builder
+	for i := 0; i < 30; i += 5 {
+		var v uint64
+		for _, c := range sum[i : i+5] {
+			v = v<<8 | uint64(c)
+		}
+		fmt.Fprintf(&b, "%05d", v%100000)
+	}
+	return b.String()
+}
+
+// writeLen writes the big-endian uint64 length of p followed by
+// p.
+func writeLen(h hash.Hash, p []byte) {
+	h.Write(binary.BigEndian.AppendUint64(nil, uint64(len(p))))
+	h.Write(p)
+}
@@ -0,0 +1,51 @@
+package x3dh
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"github.com/ericlagergren/dr"
+)
+
+// TestSafetyNumber tests that both parties compute the same
+// safety number and that changing a key changes it.
+func TestSafetyNumber(t *testing.T) {
+	r := dr.DJB(t.Name())
+	newKey := func() dr.PublicKey {
+		priv, err := r.Generate(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r.Public(priv)
+	}
+	alice, bob, mallory := newKey(), newKey(), newKey()
+	aliceID, bobID := []byte("alice"), []byte("bob")
+
+	a := SafetyNumber(alice, bob, aliceID, bobID)
+	b := SafetyNumber(bob, alice, bobID, aliceID)
+	if a != b {
+		t.Fatalf("%q != %q", a, b)
+	}
+	if len(a) != 60 {
+		t.Fatalf("expected 60 digits, got %d: %q", len(a), a)
+	}
+	for _, c := range a {
+		if c < '0' || c > '9' {
+			t.Fatalf("non-digit in %q", a)
+		}
+	}
+	if a != SafetyNumber(alice, bob, aliceID, bobID) {
+		t.Fatal("SafetyNumber is not deterministic")
+	}
+
+	for i, s := range []string{
+		SafetyNumber(alice, mallory, aliceID, bobID),
+		SafetyNumber(mallory, bob, aliceID, bobID),
+		SafetyNumber(alice, bob, bobID, aliceID),
+		SafetyNumber(alice, bob, aliceID, []byte("bob2")),
+	} {
+		if s == a {
+			t.Fatalf("#%d: safety number did not change", i)
+		}
+	}
+}
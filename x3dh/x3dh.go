@@ -0,0 +1,374 @@
+// Package x3dh implements the Extended Triple Diffie-Hellman
+// (X3DH) key agreement protocol for establishing Double Ratchet
+// sessions.
+//
+// Overview
+//
+// Bob publishes a Bundle containing his identity key, a signed
+// prekey, and optionally a one-time prekey. Alice uses the Bundle
+// to compute
+//
+//    DH1 = DH(IK_A, SPK_B)
+//    DH2 = DH(EK_A, IK_B)
+//    DH3 = DH(EK_A, SPK_B)
+//    DH4 = DH(EK_A, OPK_B)
+//    SK  = KDF(DH1 || DH2 || DH3 || DH4)
+//
+// where EK_A is a fresh ephemeral key pair, and sends Bob an
+// InitialMessage alongside her first Double Ratchet message. Bob
+// uses the InitialMessage to compute the same SK.
+//
+// The resulting Secret contains exactly what dr.NewSend and
+// dr.NewRecv expect: Alice calls
+//
+//    dr.NewSend(r, secret.SK, bundle.SignedPreKey)
+//
+// and Bob calls
+//
+//    dr.NewRecv(r, secret.SK, spk.Key)
+//
+// Both parties must pass Secret.AD as (part of) the additional
+// data for every message. See Secret.AD for more information.
+//
+// Differences from the specification
+//
+// The Diffie-Hellman functions are provided by a dr.Ratchet, so
+// every curve supported by package dr can be used. Because
+// XEdDSA is not implemented, identity keys carry a separate
+// Ed25519 key pair that signs the signed prekey.
+//
+// The KDF is HKDF with SHA-256, a 32-byte zero salt, and the
+// provided info string. Its input is prefixed with 32 0xff bytes
+// regardless of the curve.
+//
+// References
+//
+//    [x3dh]: https://signal.org/docs/specifications/x3dh/x3dh.pdf
+//
+package x3dh
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+
+	"github.com/ericlagergren/dr"
+	"github.com/ericlagergren/dr/internal/secure"
+)
+
+// IdentityKey is a long-term identity key.
+type IdentityKey struct {
+	// DH is the Diffie-Hellman key pair.
+	DH dr.PrivateKey
+	// Signing is the Ed25519 key used to sign prekeys.
+	Signing ed25519.PrivateKey
+}
+
+// NewIdentityKey generates an IdentityKey.
+func NewIdentityKey(r dr.Ratchet, rand io.Reader) (*IdentityKey, error) {
+	dh, err := r.Generate(rand)
+	if err != nil {
+		return nil, err
+	}
+	_, signing, err := ed25519.GenerateKey(rand)
+	if err != nil {
+		return nil, err
+	}
+	return &IdentityKey{DH: dh, Signing: signing}, nil
+}
+
+// Public returns the public portion of the IdentityKey.
+func (k *IdentityKey) Public(r dr.Ratchet) PublicIdentityKey {
+	return PublicIdentityKey{
+		DH:      r.Public(k.DH),
+		Signing: append(ed25519.PublicKey(nil), k.Signing.Public().(ed25519.PublicKey)...),
+	}
+}
+
+// PublicIdentityKey is the public portion of an IdentityKey.
+type PublicIdentityKey struct {
+	// DH is the Diffie-Hellman public key.
+	DH dr.PublicKey
+	// Signing is the Ed25519 public key used to verify signed
+	// prekeys.
+	Signing ed25519.PublicKey
+}
+
+// SignedPreKey is a medium-term prekey signed by an
+// IdentityKey.
+type SignedPreKey struct {
+	// ID identifies the prekey.
+	ID uint32
+	// Key is the Diffie-Hellman key pair.
+	Key dr.PrivateKey
+	// Signature is the signature over the public key.
+	Signature []byte
+}
+
+// NewSignedPreKey generates a SignedPreKey signed by ik.
+func NewSignedPreKey(r dr.Ratchet, ik *IdentityKey, id uint32, rand io.Reader) (*SignedPreKey, error) {
+	key, err := r.Generate(rand)
+	if err != nil {
+		return nil, err
+	}
+	return &SignedPreKey{
+		ID:        id,
+		Key:       key,
+		Signature: ed25519.Sign(ik.Signing, r.Public(key)),
+	}, nil
+}
+
+// OneTimePreKey is a prekey that is used for at most one
+// handshake.
+type OneTimePreKey struct {
+	// ID identifies the prekey.
+	ID uint32
+	// Key is the Diffie-Hellman key pair.
+	Key dr.PrivateKey
+}
+
+// NewOneTimePreKey generates a OneTimePreKey.
+func NewOneTimePreKey(r dr.Ratchet, id uint32, rand io.Reader) (*OneTimePreKey, error) {
+	key, err := r.Generate(rand)
+	if err != nil {
+		return nil, err
+	}
+	return &OneTimePreKey{ID: id, Key: key}, nil
+}
+
+// Bundle is the set of public keys a party publishes so that
+// others can initiate sessions with it.
+type Bundle struct {
+	// Identity is the identity key.
+	Identity PublicIdentityKey
+	// SignedPreKeyID identifies the signed prekey.
+	SignedPreKeyID uint32
+	// SignedPreKey is the signed prekey.
+	SignedPreKey dr.PublicKey
+	// Signature is the signature over SignedPreKey.
+	Signature []byte
+	// OneTimePreKeyID identifies the one-time prekey.
+	OneTimePreKeyID uint32
+	// OneTimePreKey is the optional one-time prekey.
+	OneTimePreKey dr.PublicKey
+}
+
+// NewBundle creates a Bundle from the private keys.
+//
+// The one-time prekey is optional and may be nil.
+func NewBundle(r dr.Ratchet, ik *IdentityKey, spk *SignedPreKey, opk *OneTimePreKey) Bundle {
+	b := Bundle{
+		Identity:       ik.Public(r),
+		SignedPreKeyID: spk.ID,
+		SignedPreKey:   r.Public(spk.Key),
+		Signature:      append([]byte(nil), spk.Signature...),
+	}
+	if opk != nil {
+		b.OneTimePreKeyID = opk.ID
+		b.OneTimePreKey = r.Public(opk.Key)
+	}
+	return b
+}
+
+// InitialMessage is sent by the initiator alongside the first
+// Double Ratchet message.
+type InitialMessage struct {
+	// Identity is the initiator's identity key.
+	Identity PublicIdentityKey
+	// Ephemeral is the initiator's ephemeral public key.
+	Ephemeral dr.PublicKey
+	// SignedPreKeyID identifies the responder's signed prekey.
+	SignedPreKeyID uint32
+	// OneTimePreKeyID identifies the responder's one-time
+	// prekey.
+	//
+	// It is only meaningful if HasOneTimePreKey is true.
+	OneTimePreKeyID uint32
+	// HasOneTimePreKey is true if a one-time prekey was used.
+	HasOneTimePreKey bool
+}
+
+// Secret is the result of a successful handshake.
+type Secret struct {
+	// SK is the shared key passed to dr.NewSend or dr.NewRecv.
+	SK []byte
+	// AD is the associated data that binds the Double Ratchet
+	// session to the handshake.
+	//
+	// It is an encoding of the handshake transcript: both
+	// identity keys, the ephemeral key, and the prekeys. Both
+	// parties must include it in the additional data for every
+	// message, most importantly the first, so that the peer can
+	// detect a tampered InitialMessage.
+	AD []byte
+}
+
+// ErrInvalidSignature is returned by Initiate when the signed
+// prekey's signature is invalid.
+var ErrInvalidSignature = errors.New("x3dh: invalid signed prekey signature")
+
+// Initiate performs the initiator's half of the handshake with
+// the responder's Bundle.
+//
+// The info string identifies the application and must match the
+// responder's.
+//
+// The returned InitialMessage must be sent to the responder
+// alongside the first Double Ratchet message.
+func Initiate(r dr.Ratchet, info string, ik *IdentityKey, b Bundle, rand io.Reader) (Secret, InitialMessage, error) {
+	if !ed25519.Verify(b.Identity.Signing, b.SignedPreKey, b.Signature) {
+		return Secret{}, InitialMessage{}, ErrInvalidSignature
+	}
+	ek, err := r.Generate(rand)
+	if err != nil {
+		return Secret{}, InitialMessage{}, err
+	}
+	defer wipe(ek)
+
+	pairs := []pair{
+		{ik.DH, b.SignedPreKey},
+		{ek, b.Identity.DH},
+		{ek, b.SignedPreKey},
+	}
+	if b.OneTimePreKey != nil {
+		pairs = append(pairs, pair{ek, b.OneTimePreKey})
+	}
+	ikm, err := agree(r, pairs)
+	if err != nil {
+		return Secret{}, InitialMessage{}, err
+	}
+	defer wipe(ikm)
+
+	m := InitialMessage{
+		Identity:         ik.Public(r),
+		Ephemeral:        r.Public(ek),
+		SignedPreKeyID:   b.SignedPreKeyID,
+		OneTimePreKeyID:  b.OneTimePreKeyID,
+		HasOneTimePreKey: b.OneTimePreKey != nil,
+	}
+	s, err := secret(info, ikm, transcript(m, b.Identity, b.SignedPreKey, b.OneTimePreKey))
+	if err != nil {
+		return Secret{}, InitialMessage{}, err
+	}
+	return s, m, nil
+}
+
+// Respond performs the responder's half of the handshake with
+// the initiator's InitialMessage.
+//
+// The signed prekey and one-time prekey must be the ones
+// identified by the InitialMessage. The one-time prekey must be
+// nil if the InitialMessage does not use one, and should be
+// deleted afterward.
+//
+// The info string identifies the application and must match the
+// initiator's.
+func Respond(r dr.Ratchet, info string, ik *IdentityKey, spk *SignedPreKey, opk *OneTimePreKey, m InitialMessage) (Secret, error) {
+	if m.SignedPreKeyID != spk.ID {
+		return Secret{}, fmt.Errorf("x3dh: unexpected signed prekey ID: %d", m.SignedPreKeyID)
+	}
+	if m.HasOneTimePreKey != (opk != nil) {
+		return Secret{}, errors.New("x3dh: one-time prekey mismatch")
+	}
+	if opk != nil && m.OneTimePreKeyID != opk.ID {
+		return Secret{}, fmt.Errorf("x3dh: unexpected one-time prekey ID: %d", m.OneTimePreKeyID)
+	}
+
+	pairs := []pair{
+		{spk.Key, m.Identity.DH},
+		{ik.DH, m.Ephemeral},
+		{spk.Key, m.Ephemeral},
+	}
+	var otk dr.PublicKey
+	if opk != nil {
+		otk = r.Public(opk.Key)
+		pairs = append(pairs, pair{opk.Key, m.Ephemeral})
+	}
+	ikm, err := agree(r, pairs)
+	if err != nil {
+		return Secret{}, err
+	}
+	defer wipe(ikm)
+
+	return secret(info, ikm, transcript(m, ik.Public(r), r.Public(spk.Key), otk))
+}
+
+// pair is a (key pair, public key) tuple for Diffie-Hellman.
+type pair struct {
+	priv dr.PrivateKey
+	pub  dr.PublicKey
+}
+
+// agree returns the concatenation of the DH outputs for each
+// pair, in order: DH1 || DH2 || DH3 || DH4.
+func agree(r dr.Ratchet, pairs []pair) ([]byte, error) {
+	var ikm []byte
+	for i, p := range pairs {
+		dh, err := r.DH(p.priv, p.pub)
+		if err != nil {
+			wipe(ikm)
+			return nil, fmt.Errorf("x3dh: DH%d failed: %w", i+1, err)
+		}
+		ikm = append(ikm, dh...)
+		wipe(dh)
+	}
+	return ikm, nil
+}
+
+// secret derives the Secret from the concatenated DH outputs.
+func secret(info string, ikm, ad []byte) (Secret, error) {
+	// The X3DH spec prefixes the KDF input with 0xff bytes for
+	// domain separation from XEdDSA.
+	in := make([]byte, 0, 32+len(ikm))
+	for i := 0; i < 32; i++ {
+		in = append(in, 0xff)
+	}
+	in = append(in, ikm...)
+	defer wipe(in)
+
+	salt := make([]byte, sha256.Size)
+	sk := make([]byte, 32)
+	_, err := io.ReadFull(hkdf.New(sha256.New, in, salt, []byte(info)), sk)
+	if err != nil {
+		return Secret{}, err
+	}
+	return Secret{SK: sk, AD: ad}, nil
+}
+
+// transcript encodes the handshake transcript:
+//
+//    IK_A || IK_A signing || IK_B || IK_B signing ||
+//    EK_A || SPK_B || SPK_B ID || OPK_B || OPK_B ID
+//
+// where each key is prefixed with its big-endian uint16 length
+// and each ID is a big-endian uint32. OPK_B and its ID are
+// omitted if no one-time prekey was used.
+func transcript(m InitialMessage, responder PublicIdentityKey, spk, opk dr.PublicKey) []byte {
+	var buf []byte
+	appendKey := func(key []byte) {
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(key)))
+		buf = append(buf, key...)
+	}
+	appendKey(m.Identity.DH)
+	appendKey(m.Identity.Signing)
+	appendKey(responder.DH)
+	appendKey(responder.Signing)
+	appendKey(m.Ephemeral)
+	appendKey(spk)
+	buf = binary.BigEndian.AppendUint32(buf, m.SignedPreKeyID)
+	if opk != nil {
+		appendKey(opk)
+		buf = binary.BigEndian.AppendUint32(buf, m.OneTimePreKeyID)
+	}
+	return buf
+}
+
+// wipe is shorthand for secure.Wipe.
+func wipe(p []byte) {
+	secure.Wipe(p)
+}
@@ -0,0 +1,196 @@
+package x3dh
+
+import (
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"testing"
+
+	"github.com/ericlagergren/dr"
+)
+
+var testCases = []struct {
+	name string
+	fn   func(*testing.T) dr.Ratchet
+}{
+	{"P-256", func(t *testing.T) dr.Ratchet {
+		return dr.NIST(elliptic.P256(), sha256.New, t.Name())
+	}},
+	{"DJB", func(t *testing.T) dr.Ratchet { return dr.DJB(t.Name()) }},
+	{"X448", func(t *testing.T) dr.Ratchet { return dr.X448(t.Name()) }},
+}
+
+const info = "x3dh test"
+
+// keys are Bob's private keys.
+type keys struct {
+	ik  *IdentityKey
+	spk *SignedPreKey
+	opk *OneTimePreKey
+}
+
+func newKeys(t *testing.T, r dr.Ratchet) keys {
+	ik, err := NewIdentityKey(r, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spk, err := NewSignedPreKey(r, ik, 1, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opk, err := NewOneTimePreKey(r, 2, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys{ik: ik, spk: spk, opk: opk}
+}
+
+// TestEndToEnd runs X3DH followed by a Double Ratchet
+// conversation.
+func TestEndToEnd(t *testing.T) {
+	test := func(t *testing.T, r dr.Ratchet, oneTime bool) {
+		bobKeys := newKeys(t, r)
+		if !oneTime {
+			bobKeys.opk = nil
+		}
+		aliceID, err := NewIdentityKey(r, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		bundle := NewBundle(r, bobKeys.ik, bobKeys.spk, bobKeys.opk)
+		as, m, err := Initiate(r, info, aliceID, bundle, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		alice, err := dr.NewSend(r, as.SK, bundle.SignedPreKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		first, err := alice.Seal([]byte("hello, Bob"), as.AD)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		bs, err := Respond(r, info, bobKeys.ik, bobKeys.spk, bobKeys.opk, m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !hmac.Equal(as.SK, bs.SK) {
+			t.Fatalf("SK mismatch: %#x != %#x", as.SK, bs.SK)
+		}
+		if !hmac.Equal(as.AD, bs.AD) {
+			t.Fatalf("AD mismatch: %#x != %#x", as.AD, bs.AD)
+		}
+		bob, err := dr.NewRecv(r, bs.SK,
+			append(dr.PrivateKey(nil), bobKeys.spk.Key...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := bob.Open(first, bs.AD)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != "hello, Bob" {
+			t.Fatalf("unexpected plaintext: %q", got)
+		}
+
+		send, recv := bob, alice
+		for i := 0; i < 10; i++ {
+			plaintext := make([]byte, 64)
+			rand.Read(plaintext)
+			msg, err := send.Seal(plaintext, as.AD)
+			if err != nil {
+				t.Fatalf("#%d: %v", i, err)
+			}
+			got, err := recv.Open(msg, bs.AD)
+			if err != nil {
+				t.Fatalf("#%d: %v", i, err)
+			}
+			if !hmac.Equal(plaintext, got) {
+				t.Fatalf("#%d: expected %#x, got %#x", i, plaintext, got)
+			}
+			send, recv = recv, send
+		}
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			test(t, tc.fn(t), true)
+		})
+		t.Run(tc.name+"/NoOneTimePreKey", func(t *testing.T) {
+			test(t, tc.fn(t), false)
+		})
+	}
+}
+
+// TestInvalidSignature tests that Initiate rejects a Bundle
+// with an invalid signed prekey signature.
+func TestInvalidSignature(t *testing.T) {
+	r := dr.DJB(t.Name())
+	bobKeys := newKeys(t, r)
+	aliceID, err := NewIdentityKey(r, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewSignedPreKey(r, bobKeys.ik, 1, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle := NewBundle(r, bobKeys.ik, bobKeys.spk, bobKeys.opk)
+	bundle.SignedPreKey = r.Public(other.Key)
+	_, _, err = Initiate(r, info, aliceID, bundle, rand.Reader)
+	if !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("expected %v, got %v", ErrInvalidSignature, err)
+	}
+}
+
+// TestTamperedInitialMessage tests that the transcript binds
+// the InitialMessage to the first message.
+func TestTamperedInitialMessage(t *testing.T) {
+	r := dr.DJB(t.Name())
+	bobKeys := newKeys(t, r)
+	aliceID, err := NewIdentityKey(r, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mallory, err := NewIdentityKey(r, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle := NewBundle(r, bobKeys.ik, bobKeys.spk, bobKeys.opk)
+	as, m, err := Initiate(r, info, aliceID, bundle, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err := dr.NewSend(r, as.SK, bundle.SignedPreKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := alice.Seal([]byte("hello, Bob"), as.AD)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Swapping the signing key does not change SK, but it does
+	// change AD.
+	m.Identity.Signing = mallory.Public(r).Signing
+	bs, err := Respond(r, info, bobKeys.ik, bobKeys.spk, bobKeys.opk, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := dr.NewRecv(r, bs.SK,
+		append(dr.PrivateKey(nil), bobKeys.spk.Key...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bob.Open(first, bs.AD); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	// Respond must be given the prekeys the message uses.
+	if _, err := Respond(r, info, bobKeys.ik, bobKeys.spk, nil, m); err == nil {
+		t.Fatal("expected an error for a missing one-time prekey")
+	}
+}
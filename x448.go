@@ -0,0 +1,243 @@
+package dr
+
+import (
+	"crypto/hmac"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strconv"
+
+	"github.com/cloudflare/circl/dh/x448"
+	"golang.org/x/crypto/hkdf"
+)
+
+// x448Ratchet implements Ratchet using X448, 256-bit
+// XChaCha20-Poly1305, HKDF with SHA-512, and HMAC-SHA-512.
+type x448Ratchet struct {
+	// hash is used by HKDF and HMAC.
+	hash func() hash.Hash
+	// mkInfo is the HKDF info used when deriving message keys.
+	mkInfo []byte
+	// rkInfo is the HKDF info used when deriving root keys.
+	rkInfo []byte
+	// aead is used to encrypt messages.
+	aead AEAD
+	// nonceCounter mixes the message number into the nonce.
+	nonceCounter bool
+	// keyedBLAKE2b uses keyed BLAKE2b in KDFck.
+	keyedBLAKE2b bool
+	// zeroNonce derives only the AEAD key and uses an all-zero
+	// nonce.
+	zeroNonce bool
+	// name is returned by Name.
+	name string
+}
+
+var (
+	_ AppendRatchet  = (*x448Ratchet)(nil)
+	_ CounterRatchet = (*x448Ratchet)(nil)
+	_ keySizer       = (*x448Ratchet)(nil)
+	_ hasher         = (*x448Ratchet)(nil)
+)
+
+// X448 creates a Ratchet using X448, 256-bit
+// XChaCha20-Poly1305, HKDF with SHA-512, and HMAC-SHA-512.
+//
+// The namespace is used to bind keys to a particular application
+// or context.
+//
+// Wire sizes:
+//
+//    PrivateKey: 112 bytes (56-byte scalar || 56-byte point)
+//    PublicKey:  56 bytes
+//    Header:     75 bytes (version, counters, and length-prefixed PublicKey)
+//    Overhead:   16 bytes (the Poly1305 tag)
+//
+func X448(namespace string, opts ...RatchetOption) Ratchet {
+	o := newRatchetOptions(xchacha{}, opts)
+	mkInfo, rkInfo := o.labels(namespace)
+	hash := o.kdfHash(sha512.New)
+	return &x448Ratchet{
+		hash:   hash,
+		mkInfo: mkInfo,
+		rkInfo: rkInfo,
+		aead:   o.aead,
+
+		nonceCounter: o.nonceCounter,
+		keyedBLAKE2b: o.keyedBLAKE2b,
+		zeroNonce:    o.zeroNonce,
+		name:         o.name("X448", hash, namespace),
+	}
+}
+
+func (x448Ratchet) privKeyLen() int { return 2 * x448.Size }
+
+// DHPublicKeyLen returns the size in bytes of an X448 public
+// key.
+func (x448Ratchet) DHPublicKeyLen() int { return x448.Size }
+
+func (x x448Ratchet) newHash() hash.Hash { return x.hash() }
+
+func (x448Ratchet) Generate(r io.Reader) (PrivateKey, error) {
+	var priv, pub x448.Key
+	if _, err := io.ReadFull(r, priv[:]); err != nil {
+		return nil, err
+	}
+	defer wipe(priv[:])
+	x448.KeyGen(&pub, &priv)
+	key := make([]byte, 2*x448.Size)
+	copy(key[:x448.Size], priv[:])
+	copy(key[x448.Size:], pub[:])
+	return key, nil
+}
+
+func (x448Ratchet) Public(priv PrivateKey) PublicKey {
+	if len(priv) != 2*x448.Size {
+		panic("dr: invalid key pair size: " + strconv.Itoa(len(priv)))
+	}
+	return append(PublicKey(nil), priv[x448.Size:]...)
+}
+
+func (x448Ratchet) DH(priv PrivateKey, pub PublicKey) ([]byte, error) {
+	if len(priv) != 2*x448.Size {
+		return nil, fmt.Errorf("dr: invalid key pair size: %d", len(priv))
+	}
+	if len(pub) != x448.Size {
+		return nil, fmt.Errorf("dr: invalid public key size: %d", len(pub))
+	}
+	var secret, point, shared x448.Key
+	copy(secret[:], priv[:x448.Size])
+	defer wipe(secret[:])
+	copy(point[:], pub)
+	if !x448.Shared(&shared, &secret, &point) {
+		return nil, errors.New("dr: low-order public key")
+	}
+	return shared[:], nil
+}
+
+func (x x448Ratchet) KDFrk(rk RootKey, dh []byte) (RootKey, ChainKey) {
+	mustKeySize("RootKey", rk)
+	buf := make([]byte, 2*KeySize)
+	// See djb.KDFrk for why IKM=dh and salt=rk.
+	r := hkdf.New(x.hash, dh, rk, x.rkInfo)
+	_, err := io.ReadFull(r, buf)
+	if err != nil {
+		panic(err)
+	}
+	return buf[:KeySize:KeySize], buf[KeySize : 2*KeySize : 2*KeySize]
+}
+
+func (x x448Ratchet) KDFck(ck ChainKey) (ChainKey, MessageKey) {
+	if x.keyedBLAKE2b {
+		return blake2bKDFck(ck)
+	}
+	mustKeySize("ChainKey", ck)
+
+	h := hmac.New(x.hash, ck)
+
+	const (
+		ckConst = 0x02
+		mkConst = 0x01
+	)
+
+	// HMAC-SHA-512 produces 64 bytes, but chain and message keys
+	// are always KeySize bytes.
+	h.Write([]byte{ckConst})
+	ck = h.Sum(nil)[:KeySize:KeySize]
+
+	h.Reset()
+	h.Write([]byte{mkConst})
+	mk := h.Sum(nil)[:KeySize:KeySize]
+
+	return ck, mk
+}
+
+// derive derives an AEAD key and nonce into a pooled scratch
+// buffer, which must be released with putScratch.
+//
+// By default, these are a 256-bit XChaCha20-Poly1305 key and
+// 192-bit XChaCha20-Poly1305 nonce.
+func (x x448Ratchet) derive(ikm []byte) (key, nonce []byte, buf *[]byte) {
+	K := x.aead.KeySize()
+	N := x.aead.NonceSize()
+	buf = getScratch(K + N)
+	b := *buf
+	r := hkdf.New(x.hash, ikm, nil, x.mkInfo)
+	out := b
+	if x.zeroNonce {
+		// Only derive the key. See WithZeroNonce.
+		clear(b[K:])
+		out = b[:K]
+	}
+	_, err := io.ReadFull(r, out)
+	if err != nil {
+		panic(err)
+	}
+	return b[:K:K], b[K : K+N : K+N], buf
+}
+
+func (x x448Ratchet) Seal(key MessageKey, plaintext, additionalData []byte) []byte {
+	return x.AppendSeal(nil, key, plaintext, additionalData)
+}
+
+func (x x448Ratchet) Open(key MessageKey, ciphertext, additionalData []byte) ([]byte, error) {
+	return x.AppendOpen(nil, key, ciphertext, additionalData)
+}
+
+func (x x448Ratchet) Overhead() int {
+	return x.aead.Overhead()
+}
+
+func (x x448Ratchet) Name() string {
+	return x.name
+}
+
+func (x x448Ratchet) AppendSeal(dst []byte, key MessageKey, plaintext, additionalData []byte) []byte {
+	return x.AppendSealCounter(dst, key, 0, plaintext, additionalData)
+}
+
+func (x x448Ratchet) AppendOpen(dst []byte, key MessageKey, ciphertext, additionalData []byte) ([]byte, error) {
+	return x.AppendOpenCounter(dst, key, 0, ciphertext, additionalData)
+}
+
+func (x x448Ratchet) AppendSealCounter(dst []byte, key MessageKey, n int, plaintext, additionalData []byte) []byte {
+	mustKeySize("MessageKey", key)
+
+	key, nonce, buf := x.derive(key)
+	defer putScratch(buf)
+	if x.nonceCounter {
+		mixCounter(nonce, n)
+	}
+
+	return x.aead.Seal(dst, key, nonce, plaintext, additionalData)
+}
+
+func (x x448Ratchet) AppendOpenCounter(dst []byte, key MessageKey, n int, ciphertext, additionalData []byte) ([]byte, error) {
+	if err := checkKeySize("MessageKey", key); err != nil {
+		return nil, fmt.Errorf("dr: %w", err)
+	}
+	key, nonce, buf := x.derive(key)
+	defer putScratch(buf)
+	if x.nonceCounter {
+		mixCounter(nonce, n)
+	}
+
+	return x.aead.Open(dst, key, nonce, ciphertext, additionalData)
+}
+
+func (x x448Ratchet) Header(priv PrivateKey, prevChainLength, messageNum int) Header {
+	if len(priv) != 2*x448.Size {
+		panic("Header: invalid key pair size: " + strconv.Itoa(len(priv)))
+	}
+	return Header{
+		PublicKey: x.Public(priv),
+		PN:        prevChainLength,
+		N:         messageNum,
+	}
+}
+
+func (x448Ratchet) Concat(additionalData []byte, h Header) []byte {
+	return Concat(additionalData, h)
+}